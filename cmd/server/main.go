@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/collab-platform/backend/docs"
+	"github.com/collab-platform/backend/internal/config"
+	"github.com/collab-platform/backend/internal/delivery/http/handlers"
+	"github.com/collab-platform/backend/internal/delivery/http/middleware"
+	"github.com/collab-platform/backend/internal/delivery/websocket"
+	"github.com/collab-platform/backend/internal/infrastructure/database"
+	"github.com/collab-platform/backend/internal/infrastructure/mail"
+	"github.com/collab-platform/backend/internal/infrastructure/oidc"
+	"github.com/collab-platform/backend/internal/infrastructure/ratelimit"
+	"github.com/collab-platform/backend/internal/infrastructure/redis"
+	"github.com/collab-platform/backend/internal/infrastructure/repository"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+)
+
+// @title           Real-Time Collaboration Platform API
+// @version         1.0
+// @description     A production-grade real-time collaboration platform backend built in Go.
+// @host            localhost:8080
+// @BasePath        /api/v1
+// @securityDefinitions.apikey  BearerAuth
+// @in                          header
+// @name                        Authorization
+func main() {
+	configPath := flag.String("config", "", "path to a KEY=VALUE config file (defaults to .env if present)")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	db, err := database.NewPostgresDB(cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.Password, cfg.Database.Name)
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.Close()
+
+	redisClient, err := redis.NewRedisClient(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	if err != nil {
+		log.Fatalf("Failed to initialize Redis: %v", err)
+	}
+	defer redisClient.Close()
+
+	// Repositories
+	authRepo := repository.NewPostgresAuthRepository(db.DB)
+	docRepo := repository.NewPostgresDocumentRepository(db.DB)
+	collabRepo := repository.NewPostgresCollaborationRepository(db.DB)
+	taskRepo := repository.NewPostgresTaskRepository(db.DB)
+	keyRepo := repository.NewPostgresSigningKeyRepository(db.DB)
+
+	// Usecases
+	// Every access decision goes through one policy, which also knows who
+	// came in through share links on any node
+	accessPolicy := usecase.NewAccessPolicy(docRepo, usecase.NewLinkSessions(redisClient))
+	keyRing, err := usecase.NewKeyRing(keyRepo, cfg.JWT.Secret, usecase.KeyPolicy{
+		Algorithm: cfg.JWT.Algorithm,
+		Rotation:  cfg.JWT.KeyRotation,
+		Overlap:   cfg.JWT.KeyOverlap,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize signing keys: %v", err)
+	}
+	if err := keyRing.Rotate(); err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	// Rate limits and login lockouts are shared between nodes through Redis
+	// unless they are configured to stay in memory
+	var limiter usecase.RateLimiter = redisClient
+	var loginAttempts usecase.LoginAttemptStore = redisClient
+	if cfg.RateLimit.Backend == "memory" {
+		memory := ratelimit.NewMemoryLimiter()
+		limiter, loginAttempts = memory, memory
+	}
+	authUsecase := usecase.NewAuthUsecase(authRepo, redisClient, keyRing, cfg.JWT.Expiry, cfg.JWT.RefreshExpiry, usecase.MFAPolicy{
+		Required: cfg.MFA.Required,
+		Issuer:   cfg.MFA.Issuer,
+	}, loginAttempts, usecase.LockoutPolicy{
+		Threshold: cfg.RateLimit.LockoutThreshold,
+		Base:      cfg.RateLimit.LockoutBase,
+		Max:       cfg.RateLimit.LockoutMax,
+	})
+	var identityProviders []usecase.OIDCProvider
+	for _, p := range cfg.OIDC {
+		identityProviders = append(identityProviders, usecase.OIDCProvider{
+			Name: p.Name,
+			Provider: oidc.NewProvider(oidc.Config{
+				Issuer:       p.Issuer,
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				RedirectURL:  p.RedirectURL,
+				Scopes:       p.Scopes,
+			}),
+			AllowSignup: p.AllowSignup,
+		})
+	}
+	oidcUsecase := usecase.NewOIDCUsecase(authUsecase, authRepo, redisClient, identityProviders)
+	var mailer usecase.Mailer
+	switch cfg.Mail.Driver {
+	case "smtp":
+		mailer, err = mail.NewSMTPMailer(cfg.Mail.SMTPHost, cfg.Mail.SMTPPort, cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, cfg.Mail.From)
+	case "file":
+		mailer, err = mail.NewFileMailer(cfg.Mail.Dir, cfg.Mail.From)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+	accountUsecase := usecase.NewAccountUsecase(authUsecase, authRepo, mailer, cfg.JWT.Secret, usecase.AccountPolicy{
+		AppURL:              cfg.Account.AppURL,
+		VerificationExpiry:  cfg.Account.VerificationExpiry,
+		PasswordResetExpiry: cfg.Account.PasswordResetExpiry,
+	}, log.Printf)
+	docUsecase := usecase.NewDocumentUsecase(docRepo, accessPolicy, usecase.SharingPolicy{
+		RequireVerifiedEmail: cfg.Account.RequireVerifiedEmail,
+	})
+	collabUsecase := usecase.NewCollaborationUsecase(collabRepo, accessPolicy, usecase.SnapshotPolicy{
+		EveryOps:    cfg.Collab.SnapshotEveryOps,
+		Interval:    cfg.Collab.SnapshotInterval,
+		RetainOps:   cfg.Collab.RetainOps,
+		RetryWindow: cfg.Collab.RetryWindow,
+	})
+	presenceUsecase := usecase.NewPresenceUsecase(collabRepo, redisClient, accessPolicy)
+	taskUsecase := usecase.NewTaskUsecase(taskRepo, accessPolicy)
+
+	// Background jobs stop when the server shuts down
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go collabUsecase.RunMaintenance(jobsCtx, cfg.Collab.MaintenanceInterval, log.Printf)
+	go docUsecase.RunTrashPurge(jobsCtx, cfg.Collab.MaintenanceInterval, cfg.Trash.Retention, log.Printf)
+	go authUsecase.RunTokenCleanup(jobsCtx, cfg.Collab.MaintenanceInterval, log.Printf)
+	go keyRing.RunKeyRotation(jobsCtx, cfg.Collab.MaintenanceInterval, log.Printf)
+
+	// Real-time hub
+	hub := websocket.NewHub(redisClient)
+	go hub.Run()
+
+	// Handlers
+	authHandler := handlers.NewAuthHandler(authUsecase, accountUsecase, keyRing)
+	oidcHandler := handlers.NewOIDCHandler(oidcUsecase)
+	docHandler := handlers.NewDocumentHandler(docUsecase, hub)
+	// WebSocket messages are limited per connection, which only ever lives
+	// on one node
+	wsHandler := handlers.NewWebSocketHandler(hub, authUsecase, docUsecase, collabUsecase, presenceUsecase, accessPolicy, cfg.Server.AllowedOrigins,
+		ratelimit.NewMemoryLimiter(), rateLimit(cfg, "ws_messages"))
+	syncHandler := handlers.NewSyncHandler(collabUsecase, hub)
+	presenceHandler := handlers.NewPresenceHandler(presenceUsecase)
+	taskHandler := handlers.NewTaskHandler(taskUsecase, hub)
+
+	gin.SetMode(cfg.Server.Mode)
+	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("Failed to set trusted proxies: %v", err)
+	}
+	limit := func(name string) gin.HandlerFunc {
+		return middleware.RateLimit(limiter, name, rateLimit(cfg, name))
+	}
+
+	router.GET("/health", handlers.Health)
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
+	router.GET("/docs/swagger.yaml", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/yaml", docs.SwaggerYAML)
+	})
+	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/docs/swagger.yaml")))
+
+	api := router.Group("/api/v1")
+	{
+		auth := api.Group("/auth")
+		auth.Use(limit("auth"))
+		{
+			auth.POST("/register", authHandler.Register)
+			auth.POST("/login", limit("login"), authHandler.Login)
+			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/logout", middleware.AuthMiddleware(authUsecase), authHandler.Logout)
+			auth.POST("/logout-all", middleware.AuthMiddleware(authUsecase), authHandler.LogoutAll)
+			auth.GET("/profile", middleware.AuthMiddleware(authUsecase), authHandler.GetProfile)
+			auth.POST("/forgot-password", authHandler.ForgotPassword)
+			auth.POST("/reset-password", authHandler.ResetPassword)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/verify-email/resend", middleware.AuthMiddleware(authUsecase), authHandler.ResendVerificationEmail)
+			auth.POST("/2fa/verify", limit("login"), authHandler.VerifyMFA)
+			// Setting up also works with the MFA token of a login that
+			// requires two-factor authentication
+			auth.POST("/2fa/setup", middleware.MFASetupMiddleware(authUsecase), authHandler.SetupTOTP)
+			auth.POST("/2fa/enable", middleware.MFASetupMiddleware(authUsecase), authHandler.EnableTOTP)
+			auth.POST("/2fa/disable", middleware.AuthMiddleware(authUsecase), authHandler.DisableTOTP)
+			auth.POST("/2fa/recovery-codes", middleware.AuthMiddleware(authUsecase), authHandler.RegenerateRecoveryCodes)
+			auth.GET("/oidc/providers", oidcHandler.ListProviders)
+			auth.GET("/oidc/:provider/login", oidcHandler.StartLogin)
+			auth.POST("/oidc/:provider/callback", oidcHandler.FinishLogin)
+			auth.GET("/oidc/:provider/link", middleware.AuthMiddleware(authUsecase), oidcHandler.StartLink)
+			auth.POST("/oidc/:provider/link/callback", middleware.AuthMiddleware(authUsecase), oidcHandler.FinishLink)
+		}
+
+		documents := api.Group("/documents")
+		documents.Use(middleware.AuthMiddleware(authUsecase), limit("api"))
+		{
+			documents.POST("", docHandler.CreateDocument)
+			documents.GET("", docHandler.ListDocuments)
+			documents.GET("/:id", docHandler.GetDocument)
+			documents.PUT("/:id", docHandler.UpdateDocument)
+			documents.DELETE("/:id", docHandler.DeleteDocument)
+			documents.POST("/:id/restore", docHandler.RestoreDocument)
+			documents.POST("/:id/share", docHandler.ShareDocument)
+			documents.GET("/:id/permissions", docHandler.ListPermissions)
+			documents.PUT("/:id/permissions/:user_id", docHandler.ChangeRole)
+			documents.DELETE("/:id/permissions/:user_id", docHandler.RevokePermission)
+			documents.POST("/:id/transfer", docHandler.TransferOwnership)
+			documents.GET("/:id/link", docHandler.GetShareLink)
+			documents.PUT("/:id/link", docHandler.UpdateShareLink)
+			documents.POST("/:id/link/rotate", docHandler.RotateShareLink)
+			documents.GET("/:id/versions", docHandler.GetVersions)
+			documents.GET("/:id/activities", docHandler.GetActivities)
+			documents.POST("/:id/sync", syncHandler.SyncOperations)
+			documents.GET("/:id/presence", presenceHandler.GetPresence)
+			documents.GET("/:id/tasks", taskHandler.ListTasks)
+			documents.POST("/:id/tasks", taskHandler.CreateTask)
+			documents.PUT("/:id/tasks/:task_id", taskHandler.UpdateTask)
+			documents.DELETE("/:id/tasks/:task_id", taskHandler.DeleteTask)
+			documents.POST("/:id/tasks/:task_id/move", taskHandler.MoveTask)
+			documents.POST("/:id/tasks/:task_id/assign", taskHandler.AssignTask)
+			documents.POST("/:id/tasks/:task_id/complete", taskHandler.CompleteTask)
+		}
+
+		admin := api.Group("/admin")
+		admin.Use(middleware.AuthMiddleware(authUsecase), limit("api"))
+		{
+			admin.GET("/settings", authHandler.GetSettings)
+			admin.PUT("/settings", authHandler.UpdateSettings)
+		}
+
+		api.GET("/tasks", middleware.AuthMiddleware(authUsecase), limit("api"), taskHandler.FindTasks)
+		api.GET("/trash", middleware.AuthMiddleware(authUsecase), limit("api"), docHandler.GetTrash)
+		api.GET("/share/:token", middleware.OptionalAuthMiddleware(authUsecase), limit("api"), docHandler.OpenShareLink)
+
+		// WebSocket authenticates via the token query parameter itself
+		api.GET("/ws", limit("ws"), wsHandler.HandleWebSocket)
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + cfg.Server.Port,
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Server listening on :%s", cfg.Server.Port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+}
+
+// rateLimit is the configured limit called name
+func rateLimit(cfg *config.Config, name string) usecase.RateLimit {
+	rate := cfg.RateLimit.Limits[name]
+	return usecase.RateLimit{Limit: rate.Limit, Window: rate.Window}
+}
@@ -0,0 +1,10 @@
+// Package docs carries the OpenAPI description served by the Swagger UI.
+package docs
+
+import _ "embed"
+
+// SwaggerYAML is docs/swagger.yaml baked into the binary so the UI works
+// from the container image, which ships without the source tree.
+//
+//go:embed swagger.yaml
+var SwaggerYAML []byte
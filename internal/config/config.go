@@ -0,0 +1,637 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all runtime settings for the server
+type Config struct {
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Redis     RedisConfig
+	JWT       JWTConfig
+	Collab    CollabConfig
+	Trash     TrashConfig
+	OIDC      []OIDCProviderConfig
+	MFA       MFAConfig
+	Mail      MailConfig
+	Account   AccountConfig
+	RateLimit RateLimitConfig
+}
+
+type ServerConfig struct {
+	Port string
+	Mode string // gin mode: "debug", "release" or "test"
+	// Origins browsers may open WebSockets from, as scheme://host[:port];
+	// "*" allows any. Same-origin requests are always allowed.
+	AllowedOrigins []string
+	// Proxies, as IPs or CIDRs, whose X-Forwarded-For header is believed
+	// when working out a client's IP. Empty trusts none.
+	TrustedProxies []string
+}
+
+type DatabaseConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	// Connect without a password, for local databases that trust their
+	// users; otherwise Password is required
+	AllowNoPassword bool
+}
+
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+}
+
+type JWTConfig struct {
+	Secret        string        // Encrypts the signing keys stored in the database
+	Expiry        time.Duration // Access token lifetime
+	RefreshExpiry time.Duration // How long an unused refresh token stays valid
+	Algorithm     string        // "RS256" or "EdDSA", for new signing keys
+	KeyRotation   time.Duration // How long each signing key signs
+	KeyOverlap    time.Duration // How long keys are published before and after signing
+}
+
+type CollabConfig struct {
+	SnapshotEveryOps    int64
+	SnapshotInterval    time.Duration
+	RetainOps           int64
+	RetryWindow         time.Duration // How long committed operation IDs are remembered
+	MaintenanceInterval time.Duration
+}
+
+// OIDCProviderConfig describes an OpenID Connect provider users can sign in
+// with. Its settings are read from OIDC_<NAME>_* variables.
+type OIDCProviderConfig struct {
+	Name         string // Used in URLs, e.g. /auth/oidc/<name>/login
+	Issuer       string
+	ClientID     string
+	ClientSecret string // Empty for public clients
+	RedirectURL  string // Where the provider sends users back to; the frontend's callback page
+	Scopes       []string
+	AllowSignup  bool // Create accounts for identities that match no user
+}
+
+type MFAConfig struct {
+	Required bool   // Every login needs two-factor authentication, until an administrator changes it
+	Issuer   string // Account label shown in authenticator apps
+}
+
+type MailConfig struct {
+	Driver       string // "smtp", or "file" to write messages to Dir instead
+	From         string // Sender, e.g. "Collab Platform <no-reply@example.com>"
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string // Empty to send without authenticating
+	SMTPPassword string
+	Dir          string
+}
+
+type AccountConfig struct {
+	AppURL               string        // Frontend that links in emails open
+	VerificationExpiry   time.Duration // How long email verification links work
+	PasswordResetExpiry  time.Duration // How long password reset links work
+	RequireVerifiedEmail bool          // Only verified users can share and be shared with
+}
+
+// Rate allows Limit requests per Window
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+type RateLimitConfig struct {
+	Backend string // "redis" to share limits between nodes, or "memory"
+	// Limits by name; see DefaultRateLimits
+	Limits map[string]Rate
+	// Failed logins in a row before an account is locked out; 0 turns
+	// lockouts off
+	LockoutThreshold int
+	LockoutBase      time.Duration // First lockout; each further failure doubles it
+	LockoutMax       time.Duration
+}
+
+// DefaultRateLimits are the limits RATE_LIMITS can change:
+//
+//   - login: password logins and two-factor codes, per client IP
+//   - auth: all other /auth routes, per client IP
+//   - api: other REST routes, per user or, for share links, per client IP
+//   - ws: WebSocket connections, per client IP
+//   - ws_messages: messages on each WebSocket connection
+var DefaultRateLimits = map[string]Rate{
+	"login":       {Limit: 10, Window: time.Minute},
+	"auth":        {Limit: 60, Window: time.Minute},
+	"api":         {Limit: 600, Window: time.Minute},
+	"ws":          {Limit: 30, Window: time.Minute},
+	"ws_messages": {Limit: 100, Window: time.Second},
+}
+
+type TrashConfig struct {
+	Retention time.Duration // How long deleted documents stay restorable
+}
+
+// Load reads configuration from an optional KEY=VALUE file and the process
+// environment. Environment variables always take precedence over the file.
+// An empty path falls back to ".env" if it exists.
+func Load(path string) (*Config, error) {
+	fileValues := map[string]string{}
+	if path == "" {
+		if _, err := os.Stat(".env"); err == nil {
+			path = ".env"
+		}
+	}
+	if path != "" {
+		values, err := readEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileValues = values
+	}
+
+	get := func(key, def string) string {
+		if v, ok := os.LookupEnv(key); ok {
+			return v
+		}
+		if v, ok := fileValues[key]; ok {
+			return v
+		}
+		return def
+	}
+
+	redisDB, err := strconv.Atoi(get("REDIS_DB", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_DB: %w", err)
+	}
+
+	jwtExpiry, err := time.ParseDuration(get("JWT_EXPIRY", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_EXPIRY: %w", err)
+	}
+
+	refreshExpiry, err := time.ParseDuration(get("REFRESH_TOKEN_EXPIRY", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REFRESH_TOKEN_EXPIRY: %w", err)
+	}
+
+	keyRotation, err := time.ParseDuration(get("JWT_KEY_ROTATION", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_ROTATION: %w", err)
+	}
+
+	keyOverlap, err := time.ParseDuration(get("JWT_KEY_OVERLAP", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_KEY_OVERLAP: %w", err)
+	}
+
+	snapshotEveryOps, err := strconv.ParseInt(get("SNAPSHOT_EVERY_OPS", "100"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNAPSHOT_EVERY_OPS: %w", err)
+	}
+
+	snapshotInterval, err := time.ParseDuration(get("SNAPSHOT_INTERVAL", "30s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNAPSHOT_INTERVAL: %w", err)
+	}
+
+	retainOps, err := strconv.ParseInt(get("OPLOG_RETAIN_OPS", "1000"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPLOG_RETAIN_OPS: %w", err)
+	}
+
+	retryWindow, err := time.ParseDuration(get("OPERATION_RETRY_WINDOW", "168h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPERATION_RETRY_WINDOW: %w", err)
+	}
+
+	maintenanceInterval, err := time.ParseDuration(get("MAINTENANCE_INTERVAL", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAINTENANCE_INTERVAL: %w", err)
+	}
+
+	trashRetention, err := time.ParseDuration(get("TRASH_RETENTION", "720h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRASH_RETENTION: %w", err)
+	}
+
+	dbAllowNoPassword, err := strconv.ParseBool(get("DB_ALLOW_NO_PASSWORD", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DB_ALLOW_NO_PASSWORD: %w", err)
+	}
+
+	mfaRequired, err := strconv.ParseBool(get("MFA_REQUIRED", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MFA_REQUIRED: %w", err)
+	}
+
+	verificationExpiry, err := time.ParseDuration(get("EMAIL_VERIFICATION_EXPIRY", "48h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_VERIFICATION_EXPIRY: %w", err)
+	}
+
+	passwordResetExpiry, err := time.ParseDuration(get("PASSWORD_RESET_EXPIRY", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_RESET_EXPIRY: %w", err)
+	}
+
+	requireVerifiedEmail, err := strconv.ParseBool(get("REQUIRE_VERIFIED_EMAIL", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REQUIRE_VERIFIED_EMAIL: %w", err)
+	}
+
+	rateLimits, err := parseRateLimits(get("RATE_LIMITS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RATE_LIMITS: %w", err)
+	}
+
+	lockoutThreshold, err := strconv.Atoi(get("LOGIN_LOCKOUT_THRESHOLD", "5"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOGIN_LOCKOUT_THRESHOLD: %w", err)
+	}
+
+	lockoutBase, err := time.ParseDuration(get("LOGIN_LOCKOUT_BASE", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOGIN_LOCKOUT_BASE: %w", err)
+	}
+
+	lockoutMax, err := time.ParseDuration(get("LOGIN_LOCKOUT_MAX", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOGIN_LOCKOUT_MAX: %w", err)
+	}
+
+	var providers []OIDCProviderConfig
+	for _, name := range splitList(get("OIDC_PROVIDERS", "")) {
+		prefix := oidcPrefix(name)
+		allowSignup, err := strconv.ParseBool(get(prefix+"ALLOW_SIGNUP", "false"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sALLOW_SIGNUP: %w", prefix, err)
+		}
+		providers = append(providers, OIDCProviderConfig{
+			Name:         name,
+			Issuer:       get(prefix+"ISSUER", ""),
+			ClientID:     get(prefix+"CLIENT_ID", ""),
+			ClientSecret: get(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  get(prefix+"REDIRECT_URL", ""),
+			Scopes:       strings.Fields(get(prefix+"SCOPES", "openid email profile")),
+			AllowSignup:  allowSignup,
+		})
+	}
+
+	cfg := &Config{
+		Server: ServerConfig{
+			Port:           get("SERVER_PORT", "8080"),
+			Mode:           get("GIN_MODE", "debug"),
+			AllowedOrigins: splitList(get("ALLOWED_ORIGINS", "")),
+			TrustedProxies: splitList(get("TRUSTED_PROXIES", "")),
+		},
+		Database: DatabaseConfig{
+			Host:     get("DB_HOST", "localhost"),
+			Port:     get("DB_PORT", "5432"),
+			User:     get("DB_USER", "postgres"),
+			Password: get("DB_PASSWORD", ""),
+			Name:     get("DB_NAME", "collab_platform"),
+
+			AllowNoPassword: dbAllowNoPassword,
+		},
+		Redis: RedisConfig{
+			Addr:     get("REDIS_ADDR", "localhost:6379"),
+			Password: get("REDIS_PASSWORD", ""),
+			DB:       redisDB,
+		},
+		JWT: JWTConfig{
+			Secret:        get("JWT_SECRET", ""),
+			Expiry:        jwtExpiry,
+			RefreshExpiry: refreshExpiry,
+			Algorithm:     get("JWT_ALGORITHM", "RS256"),
+			KeyRotation:   keyRotation,
+			KeyOverlap:    keyOverlap,
+		},
+		Collab: CollabConfig{
+			SnapshotEveryOps:    snapshotEveryOps,
+			SnapshotInterval:    snapshotInterval,
+			RetainOps:           retainOps,
+			RetryWindow:         retryWindow,
+			MaintenanceInterval: maintenanceInterval,
+		},
+		Trash: TrashConfig{
+			Retention: trashRetention,
+		},
+		OIDC: providers,
+		MFA: MFAConfig{
+			Required: mfaRequired,
+			Issuer:   get("MFA_ISSUER", "Collab Platform"),
+		},
+		Mail: MailConfig{
+			Driver:       get("MAIL_DRIVER", "file"),
+			From:         get("MAIL_FROM", "Collab Platform <no-reply@localhost>"),
+			SMTPHost:     get("SMTP_HOST", ""),
+			SMTPPort:     get("SMTP_PORT", "587"),
+			SMTPUsername: get("SMTP_USERNAME", ""),
+			SMTPPassword: get("SMTP_PASSWORD", ""),
+			Dir:          get("MAIL_DIR", "mail"),
+		},
+		Account: AccountConfig{
+			AppURL:               get("APP_URL", "http://localhost:3000"),
+			VerificationExpiry:   verificationExpiry,
+			PasswordResetExpiry:  passwordResetExpiry,
+			RequireVerifiedEmail: requireVerifiedEmail,
+		},
+		RateLimit: RateLimitConfig{
+			Backend:          get("RATE_LIMIT_BACKEND", "redis"),
+			Limits:           rateLimits,
+			LockoutThreshold: lockoutThreshold,
+			LockoutBase:      lockoutBase,
+			LockoutMax:       lockoutMax,
+		},
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every missing or malformed setting at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.JWT.Secret == "" {
+		errs = append(errs, errors.New("JWT_SECRET is required"))
+	} else if len(c.JWT.Secret) < 16 {
+		errs = append(errs, errors.New("JWT_SECRET must be at least 16 characters"))
+	}
+	if c.JWT.Expiry <= 0 {
+		errs = append(errs, errors.New("JWT_EXPIRY must be positive"))
+	}
+	if c.JWT.RefreshExpiry < c.JWT.Expiry {
+		errs = append(errs, errors.New("REFRESH_TOKEN_EXPIRY must not be shorter than JWT_EXPIRY"))
+	}
+	switch c.JWT.Algorithm {
+	case "RS256", "EdDSA":
+	default:
+		errs = append(errs, fmt.Errorf("JWT_ALGORITHM must be RS256 or EdDSA, got %q", c.JWT.Algorithm))
+	}
+	if c.JWT.KeyRotation <= 0 {
+		errs = append(errs, errors.New("JWT_KEY_ROTATION must be positive"))
+	} else if c.JWT.KeyRotation <= c.JWT.KeyOverlap {
+		// Otherwise more than one upcoming key has to be published at a time
+		errs = append(errs, errors.New("JWT_KEY_ROTATION must be longer than JWT_KEY_OVERLAP"))
+	}
+	// Tokens signed just before a key retires must still verify, and the
+	// next key must be published before it is needed
+	if c.JWT.KeyOverlap < c.JWT.Expiry {
+		errs = append(errs, errors.New("JWT_KEY_OVERLAP must not be shorter than JWT_EXPIRY"))
+	}
+	if c.JWT.KeyOverlap <= c.Collab.MaintenanceInterval {
+		errs = append(errs, errors.New("JWT_KEY_OVERLAP must be longer than MAINTENANCE_INTERVAL"))
+	}
+	if c.Collab.SnapshotEveryOps <= 0 {
+		errs = append(errs, errors.New("SNAPSHOT_EVERY_OPS must be positive"))
+	}
+	if c.Collab.SnapshotInterval <= 0 {
+		errs = append(errs, errors.New("SNAPSHOT_INTERVAL must be positive"))
+	}
+	if c.Collab.RetainOps < 0 {
+		errs = append(errs, errors.New("OPLOG_RETAIN_OPS must not be negative"))
+	}
+	if c.Collab.RetryWindow <= 0 {
+		errs = append(errs, errors.New("OPERATION_RETRY_WINDOW must be positive"))
+	}
+	if c.Collab.MaintenanceInterval <= 0 {
+		errs = append(errs, errors.New("MAINTENANCE_INTERVAL must be positive"))
+	}
+	if c.Trash.Retention <= 0 {
+		errs = append(errs, errors.New("TRASH_RETENTION must be positive"))
+	}
+	if c.Database.Host == "" {
+		errs = append(errs, errors.New("DB_HOST is required"))
+	}
+	if c.Database.User == "" {
+		errs = append(errs, errors.New("DB_USER is required"))
+	}
+	if c.Database.Password == "" && !c.Database.AllowNoPassword {
+		errs = append(errs, errors.New("DB_PASSWORD is required; set DB_ALLOW_NO_PASSWORD=true for a local database without one"))
+	}
+	if c.Database.Name == "" {
+		errs = append(errs, errors.New("DB_NAME is required"))
+	}
+	if _, err := strconv.Atoi(c.Database.Port); err != nil {
+		errs = append(errs, fmt.Errorf("DB_PORT must be a number, got %q", c.Database.Port))
+	}
+	if c.Redis.Addr == "" {
+		errs = append(errs, errors.New("REDIS_ADDR is required"))
+	}
+	if _, err := strconv.Atoi(c.Server.Port); err != nil {
+		errs = append(errs, fmt.Errorf("SERVER_PORT must be a number, got %q", c.Server.Port))
+	}
+	for _, origin := range c.Server.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("ALLOWED_ORIGINS entries must look like https://example.com, got %q", origin))
+		}
+	}
+	for _, p := range c.OIDC {
+		prefix := oidcPrefix(p.Name)
+		if !validProviderName(p.Name) {
+			errs = append(errs, fmt.Errorf("OIDC_PROVIDERS entries may only use a-z, 0-9 and -, got %q", p.Name))
+		}
+		// Plain HTTP is only trusted for a provider on this machine, such as
+		// a mock one in development
+		if u, err := url.Parse(p.Issuer); err != nil || u.Host == "" ||
+			(u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname()))) {
+			errs = append(errs, fmt.Errorf("%sISSUER must be an https URL, got %q", prefix, p.Issuer))
+		}
+		if p.ClientID == "" {
+			errs = append(errs, fmt.Errorf("%sCLIENT_ID is required", prefix))
+		}
+		if u, err := url.Parse(p.RedirectURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%sREDIRECT_URL must be an absolute URL, got %q", prefix, p.RedirectURL))
+		}
+		if !containsString(p.Scopes, "openid") {
+			errs = append(errs, fmt.Errorf("%sSCOPES must include openid", prefix))
+		}
+	}
+	if c.MFA.Issuer == "" || strings.Contains(c.MFA.Issuer, ":") {
+		errs = append(errs, fmt.Errorf("MFA_ISSUER must be set and must not contain ':', got %q", c.MFA.Issuer))
+	}
+	switch c.Mail.Driver {
+	case "smtp":
+		if c.Mail.SMTPHost == "" {
+			errs = append(errs, errors.New("SMTP_HOST is required when MAIL_DRIVER is smtp"))
+		}
+		if _, err := strconv.Atoi(c.Mail.SMTPPort); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP_PORT must be a number, got %q", c.Mail.SMTPPort))
+		}
+	case "file":
+		if c.Mail.Dir == "" {
+			errs = append(errs, errors.New("MAIL_DIR is required when MAIL_DRIVER is file"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("MAIL_DRIVER must be smtp or file, got %q", c.Mail.Driver))
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		errs = append(errs, fmt.Errorf("MAIL_FROM must be an email address, got %q", c.Mail.From))
+	}
+	if u, err := url.Parse(c.Account.AppURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("APP_URL must be an absolute URL, got %q", c.Account.AppURL))
+	}
+	if c.Account.VerificationExpiry <= 0 {
+		errs = append(errs, errors.New("EMAIL_VERIFICATION_EXPIRY must be positive"))
+	}
+	if c.Account.PasswordResetExpiry <= 0 {
+		errs = append(errs, errors.New("PASSWORD_RESET_EXPIRY must be positive"))
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				errs = append(errs, fmt.Errorf("TRUSTED_PROXIES entries must be IPs or CIDRs, got %q", proxy))
+			}
+		}
+	}
+	switch c.RateLimit.Backend {
+	case "redis", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_BACKEND must be redis or memory, got %q", c.RateLimit.Backend))
+	}
+	for name, rate := range c.RateLimit.Limits {
+		if _, ok := DefaultRateLimits[name]; !ok {
+			errs = append(errs, fmt.Errorf("RATE_LIMITS has unknown limit %q", name))
+		} else if rate.Limit <= 0 || rate.Window <= 0 {
+			errs = append(errs, fmt.Errorf("RATE_LIMITS %s must allow at least 1 request per positive window", name))
+		}
+	}
+	if c.RateLimit.LockoutThreshold < 0 {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_THRESHOLD must not be negative"))
+	}
+	if c.RateLimit.LockoutBase <= 0 {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_BASE must be positive"))
+	}
+	if c.RateLimit.LockoutMax < c.RateLimit.LockoutBase {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_MAX must not be shorter than LOGIN_LOCKOUT_BASE"))
+	}
+	switch c.Server.Mode {
+	case "debug", "release", "test":
+	default:
+		errs = append(errs, fmt.Errorf("GIN_MODE must be debug, release or test, got %q", c.Server.Mode))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// splitList parses a comma-separated setting, skipping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseRateLimits reads limits like "login=10/1m,api=600/1m" on top of
+// DefaultRateLimits
+func parseRateLimits(value string) (map[string]Rate, error) {
+	limits := make(map[string]Rate, len(DefaultRateLimits))
+	for name, rate := range DefaultRateLimits {
+		limits[name] = rate
+	}
+	for _, item := range splitList(value) {
+		name, spec, ok := strings.Cut(item, "=")
+		count, window, ok2 := strings.Cut(spec, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%q must look like name=requests/window", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(window))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		limits[strings.TrimSpace(name)] = Rate{Limit: limit, Window: d}
+	}
+	return limits, nil
+}
+
+// oidcPrefix is how a provider's settings are named, e.g. OIDC_MY_IDP_
+func oidcPrefix(name string) string {
+	return "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+func validProviderName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// readEnvFile parses a dotenv-style file of KEY=VALUE lines
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return values, nil
+}
@@ -0,0 +1,310 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnknownShape   = errors.New("operation references an unknown shape")
+	ErrDuplicateShape = errors.New("shape id already used")
+)
+
+// stamp orders writes to a register: higher Lamport clock wins, ties go to
+// the higher site. Stamps of writes that came with a document's seed content
+// are zero, so any real write beats them.
+type stamp = domain.ElementID
+
+// shape holds one whiteboard item as a set of last-writer-wins registers.
+// Kind and the add stamp never change; a delete is final.
+type shape struct {
+	ID      uuid.UUID
+	Kind    domain.ShapeKind
+	Added   stamp
+	Deleted bool
+
+	Position stamp
+	X, Y     float64
+	Size     stamp
+	Width    float64
+	Height   float64
+	TextAt   stamp
+	Text     string
+	ZAt      stamp
+	Z        float64
+	GroupAt  stamp
+	GroupID  *uuid.UUID
+	From, To *uuid.UUID // Set when the shape is added
+
+	Style map[string]styleValue
+}
+
+type styleValue struct {
+	At    stamp       `json:"at"`
+	Value interface{} `json:"value"` // nil once removed
+}
+
+// Board is the CRDT behind whiteboard documents: a map from shape ID to a
+// shape whose every property is a last-writer-wins register. Because the
+// winner of concurrent writes depends only on their stamps, two users moving
+// the same shape at once see it end up in the same place on every replica,
+// whatever order the moves arrive in.
+type Board struct {
+	shapes map[uuid.UUID]*shape
+	clock  int64
+}
+
+func NewBoard() *Board {
+	return &Board{shapes: make(map[uuid.UUID]*shape)}
+}
+
+// BoardFromWhiteboard seeds a board with rendered content, as stored in a
+// whiteboard document's Content. Every seeded register has the zero stamp.
+func BoardFromWhiteboard(wb domain.Whiteboard) *Board {
+	b := NewBoard()
+	for _, s := range wb.Shapes {
+		b.add(s, stamp{})
+	}
+	return b
+}
+
+// Clock returns the highest Lamport clock seen by this replica
+func (b *Board) Clock() int64 {
+	return b.clock
+}
+
+// IsBoardOperation reports whether opType is a whiteboard operation
+func IsBoardOperation(opType string) bool {
+	switch opType {
+	case "add_shape", "move", "resize", "restyle", "set_text", "reorder", "group", "ungroup", "delete":
+		return true
+	}
+	return false
+}
+
+// Has reports whether a shape was ever added, and whether it is still live
+func (b *Board) Has(id uuid.UUID) (exists, live bool) {
+	s, ok := b.shapes[id]
+	return ok, ok && !s.Deleted
+}
+
+// Integrate applies a whiteboard operation. Writes that lose to a register's
+// current stamp and changes to deleted shapes are ignored; changes to shapes
+// that were never added fail with ErrUnknownShape and leave the board as it was.
+func (b *Board) Integrate(op domain.Operation) error {
+	if !IsBoardOperation(op.Type) {
+		return ErrUnsupportedOp
+	}
+	at := stamp{Clock: op.Timestamp, Site: op.UserID}
+
+	for _, s := range op.Shapes {
+		existing, ok := b.shapes[s.ID]
+		if op.Type == "add_shape" {
+			// A retried add is a no-op; a different add reusing the ID is not
+			if ok && existing.Added != at {
+				return ErrDuplicateShape
+			}
+		} else if !ok {
+			return ErrUnknownShape
+		}
+	}
+
+	for _, s := range op.Shapes {
+		if op.Type == "add_shape" {
+			if _, ok := b.shapes[s.ID]; !ok {
+				b.add(s, at)
+			}
+			continue
+		}
+
+		target := b.shapes[s.ID]
+		if target.Deleted {
+			continue
+		}
+		switch op.Type {
+		case "move":
+			if newer(at, &target.Position) {
+				target.X, target.Y = s.X, s.Y
+			}
+		case "resize":
+			if newer(at, &target.Size) {
+				target.Width, target.Height = s.Width, s.Height
+			}
+		case "set_text":
+			if newer(at, &target.TextAt) {
+				target.Text = s.Text
+			}
+		case "reorder":
+			if newer(at, &target.ZAt) {
+				target.Z = s.Z
+			}
+		case "group":
+			if newer(at, &target.GroupAt) {
+				target.GroupID = s.GroupID
+			}
+		case "ungroup":
+			if newer(at, &target.GroupAt) {
+				target.GroupID = nil
+			}
+		case "restyle":
+			for key, value := range s.Style {
+				current := target.Style[key]
+				if newer(at, &current.At) {
+					current.Value = value
+					target.Style[key] = current
+				}
+			}
+		case "delete":
+			target.Deleted = true
+		}
+	}
+
+	if op.Timestamp > b.clock {
+		b.clock = op.Timestamp
+	}
+	return nil
+}
+
+func (b *Board) add(s domain.Shape, at stamp) {
+	added := &shape{
+		ID: s.ID, Kind: s.Kind, Added: at,
+		Position: at, X: s.X, Y: s.Y,
+		Size: at, Width: s.Width, Height: s.Height,
+		TextAt: at, Text: s.Text,
+		ZAt: at, Z: s.Z,
+		GroupAt: at, GroupID: s.GroupID,
+		From: s.From, To: s.To,
+		Style: make(map[string]styleValue, len(s.Style)),
+	}
+	for key, value := range s.Style {
+		added.Style[key] = styleValue{At: at, Value: value}
+	}
+	b.shapes[s.ID] = added
+}
+
+// newer reports whether a write stamped at beats the register stamped
+// *current, and moves the register's stamp up if so
+func newer(at stamp, current *stamp) bool {
+	if compareIDs(at, *current) <= 0 {
+		return false
+	}
+	*current = at
+	return true
+}
+
+// Whiteboard renders the live shapes back to front. Connector ends attached
+// to deleted shapes are left unattached.
+func (b *Board) Whiteboard() domain.Whiteboard {
+	live := make([]*shape, 0, len(b.shapes))
+	for _, s := range b.shapes {
+		if !s.Deleted {
+			live = append(live, s)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Z != live[j].Z {
+			return live[i].Z < live[j].Z
+		}
+		if c := compareIDs(live[i].Added, live[j].Added); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(live[i].ID[:], live[j].ID[:]) < 0
+	})
+
+	wb := domain.Whiteboard{Shapes: make([]domain.Shape, len(live))}
+	for i, s := range live {
+		rendered := domain.Shape{
+			ID: s.ID, Kind: s.Kind,
+			X: s.X, Y: s.Y, Width: s.Width, Height: s.Height,
+			Text: s.Text, Z: s.Z, GroupID: s.GroupID,
+			From: b.attached(s.From), To: b.attached(s.To),
+		}
+		for key, value := range s.Style {
+			if value.Value == nil {
+				continue
+			}
+			if rendered.Style == nil {
+				rendered.Style = make(map[string]interface{})
+			}
+			rendered.Style[key] = value.Value
+		}
+		wb.Shapes[i] = rendered
+	}
+	return wb
+}
+
+func (b *Board) attached(id *uuid.UUID) *uuid.UUID {
+	if id == nil {
+		return nil
+	}
+	if _, live := b.Has(*id); !live {
+		return nil
+	}
+	return id
+}
+
+// Text renders the board as JSON, the form whiteboard documents keep as their content
+func (b *Board) Text() string {
+	data, _ := json.Marshal(b.Whiteboard())
+	return string(data)
+}
+
+type boardState struct {
+	Clock  int64        `json:"clock"`
+	Shapes []shapeState `json:"shapes"`
+}
+
+type shapeState struct {
+	ID       uuid.UUID             `json:"id"`
+	Kind     domain.ShapeKind      `json:"kind"`
+	Added    stamp                 `json:"added"`
+	Deleted  bool                  `json:"deleted,omitempty"`
+	Position stamp                 `json:"position_at"`
+	X        float64               `json:"x"`
+	Y        float64               `json:"y"`
+	Size     stamp                 `json:"size_at"`
+	Width    float64               `json:"width"`
+	Height   float64               `json:"height"`
+	TextAt   stamp                 `json:"text_at"`
+	Text     string                `json:"text,omitempty"`
+	ZAt      stamp                 `json:"z_at"`
+	Z        float64               `json:"z"`
+	GroupAt  stamp                 `json:"group_at"`
+	GroupID  *uuid.UUID            `json:"group_id,omitempty"`
+	From     *uuid.UUID            `json:"from,omitempty"`
+	To       *uuid.UUID            `json:"to,omitempty"`
+	Style    map[string]styleValue `json:"style,omitempty"`
+}
+
+func (b *Board) MarshalJSON() ([]byte, error) {
+	state := boardState{Clock: b.clock, Shapes: make([]shapeState, 0, len(b.shapes))}
+	for _, s := range b.shapes {
+		state.Shapes = append(state.Shapes, shapeState(*s))
+	}
+	sort.Slice(state.Shapes, func(i, j int) bool {
+		return bytes.Compare(state.Shapes[i].ID[:], state.Shapes[j].ID[:]) < 0
+	})
+	return json.Marshal(state)
+}
+
+func (b *Board) UnmarshalJSON(data []byte) error {
+	var state boardState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*b = *NewBoard()
+	b.clock = state.Clock
+	for _, s := range state.Shapes {
+		restored := shape(s)
+		if restored.Style == nil {
+			restored.Style = make(map[string]styleValue)
+		}
+		b.shapes[s.ID] = &restored
+	}
+	return nil
+}
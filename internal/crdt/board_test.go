@@ -0,0 +1,209 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+var (
+	rect      = uuid.UUID{10}
+	circle    = uuid.UUID{11}
+	connector = uuid.UUID{12}
+)
+
+func shapeOp(site uuid.UUID, clock int64, opType string, shapes ...domain.Shape) domain.Operation {
+	return domain.Operation{ID: uuid.New(), Type: opType, UserID: site, Timestamp: clock, Shapes: shapes}
+}
+
+// seededBoard is a rectangle and a circle joined by a connector
+func seededBoard() *Board {
+	return BoardFromWhiteboard(domain.Whiteboard{Shapes: []domain.Shape{
+		{ID: rect, Kind: domain.ShapeRectangle, Width: 10, Height: 10, Style: map[string]interface{}{"fill": "red"}},
+		{ID: circle, Kind: domain.ShapeEllipse, X: 50, Width: 10, Height: 10, Z: 1},
+		{ID: connector, Kind: domain.ShapeConnector, From: &rect, To: &circle, Z: 2},
+	}})
+}
+
+func integrateAll(t *testing.T, b *Board, ops []domain.Operation) {
+	t.Helper()
+	for _, op := range ops {
+		if err := b.Integrate(op); err != nil {
+			t.Fatalf("integrate %s: %v", op.Type, err)
+		}
+	}
+}
+
+// shapeIn returns the rendered shape with the given ID, if it is live
+func shapeIn(wb domain.Whiteboard, id uuid.UUID) (domain.Shape, bool) {
+	for _, s := range wb.Shapes {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return domain.Shape{}, false
+}
+
+func TestBoardConvergesUnderConcurrentWrites(t *testing.T) {
+	tests := []struct {
+		name       string
+		alice, bob []domain.Operation
+		check      func(t *testing.T, wb domain.Whiteboard)
+	}{
+		{
+			name:  "moves at the same clock go to the higher site",
+			alice: []domain.Operation{shapeOp(alice, 1, "move", domain.Shape{ID: rect, X: 5, Y: 5})},
+			bob:   []domain.Operation{shapeOp(bob, 1, "move", domain.Shape{ID: rect, X: 7, Y: 7})},
+			check: func(t *testing.T, wb domain.Whiteboard) {
+				if s, _ := shapeIn(wb, rect); s.X != 7 || s.Y != 7 {
+					t.Errorf("rectangle at (%v, %v), want bob's (7, 7)", s.X, s.Y)
+				}
+			},
+		},
+		{
+			name:  "the later move wins",
+			alice: []domain.Operation{shapeOp(alice, 2, "move", domain.Shape{ID: rect, X: 5, Y: 5})},
+			bob:   []domain.Operation{shapeOp(bob, 1, "move", domain.Shape{ID: rect, X: 7, Y: 7})},
+			check: func(t *testing.T, wb domain.Whiteboard) {
+				if s, _ := shapeIn(wb, rect); s.X != 5 || s.Y != 5 {
+					t.Errorf("rectangle at (%v, %v), want alice's (5, 5)", s.X, s.Y)
+				}
+			},
+		},
+		{
+			name:  "restyle and move both land",
+			alice: []domain.Operation{shapeOp(alice, 1, "restyle", domain.Shape{ID: rect, Style: map[string]interface{}{"fill": "blue", "stroke": nil}})},
+			bob:   []domain.Operation{shapeOp(bob, 1, "move", domain.Shape{ID: rect, X: 7, Y: 7})},
+			check: func(t *testing.T, wb domain.Whiteboard) {
+				s, _ := shapeIn(wb, rect)
+				if s.X != 7 || s.Y != 7 || !reflect.DeepEqual(s.Style, map[string]interface{}{"fill": "blue"}) {
+					t.Errorf("rectangle = %+v, want moved and blue", s)
+				}
+			},
+		},
+		{
+			name:  "restyles of the same key at the same clock go to the higher site",
+			alice: []domain.Operation{shapeOp(alice, 1, "restyle", domain.Shape{ID: rect, Style: map[string]interface{}{"fill": "blue", "stroke": "black"}})},
+			bob:   []domain.Operation{shapeOp(bob, 1, "restyle", domain.Shape{ID: rect, Style: map[string]interface{}{"fill": nil}})},
+			check: func(t *testing.T, wb domain.Whiteboard) {
+				if s, _ := shapeIn(wb, rect); !reflect.DeepEqual(s.Style, map[string]interface{}{"stroke": "black"}) {
+					t.Errorf("style = %v, want bob's removed fill and alice's stroke", s.Style)
+				}
+			},
+		},
+		{
+			name:  "delete beats a later move",
+			alice: []domain.Operation{shapeOp(alice, 1, "delete", domain.Shape{ID: rect})},
+			bob:   []domain.Operation{shapeOp(bob, 2, "move", domain.Shape{ID: rect, X: 7, Y: 7})},
+			check: func(t *testing.T, wb domain.Whiteboard) {
+				if _, live := shapeIn(wb, rect); live {
+					t.Errorf("deleted rectangle is still rendered")
+				}
+				if s, _ := shapeIn(wb, connector); s.From != nil || s.To == nil || *s.To != circle {
+					t.Errorf("connector = %+v, want it detached from the rectangle only", s)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aliceFirst, bobFirst := seededBoard(), seededBoard()
+			integrateAll(t, aliceFirst, tt.alice)
+			integrateAll(t, aliceFirst, tt.bob)
+			integrateAll(t, bobFirst, tt.bob)
+			integrateAll(t, bobFirst, tt.alice)
+
+			got := aliceFirst.Whiteboard()
+			if other := bobFirst.Whiteboard(); !reflect.DeepEqual(got, other) {
+				t.Fatalf("replicas diverged:\n%+v\n%+v", got, other)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestBoardRejectsBadShapeReferences(t *testing.T) {
+	b := seededBoard()
+	added := shapeOp(alice, 1, "add_shape", domain.Shape{ID: uuid.UUID{20}, Kind: domain.ShapeText, Text: "hi", Z: 3})
+	integrateAll(t, b, []domain.Operation{added, added}) // A retry changes nothing
+	before := b.Whiteboard()
+
+	if err := b.Integrate(shapeOp(bob, 2, "add_shape", domain.Shape{ID: uuid.UUID{20}, Kind: domain.ShapeText})); !errors.Is(err, ErrDuplicateShape) {
+		t.Errorf("add reusing an ID: err = %v, want ErrDuplicateShape", err)
+	}
+	// The whole operation is refused, including the shape it knows
+	move := shapeOp(bob, 2, "move", domain.Shape{ID: rect, X: 9}, domain.Shape{ID: uuid.UUID{99}, X: 9})
+	if err := b.Integrate(move); !errors.Is(err, ErrUnknownShape) {
+		t.Errorf("move of an unknown shape: err = %v, want ErrUnknownShape", err)
+	}
+	if after := b.Whiteboard(); !reflect.DeepEqual(after, before) {
+		t.Errorf("board changed by refused operations:\n%+v\n%+v", after, before)
+	}
+	if b.Clock() != 1 {
+		t.Errorf("clock = %d, want 1", b.Clock())
+	}
+}
+
+func TestBoardJSONRoundTrip(t *testing.T) {
+	b := seededBoard()
+	integrateAll(t, b, []domain.Operation{
+		shapeOp(alice, 1, "move", domain.Shape{ID: rect, X: 5, Y: 5}),
+		shapeOp(bob, 2, "restyle", domain.Shape{ID: circle, Style: map[string]interface{}{"fill": "green"}}),
+		shapeOp(alice, 3, "group", domain.Shape{ID: rect, GroupID: &circle}),
+		shapeOp(bob, 4, "delete", domain.Shape{ID: connector}),
+	})
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var restored Board
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(restored.Whiteboard(), b.Whiteboard()) || restored.Clock() != b.Clock() {
+		t.Fatalf("restored %+v at %d, want %+v at %d", restored.Whiteboard(), restored.Clock(), b.Whiteboard(), b.Clock())
+	}
+	if again, _ := json.Marshal(&restored); string(again) != string(data) {
+		t.Errorf("re-marshalled state differs:\n%s\n%s", again, data)
+	}
+
+	// The register stamps survive, so late writes resolve the same way
+	late := []domain.Operation{
+		shapeOp(uuid.UUID{}, 1, "move", domain.Shape{ID: rect, X: 1, Y: 1}),
+		shapeOp(bob, 1, "move", domain.Shape{ID: rect, X: 8, Y: 8}),
+		shapeOp(alice, 2, "restyle", domain.Shape{ID: circle, Style: map[string]interface{}{"fill": "red", "stroke": "black"}}),
+		shapeOp(alice, 5, "move", domain.Shape{ID: connector, X: 3}),
+	}
+	integrateAll(t, b, late)
+	integrateAll(t, &restored, late)
+	if !reflect.DeepEqual(restored.Whiteboard(), b.Whiteboard()) {
+		t.Errorf("after late writes restored = %+v, want %+v", restored.Whiteboard(), b.Whiteboard())
+	}
+	if s, _ := shapeIn(restored.Whiteboard(), rect); s.X != 8 {
+		t.Errorf("rectangle x = %v, want bob's later-site move to 8", s.X)
+	}
+}
+
+func TestBoardRendersBackToFront(t *testing.T) {
+	b := seededBoard()
+	later, earlier := uuid.UUID{30}, uuid.UUID{31}
+	integrateAll(t, b, []domain.Operation{
+		shapeOp(bob, 1, "add_shape", domain.Shape{ID: earlier, Kind: domain.ShapeLine, Z: 1}),
+		shapeOp(alice, 2, "add_shape", domain.Shape{ID: later, Kind: domain.ShapeLine, Z: 1}),
+		shapeOp(alice, 3, "reorder", domain.Shape{ID: connector, Z: -1}),
+	})
+
+	// Ties on z go to the newer shape, seeded ones being oldest
+	var got []uuid.UUID
+	for _, s := range b.Whiteboard().Shapes {
+		got = append(got, s.ID)
+	}
+	if want := []uuid.UUID{connector, rect, circle, earlier, later}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,220 @@
+package crdt
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/collab-platform/backend/internal/domain"
+)
+
+// mark applies formatting attributes to the elements between two anchors,
+// inclusive. Anchoring to element IDs rather than offsets means text inserted
+// inside the range later is formatted too, and the range survives deletes.
+// When marks disagree on an attribute the one with the higher ID wins.
+type mark struct {
+	ID         domain.ElementID
+	Start      domain.ElementID
+	End        domain.ElementID
+	Attributes map[string]interface{}
+}
+
+type markState struct {
+	ID         domain.ElementID       `json:"id"`
+	Start      domain.ElementID       `json:"start"`
+	End        domain.ElementID       `json:"end"`
+	Attributes map[string]interface{} `json:"attrs"`
+}
+
+func (s *Sequence) integrateFormat(op domain.Operation) error {
+	if len(op.Targets) != 2 {
+		return ErrUnsupportedOp
+	}
+	start, end := op.Targets[0], op.Targets[1]
+	startIdx, ok := s.index[start]
+	if !ok {
+		return ErrMissingDependency
+	}
+	endIdx, ok := s.index[end]
+	if !ok {
+		return ErrMissingDependency
+	}
+	if startIdx > endIdx {
+		return ErrUnsupportedOp
+	}
+
+	id := domain.ElementID{Clock: op.Timestamp, Site: op.UserID}
+	for _, m := range s.marks {
+		if m.ID == id {
+			return nil
+		}
+	}
+
+	s.marks = append(s.marks, mark{ID: id, Start: start, End: end, Attributes: op.Attributes})
+	if op.Timestamp > s.clock {
+		s.clock = op.Timestamp
+	}
+	return nil
+}
+
+// RangeOf returns the visible offset and rune count of the range between two
+// anchors, inclusive, or ok=false if either is unknown or they are reversed
+func (s *Sequence) RangeOf(start, end domain.ElementID) (pos, n int, ok bool) {
+	startIdx, ok1 := s.index[start]
+	endIdx, ok2 := s.index[end]
+	if !ok1 || !ok2 || startIdx > endIdx {
+		return 0, 0, false
+	}
+	for i, e := range s.elements {
+		if i > endIdx {
+			break
+		}
+		if e.Deleted {
+			continue
+		}
+		if i < startIdx {
+			pos++
+		} else {
+			n++
+		}
+	}
+	return pos, n, true
+}
+
+// FormatRun is a range of elements, between two anchors inclusive, and the
+// attributes to set on it
+type FormatRun struct {
+	Start      domain.ElementID
+	End        domain.ElementID
+	Attributes map[string]interface{}
+}
+
+// RevertFormat returns the formatting that would take back the mark with the
+// given ID: the runs of its range where it still decides an attribute, each
+// with the values those attributes would have without it (nil where they
+// would be unset). Attributes a later mark has set since are left alone.
+func (s *Sequence) RevertFormat(id domain.ElementID) []FormatRun {
+	var target *mark
+	for i := range s.marks {
+		if s.marks[i].ID == id {
+			target = &s.marks[i]
+		}
+	}
+	if target == nil {
+		return nil
+	}
+
+	var runs []FormatRun
+	var current map[string]interface{}
+	for i := s.index[target.Start]; i <= s.index[target.End]; i++ {
+		restore := s.restoreAt(i, target)
+		if len(restore) == 0 {
+			current = nil
+			continue
+		}
+		if current != nil && reflect.DeepEqual(restore, current) {
+			runs[len(runs)-1].End = s.elements[i].ID
+			continue
+		}
+		runs = append(runs, FormatRun{Start: s.elements[i].ID, End: s.elements[i].ID, Attributes: restore})
+		current = restore
+	}
+	return runs
+}
+
+// restoreAt returns, for each attribute m still decides at element index i,
+// the value the attribute would have there without m
+func (s *Sequence) restoreAt(i int, m *mark) map[string]interface{} {
+	restore := make(map[string]interface{})
+	for key := range m.Attributes {
+		var winner, prior *mark
+		for j := range s.marks {
+			other := &s.marks[j]
+			if _, ok := other.Attributes[key]; !ok || !s.covers(other, i) {
+				continue
+			}
+			if winner == nil || compareIDs(other.ID, winner.ID) > 0 {
+				winner = other
+			}
+			if other.ID != m.ID && (prior == nil || compareIDs(other.ID, prior.ID) > 0) {
+				prior = other
+			}
+		}
+		if winner == nil || winner.ID != m.ID {
+			continue
+		}
+		restore[key] = nil
+		if prior != nil {
+			restore[key] = prior.Attributes[key]
+		}
+	}
+	return restore
+}
+
+func (s *Sequence) covers(m *mark, i int) bool {
+	return s.index[m.Start] <= i && i <= s.index[m.End]
+}
+
+// attributes resolves the formatting of every element, indexed like s.elements
+func (s *Sequence) attributes() []map[string]interface{} {
+	attrs := make([]map[string]interface{}, len(s.elements))
+	if len(s.marks) == 0 {
+		return attrs
+	}
+
+	marks := make([]mark, len(s.marks))
+	copy(marks, s.marks)
+	sort.Slice(marks, func(i, j int) bool {
+		return compareIDs(marks[i].ID, marks[j].ID) < 0
+	})
+
+	for _, m := range marks {
+		startIdx, endIdx := s.index[m.Start], s.index[m.End]
+		for i := startIdx; i <= endIdx; i++ {
+			for k, v := range m.Attributes {
+				if v == nil {
+					delete(attrs[i], k)
+					continue
+				}
+				if attrs[i] == nil {
+					attrs[i] = make(map[string]interface{})
+				}
+				attrs[i][k] = v
+			}
+		}
+	}
+	return attrs
+}
+
+// Delta returns the visible text as runs of identically formatted text
+func (s *Sequence) Delta() []domain.DeltaOp {
+	attrs := s.attributes()
+
+	var ops []domain.DeltaOp
+	var b strings.Builder
+	var current map[string]interface{}
+	flush := func() {
+		if b.Len() == 0 {
+			return
+		}
+		op := domain.DeltaOp{Insert: b.String()}
+		if len(current) > 0 {
+			op.Attributes = current
+		}
+		ops = append(ops, op)
+		b.Reset()
+	}
+
+	for i, e := range s.elements {
+		if e.Deleted {
+			continue
+		}
+		if b.Len() > 0 && !reflect.DeepEqual(attrs[i], current) {
+			flush()
+		}
+		current = attrs[i]
+		b.WriteRune(e.Value)
+	}
+	flush()
+	return ops
+}
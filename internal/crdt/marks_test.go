@@ -0,0 +1,204 @@
+package crdt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+var (
+	alice = uuid.UUID{1}
+	bob   = uuid.UUID{2}
+)
+
+// seeded returns the ID FromText gives the rune at offset pos
+func seeded(pos int) domain.ElementID {
+	return domain.ElementID{Clock: int64(pos + 1), Site: uuid.Nil}
+}
+
+func insertOp(site uuid.UUID, clock int64, origin domain.ElementID, content string) domain.Operation {
+	return domain.Operation{ID: uuid.New(), Type: "insert", UserID: site, Timestamp: clock, Origin: &origin, Content: content}
+}
+
+func deleteOp(site uuid.UUID, clock int64, targets ...domain.ElementID) domain.Operation {
+	return domain.Operation{ID: uuid.New(), Type: "delete", UserID: site, Timestamp: clock, Targets: targets}
+}
+
+func formatOp(site uuid.UUID, clock int64, start, end domain.ElementID, attrs map[string]interface{}) domain.Operation {
+	return domain.Operation{ID: uuid.New(), Type: "format", UserID: site, Timestamp: clock, Targets: []domain.ElementID{start, end}, Attributes: attrs}
+}
+
+var bold = map[string]interface{}{"bold": true}
+
+func TestMarksUnderConcurrentEdits(t *testing.T) {
+	// Alice bolds "world" in "hello world" while Bob edits the same text
+	mark := formatOp(alice, 12, seeded(6), seeded(10), bold)
+
+	tests := []struct {
+		name string
+		edit []domain.Operation // Bob's, concurrent with the mark
+		want []domain.DeltaOp
+	}{
+		{
+			name: "insert inside the range is formatted",
+			edit: []domain.Operation{insertOp(bob, 12, seeded(7), "--")},
+			want: []domain.DeltaOp{{Insert: "hello "}, {Insert: "wo--rld", Attributes: bold}},
+		},
+		{
+			name: "insert before the range is not",
+			edit: []domain.Operation{insertOp(bob, 12, seeded(5), "--")},
+			want: []domain.DeltaOp{{Insert: "hello --"}, {Insert: "world", Attributes: bold}},
+		},
+		{
+			name: "insert after the range is not",
+			edit: []domain.Operation{insertOp(bob, 12, seeded(10), "!")},
+			want: []domain.DeltaOp{{Insert: "hello "}, {Insert: "world", Attributes: bold}, {Insert: "!"}},
+		},
+		{
+			name: "range survives deleting its anchors",
+			edit: []domain.Operation{deleteOp(bob, 12, seeded(6), seeded(10))},
+			want: []domain.DeltaOp{{Insert: "hello "}, {Insert: "orl", Attributes: bold}},
+		},
+		{
+			name: "range survives a delete across its start",
+			edit: []domain.Operation{deleteOp(bob, 12, seeded(4), seeded(5), seeded(6))},
+			want: []domain.DeltaOp{{Insert: "hell"}, {Insert: "orld", Attributes: bold}},
+		},
+		{
+			name: "insert into a range whose anchors are gone",
+			edit: []domain.Operation{
+				deleteOp(bob, 12, seeded(6), seeded(7), seeded(8), seeded(9), seeded(10)),
+				insertOp(bob, 13, seeded(8), "X"),
+			},
+			want: []domain.DeltaOp{{Insert: "hello "}, {Insert: "X", Attributes: bold}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			markFirst, editFirst := FromText("hello world"), FromText("hello world")
+			for _, op := range append([]domain.Operation{mark}, tt.edit...) {
+				if err := markFirst.Apply(op); err != nil {
+					t.Fatalf("apply %s: %v", op.Type, err)
+				}
+			}
+			for _, op := range append(append([]domain.Operation{}, tt.edit...), mark) {
+				if err := editFirst.Apply(op); err != nil {
+					t.Fatalf("apply %s: %v", op.Type, err)
+				}
+			}
+
+			if got := markFirst.Delta(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mark first: delta = %v, want %v", got, tt.want)
+			}
+			if got := editFirst.Delta(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("edit first: delta = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarksResolveByID(t *testing.T) {
+	red := map[string]interface{}{"color": "red"}
+	blue := map[string]interface{}{"color": "blue"}
+
+	tests := []struct {
+		name  string
+		marks []domain.Operation
+		want  []domain.DeltaOp
+	}{
+		{
+			name: "higher clock wins",
+			marks: []domain.Operation{
+				formatOp(alice, 5, seeded(0), seeded(3), red),
+				formatOp(bob, 4, seeded(2), seeded(5), blue),
+			},
+			want: []domain.DeltaOp{
+				{Insert: "abcd", Attributes: red},
+				{Insert: "ef", Attributes: blue},
+			},
+		},
+		{
+			name: "site breaks a clock tie",
+			marks: []domain.Operation{
+				formatOp(alice, 4, seeded(0), seeded(3), red),
+				formatOp(bob, 4, seeded(2), seeded(5), blue),
+			},
+			want: []domain.DeltaOp{
+				{Insert: "ab", Attributes: red},
+				{Insert: "cdef", Attributes: blue},
+			},
+		},
+		{
+			name: "nil clears an attribute",
+			marks: []domain.Operation{
+				formatOp(alice, 4, seeded(0), seeded(5), map[string]interface{}{"bold": true, "color": "red"}),
+				formatOp(bob, 5, seeded(1), seeded(2), map[string]interface{}{"bold": nil}),
+			},
+			want: []domain.DeltaOp{
+				{Insert: "a", Attributes: map[string]interface{}{"bold": true, "color": "red"}},
+				{Insert: "bc", Attributes: red},
+				{Insert: "def", Attributes: map[string]interface{}{"bold": true, "color": "red"}},
+			},
+		},
+		{
+			name: "clearing the only attribute leaves a plain run",
+			marks: []domain.Operation{
+				formatOp(alice, 4, seeded(0), seeded(5), bold),
+				formatOp(bob, 5, seeded(0), seeded(2), map[string]interface{}{"bold": nil}),
+			},
+			want: []domain.DeltaOp{{Insert: "abc"}, {Insert: "def", Attributes: bold}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, order := range [][]int{{0, 1}, {1, 0}} {
+				s := FromText("abcdef")
+				for _, i := range order {
+					if err := s.Apply(tt.marks[i]); err != nil {
+						t.Fatalf("apply format: %v", err)
+					}
+				}
+				if got := s.Delta(); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("order %v: delta = %v, want %v", order, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMarksRoundTripThroughJSON(t *testing.T) {
+	s := FromText("hello world")
+	for _, op := range []domain.Operation{
+		formatOp(alice, 12, seeded(0), seeded(4), bold),
+		deleteOp(bob, 12, seeded(4)),
+		formatOp(bob, 13, seeded(2), seeded(7), map[string]interface{}{"color": "red"}),
+	} {
+		if err := s.Apply(op); err != nil {
+			t.Fatalf("apply %s: %v", op.Type, err)
+		}
+	}
+
+	data, err := s.MarshalJSON()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	restored := NewSequence()
+	if err := restored.UnmarshalJSON(data); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got, want := restored.Delta(), s.Delta(); !reflect.DeepEqual(got, want) {
+		t.Errorf("delta after round trip = %v, want %v", got, want)
+	}
+
+	// The anchors still work after the round trip
+	for _, seq := range []*Sequence{s, restored} {
+		if err := seq.Apply(insertOp(alice, 14, seeded(2), "X")); err != nil {
+			t.Fatalf("apply insert: %v", err)
+		}
+	}
+	if got, want := restored.Delta(), s.Delta(); !reflect.DeepEqual(got, want) {
+		t.Errorf("delta after an insert = %v, want %v", got, want)
+	}
+}
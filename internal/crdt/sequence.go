@@ -0,0 +1,466 @@
+// Package crdt implements the replicated data types behind collaborative documents.
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMissingDependency = errors.New("operation references an unknown element")
+	ErrInvalidClock      = errors.New("element clock must be greater than its origin's")
+	ErrDuplicateElement  = errors.New("element id already used for different content")
+	ErrUnsupportedOp     = errors.New("unsupported operation type")
+)
+
+// Head is the origin used for text inserted at the very start of a document
+var Head = domain.ElementID{}
+
+type element struct {
+	ID      domain.ElementID
+	Value   rune
+	Deleted bool
+}
+
+// Sequence is an RGA (replicated growable array) of runes. Every rune has a
+// unique ElementID; inserts name the element they follow and deletes leave
+// tombstones, so replicas that integrate the same set of operations end up
+// with the same text regardless of the order the operations arrived in.
+type Sequence struct {
+	elements []element
+	index    map[domain.ElementID]int
+	clock    int64
+
+	// Operations whose dependencies have not arrived yet (see Apply)
+	pending []domain.Operation
+	// Deletes that arrived before the element they remove
+	deletedEarly map[domain.ElementID]bool
+
+	// Formatting ranges, see marks.go
+	marks []mark
+}
+
+func NewSequence() *Sequence {
+	return &Sequence{
+		index:        make(map[domain.ElementID]int),
+		deletedEarly: make(map[domain.ElementID]bool),
+	}
+}
+
+// FromText seeds a sequence with plain text. Seeded elements belong to the nil
+// site with clocks 1..n so every replica derives the same IDs from the same text.
+func FromText(text string) *Sequence {
+	s := NewSequence()
+	for _, r := range text {
+		s.clock++
+		s.elements = append(s.elements, element{
+			ID:    domain.ElementID{Clock: s.clock, Site: uuid.Nil},
+			Value: r,
+		})
+	}
+	s.reindex(0)
+	return s
+}
+
+// Clock returns the highest Lamport clock seen by this replica
+func (s *Sequence) Clock() int64 {
+	return s.clock
+}
+
+// Text returns the visible document content
+func (s *Sequence) Text() string {
+	var b strings.Builder
+	for _, e := range s.elements {
+		if !e.Deleted {
+			b.WriteRune(e.Value)
+		}
+	}
+	return b.String()
+}
+
+// Len returns the number of visible runes
+func (s *Sequence) Len() int {
+	n := 0
+	for _, e := range s.elements {
+		if !e.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// Pending returns the number of operations waiting for their dependencies
+func (s *Sequence) Pending() int {
+	return len(s.pending)
+}
+
+// OriginAt returns the ID of the visible rune immediately before position pos
+// (a rune offset), or Head when pos is 0. Positions past the end clamp to it.
+func (s *Sequence) OriginAt(pos int) domain.ElementID {
+	if pos <= 0 {
+		return Head
+	}
+	last := Head
+	seen := 0
+	for _, e := range s.elements {
+		if e.Deleted {
+			continue
+		}
+		last = e.ID
+		seen++
+		if seen == pos {
+			break
+		}
+	}
+	return last
+}
+
+// IDsInRange returns the IDs of the visible runes in [pos, pos+length)
+func (s *Sequence) IDsInRange(pos, length int) []domain.ElementID {
+	ids := make([]domain.ElementID, 0, length)
+	visible := 0
+	for _, e := range s.elements {
+		if e.Deleted {
+			continue
+		}
+		if visible >= pos && visible < pos+length {
+			ids = append(ids, e.ID)
+		}
+		visible++
+		if visible >= pos+length {
+			break
+		}
+	}
+	return ids
+}
+
+// PositionOf returns the visible offset of an element and whether it is
+// still visible. Tombstones report the offset they would occupy.
+func (s *Sequence) PositionOf(id domain.ElementID) (int, bool) {
+	idx, ok := s.index[id]
+	if !ok {
+		return 0, false
+	}
+	pos := 0
+	for i := 0; i < idx; i++ {
+		if !s.elements[i].Deleted {
+			pos++
+		}
+	}
+	return pos, !s.elements[idx].Deleted
+}
+
+// Span is a run of adjacent visible runes
+type Span struct {
+	Position int
+	IDs      []domain.ElementID
+}
+
+// VisibleSpans groups the still-visible elements among ids into runs of
+// adjacent runes, in document order. Unknown and deleted IDs are skipped.
+func (s *Sequence) VisibleSpans(ids []domain.ElementID) []Span {
+	wanted := make(map[domain.ElementID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var spans []Span
+	visible := 0
+	inRun := false
+	for _, e := range s.elements {
+		if e.Deleted {
+			continue
+		}
+		if wanted[e.ID] {
+			if !inRun {
+				spans = append(spans, Span{Position: visible})
+				inRun = true
+			}
+			spans[len(spans)-1].IDs = append(spans[len(spans)-1].IDs, e.ID)
+		} else {
+			inRun = false
+		}
+		visible++
+	}
+	return spans
+}
+
+// View returns the IDs and text a replica that has not seen some of the
+// integrated operations would have: elements for which hide reports true are
+// left out and tombstones for which reveal reports true are kept.
+func (s *Sequence) View(hide, reveal func(domain.ElementID) bool) ([]domain.ElementID, string) {
+	var ids []domain.ElementID
+	var b strings.Builder
+	for _, e := range s.elements {
+		if hide(e.ID) || (e.Deleted && !reveal(e.ID)) {
+			continue
+		}
+		ids = append(ids, e.ID)
+		b.WriteRune(e.Value)
+	}
+	return ids, b.String()
+}
+
+// Before returns the nearest element before id, tombstones included, that
+// was inserted before Lamport clock clock, or Head if there is none. Skipping
+// later elements finds what id followed at that time. ok is false if id is
+// unknown.
+func (s *Sequence) Before(id domain.ElementID, clock int64) (domain.ElementID, bool) {
+	idx, ok := s.index[id]
+	if !ok {
+		return Head, false
+	}
+	for i := idx - 1; i >= 0; i-- {
+		if s.elements[i].ID.Clock < clock {
+			return s.elements[i].ID, true
+		}
+	}
+	return Head, true
+}
+
+// Run is a stretch of adjacent elements, tombstones included, and their text
+type Run struct {
+	IDs  []domain.ElementID
+	Text string
+}
+
+// Runs groups the known elements among ids into runs of adjacent elements,
+// deleted or not, in document order. Unknown IDs are skipped.
+func (s *Sequence) Runs(ids []domain.ElementID) []Run {
+	indices := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if idx, ok := s.index[id]; ok {
+			indices = append(indices, idx)
+		}
+	}
+	sort.Ints(indices)
+
+	var runs []Run
+	var b strings.Builder
+	for i, idx := range indices {
+		if i > 0 && idx == indices[i-1] {
+			continue
+		}
+		if i == 0 || idx != indices[i-1]+1 {
+			if len(runs) > 0 {
+				runs[len(runs)-1].Text = b.String()
+				b.Reset()
+			}
+			runs = append(runs, Run{})
+		}
+		runs[len(runs)-1].IDs = append(runs[len(runs)-1].IDs, s.elements[idx].ID)
+		b.WriteRune(s.elements[idx].Value)
+	}
+	if len(runs) > 0 {
+		runs[len(runs)-1].Text = b.String()
+	}
+	return runs
+}
+
+// Integrate applies an ID-based operation whose dependencies are all present.
+// It returns ErrMissingDependency otherwise and leaves the sequence untouched.
+func (s *Sequence) Integrate(op domain.Operation) error {
+	switch op.Type {
+	case "insert":
+		return s.integrateInsert(op)
+	case "delete":
+		return s.integrateDelete(op)
+	case "format":
+		return s.integrateFormat(op)
+	default:
+		return ErrUnsupportedOp
+	}
+}
+
+// Apply integrates an operation, buffering it until its dependencies arrive
+// when they are missing. This is what lets replicas accept operations in any
+// delivery order.
+func (s *Sequence) Apply(op domain.Operation) error {
+	err := s.Integrate(op)
+	if errors.Is(err, ErrMissingDependency) {
+		s.pending = append(s.pending, op)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.drainPending()
+	return nil
+}
+
+func (s *Sequence) drainPending() {
+	for progress := true; progress; {
+		progress = false
+		remaining := s.pending[:0]
+		for _, op := range s.pending {
+			if err := s.Integrate(op); errors.Is(err, ErrMissingDependency) {
+				remaining = append(remaining, op)
+			} else {
+				progress = true
+			}
+		}
+		s.pending = remaining
+	}
+}
+
+func (s *Sequence) integrateInsert(op domain.Operation) error {
+	if op.Origin == nil {
+		return ErrMissingDependency
+	}
+	origin := *op.Origin
+	originIdx := -1
+	if origin != Head {
+		idx, ok := s.index[origin]
+		if !ok {
+			return ErrMissingDependency
+		}
+		originIdx = idx
+	}
+	if op.Timestamp <= origin.Clock {
+		return ErrInvalidClock
+	}
+
+	// A retried insert is a no-op; a different insert reusing any ID is not
+	i := 0
+	retried := 0
+	for _, r := range op.Content {
+		id := domain.ElementID{Clock: op.Timestamp + int64(i), Site: op.UserID}
+		if idx, ok := s.index[id]; ok {
+			if s.elements[idx].Value != r {
+				return ErrDuplicateElement
+			}
+			retried++
+		}
+		i++
+	}
+	if retried == i {
+		return nil
+	}
+	if retried > 0 {
+		return ErrDuplicateElement
+	}
+
+	i = 0
+	for _, r := range op.Content {
+		id := domain.ElementID{Clock: op.Timestamp + int64(i), Site: op.UserID}
+		originIdx = s.insertAfter(originIdx, element{ID: id, Value: r, Deleted: s.deletedEarly[id]})
+		delete(s.deletedEarly, id)
+		if id.Clock > s.clock {
+			s.clock = id.Clock
+		}
+		i++
+	}
+	return nil
+}
+
+// insertAfter places e after the element at originIdx (-1 for Head) following
+// RGA ordering and returns e's index. Elements that follow the origin and sort
+// higher than e were inserted concurrently with priority (or descend from such
+// an insert), so e goes after all of them.
+func (s *Sequence) insertAfter(originIdx int, e element) int {
+	i := originIdx + 1
+	for i < len(s.elements) && compareIDs(s.elements[i].ID, e.ID) > 0 {
+		i++
+	}
+	s.elements = append(s.elements, element{})
+	copy(s.elements[i+1:], s.elements[i:])
+	s.elements[i] = e
+	s.reindex(i)
+	return i
+}
+
+func (s *Sequence) integrateDelete(op domain.Operation) error {
+	// Deletes never block: removing an element that has not arrived yet is
+	// remembered and applied on arrival, which keeps delete/insert commutative.
+	for _, id := range op.Targets {
+		if idx, ok := s.index[id]; ok {
+			s.elements[idx].Deleted = true
+		} else {
+			s.deletedEarly[id] = true
+		}
+	}
+	if op.Timestamp > s.clock {
+		s.clock = op.Timestamp
+	}
+	return nil
+}
+
+// HasElement reports whether id has been integrated
+func (s *Sequence) HasElement(id domain.ElementID) bool {
+	_, ok := s.index[id]
+	return ok || id == Head
+}
+
+func (s *Sequence) reindex(from int) {
+	for i := from; i < len(s.elements); i++ {
+		s.index[s.elements[i].ID] = i
+	}
+}
+
+// compareIDs orders elements by Lamport clock, breaking ties by site
+func compareIDs(a, b domain.ElementID) int {
+	if a.Clock != b.Clock {
+		if a.Clock > b.Clock {
+			return 1
+		}
+		return -1
+	}
+	return bytes.Compare(a.Site[:], b.Site[:])
+}
+
+type sequenceState struct {
+	Clock    int64              `json:"clock"`
+	Elements []elementState     `json:"elements"`
+	Deleted  []domain.ElementID `json:"deleted_early,omitempty"`
+	Marks    []markState        `json:"marks,omitempty"`
+}
+
+type elementState struct {
+	Clock   int64     `json:"c"`
+	Site    uuid.UUID `json:"s"`
+	Value   string    `json:"v"`
+	Deleted bool      `json:"d,omitempty"`
+}
+
+func (s *Sequence) MarshalJSON() ([]byte, error) {
+	state := sequenceState{Clock: s.clock, Elements: make([]elementState, len(s.elements))}
+	for i, e := range s.elements {
+		state.Elements[i] = elementState{Clock: e.ID.Clock, Site: e.ID.Site, Value: string(e.Value), Deleted: e.Deleted}
+	}
+	for id := range s.deletedEarly {
+		state.Deleted = append(state.Deleted, id)
+	}
+	for _, m := range s.marks {
+		state.Marks = append(state.Marks, markState(m))
+	}
+	return json.Marshal(state)
+}
+
+func (s *Sequence) UnmarshalJSON(data []byte) error {
+	var state sequenceState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	*s = *NewSequence()
+	s.clock = state.Clock
+	s.elements = make([]element, len(state.Elements))
+	for i, e := range state.Elements {
+		r, _ := utf8.DecodeRuneInString(e.Value)
+		s.elements[i] = element{ID: domain.ElementID{Clock: e.Clock, Site: e.Site}, Value: r, Deleted: e.Deleted}
+	}
+	for _, id := range state.Deleted {
+		s.deletedEarly[id] = true
+	}
+	for _, m := range state.Marks {
+		s.marks = append(s.marks, mark(m))
+	}
+	s.reindex(0)
+	return nil
+}
@@ -0,0 +1,158 @@
+package crdt
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+// replica is one simulated client: its copy of the document and which
+// operations it has seen
+type replica struct {
+	site uuid.UUID
+	seq  *Sequence
+	seen map[int]bool // Indexes into the shared operation log
+}
+
+// edit makes a random insert, delete or format on r's own copy, the way a
+// client would against whatever it has received so far
+func (r *replica) edit(rng *rand.Rand) (domain.Operation, bool) {
+	n := r.seq.Len()
+	op := domain.Operation{ID: uuid.New(), UserID: r.site, Timestamp: r.seq.Clock() + 1}
+
+	switch kind := rng.Intn(10); {
+	case kind < 5 || n == 0:
+		// Favour the ends so concurrent inserts often share an origin and
+		// a Lamport clock, which is where the tie-breaking is tested
+		pos := []int{0, n, rng.Intn(n + 1)}[rng.Intn(3)]
+		origin := r.seq.OriginAt(pos)
+		op.Type = "insert"
+		op.Origin = &origin
+		op.Content = randomText(rng)
+
+	case kind < 8:
+		pos := rng.Intn(n)
+		op.Type = "delete"
+		op.Targets = r.seq.IDsInRange(pos, 1+rng.Intn(min(3, n-pos)))
+
+	default:
+		pos := rng.Intn(n)
+		ids := r.seq.IDsInRange(pos, 1+rng.Intn(n-pos))
+		op.Type = "format"
+		op.Targets = []domain.ElementID{ids[0], ids[len(ids)-1]}
+		op.Attributes = randomAttributes(rng)
+	}
+	return op, len(op.Targets) > 0 || op.Content != ""
+}
+
+func randomText(rng *rand.Rand) string {
+	const alphabet = "abcdefgh é😀"
+	runes := []rune(alphabet)
+	b := make([]rune, 1+rng.Intn(4))
+	for i := range b {
+		b[i] = runes[rng.Intn(len(runes))]
+	}
+	return string(b)
+}
+
+func randomAttributes(rng *rand.Rand) map[string]interface{} {
+	switch rng.Intn(4) {
+	case 0:
+		return map[string]interface{}{"bold": true}
+	case 1:
+		return map[string]interface{}{"bold": nil}
+	case 2:
+		return map[string]interface{}{"color": []string{"red", "blue"}[rng.Intn(2)]}
+	default:
+		return map[string]interface{}{"italic": true, "color": nil}
+	}
+}
+
+// deliver applies the operations of log that r has not seen yet and pick
+// selects, in a random order
+func (r *replica) deliver(t *testing.T, rng *rand.Rand, log []domain.Operation, pick func() bool) {
+	t.Helper()
+	var order []int
+	for i := range log {
+		if !r.seen[i] && pick() {
+			order = append(order, i)
+		}
+	}
+	rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	for _, i := range order {
+		if err := r.seq.Apply(log[i]); err != nil {
+			t.Fatalf("apply %s from %s: %v", log[i].Type, log[i].UserID, err)
+		}
+		r.seen[i] = true
+	}
+}
+
+func TestSequenceConvergesUnderShuffledDelivery(t *testing.T) {
+	const (
+		replicas = 4
+		rounds   = 30
+		edits    = 3 // per replica per round
+	)
+
+	for seed := int64(1); seed <= 20; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(seed))
+
+			clients := make([]*replica, replicas)
+			for i := range clients {
+				clients[i] = &replica{
+					site: uuid.UUID{byte(i + 1)},
+					seq:  FromText("shared start"),
+					seen: make(map[int]bool),
+				}
+			}
+
+			var log []domain.Operation
+			for round := 0; round < rounds; round++ {
+				// Everyone edits concurrently against what they have so far...
+				for _, c := range clients {
+					for e := 0; e < edits; e++ {
+						op, ok := c.edit(rng)
+						if !ok {
+							continue
+						}
+						if err := c.seq.Apply(op); err != nil {
+							t.Fatalf("apply own %s: %v", op.Type, err)
+						}
+						c.seen[len(log)] = true
+						log = append(log, op)
+					}
+				}
+				// ...then hears about a random part of everyone else's edits,
+				// causal order not guaranteed
+				for _, c := range clients {
+					c.deliver(t, rng, log, func() bool { return rng.Intn(3) == 0 })
+				}
+			}
+
+			// A late joiner that gets the whole log in one random order
+			late := &replica{site: uuid.UUID{0xff}, seq: FromText("shared start"), seen: make(map[int]bool)}
+			clients = append(clients, late)
+			for _, c := range clients {
+				c.deliver(t, rng, log, func() bool { return true })
+			}
+
+			want := clients[0].seq
+			for i, c := range clients {
+				if p := c.seq.Pending(); p != 0 {
+					t.Errorf("replica %d still has %d operations pending", i, p)
+				}
+				if got := c.seq.Text(); got != want.Text() {
+					t.Errorf("replica %d text = %q, want %q", i, got, want.Text())
+				}
+				if got := c.seq.Delta(); !reflect.DeepEqual(got, want.Delta()) {
+					t.Errorf("replica %d delta = %v, want %v", i, got, want.Delta())
+				}
+			}
+		})
+	}
+}
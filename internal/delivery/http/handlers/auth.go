@@ -1,18 +1,25 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/collab-platform/backend/internal/usecase"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
-	authUsecase *usecase.AuthUsecase
+	authUsecase    *usecase.AuthUsecase
+	accountUsecase *usecase.AccountUsecase
+	keys           *usecase.KeyRing
 }
 
-func NewAuthHandler(authUsecase *usecase.AuthUsecase) *AuthHandler {
-	return &AuthHandler{authUsecase: authUsecase}
+func NewAuthHandler(authUsecase *usecase.AuthUsecase, accountUsecase *usecase.AccountUsecase, keys *usecase.KeyRing) *AuthHandler {
+	return &AuthHandler{authUsecase: authUsecase, accountUsecase: accountUsecase, keys: keys}
 }
 
 type RegisterRequest struct {
@@ -26,9 +33,15 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required" example:"password123"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required" example:"k3Jv9c2kq7J0rXW6bq0m1nS3r5dTzKpq3f5yA8gQH1c"`
+}
+
 type AuthResponse struct {
-	Token string      `json:"token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
-	User  interface{} `json:"user"`
+	Token        string      `json:"token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
+	RefreshToken string      `json:"refresh_token" example:"k3Jv9c2kq7J0rXW6bq0m1nS3r5dTzKpq3f5yA8gQH1c"`
+	ExpiresAt    time.Time   `json:"expires_at"`
+	User         interface{} `json:"user"`
 }
 
 type ErrorResponse struct {
@@ -42,7 +55,7 @@ type SuccessResponse struct {
 
 // Register godoc
 // @Summary      Register a new user
-// @Description  Register a new user account with email, username, and password
+// @Description  Register a new user account with email, username, and password. A link to verify the email address is sent to it.
 // @Tags         authentication
 // @Accept       json
 // @Produce      json
@@ -68,20 +81,23 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.accountUsecase.SendVerificationEmail(user)
 
 	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully", "user": user})
 }
 
 // Login godoc
 // @Summary      Login user
-// @Description  Authenticate user and receive JWT token
+// @Description  Authenticate user and receive a short-lived JWT access token and a refresh token. Repeated failures lock the account out for a while, answered with 429 and Retry-After. Users with two-factor authentication get 202 and an MFA token to finish with /auth/2fa/verify; when two-factor authentication is required and not yet set up, the MFA token is for /auth/2fa/setup and /auth/2fa/enable instead.
 // @Tags         authentication
 // @Accept       json
 // @Produce      json
 // @Param        request  body      LoginRequest  true  "Login credentials"
 // @Success      200      {object}  AuthResponse
+// @Success      202      {object}  MFAChallengeResponse
 // @Failure      400      {object}  ErrorResponse
 // @Failure      401      {object}  ErrorResponse
+// @Failure      429      {object}  ErrorResponse
 // @Failure      500      {object}  ErrorResponse
 // @Router       /auth/login [post]
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -91,22 +107,140 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	token, user, err := h.authUsecase.Login(req.Email, req.Password)
+	result, err := h.authUsecase.Login(req.Email, req.Password)
 	if err != nil {
 		if err == usecase.ErrInvalidCredentials {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
+		var locked *usecase.AccountLockedError
+		if errors.As(err, &locked) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if result.Tokens == nil {
+		c.JSON(http.StatusAccepted, MFAChallengeResponse{
+			MFARequired:      true,
+			MFASetupRequired: result.MFASetupRequired,
+			MFAToken:         result.MFAToken,
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, AuthResponse{
-		Token: token,
-		User:  user,
+		Token:        result.Tokens.AccessToken,
+		RefreshToken: result.Tokens.RefreshToken,
+		ExpiresAt:    result.Tokens.ExpiresAt,
+		User:         result.User,
 	})
 }
 
+// Refresh godoc
+// @Summary      Refresh access token
+// @Description  Exchange a refresh token for a new access token and a new refresh token. Each refresh token works once; using one again signs out every session from the same login.
+// @Tags         authentication
+// @Accept       json
+// @Produce      json
+// @Param        request  body      RefreshRequest  true  "Refresh token"
+// @Success      200      {object}  domain.TokenPair
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /auth/refresh [post]
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.authUsecase.Refresh(req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, usecase.ErrInvalidRefreshToken) || errors.Is(err, usecase.ErrRefreshTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout godoc
+// @Summary      Logout
+// @Description  End the current session: its refresh token stops working and its access tokens are rejected
+// @Tags         authentication
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  SuccessMessageResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /auth/logout [post]
+func (h *AuthHandler) Logout(c *gin.Context) {
+	claims, exists := c.Get("claims")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.authUsecase.Logout(claims.(*usecase.Claims)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAll godoc
+// @Summary      Logout everywhere
+// @Description  End every session of the current user, on every device
+// @Tags         authentication
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  SuccessMessageResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /auth/logout-all [post]
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := h.authUsecase.LogoutAll(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+}
+
+// JWKS godoc
+// @Summary      Token signing keys
+// @Description  Get the public keys access tokens are signed with, as a JSON Web Key Set. Tokens name their key in the kid header. Keys are listed before they start signing and for a while after they stop, so the set can be cached for a few minutes.
+// @Tags         authentication
+// @Produce      json
+// @Success      200  {object}  domain.JSONWebKeySet
+// @Router       /.well-known/jwks.json [get]
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
+
 // GetProfile godoc
 // @Summary      Get user profile
 // @Description  Get the current authenticated user's profile information
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
+	ws "github.com/collab-platform/backend/internal/delivery/websocket"
 	"github.com/collab-platform/backend/internal/domain"
 	"github.com/collab-platform/backend/internal/usecase"
 	"github.com/gin-gonic/gin"
@@ -11,10 +13,11 @@ import (
 
 type DocumentHandler struct {
 	docUsecase *usecase.DocumentUsecase
+	hub        *ws.Hub
 }
 
-func NewDocumentHandler(docUsecase *usecase.DocumentUsecase) *DocumentHandler {
-	return &DocumentHandler{docUsecase: docUsecase}
+func NewDocumentHandler(docUsecase *usecase.DocumentUsecase, hub *ws.Hub) *DocumentHandler {
+	return &DocumentHandler{docUsecase: docUsecase, hub: hub}
 }
 
 type CreateDocumentRequest struct {
@@ -29,11 +32,7 @@ type UpdateDocumentRequest struct {
 
 type ShareDocumentRequest struct {
 	UserID string      `json:"user_id" binding:"required" example:"550e8400-e29b-41d4-a716-446655440000"`
-	Role   domain.Role `json:"role" binding:"required" example:"editor" enums:"owner,editor,viewer"`
-}
-
-type ErrorResponse struct {
-	Error string `json:"error" example:"error message"`
+	Role   domain.Role `json:"role" binding:"required" example:"editor" enums:"editor,commenter,viewer"`
 }
 
 type SuccessMessageResponse struct {
@@ -117,15 +116,7 @@ func (h *DocumentHandler) GetDocument(c *gin.Context) {
 
 	doc, err := h.docUsecase.GetDocument(userID, docID)
 	if err != nil {
-		if err == usecase.ErrDocumentNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-		if err == usecase.ErrPermissionDenied {
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondDocumentError(c, err)
 		return
 	}
 
@@ -134,7 +125,7 @@ func (h *DocumentHandler) GetDocument(c *gin.Context) {
 
 // UpdateDocument godoc
 // @Summary      Update document
-// @Description  Update document title and/or content
+// @Description  Update document title and/or content. Whiteboard content is the JSON of a domain.Whiteboard. Returns 409 if an edit was committed while the update was being made. Connected clients are sent a reset frame with the new document.
 // @Tags         documents
 // @Accept       json
 // @Produce      json
@@ -146,6 +137,7 @@ func (h *DocumentHandler) GetDocument(c *gin.Context) {
 // @Failure      401       {object}  ErrorResponse
 // @Failure      403       {object}  ErrorResponse
 // @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
 // @Failure      500       {object}  ErrorResponse
 // @Router       /documents/{id} [put]
 func (h *DocumentHandler) UpdateDocument(c *gin.Context) {
@@ -175,18 +167,13 @@ func (h *DocumentHandler) UpdateDocument(c *gin.Context) {
 
 	doc, err := h.docUsecase.UpdateDocument(userID, docID, req.Title, req.Content)
 	if err != nil {
-		if err == usecase.ErrDocumentNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-		if err == usecase.ErrPermissionDenied {
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondDocumentError(c, err)
 		return
 	}
 
+	// The update bypasses the operation log, so live clients have to reload
+	h.hub.ResetDocument(doc, userID)
+
 	c.JSON(http.StatusOK, doc)
 }
 
@@ -225,7 +212,7 @@ func (h *DocumentHandler) ListDocuments(c *gin.Context) {
 
 // ShareDocument godoc
 // @Summary      Share document with user
-// @Description  Share a document with another user with specified role (owner, editor, viewer)
+// @Description  Share a document with another user as an editor, commenter or viewer (owner only). Sharing with someone who already has access changes their role. When REQUIRE_VERIFIED_EMAIL is on, both users need a verified email address.
 // @Tags         documents
 // @Accept       json
 // @Produce      json
@@ -237,6 +224,7 @@ func (h *DocumentHandler) ListDocuments(c *gin.Context) {
 // @Failure      401       {object}  ErrorResponse
 // @Failure      403       {object}  ErrorResponse
 // @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
 // @Failure      500       {object}  ErrorResponse
 // @Router       /documents/{id}/share [post]
 func (h *DocumentHandler) ShareDocument(c *gin.Context) {
@@ -271,24 +259,133 @@ func (h *DocumentHandler) ShareDocument(c *gin.Context) {
 	}
 
 	if err := h.docUsecase.ShareDocument(ownerID, docID, shareUserID, req.Role); err != nil {
-		if err == usecase.ErrDocumentNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-			return
-		}
-		if err == usecase.ErrPermissionDenied {
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondPermissionError(c, err)
 		return
 	}
 
+	h.hub.ChangeRole(docID, shareUserID, req.Role)
 	c.JSON(http.StatusOK, gin.H{"message": "Document shared successfully"})
 }
 
+// DeleteDocument godoc
+// @Summary      Delete document
+// @Description  Move a document to the trash (owner only). Everyone connected to it is disconnected; it can be restored until it is purged.
+// @Tags         documents
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Document ID"
+// @Success      200  {object}  SuccessMessageResponse
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /documents/{id} [delete]
+func (h *DocumentHandler) DeleteDocument(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	if err := h.docUsecase.DeleteDocument(userID, docID); err != nil {
+		respondDocumentError(c, err)
+		return
+	}
+
+	h.hub.CloseDocument(docID, "document deleted")
+	c.JSON(http.StatusOK, gin.H{"message": "Document moved to trash"})
+}
+
+// RestoreDocument godoc
+// @Summary      Restore document
+// @Description  Take a document out of the trash (owner only)
+// @Tags         documents
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Document ID"
+// @Success      200  {object}  domain.Document
+// @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /documents/{id}/restore [post]
+func (h *DocumentHandler) RestoreDocument(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	doc, err := h.docUsecase.RestoreDocument(userID, docID)
+	if err != nil {
+		respondDocumentError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
+
+// GetTrash godoc
+// @Summary      List trash
+// @Description  Get the documents the user owns that are in the trash, most recently deleted first
+// @Tags         documents
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   domain.Document
+// @Failure      401   {object}  ErrorResponse
+// @Failure      500   {object}  ErrorResponse
+// @Router       /trash [get]
+func (h *DocumentHandler) GetTrash(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docs, err := h.docUsecase.GetTrash(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, docs)
+}
+
 // GetVersions godoc
 // @Summary      Get document versions
-// @Description  Get version history for a document
+// @Description  Get version history for a document (anyone who can see it)
 // @Tags         documents
 // @Accept       json
 // @Produce      json
@@ -296,18 +393,33 @@ func (h *DocumentHandler) ShareDocument(c *gin.Context) {
 // @Param        id   path      string  true  "Document ID"
 // @Success      200  {array}   domain.DocumentVersion
 // @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
 // @Router       /documents/{id}/versions [get]
 func (h *DocumentHandler) GetVersions(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
 	docID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
 		return
 	}
 
-	versions, err := h.docUsecase.GetDocumentVersions(docID, 50)
+	versions, err := h.docUsecase.GetDocumentVersions(userID, docID, 50)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondDocumentError(c, err)
 		return
 	}
 
@@ -316,7 +428,7 @@ func (h *DocumentHandler) GetVersions(c *gin.Context) {
 
 // GetActivities godoc
 // @Summary      Get document activities
-// @Description  Get activity feed for a document (who edited what and when)
+// @Description  Get activity feed for a document (who edited what and when; anyone who can see it)
 // @Tags         documents
 // @Accept       json
 // @Produce      json
@@ -324,20 +436,52 @@ func (h *DocumentHandler) GetVersions(c *gin.Context) {
 // @Param        id   path      string  true  "Document ID"
 // @Success      200  {array}   domain.Activity
 // @Failure      400   {object}  ErrorResponse
+// @Failure      401   {object}  ErrorResponse
+// @Failure      403   {object}  ErrorResponse
+// @Failure      404   {object}  ErrorResponse
 // @Failure      500   {object}  ErrorResponse
 // @Router       /documents/{id}/activities [get]
 func (h *DocumentHandler) GetActivities(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
 	docID, err := uuid.Parse(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
 		return
 	}
 
-	activities, err := h.docUsecase.GetDocumentActivities(docID, 100)
+	activities, err := h.docUsecase.GetDocumentActivities(userID, docID, 100)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondDocumentError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, activities)
 }
+
+// respondDocumentError maps usecase errors to responses; the access policy's
+// refusals are all 403
+func respondDocumentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrDocumentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrPermissionDenied), errors.Is(err, usecase.ErrReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrInvalidContent):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrStaleWrite):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type MFAChallengeResponse struct {
+	MFARequired bool `json:"mfa_required" example:"true"`
+	// Two-factor authentication has to be set up before the login can finish
+	MFASetupRequired bool   `json:"mfa_setup_required" example:"false"`
+	MFAToken         string `json:"mfa_token" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6IjNmMWMwZTVhOWI3ZDRjMjEifQ..."`
+}
+
+type VerifyMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required" example:"eyJhbGciOiJSUzI1NiIsImtpZCI6IjNmMWMwZTVhOWI3ZDRjMjEifQ..."`
+	// An authenticator code or a recovery code
+	Code string `json:"code" binding:"required" example:"123456"`
+}
+
+type MFACodeRequest struct {
+	// An authenticator code, or for disabling and new recovery codes also a
+	// recovery code
+	Code string `json:"code" binding:"required" example:"123456"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes" example:"k4tqz-7mb2x"`
+	// Set when enabling finished a login that required two-factor
+	// authentication
+	Tokens *AuthResponse `json:"tokens,omitempty"`
+}
+
+// VerifyMFA godoc
+// @Summary      Finish a two-factor login
+// @Description  Finish a login with the MFA token it returned and an authenticator code or recovery code. Each recovery code works once.
+// @Tags         two-factor
+// @Accept       json
+// @Produce      json
+// @Param        request  body      VerifyMFARequest  true  "MFA token and code"
+// @Success      200      {object}  AuthResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      429      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /auth/2fa/verify [post]
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req VerifyMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, user, err := h.authUsecase.VerifyMFA(req.MFAToken, req.Code)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresAt:    tokens.ExpiresAt,
+		User:         user,
+	})
+}
+
+// SetupTOTP godoc
+// @Summary      Set up two-factor authentication
+// @Description  Start setting up an authenticator app. Show the otpauth URI as a QR code or the secret for typing in, then confirm with /auth/2fa/enable. Accepts an access token or the MFA token of a login that requires two-factor authentication.
+// @Tags         two-factor
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  usecase.TOTPSetup
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      409  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /auth/2fa/setup [post]
+func (h *AuthHandler) SetupTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	setup, err := h.authUsecase.SetupTOTP(userID)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, setup)
+}
+
+// EnableTOTP godoc
+// @Summary      Enable two-factor authentication
+// @Description  Turn two-factor authentication on with a code from the app just set up, and get recovery codes. They are only shown once. With the MFA token of a login that requires two-factor authentication, the login finishes too and its tokens are returned.
+// @Tags         two-factor
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      MFACodeRequest  true  "Authenticator code"
+// @Success      200      {object}  RecoveryCodesResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      429      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /auth/2fa/enable [post]
+func (h *AuthHandler) EnableTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.authUsecase.EnableTOTP(userID, req.Code)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	resp := RecoveryCodesResponse{RecoveryCodes: codes}
+	if claims, ok := c.Get("mfa_setup"); ok {
+		tokens, err := h.authUsecase.CompleteMFASetup(claims.(*usecase.Claims))
+		if err != nil {
+			respondMFAError(c, err)
+			return
+		}
+		resp.Tokens = &AuthResponse{
+			Token:        tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresAt:    tokens.ExpiresAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// DisableTOTP godoc
+// @Summary      Disable two-factor authentication
+// @Description  Turn two-factor authentication off with an authenticator code or recovery code. Refused when two-factor authentication is required for every account.
+// @Tags         two-factor
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      MFACodeRequest  true  "Authenticator or recovery code"
+// @Success      200      {object}  SuccessMessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      429      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /auth/2fa/disable [post]
+func (h *AuthHandler) DisableTOTP(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.authUsecase.DisableTOTP(userID, req.Code); err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary      Replace recovery codes
+// @Description  Get a new set of recovery codes with an authenticator code or recovery code. The old ones stop working.
+// @Tags         two-factor
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        request  body      MFACodeRequest  true  "Authenticator or recovery code"
+// @Success      200      {object}  RecoveryCodesResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      429      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /auth/2fa/recovery-codes [post]
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.authUsecase.RegenerateRecoveryCodes(userID, req.Code)
+	if err != nil {
+		respondMFAError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func respondMFAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrInvalidMFAToken), errors.Is(err, usecase.ErrInvalidMFACode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrTooManyMFAAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrTwoFactorRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrTwoFactorEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrTwoFactorNotEnabled), errors.Is(err, usecase.ErrTwoFactorNotSetUp):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
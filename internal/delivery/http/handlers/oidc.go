@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type OIDCHandler struct {
+	oidcUsecase *usecase.OIDCUsecase
+}
+
+func NewOIDCHandler(oidcUsecase *usecase.OIDCUsecase) *OIDCHandler {
+	return &OIDCHandler{oidcUsecase: oidcUsecase}
+}
+
+type OIDCProvidersResponse struct {
+	Providers []string `json:"providers" example:"corp"`
+}
+
+type OIDCLoginResponse struct {
+	AuthorizationURL string `json:"authorization_url" example:"https://idp.example.com/authorize?response_type=code&client_id=collab&..."`
+	State            string `json:"state" example:"Vh2m8o5S1xk0h3f6Qe9rT4yU7iO2pA5sD8fG1hJ4kL0"`
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" binding:"required" example:"SplxlOBeZQQYbYS6WxSbIA"`
+	State string `json:"state" binding:"required" example:"Vh2m8o5S1xk0h3f6Qe9rT4yU7iO2pA5sD8fG1hJ4kL0"`
+}
+
+// ListProviders godoc
+// @Summary      List identity providers
+// @Description  Get the names of the OpenID Connect providers users can sign in with
+// @Tags         authentication
+// @Produce      json
+// @Success      200  {object}  OIDCProvidersResponse
+// @Router       /auth/oidc/providers [get]
+func (h *OIDCHandler) ListProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, OIDCProvidersResponse{Providers: h.oidcUsecase.Providers()})
+}
+
+// StartLogin godoc
+// @Summary      Start an identity provider login
+// @Description  Get the URL to send the user to in order to sign in with an OpenID Connect provider. The provider sends them back to its configured redirect URL with a code and the returned state; keep the state to check it matches.
+// @Tags         authentication
+// @Produce      json
+// @Param        provider  path      string  true  "Provider name"
+// @Success      200       {object}  OIDCLoginResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      502       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /auth/oidc/{provider}/login [get]
+func (h *OIDCHandler) StartLogin(c *gin.Context) {
+	authURL, state, err := h.oidcUsecase.StartLogin(c.Param("provider"))
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, OIDCLoginResponse{AuthorizationURL: authURL, State: state})
+}
+
+// FinishLogin godoc
+// @Summary      Finish an identity provider login
+// @Description  Exchange the code and state the provider sent the user back with for the same tokens a password login returns. The identity is linked to the user with the same email if both the provider and this server have verified it, or to a new user if the provider allows signups. Other accounts must link the identity while signed in. Users with two-factor authentication, or who must set it up, get 202 and an MFA token exactly as with /auth/login.
+// @Tags         authentication
+// @Accept       json
+// @Produce      json
+// @Param        provider  path      string               true  "Provider name"
+// @Param        request   body      OIDCCallbackRequest  true  "Code and state from the provider"
+// @Success      200       {object}  AuthResponse
+// @Success      202       {object}  MFAChallengeResponse
+// @Failure      400       {object}  ErrorResponse
+// @Failure      401       {object}  ErrorResponse
+// @Failure      403       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /auth/oidc/{provider}/callback [post]
+func (h *OIDCHandler) FinishLogin(c *gin.Context) {
+	var req OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.oidcUsecase.FinishLogin(c.Param("provider"), req.Code, req.State)
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+
+	if result.Tokens == nil {
+		c.JSON(http.StatusAccepted, MFAChallengeResponse{
+			MFARequired:      true,
+			MFASetupRequired: result.MFASetupRequired,
+			MFAToken:         result.MFAToken,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Token:        result.Tokens.AccessToken,
+		RefreshToken: result.Tokens.RefreshToken,
+		ExpiresAt:    result.Tokens.ExpiresAt,
+		User:         result.User,
+	})
+}
+
+// StartLink godoc
+// @Summary      Start linking an identity provider
+// @Description  Get the URL to send the signed-in user to in order to link their account with an OpenID Connect provider. The provider sends them back to its configured redirect URL as for a login; post the code and state to the link callback.
+// @Tags         authentication
+// @Produce      json
+// @Security     BearerAuth
+// @Param        provider  path      string  true  "Provider name"
+// @Success      200       {object}  OIDCLoginResponse
+// @Failure      401       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      502       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /auth/oidc/{provider}/link [get]
+func (h *OIDCHandler) StartLink(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	authURL, state, err := h.oidcUsecase.StartLink(userID, c.Param("provider"))
+	if err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, OIDCLoginResponse{AuthorizationURL: authURL, State: state})
+}
+
+// FinishLink godoc
+// @Summary      Finish linking an identity provider
+// @Description  Link the provider account the user signed in to, with the code and state the provider sent them back with, to the current user. Later logins with that provider account sign in as them.
+// @Tags         authentication
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        provider  path      string               true  "Provider name"
+// @Param        request   body      OIDCCallbackRequest  true  "Code and state from the provider"
+// @Success      200       {object}  SuccessMessageResponse
+// @Failure      400       {object}  ErrorResponse
+// @Failure      401       {object}  ErrorResponse
+// @Failure      404       {object}  ErrorResponse
+// @Failure      409       {object}  ErrorResponse
+// @Failure      500       {object}  ErrorResponse
+// @Router       /auth/oidc/{provider}/link/callback [post]
+func (h *OIDCHandler) FinishLink(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req OIDCCallbackRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err = h.oidcUsecase.FinishLink(userID, c.Param("provider"), req.Code, req.State); err != nil {
+		respondOIDCError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity linked"})
+}
+
+func respondOIDCError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrUnknownProvider):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrInvalidLoginState):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrIdentityNotVerified):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrIdentityNotLinked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrIdentityInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrProviderUnavailable):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
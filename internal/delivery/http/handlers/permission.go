@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ChangeRoleRequest struct {
+	Role domain.Role `json:"role" binding:"required" example:"viewer" enums:"editor,commenter,viewer"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"user_id" binding:"required" example:"550e8400-e29b-41d4-a716-446655440000"`
+}
+
+// ListPermissions godoc
+// @Summary      List document permissions
+// @Description  Get everyone with access to a document and their role, oldest first
+// @Tags         permissions
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Document ID"
+// @Success      200  {array}   domain.DocumentPermission
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /documents/{id}/permissions [get]
+func (h *DocumentHandler) ListPermissions(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	perms, err := h.docUsecase.ListPermissions(userID, docID)
+	if err != nil {
+		respondPermissionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, perms)
+}
+
+// ChangeRole godoc
+// @Summary      Change a user's role
+// @Description  Make someone who already has access an editor, commenter or viewer (owner only). Their live sessions switch to read-only straight away when they lose edit access.
+// @Tags         permissions
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string             true  "Document ID"
+// @Param        user_id  path      string             true  "User ID"
+// @Param        request  body      ChangeRoleRequest  true  "New role"
+// @Success      200      {object}  domain.DocumentPermission
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/permissions/{user_id} [put]
+func (h *DocumentHandler) ChangeRole(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ownerID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	targetID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
+		return
+	}
+
+	var req ChangeRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	perm, err := h.docUsecase.ChangeRole(ownerID, docID, targetID, req.Role)
+	if err != nil {
+		respondPermissionError(c, err)
+		return
+	}
+
+	h.hub.ChangeRole(docID, targetID, perm.Role)
+	c.JSON(http.StatusOK, perm)
+}
+
+// RevokePermission godoc
+// @Summary      Revoke a user's access
+// @Description  Take away someone's access to a document. The owner can remove anyone else; other users can remove themselves. Their live sessions are closed straight away.
+// @Tags         permissions
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string  true  "Document ID"
+// @Param        user_id  path      string  true  "User ID"
+// @Success      200      {object}  SuccessMessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/permissions/{user_id} [delete]
+func (h *DocumentHandler) RevokePermission(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	targetID, err := uuid.Parse(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
+		return
+	}
+
+	if err := h.docUsecase.RevokePermission(userID, docID, targetID); err != nil {
+		respondPermissionError(c, err)
+		return
+	}
+
+	h.hub.RevokeAccess(docID, targetID)
+	c.JSON(http.StatusOK, gin.H{"message": "Access revoked"})
+}
+
+// TransferOwnership godoc
+// @Summary      Transfer ownership
+// @Description  Make another user the owner of a document (owner only), giving them access first if they have none. When REQUIRE_VERIFIED_EMAIL is on, that needs both users to have a verified email address, as sharing does. The previous owner stays on as an editor.
+// @Tags         permissions
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string                    true  "Document ID"
+// @Param        request  body      TransferOwnershipRequest  true  "New owner"
+// @Success      200      {object}  domain.Document
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/transfer [post]
+func (h *DocumentHandler) TransferOwnership(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ownerID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	var req TransferOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	newOwnerID, err := uuid.Parse(req.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid new owner ID"})
+		return
+	}
+
+	doc, err := h.docUsecase.TransferOwnership(ownerID, docID, newOwnerID)
+	if err != nil {
+		respondPermissionError(c, err)
+		return
+	}
+
+	if newOwnerID != ownerID {
+		h.hub.ChangeRole(docID, newOwnerID, domain.RoleOwner)
+		h.hub.ChangeRole(docID, ownerID, domain.RoleEditor)
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+func respondPermissionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrDocumentNotFound), errors.Is(err, usecase.ErrPermissionNotFound), errors.Is(err, usecase.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrPermissionDenied), errors.Is(err, usecase.ErrReadOnly), errors.Is(err, usecase.ErrEmailNotVerified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrRecipientNotVerified):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrInvalidRole), errors.Is(err, usecase.ErrOwnerAccess):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type UpdateShareLinkRequest struct {
+	Enabled   bool        `json:"enabled" example:"true"`
+	Role      domain.Role `json:"role" example:"viewer" enums:"viewer,commenter,editor"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty" example:"2030-01-01T00:00:00Z"`
+	// Omit to keep the current password, send "" to remove it
+	Password *string `json:"password,omitempty" example:"hunter2"`
+}
+
+type SharedDocumentResponse struct {
+	Document *domain.Document `json:"document"`
+	Role     domain.Role      `json:"role" example:"viewer"`
+}
+
+// GetShareLink godoc
+// @Summary      Get share link settings
+// @Description  Get a document's share link token and settings (owner only)
+// @Tags         sharing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Document ID"
+// @Success      200  {object}  domain.ShareLink
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /documents/{id}/link [get]
+func (h *DocumentHandler) GetShareLink(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	link, err := h.docUsecase.GetShareLink(userID, docID)
+	if err != nil {
+		respondShareLinkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, link)
+}
+
+// UpdateShareLink godoc
+// @Summary      Update share link settings
+// @Description  Turn link sharing on or off and set the role, expiry and optional password it comes with (owner only). Disabling the link or changing its password disconnects everyone who came in through it.
+// @Tags         sharing
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string                  true  "Document ID"
+// @Param        request  body      UpdateShareLinkRequest  true  "Share link settings"
+// @Success      200      {object}  domain.ShareLink
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/link [put]
+func (h *DocumentHandler) UpdateShareLink(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	var req UpdateShareLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	link, err := h.docUsecase.UpdateShareLink(userID, docID, usecase.ShareLinkInput{
+		Enabled:   req.Enabled,
+		Role:      req.Role,
+		ExpiresAt: req.ExpiresAt,
+		Password:  req.Password,
+	})
+	if err != nil {
+		respondShareLinkError(c, err)
+		return
+	}
+
+	// Role and expiry changes apply to live sessions on their next edit
+	if !link.Enabled || req.Password != nil {
+		h.hub.CloseLinkSessions(docID)
+	}
+	c.JSON(http.StatusOK, link)
+}
+
+// RotateShareLink godoc
+// @Summary      Rotate share link token
+// @Description  Replace a document's share link token so the old link stops working (owner only). Everyone who came in through the old link is disconnected.
+// @Tags         sharing
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      string  true  "Document ID"
+// @Success      200  {object}  domain.ShareLink
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /documents/{id}/link/rotate [post]
+func (h *DocumentHandler) RotateShareLink(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	link, err := h.docUsecase.RotateShareToken(userID, docID)
+	if err != nil {
+		respondShareLinkError(c, err)
+		return
+	}
+
+	h.hub.CloseLinkSessions(docID)
+	c.JSON(http.StatusOK, link)
+}
+
+// OpenShareLink godoc
+// @Summary      Open a shared document
+// @Description  Get the document a share link leads to, with the role it grants. Works without logging in; a logged-in user keeps their own role if it is better. Password-protected links need the X-Share-Password header.
+// @Tags         sharing
+// @Produce      json
+// @Param        token             path      string  true   "Share token"
+// @Param        X-Share-Password  header    string  false  "Share link password"
+// @Success      200  {object}  SharedDocumentResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      410  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /share/{token} [get]
+func (h *DocumentHandler) OpenShareLink(c *gin.Context) {
+	var userID *uuid.UUID
+	if userIDStr, exists := c.Get("user_id"); exists {
+		id, err := uuid.Parse(userIDStr.(string))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		userID = &id
+	}
+
+	doc, role, err := h.docUsecase.OpenShareLink(c.Param("token"), c.GetHeader("X-Share-Password"), userID)
+	if err != nil {
+		respondShareLinkError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SharedDocumentResponse{Document: doc, Role: role})
+}
+
+func respondShareLinkError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrDocumentNotFound), errors.Is(err, usecase.ErrShareLinkNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrShareLinkExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrSharePasswordRequired):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrPermissionDenied), errors.Is(err, usecase.ErrReadOnly), errors.Is(err, usecase.ErrEmailNotVerified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrInvalidRole), errors.Is(err, usecase.ErrInvalidShareLink), errors.Is(err, usecase.ErrInvalidGuestName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	ws "github.com/collab-platform/backend/internal/delivery/websocket"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type SyncHandler struct {
+	collabUsecase *usecase.CollaborationUsecase
+	hub           *ws.Hub
+}
+
+func NewSyncHandler(collabUsecase *usecase.CollaborationUsecase, hub *ws.Hub) *SyncHandler {
+	return &SyncHandler{collabUsecase: collabUsecase, hub: hub}
+}
+
+type SyncRequest struct {
+	BaseVersion *int64             `json:"base_version" binding:"required" example:"42"`
+	Operations  []domain.Operation `json:"operations"`
+}
+
+// SyncOperations godoc
+// @Summary      Sync offline edits
+// @Description  Merge a queue of operations made offline against everything committed since base_version
+// @Tags         documents
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string       true  "Document ID"
+// @Param        request  body      SyncRequest  true  "Offline operation queue"
+// @Success      200      {object}  usecase.SyncResult
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      409      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/sync [post]
+func (h *SyncHandler) SyncOperations(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	var req SyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.collabUsecase.SyncOperations(userID, docID, *req.BaseVersion, req.Operations)
+	if err != nil {
+		switch {
+		case errors.Is(err, usecase.ErrDocumentNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, usecase.ErrPermissionDenied), errors.Is(err, usecase.ErrReadOnly):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		case errors.Is(err, usecase.ErrStaleVersion), errors.Is(err, usecase.ErrStaleWrite):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, usecase.ErrInvalidOperation):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	// Live collaborators see the merged edits like any others
+	for _, op := range result.Committed {
+		h.hub.BroadcastToDocument(docID, ws.OperationMessage(op))
+	}
+
+	c.JSON(http.StatusOK, result)
+}
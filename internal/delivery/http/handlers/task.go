@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	ws "github.com/collab-platform/backend/internal/delivery/websocket"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type TaskHandler struct {
+	taskUsecase *usecase.TaskUsecase
+	hub         *ws.Hub
+}
+
+func NewTaskHandler(taskUsecase *usecase.TaskUsecase, hub *ws.Hub) *TaskHandler {
+	return &TaskHandler{taskUsecase: taskUsecase, hub: hub}
+}
+
+type CreateTaskRequest struct {
+	Title       string              `json:"title" binding:"required" example:"Write release notes"`
+	Description string              `json:"description" example:"Cover the new task board"`
+	Status      domain.TaskStatus   `json:"status" example:"todo" enums:"todo,in_progress,done"`
+	Priority    domain.TaskPriority `json:"priority" example:"medium" enums:"low,medium,high,urgent"`
+	AssigneeID  *uuid.UUID          `json:"assignee_id" example:"550e8400-e29b-41d4-a716-446655440000"`
+	DueDate     *time.Time          `json:"due_date" example:"2024-06-01T17:00:00Z"`
+}
+
+type UpdateTaskRequest struct {
+	Title       string              `json:"title" binding:"required" example:"Write release notes"`
+	Description string              `json:"description" example:"Cover the new task board"`
+	Priority    domain.TaskPriority `json:"priority" example:"high" enums:"low,medium,high,urgent"`
+	DueDate     *time.Time          `json:"due_date" example:"2024-06-01T17:00:00Z"`
+}
+
+type MoveTaskRequest struct {
+	Status   domain.TaskStatus `json:"status" binding:"required" example:"in_progress" enums:"todo,in_progress,done"`
+	Position *int              `json:"position" binding:"required" example:"0"`
+}
+
+type AssignTaskRequest struct {
+	AssigneeID *uuid.UUID `json:"assignee_id" example:"550e8400-e29b-41d4-a716-446655440000"` // null unassigns the task
+}
+
+// ListTasks godoc
+// @Summary      List a task board
+// @Description  Get the tasks of a task document, column by column in board order
+// @Tags         tasks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id          path      string  true   "Document ID"
+// @Param        status      query     string  false  "Only tasks in this column"  Enums(todo, in_progress, done)
+// @Param        assignee    query     string  false  "Only tasks assigned to this user ID, or me"
+// @Param        due_before  query     string  false  "Only tasks due before this RFC 3339 time"
+// @Success      200  {array}   domain.Task
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      403  {object}  ErrorResponse
+// @Failure      404  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /documents/{id}/tasks [get]
+func (h *TaskHandler) ListTasks(c *gin.Context) {
+	userID, docID, _, ok := taskParams(c, false)
+	if !ok {
+		return
+	}
+
+	filter, err := taskFilter(c, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tasks, err := h.taskUsecase.ListTasks(userID, docID, filter)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tasks)
+}
+
+// FindTasks godoc
+// @Summary      Find tasks across documents
+// @Description  Get the tasks in every document the user can view, soonest due first. assignee=me lists the user's own tasks.
+// @Tags         tasks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        status      query     string  false  "Only tasks in this column"  Enums(todo, in_progress, done)
+// @Param        assignee    query     string  false  "Only tasks assigned to this user ID, or me"
+// @Param        due_before  query     string  false  "Only tasks due before this RFC 3339 time"
+// @Success      200  {array}   domain.Task
+// @Failure      400  {object}  ErrorResponse
+// @Failure      401  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Router       /tasks [get]
+func (h *TaskHandler) FindTasks(c *gin.Context) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	filter, err := taskFilter(c, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tasks, err := h.taskUsecase.FindTasks(userID, filter)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tasks)
+}
+
+// CreateTask godoc
+// @Summary      Create a task
+// @Description  Add a task to the bottom of its column (todo unless given)
+// @Tags         tasks
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string             true  "Document ID"
+// @Param        request  body      CreateTaskRequest  true  "Task details"
+// @Success      201      {object}  domain.Task
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks [post]
+func (h *TaskHandler) CreateTask(c *gin.Context) {
+	userID, docID, _, ok := taskParams(c, false)
+	if !ok {
+		return
+	}
+
+	var req CreateTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.taskUsecase.CreateTask(userID, docID, usecase.TaskInput{
+		Title:       req.Title,
+		Description: req.Description,
+		Status:      req.Status,
+		Priority:    req.Priority,
+		AssigneeID:  req.AssigneeID,
+		DueDate:     req.DueDate,
+	})
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("created", task, userID))
+	c.JSON(http.StatusCreated, task)
+}
+
+// UpdateTask godoc
+// @Summary      Update a task
+// @Description  Replace a task's title, description, priority and due date
+// @Tags         tasks
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string             true  "Document ID"
+// @Param        task_id  path      string             true  "Task ID"
+// @Param        request  body      UpdateTaskRequest  true  "Task details"
+// @Success      200      {object}  domain.Task
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks/{task_id} [put]
+func (h *TaskHandler) UpdateTask(c *gin.Context) {
+	userID, docID, taskID, ok := taskParams(c, true)
+	if !ok {
+		return
+	}
+
+	var req UpdateTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.taskUsecase.UpdateTask(userID, docID, taskID, usecase.TaskInput{
+		Title:       req.Title,
+		Description: req.Description,
+		Priority:    req.Priority,
+		DueDate:     req.DueDate,
+	})
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("updated", task, userID))
+	c.JSON(http.StatusOK, task)
+}
+
+// MoveTask godoc
+// @Summary      Move a task
+// @Description  Put a task at a position (from 0) in a column; positions past the end put it last. Moving into done completes the task.
+// @Tags         tasks
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string           true  "Document ID"
+// @Param        task_id  path      string           true  "Task ID"
+// @Param        request  body      MoveTaskRequest  true  "Target column and position"
+// @Success      200      {object}  domain.Task
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks/{task_id}/move [post]
+func (h *TaskHandler) MoveTask(c *gin.Context) {
+	userID, docID, taskID, ok := taskParams(c, true)
+	if !ok {
+		return
+	}
+
+	var req MoveTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.taskUsecase.MoveTask(userID, docID, taskID, req.Status, *req.Position)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("moved", task, userID))
+	c.JSON(http.StatusOK, task)
+}
+
+// AssignTask godoc
+// @Summary      Assign a task
+// @Description  Hand a task to a user with access to the document, or unassign it with a null assignee_id
+// @Tags         tasks
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string             true  "Document ID"
+// @Param        task_id  path      string             true  "Task ID"
+// @Param        request  body      AssignTaskRequest  true  "Assignee"
+// @Success      200      {object}  domain.Task
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks/{task_id}/assign [post]
+func (h *TaskHandler) AssignTask(c *gin.Context) {
+	userID, docID, taskID, ok := taskParams(c, true)
+	if !ok {
+		return
+	}
+
+	var req AssignTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	task, err := h.taskUsecase.AssignTask(userID, docID, taskID, req.AssigneeID)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("assigned", task, userID))
+	c.JSON(http.StatusOK, task)
+}
+
+// CompleteTask godoc
+// @Summary      Complete a task
+// @Description  Move a task to the bottom of the done column
+// @Tags         tasks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string  true  "Document ID"
+// @Param        task_id  path      string  true  "Task ID"
+// @Success      200      {object}  domain.Task
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks/{task_id}/complete [post]
+func (h *TaskHandler) CompleteTask(c *gin.Context) {
+	userID, docID, taskID, ok := taskParams(c, true)
+	if !ok {
+		return
+	}
+
+	task, err := h.taskUsecase.CompleteTask(userID, docID, taskID)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("completed", task, userID))
+	c.JSON(http.StatusOK, task)
+}
+
+// DeleteTask godoc
+// @Summary      Delete a task
+// @Description  Remove a task from the board
+// @Tags         tasks
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id       path      string  true  "Document ID"
+// @Param        task_id  path      string  true  "Task ID"
+// @Success      200      {object}  SuccessMessageResponse
+// @Failure      400      {object}  ErrorResponse
+// @Failure      401      {object}  ErrorResponse
+// @Failure      403      {object}  ErrorResponse
+// @Failure      404      {object}  ErrorResponse
+// @Failure      500      {object}  ErrorResponse
+// @Router       /documents/{id}/tasks/{task_id} [delete]
+func (h *TaskHandler) DeleteTask(c *gin.Context) {
+	userID, docID, taskID, ok := taskParams(c, true)
+	if !ok {
+		return
+	}
+
+	task, err := h.taskUsecase.DeleteTask(userID, docID, taskID)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+
+	h.hub.BroadcastToDocument(docID, ws.TaskMessage("deleted", task, userID))
+	c.JSON(http.StatusOK, gin.H{"message": "Task deleted successfully"})
+}
+
+// taskParams reads the caller and the document and task in the path,
+// responding with an error if any of them is missing or malformed
+func taskParams(c *gin.Context, withTask bool) (userID, docID, taskID uuid.UUID, ok bool) {
+	userIDStr, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	userID, err := uuid.Parse(userIDStr.(string))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	docID, err = uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return
+	}
+
+	if withTask {
+		taskID, err = uuid.Parse(c.Param("task_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid task ID"})
+			return
+		}
+	}
+	return userID, docID, taskID, true
+}
+
+// taskFilter reads a task listing's query parameters
+func taskFilter(c *gin.Context, userID uuid.UUID) (domain.TaskFilter, error) {
+	filter := domain.TaskFilter{Status: domain.TaskStatus(c.Query("status"))}
+
+	switch assignee := c.Query("assignee"); assignee {
+	case "":
+	case "me":
+		filter.AssigneeID = &userID
+	default:
+		id, err := uuid.Parse(assignee)
+		if err != nil {
+			return filter, errors.New("Invalid assignee")
+		}
+		filter.AssigneeID = &id
+	}
+
+	if due := c.Query("due_before"); due != "" {
+		t, err := time.Parse(time.RFC3339, due)
+		if err != nil {
+			return filter, errors.New("Invalid due_before, expected RFC 3339")
+		}
+		filter.DueBefore = &t
+	}
+	return filter, nil
+}
+
+func respondTaskError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, usecase.ErrDocumentNotFound), errors.Is(err, usecase.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrPermissionDenied), errors.Is(err, usecase.ErrReadOnly):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, usecase.ErrInvalidTask), errors.Is(err, usecase.ErrInvalidAssignee), errors.Is(err, usecase.ErrNotTaskBoard):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -3,9 +3,11 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
-	"github.com/collab-platform/backend/internal/delivery/websocket"
+	ws "github.com/collab-platform/backend/internal/delivery/websocket"
 	"github.com/collab-platform/backend/internal/usecase"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -13,28 +15,67 @@ import (
 )
 
 type WebSocketHandler struct {
-	hub              *websocket.Hub
-	authUsecase      *usecase.AuthUsecase
-	collabUsecase    *usecase.CollaborationUsecase
-}
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // In production, check origin properly
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	hub             *ws.Hub
+	authUsecase     *usecase.AuthUsecase
+	docUsecase      *usecase.DocumentUsecase
+	collabUsecase   *usecase.CollaborationUsecase
+	presenceUsecase *usecase.PresenceUsecase
+	access          *usecase.AccessPolicy
+	messages        usecase.RateLimiter
+	messageLimit    usecase.RateLimit
+	upgrader        websocket.Upgrader
 }
 
 func NewWebSocketHandler(
-	hub *websocket.Hub,
+	hub *ws.Hub,
 	authUsecase *usecase.AuthUsecase,
+	docUsecase *usecase.DocumentUsecase,
 	collabUsecase *usecase.CollaborationUsecase,
+	presenceUsecase *usecase.PresenceUsecase,
+	access *usecase.AccessPolicy,
+	allowedOrigins []string,
+	messages usecase.RateLimiter,
+	messageLimit usecase.RateLimit,
 ) *WebSocketHandler {
 	return &WebSocketHandler{
-		hub:           hub,
-		authUsecase:   authUsecase,
-		collabUsecase: collabUsecase,
+		hub:             hub,
+		authUsecase:     authUsecase,
+		docUsecase:      docUsecase,
+		collabUsecase:   collabUsecase,
+		presenceUsecase: presenceUsecase,
+		access:          access,
+		messages:        messages,
+		messageLimit:    messageLimit,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:     checkOrigin(allowedOrigins),
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+	}
+}
+
+// checkOrigin accepts browser requests from the server's own origin and from
+// allowed origins, "*" allowing any. Requests without an Origin header come
+// from non-browser clients and are accepted too.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, u.Scheme+"://"+u.Host) {
+				return true
+			}
+		}
+		return false
 	}
 }
 
@@ -51,55 +92,123 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 		}
 	}
 
-	if token == "" {
+	// Guests can come in through a share link without logging in
+	shareToken := c.Query("share_token")
+	if token == "" && shareToken == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token required"})
 		return
 	}
 
-	// Validate token
-	claims, err := h.authUsecase.ValidateToken(token)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
-	}
+	var userID *uuid.UUID
+	if token != "" {
+		// Validate token
+		claims, err := h.authUsecase.ValidateToken(token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
 
-	userID, err := uuid.Parse(claims.UserID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-		return
+		id, err := uuid.Parse(claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		userID = &id
 	}
 
-	docIDStr := c.Query("document_id")
-	if docIDStr == "" {
+	var docID uuid.UUID
+	if docIDStr := c.Query("document_id"); docIDStr != "" {
+		id, err := uuid.Parse(docIDStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+			return
+		}
+		docID = id
+	} else if shareToken == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "document_id required"})
 		return
 	}
 
-	docID, err := uuid.Parse(docIDStr)
+	// A reconnecting client names the last version it saw so it can be
+	// replayed what it missed
+	var sinceVersion *int64
+	if since := c.Query("since_version"); since != "" {
+		v, err := strconv.ParseInt(since, 10, 64)
+		if err != nil || v < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid since_version"})
+			return
+		}
+		sinceVersion = &v
+	}
+
+	// The share link names the document; a document_id given alongside it
+	// must agree
+	var link *usecase.LinkSession
+	if shareToken != "" {
+		var err error
+		link, err = h.docUsecase.JoinShareLink(shareToken, c.Query("share_password"), userID, c.Query("name"))
+		if err != nil {
+			respondShareLinkError(c, err)
+			return
+		}
+		if docID != uuid.Nil && docID != link.DocumentID {
+			link.Leave()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "document_id does not match the share link"})
+			return
+		}
+		userID = &link.UserID
+		docID = link.DocumentID
+	}
+
+	// Only people who can see the document get to listen in
+	_, role, err := h.access.Authorize(*userID, docID, usecase.ActionView)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		if link != nil {
+			link.Leave()
+		}
+		respondDocumentError(c, err)
 		return
 	}
 
 	// Upgrade connection
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
+		if link != nil {
+			link.Leave()
+		}
 		return
 	}
 
-	client := &websocket.Client{
-		Hub:        h.hub,
-		Conn:       conn,
-		Send:       make(chan []byte, 256),
-		UserID:     userID,
-		DocumentID: docID,
+	client := &ws.Client{
+		Hub:          h.hub,
+		Conn:         conn,
+		Send:         make(chan []byte, 256),
+		UserID:       *userID,
+		DocumentID:   docID,
+		Collab:       h.collabUsecase,
+		Link:         link,
+		SessionID:    uuid.New(),
+		Presence:     h.presenceUsecase,
+		Messages:     h.messages,
+		MessageLimit: h.messageLimit,
 	}
+	client.SetRole(role)
 
-	client.Hub.register <- client
+	if sinceVersion != nil {
+		if err := client.Resume(*sinceVersion); err != nil {
+			log.Printf("WebSocket resume failed for user %s on document %s: %v", *userID, docID, err)
+			if link != nil {
+				link.Leave()
+			}
+			return
+		}
+	} else {
+		client.Hub.Register(client)
+	}
+	client.JoinPresence()
 
 	// Start goroutines
 	go client.WritePump()
 	go client.ReadPump()
 }
-
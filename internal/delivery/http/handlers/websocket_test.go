@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin header", nil, "", true},
+		{"same host", nil, "https://collab.example.com", true},
+		{"same host in another case", nil, "https://Collab.Example.com", true},
+		{"other host", nil, "https://evil.example.com", false},
+		{"same host on another port", nil, "https://collab.example.com:8443", false},
+		{"allowed origin", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"allowed origin in another case", []string{"https://APP.example.com"}, "https://app.example.com", true},
+		{"allowed host with another scheme", []string{"https://app.example.com"}, "http://app.example.com", false},
+		{"allowed host with another port", []string{"https://app.example.com"}, "https://app.example.com:8443", false},
+		{"not in the list", []string{"https://app.example.com"}, "https://evil.example.com", false},
+		{"wildcard", []string{"*"}, "https://evil.example.com", true},
+		{"unparseable origin", []string{"https://app.example.com"}, "://app.example.com", false},
+		{"null origin", nil, "null", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://collab.example.com/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := checkOrigin(tt.allowed)(r); got != tt.want {
+				t.Errorf("checkOrigin(%v) for %q = %v, want %v", tt.allowed, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -34,7 +34,38 @@ func AuthMiddleware(authUsecase *usecase.AuthUsecase) gin.HandlerFunc {
 
 		c.Set("user_id", claims.UserID)
 		c.Set("email", claims.Email)
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
 
+// OptionalAuthMiddleware identifies the user like AuthMiddleware when a
+// bearer token is sent and lets anonymous requests through
+func OptionalAuthMiddleware(authUsecase *usecase.AuthUsecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		AuthMiddleware(authUsecase)(c)
+	}
+}
+
+// MFASetupMiddleware accepts an access token like AuthMiddleware, or the MFA
+// token of a login that cannot finish until two-factor authentication is set
+// up. The latter is available to handlers as "mfa_setup".
+func MFASetupMiddleware(authUsecase *usecase.AuthUsecase) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok {
+			if claims, err := authUsecase.ValidateMFASetupToken(token); err == nil {
+				c.Set("user_id", claims.UserID)
+				c.Set("email", claims.Email)
+				c.Set("mfa_setup", claims)
+				c.Next()
+				return
+			}
+		}
+		AuthMiddleware(authUsecase)(c)
+	}
+}
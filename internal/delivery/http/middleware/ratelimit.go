@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit limits the requests of the routes it guards to limit, counting
+// them under name. Authenticated requests are counted per user and others
+// per client IP, so put it after the auth middleware to limit by user.
+//
+// Responses carry the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset
+// and RateLimit-Policy headers, and rejected ones Retry-After. If the
+// limiter fails, requests are let through.
+func RateLimit(limiter usecase.RateLimiter, name string, limit usecase.RateLimit) gin.HandlerFunc {
+	policy := fmt.Sprintf("%d;w=%d", limit.Limit, seconds(limit.Window))
+	return func(c *gin.Context) {
+		key := name + ":ip:" + c.ClientIP()
+		if userID, exists := c.Get("user_id"); exists {
+			key = name + ":user:" + userID.(string)
+		}
+
+		result, err := limiter.Allow(key, limit)
+		if err != nil {
+			log.Printf("Rate limiter failed for %s: %v", key, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", strconv.FormatInt(seconds(result.Reset), 10))
+		c.Header("RateLimit-Policy", policy)
+		if !result.Allowed {
+			RespondTooManyRequests(c, result.RetryAfter, "Too many requests")
+			return
+		}
+		c.Next()
+	}
+}
+
+// RespondTooManyRequests rejects a request with 429 and a Retry-After header
+func RespondTooManyRequests(c *gin.Context, retryAfter time.Duration, message string) {
+	c.Header("Retry-After", strconv.FormatInt(seconds(retryAfter), 10))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": message})
+}
+
+// seconds rounds d up to whole seconds, as the headers expect
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/infrastructure/ratelimit"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/gin-gonic/gin"
+)
+
+// clock is a time that only moves when told to
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestRateLimitHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	clk := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	limiter := ratelimit.NewMemoryLimiterWithClock(clk.Now)
+
+	router := gin.New()
+	router.GET("/", RateLimit(limiter, "test", usecase.RateLimit{Limit: 3, Window: 30 * time.Second}), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	request := func(ip string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		router.ServeHTTP(w, req)
+		return w
+	}
+	check := func(t *testing.T, w *httptest.ResponseRecorder, status int, headers map[string]string) {
+		t.Helper()
+		if w.Code != status {
+			t.Errorf("status = %d, want %d", w.Code, status)
+		}
+		for name, want := range headers {
+			if got := w.Header().Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	}
+
+	// 3 per 30s is one every 10s
+	for i, remaining := range []string{"2", "1", "0"} {
+		check(t, request("10.0.0.1"), http.StatusNoContent, map[string]string{
+			"RateLimit-Limit":     "3",
+			"RateLimit-Remaining": remaining,
+			"RateLimit-Reset":     []string{"10", "20", "30"}[i],
+			"RateLimit-Policy":    "3;w=30",
+			"Retry-After":         "",
+		})
+	}
+
+	clk.Advance(2500 * time.Millisecond)
+	check(t, request("10.0.0.1"), http.StatusTooManyRequests, map[string]string{
+		"RateLimit-Limit":     "3",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "28", // 27.5s, rounded up
+		"RateLimit-Policy":    "3;w=30",
+		"Retry-After":         "8", // 7.5s, rounded up
+	})
+	check(t, request("10.0.0.2"), http.StatusNoContent, map[string]string{"RateLimit-Remaining": "2"})
+
+	clk.Advance(7500 * time.Millisecond)
+	check(t, request("10.0.0.1"), http.StatusNoContent, map[string]string{
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "30",
+	})
+}
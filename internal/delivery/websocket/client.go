@@ -2,10 +2,13 @@ package websocket
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -23,24 +26,90 @@ type Client struct {
 	Send       chan []byte
 	UserID     uuid.UUID
 	DocumentID uuid.UUID
+	Collab     *usecase.CollaborationUsecase
+	// Set when the connection came in through the document's share link
+	Link *usecase.LinkSession
+
+	// Identifies this connection's presence; a user can have several
+	SessionID uuid.UUID
+	Presence  *usecase.PresenceUsecase
+	// Limits how fast the connection may send messages, keyed by SessionID;
+	// nil for no limit
+	Messages     usecase.RateLimiter
+	MessageLimit usecase.RateLimit
+	// What this connection currently shares, nil until JoinPresence succeeds.
+	// Only touched before the pumps start and from ReadPump.
+	presence *domain.Presence
+
+	// Guards the catch-up state below, which the hub consults on delivery
+	mu sync.Mutex
+	// Set while the client is being replayed what it missed; live messages
+	// are held back until the replay has been written
+	resuming bool
+	held     []heldMessage
+	// Operations up to this version were already sent by the catch-up
+	syncedVersion int64
+	// Set once the hub has closed Send to end the connection; closeFrame is
+	// what WritePump sends before hanging up
+	closed     bool
+	closeFrame []byte
+	// The user's role, set on connecting and kept up to date by the hub
+	role domain.Role
+}
+
+type heldMessage struct {
+	version int64
+	data    []byte
 }
 
 type ClientMessage struct {
-	Type      string          `json:"type"`
-	Operation domain.Operation `json:"operation"`
-	DocumentID string         `json:"document_id"`
+	Type       string           `json:"type"`
+	Operation  domain.Operation `json:"operation"`
+	DocumentID string           `json:"document_id"`
+
+	// "sync" frames upload an offline queue made on top of BaseVersion
+	BaseVersion *int64             `json:"base_version,omitempty"`
+	Operations  []domain.Operation `json:"operations,omitempty"`
+
+	// "presence" frames update this connection's cursor, selection and state
+	Presence *domain.Presence `json:"presence,omitempty"`
+
+	// "undo" and "redo" frames may name an ID for the ack, which also
+	// makes resending them safe
+	RequestID uuid.UUID `json:"request_id,omitempty"`
+}
+
+// ServerMessage is a reply sent only to the originating client
+type ServerMessage struct {
+	Type        string              `json:"type"` // "ack", "error", "snapshot", "synced", "sync_result" or "presence_list"
+	OperationID uuid.UUID           `json:"operation_id,omitempty"`
+	Operations  []domain.Operation  `json:"operations,omitempty"` // What the operation committed as, after transformation
+	Version     int64               `json:"version,omitempty"`
+	Snapshot    *domain.Document    `json:"snapshot,omitempty"`
+	Sync        *usecase.SyncResult `json:"sync,omitempty"`
+	Presences   []*domain.Presence  `json:"presences,omitempty"`
+	Code        string              `json:"code,omitempty"`
+	Error       string              `json:"error,omitempty"`
 }
 
 func (c *Client) ReadPump() {
 	defer func() {
+		c.leavePresence()
 		c.Hub.unregister <- c
 		c.Conn.Close()
+		if c.Link != nil {
+			if err := c.Link.Leave(); err != nil {
+				log.Printf("Error ending link session for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+			}
+		}
 	}()
 
 	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.refreshPresence()
+		c.refreshLink()
 		return nil
 	})
 
@@ -59,28 +128,416 @@ func (c *Client) ReadPump() {
 			continue
 		}
 
+		id := clientMsg.Operation.ID
+		if clientMsg.RequestID != uuid.Nil {
+			id = clientMsg.RequestID
+		}
+		if !c.allowMessage() {
+			c.sendError(id, "rate_limited", "too many messages; slow down and resend")
+			continue
+		}
+		if !c.Hub.admit(c, clientMsg.Type) {
+			c.sendError(id, "read_only", usecase.ErrReadOnly.Error())
+			continue
+		}
+
+		switch clientMsg.Type {
+		case "operation", "":
+			c.handleOperation(clientMsg)
+		case "sync":
+			c.handleSync(clientMsg)
+		case "presence":
+			c.handlePresence(clientMsg)
+		case "undo", "redo":
+			c.handleRevert(clientMsg)
+		default:
+			c.sendError(uuid.Nil, "unknown_type", "unknown message type: "+clientMsg.Type)
+		}
+	}
+}
+
+// handleOperation commits an inbound operation through the collaboration
+// usecase and only broadcasts it once the server has accepted and versioned it
+func (c *Client) handleOperation(clientMsg ClientMessage) {
+	op := clientMsg.Operation
+
+	if clientMsg.DocumentID != "" {
 		docID, err := uuid.Parse(clientMsg.DocumentID)
+		if err != nil || docID != c.DocumentID {
+			c.sendError(op.ID, "invalid_document", "operation does not belong to this document")
+			return
+		}
+	}
+
+	// Set timestamps and IDs; a client-chosen ID is kept so the ack can be correlated
+	if op.ID == uuid.Nil {
+		op.ID = uuid.New()
+	}
+	op.DocumentID = c.DocumentID
+	op.UserID = c.UserID
+	op.CreatedAt = time.Now()
+
+	doc, committed, err := c.Collab.ApplyOperation(c.UserID, c.DocumentID, op)
+	var dup *usecase.DuplicateOperationError
+	if errors.As(err, &dup) {
+		// Already committed and broadcast; only the ack went missing
+		c.send(ServerMessage{Type: "ack", OperationID: op.ID, Operations: dup.Operations, Version: dup.Version()})
+		return
+	}
+	if err != nil {
+		code, message := operationErrorCode(err)
+		if code == "internal_error" {
+			log.Printf("Error applying operation for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+		}
+		c.sendError(op.ID, code, message)
+		return
+	}
+
+	c.send(ServerMessage{Type: "ack", OperationID: op.ID, Operations: committed, Version: doc.Version})
+
+	c.broadcastOperations(committed)
+}
+
+// handleSync merges an offline queue and broadcasts whatever it committed
+func (c *Client) handleSync(clientMsg ClientMessage) {
+	if clientMsg.BaseVersion == nil {
+		c.sendError(uuid.Nil, "invalid_operation", "sync requires base_version")
+		return
+	}
+
+	result, err := c.Collab.SyncOperations(c.UserID, c.DocumentID, *clientMsg.BaseVersion, clientMsg.Operations)
+	if err != nil {
+		code, message := operationErrorCode(err)
+		if code == "internal_error" {
+			log.Printf("Error syncing operations for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+		}
+		c.sendError(uuid.Nil, code, message)
+		return
+	}
+
+	c.send(ServerMessage{Type: "sync_result", Version: result.Version, Sync: result})
+
+	c.broadcastOperations(result.Committed)
+}
+
+// handleRevert undoes or redoes the user's own most recent change
+func (c *Client) handleRevert(clientMsg ClientMessage) {
+	revert := c.Collab.Undo
+	if clientMsg.Type == "redo" {
+		revert = c.Collab.Redo
+	}
+
+	requestID := clientMsg.RequestID
+	if requestID == uuid.Nil {
+		requestID = uuid.New()
+	}
+
+	doc, committed, err := revert(c.UserID, c.DocumentID, requestID)
+	var dup *usecase.DuplicateOperationError
+	if errors.As(err, &dup) {
+		c.send(ServerMessage{Type: "ack", OperationID: requestID, Operations: dup.Operations, Version: dup.Version()})
+		return
+	}
+	if err != nil {
+		code, message := operationErrorCode(err)
+		if code == "internal_error" {
+			log.Printf("Error reverting for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+		}
+		c.sendError(requestID, code, message)
+		return
+	}
+
+	c.send(ServerMessage{Type: "ack", OperationID: requestID, Operations: committed, Version: doc.Version})
+
+	c.broadcastOperations(committed)
+}
+
+// broadcastOperations passes operations the client committed on to every
+// other connection to the document, including the user's own other tabs
+func (c *Client) broadcastOperations(ops []domain.Operation) {
+	for _, op := range ops {
+		msg := OperationMessage(op)
+		msg.SessionID = c.SessionID
+		c.Hub.BroadcastToDocument(c.DocumentID, msg)
+	}
+}
+
+// JoinPresence announces the client to everyone else in the document and
+// sends it who is already there. Call it once the client is registered and
+// before the read pump starts.
+func (c *Client) JoinPresence() {
+	if c.Presence == nil {
+		return
+	}
+
+	presence, err := c.Presence.Join(c.UserID, c.DocumentID, c.SessionID)
+	if err != nil {
+		log.Printf("Presence unavailable for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+		return
+	}
+	c.presence = presence
+
+	present, err := c.Presence.List(c.UserID, c.DocumentID)
+	if err != nil {
+		log.Printf("Error listing presence for document %s: %v", c.DocumentID, err)
+	} else {
+		c.send(ServerMessage{Type: "presence_list", Version: presence.Version, Presences: present})
+	}
+
+	c.Hub.BroadcastToDocument(c.DocumentID, PresenceMessage("join", presence))
+}
+
+// handlePresence stores a cursor, selection or state change and passes it on
+func (c *Client) handlePresence(clientMsg ClientMessage) {
+	if c.presence == nil {
+		c.sendError(uuid.Nil, "presence_unavailable", "presence is not available for this connection")
+		return
+	}
+	if clientMsg.Presence == nil {
+		c.sendError(uuid.Nil, "invalid_operation", "presence frame requires presence")
+		return
+	}
+
+	presence, err := c.Presence.Update(c.presence, *clientMsg.Presence)
+	if err != nil {
+		code, message := operationErrorCode(err)
+		if code == "internal_error" {
+			log.Printf("Error updating presence for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+			message = "failed to update presence"
+		}
+		c.sendError(uuid.Nil, code, message)
+		return
+	}
+	c.presence = presence
+
+	c.Hub.BroadcastToDocument(c.DocumentID, PresenceMessage("update", presence))
+}
+
+// refreshPresence keeps the client's presence record from expiring
+func (c *Client) refreshPresence() {
+	if c.presence == nil {
+		return
+	}
+	presence, err := c.Presence.Refresh(c.presence)
+	if err != nil {
+		log.Printf("Error refreshing presence for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+		return
+	}
+	c.presence = presence
+}
+
+// refreshLink keeps the session the client came in through its share link
+// from expiring
+func (c *Client) refreshLink() {
+	if c.Link == nil {
+		return
+	}
+	if err := c.Link.Refresh(); err != nil {
+		log.Printf("Error refreshing link session for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+	}
+}
+
+func (c *Client) leavePresence() {
+	if c.presence == nil {
+		return
+	}
+	if err := c.Presence.Leave(c.presence); err != nil {
+		log.Printf("Error removing presence for user %s on document %s: %v", c.UserID, c.DocumentID, err)
+	}
+	c.Hub.BroadcastToDocument(c.DocumentID, PresenceMessage("leave", c.presence))
+	c.presence = nil
+}
+
+// allowMessage spends one message from the connection's allowance
+func (c *Client) allowMessage() bool {
+	if c.Messages == nil {
+		return true
+	}
+	result, err := c.Messages.Allow(c.SessionID.String(), c.MessageLimit)
+	if err != nil {
+		log.Printf("Message rate limiter failed for user %s: %v", c.UserID, err)
+		return true
+	}
+	return result.Allowed
+}
+
+func (c *Client) sendError(opID uuid.UUID, code, message string) {
+	c.send(ServerMessage{Type: "error", OperationID: opID, Code: code, Error: message})
+}
+
+func (c *Client) send(msg ServerMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling server message: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.Send <- data:
+	default:
+		log.Printf("Dropping reply for user %s: send buffer full", c.UserID)
+	}
+}
+
+func isEdit(msgType string) bool {
+	switch msgType {
+	case "operation", "", "sync", "undo", "redo":
+		return true
+	}
+	return false
+}
+
+// SetRole records the user's role on the document. It is set when the
+// connection is authorized and the hub updates it when the role changes.
+func (c *Client) SetRole(role domain.Role) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+// Role is the user's role on the document as far as this connection knows
+func (c *Client) Role() domain.Role {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+// shutdown closes Send so WritePump ends the connection with frame. The hub
+// calls it after dropping the client from its document.
+func (c *Client) shutdown(frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.closeFrame = frame
+	c.held = nil
+	close(c.Send)
+}
+
+// Resume registers the client and brings it up to date from version since
+// before it starts receiving live broadcasts. It must be called before the
+// read and write pumps start, as it writes the catch-up to the connection
+// itself. On failure the client is unregistered and its connection closed.
+func (c *Client) Resume(since int64) error {
+	c.mu.Lock()
+	c.resuming = true
+	c.mu.Unlock()
+
+	// Register first so nothing committed during the catch-up is missed
+	c.Hub.Register(c)
+
+	catchUp, err := c.Collab.CatchUp(c.UserID, c.DocumentID, since)
+	if err != nil {
+		code, message := operationErrorCode(err)
+		c.write(ServerMessage{Type: "error", Code: code, Error: message})
+		c.Hub.unregister <- c
+		c.Conn.Close()
+		return err
+	}
+
+	if catchUp.Snapshot != nil {
+		err = c.write(ServerMessage{Type: "snapshot", Version: catchUp.Version, Snapshot: catchUp.Snapshot})
+	}
+	for _, op := range catchUp.Operations {
 		if err != nil {
-			log.Printf("Invalid document ID: %v", err)
-			continue
+			break
 		}
+		msg := OperationMessage(op)
+		msg.Timestamp = op.CreatedAt
+		err = c.write(msg)
+	}
+	if err == nil {
+		err = c.write(ServerMessage{Type: "synced", Version: catchUp.Version})
+	}
+	if err != nil {
+		c.Hub.unregister <- c
+		c.Conn.Close()
+		return err
+	}
+
+	c.finishResume(catchUp.Version)
+	return nil
+}
+
+// write sends a message straight to the connection; only safe before WritePump runs
+func (c *Client) write(msg interface{}) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.Conn.WriteJSON(msg)
+}
 
-		// Set timestamps and IDs
-		clientMsg.Operation.ID = uuid.New()
-		clientMsg.Operation.DocumentID = docID
-		clientMsg.Operation.UserID = c.UserID
-		clientMsg.Operation.Timestamp = time.Now().UnixNano()
-		clientMsg.Operation.CreatedAt = time.Now()
+// accept is called by the hub for every message addressed to the client.
+// It drops operations the catch-up already covered and holds the rest back
+// while a catch-up is in progress, returning false if the hub should deliver
+// the message itself. version is 0 for messages that are not operations.
+func (c *Client) accept(version int64, data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version > 0 && version <= c.syncedVersion {
+		return true
+	}
+	if c.resuming {
+		c.held = append(c.held, heldMessage{version: version, data: data})
+		return true
+	}
+	return false
+}
 
-		// Broadcast operation
-		broadcastMsg := &BroadcastMessage{
-			DocumentID: docID,
-			Operation:  clientMsg.Operation,
-			UserID:     c.UserID,
-			Timestamp:  time.Now(),
+// finishResume releases the messages held back during a catch-up that ended at version
+func (c *Client) finishResume(version int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.syncedVersion = version
+	c.resuming = false
+	if c.closed {
+		return
+	}
+	for _, m := range c.held {
+		if m.version > 0 && m.version <= version {
+			continue
+		}
+		select {
+		case c.Send <- m.data:
+		default:
+			log.Printf("Dropping slow client: User %s for Document %s", c.UserID, c.DocumentID)
+			c.Conn.Close()
+			c.held = nil
+			return
 		}
+	}
+	c.held = nil
+}
 
-		c.Hub.BroadcastToDocument(docID, broadcastMsg)
+func operationErrorCode(err error) (string, string) {
+	var posErr *usecase.PositionError
+	switch {
+	case errors.As(err, &posErr):
+		return "invalid_position", err.Error()
+	case errors.Is(err, usecase.ErrPermissionDenied):
+		return "permission_denied", err.Error()
+	case errors.Is(err, usecase.ErrReadOnly):
+		return "read_only", err.Error()
+	case errors.Is(err, usecase.ErrInvalidOperation):
+		return "invalid_operation", err.Error()
+	case errors.Is(err, usecase.ErrStaleVersion):
+		return "stale_version", err.Error()
+	case errors.Is(err, usecase.ErrConflict), errors.Is(err, usecase.ErrStaleWrite):
+		return "conflict", err.Error()
+	case errors.Is(err, usecase.ErrDocumentNotFound):
+		return "document_not_found", err.Error()
+	case errors.Is(err, usecase.ErrNothingToUndo):
+		return "nothing_to_undo", err.Error()
+	case errors.Is(err, usecase.ErrNothingToRedo):
+		return "nothing_to_redo", err.Error()
+	default:
+		return "internal_error", "failed to apply operation"
 	}
 }
 
@@ -96,7 +553,13 @@ func (c *Client) WritePump() {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.mu.Lock()
+				frame := c.closeFrame
+				c.mu.Unlock()
+				if frame == nil {
+					frame = []byte{}
+				}
+				c.Conn.WriteMessage(websocket.CloseMessage, frame)
 				return
 			}
 
@@ -125,4 +588,3 @@ func (c *Client) WritePump() {
 		}
 	}
 }
-
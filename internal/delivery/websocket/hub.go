@@ -9,6 +9,7 @@ import (
 	"github.com/collab-platform/backend/internal/domain"
 	"github.com/collab-platform/backend/internal/infrastructure/redis"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 type Hub struct {
@@ -24,6 +25,12 @@ type Hub struct {
 	// Unregister requests from clients
 	unregister chan *Client
 
+	// Messages published by other nodes
+	remote chan *BroadcastMessage
+
+	// Identifies this node so it can ignore its own Redis echoes
+	nodeID string
+
 	// Redis client for distributed pub/sub
 	redisClient *redis.RedisClient
 
@@ -31,11 +38,165 @@ type Hub struct {
 	mu sync.RWMutex
 }
 
+// Close codes the server ends document connections with
+const (
+	// CloseDocumentDeleted: the document was moved to the trash
+	CloseDocumentDeleted = 4410
+	// CloseAccessRevoked: the user no longer has access to the document
+	CloseAccessRevoked = 4403
+)
+
 type BroadcastMessage struct {
-	DocumentID uuid.UUID      `json:"document_id"`
-	Operation  domain.Operation `json:"operation"`
-	UserID     uuid.UUID      `json:"user_id"`
-	Timestamp  time.Time      `json:"timestamp"`
+	Type       string            `json:"type"`            // "operation", "presence", "task", "reset", "close" or "permission"
+	Event      string            `json:"event,omitempty"` // presence: "join", "update" or "leave"; task: what happened to it; close: why; permission: "changed", "revoked" or "link_revoked"
+	DocumentID uuid.UUID         `json:"document_id"`
+	Operation  *domain.Operation `json:"operation,omitempty"`
+	Presence   *domain.Presence  `json:"presence,omitempty"`
+	Task       *domain.Task      `json:"task,omitempty"`
+	Document   *domain.Document  `json:"document,omitempty"` // reset: the document as it was replaced
+	Role       domain.Role       `json:"role,omitempty"`     // permission: UserID's new role
+	UserID     uuid.UUID         `json:"user_id"`
+	Timestamp  time.Time         `json:"timestamp"`
+
+	// Connection the message came from, which already has it; unset for
+	// changes made over REST. Only meaningful on the node that sent it.
+	SessionID uuid.UUID `json:"-"`
+}
+
+// OperationMessage wraps a committed operation for broadcasting
+func OperationMessage(op domain.Operation) *BroadcastMessage {
+	return &BroadcastMessage{
+		Type:       "operation",
+		DocumentID: op.DocumentID,
+		Operation:  &op,
+		UserID:     op.UserID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// PresenceMessage wraps a presence change for broadcasting
+func PresenceMessage(event string, presence *domain.Presence) *BroadcastMessage {
+	return &BroadcastMessage{
+		Type:       "presence",
+		Event:      event,
+		DocumentID: presence.DocumentID,
+		Presence:   presence,
+		UserID:     presence.UserID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// TaskMessage wraps a change userID made to a task for broadcasting. event is
+// "created", "updated", "moved", "assigned", "completed" or "deleted".
+func TaskMessage(event string, task *domain.Task, userID uuid.UUID) *BroadcastMessage {
+	return &BroadcastMessage{
+		Type:       "task",
+		Event:      event,
+		DocumentID: task.DocumentID,
+		Task:       task,
+		UserID:     userID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// ResetDocument tells everyone connected to a document, on every node, that
+// userID replaced it over REST. Operations and element IDs from before doc's
+// version no longer apply, so clients start over from doc.
+func (h *Hub) ResetDocument(doc *domain.Document, userID uuid.UUID) {
+	h.broadcast <- &BroadcastMessage{
+		Type:       "reset",
+		DocumentID: doc.ID,
+		Document:   doc,
+		UserID:     userID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// CloseDocument disconnects everyone connected to a document, on every node.
+// The connections are closed with CloseDocumentDeleted and reason.
+func (h *Hub) CloseDocument(docID uuid.UUID, reason string) {
+	h.broadcast <- &BroadcastMessage{
+		Type:       "close",
+		Event:      reason,
+		DocumentID: docID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// ChangeRole tells a user's connections to a document, on every node, that
+// their role is now role. Connections that can no longer edit reject edits
+// from then on.
+func (h *Hub) ChangeRole(docID, userID uuid.UUID, role domain.Role) {
+	h.broadcast <- &BroadcastMessage{
+		Type:       "permission",
+		Event:      "changed",
+		DocumentID: docID,
+		UserID:     userID,
+		Role:       role,
+		Timestamp:  time.Now(),
+	}
+}
+
+// RevokeAccess disconnects a user from a document on every node, closing
+// their connections with CloseAccessRevoked
+func (h *Hub) RevokeAccess(docID, userID uuid.UUID) {
+	h.broadcast <- &BroadcastMessage{
+		Type:       "permission",
+		Event:      "revoked",
+		DocumentID: docID,
+		UserID:     userID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// CloseLinkSessions disconnects everyone who came into a document through its
+// share link, on every node, closing their connections with
+// CloseAccessRevoked. Logged-in users can reconnect with their own access.
+func (h *Hub) CloseLinkSessions(docID uuid.UUID) {
+	h.broadcast <- &BroadcastMessage{
+		Type:       "permission",
+		Event:      "link_revoked",
+		DocumentID: docID,
+		Timestamp:  time.Now(),
+	}
+}
+
+// version is the document version an operation or reset message brings
+// clients to, or 0 for messages that do not change the document
+func (m *BroadcastMessage) version() int64 {
+	switch {
+	case m.Operation != nil:
+		return m.Operation.Version
+	case m.Document != nil:
+		return m.Document.Version
+	}
+	return 0
+}
+
+// sentBy reports whether client is the connection the message came from.
+// A user's other tabs and devices still get it, and changes made over REST
+// come from no connection, so everyone does.
+func (m *BroadcastMessage) sentBy(client *Client) bool {
+	if m.Presence != nil {
+		return client.SessionID == m.Presence.SessionID
+	}
+	return m.SessionID != uuid.Nil && client.SessionID == m.SessionID
+}
+
+func (m *BroadcastMessage) toDomain(nodeID string) domain.BroadcastMessage {
+	return domain.BroadcastMessage{
+		Type:       m.Type,
+		Event:      m.Event,
+		DocumentID: m.DocumentID,
+		Operation:  m.Operation,
+		Presence:   m.Presence,
+		Task:       m.Task,
+		Document:   m.Document,
+		Role:       m.Role,
+		UserID:     m.UserID,
+		Timestamp:  m.Timestamp,
+		NodeID:     nodeID,
+	}
 }
 
 func NewHub(redisClient *redis.RedisClient) *Hub {
@@ -44,12 +205,25 @@ func NewHub(redisClient *redis.RedisClient) *Hub {
 		broadcast:   make(chan *BroadcastMessage, 256),
 		register:    make(chan *Client),
 		unregister:  make(chan *Client),
+		remote:      make(chan *BroadcastMessage, 256),
+		nodeID:      uuid.New().String(),
 		redisClient: redisClient,
 	}
 	return hub
 }
 
+// NodeID returns the identifier this hub stamps on published messages
+func (h *Hub) NodeID() string {
+	return h.nodeID
+}
+
 func (h *Hub) Run() {
+	if h.redisClient != nil {
+		if err := h.redisClient.SubscribeToDocuments(h.receiveRemote); err != nil {
+			log.Printf("Cross-node broadcasting disabled: %v", err)
+		}
+	}
+
 	for {
 		select {
 		case client := <-h.register:
@@ -67,7 +241,7 @@ func (h *Hub) Run() {
 			if clients, ok := h.documents[client.DocumentID]; ok {
 				if _, ok := clients[client]; ok {
 					delete(clients, client)
-					close(client.send)
+					close(client.Send)
 					if len(clients) == 0 {
 						delete(h.documents, client.DocumentID)
 					}
@@ -80,15 +254,17 @@ func (h *Hub) Run() {
 		case message := <-h.broadcast:
 			// Publish to Redis for distributed broadcasting
 			if h.redisClient != nil {
-				if err := h.redisClient.PublishOperation(message.DocumentID.String(), *message); err != nil {
+				if err := h.redisClient.PublishOperation(message.DocumentID.String(), message.toDomain(h.nodeID)); err != nil {
 					log.Printf("Error publishing to Redis: %v", err)
 				}
 			}
 
+			if h.control(message) {
+				continue
+			}
+
 			// Broadcast to local clients
-			h.mu.RLock()
-			clients := h.documents[message.DocumentID]
-			h.mu.RUnlock()
+			clients := h.GetDocumentClients(message.DocumentID)
 
 			data, err := json.Marshal(message)
 			if err != nil {
@@ -96,23 +272,49 @@ func (h *Hub) Run() {
 				continue
 			}
 
-			for client := range clients {
+			for _, client := range clients {
 				// Don't send message back to sender
-				if client.UserID != message.UserID {
-					select {
-					case client.send <- data:
-					default:
-						close(client.send)
-						h.mu.Lock()
-						delete(clients, client)
-						h.mu.Unlock()
-					}
+				if !message.sentBy(client) {
+					h.deliver(client, message.version(), data)
 				}
 			}
+
+		case message := <-h.remote:
+			h.HandleRedisMessage(message.DocumentID, message)
 		}
 	}
 }
 
+// receiveRemote queues a message from Redis for delivery on the hub goroutine,
+// dropping the ones this node published itself
+func (h *Hub) receiveRemote(message domain.BroadcastMessage) {
+	if message.NodeID == h.nodeID {
+		return
+	}
+
+	msgType := message.Type
+	if msgType == "" {
+		msgType = "operation"
+	}
+	h.remote <- &BroadcastMessage{
+		Type:       msgType,
+		Event:      message.Event,
+		DocumentID: message.DocumentID,
+		Operation:  message.Operation,
+		Presence:   message.Presence,
+		Task:       message.Task,
+		Document:   message.Document,
+		Role:       message.Role,
+		UserID:     message.UserID,
+		Timestamp:  message.Timestamp,
+	}
+}
+
+// Register adds a client to its document's set of listeners
+func (h *Hub) Register(client *Client) {
+	h.register <- client
+}
+
 func (h *Hub) BroadcastToDocument(docID uuid.UUID, message *BroadcastMessage) {
 	h.broadcast <- message
 }
@@ -130,11 +332,14 @@ func (h *Hub) GetDocumentClients(docID uuid.UUID) []*Client {
 	return clients
 }
 
-// HandleRedisMessage handles messages received from Redis pub/sub
+// HandleRedisMessage handles messages received from Redis pub/sub.
+// It must run on the hub goroutine, which owns closing client channels.
 func (h *Hub) HandleRedisMessage(docID uuid.UUID, message *BroadcastMessage) {
-	h.mu.RLock()
-	clients := h.documents[docID]
-	h.mu.RUnlock()
+	if h.control(message) {
+		return
+	}
+
+	clients := h.GetDocumentClients(docID)
 
 	data, err := json.Marshal(message)
 	if err != nil {
@@ -142,15 +347,95 @@ func (h *Hub) HandleRedisMessage(docID uuid.UUID, message *BroadcastMessage) {
 		return
 	}
 
-	for client := range clients {
-		select {
-		case client.send <- data:
-		default:
-			close(client.send)
-			h.mu.Lock()
-			delete(clients, client)
-			h.mu.Unlock()
+	for _, client := range clients {
+		h.deliver(client, message.version(), data)
+	}
+}
+
+// control acts on messages that manage connections rather than being passed
+// on as is, reporting whether message was one. It must run on the hub goroutine.
+func (h *Hub) control(message *BroadcastMessage) bool {
+	switch {
+	case message.Type == "close":
+		h.disconnect(message.DocumentID, nil, CloseDocumentDeleted, message.Event)
+
+	case message.Type == "permission" && message.Event == "revoked":
+		h.disconnect(message.DocumentID, func(client *Client) bool {
+			return client.UserID == message.UserID
+		}, CloseAccessRevoked, "access revoked")
+
+	case message.Type == "permission" && message.Event == "link_revoked":
+		h.disconnect(message.DocumentID, func(client *Client) bool {
+			return client.Link != nil
+		}, CloseAccessRevoked, "share link changed")
+
+	case message.Type == "permission":
+		data, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("Error marshaling permission message: %v", err)
+			return true
+		}
+		for _, client := range h.GetDocumentClients(message.DocumentID) {
+			if client.UserID == message.UserID {
+				client.SetRole(message.Role)
+				h.deliver(client, 0, data)
+			}
+		}
+
+	default:
+		return false
+	}
+	return true
+}
+
+// admit decides whether a frame of msgType from client goes any further.
+// Edits from clients whose role cannot edit stop here; the usecases check
+// the stored permission again for those that pass.
+func (h *Hub) admit(client *Client, msgType string) bool {
+	return !isEdit(msgType) || client.Role().CanEdit()
+}
+
+// disconnect drops the clients of a document that match, or all of them if
+// match is nil, and has each connection closed with code and reason. It must
+// run on the hub goroutine, which owns closing Send.
+func (h *Hub) disconnect(docID uuid.UUID, match func(*Client) bool, code int, reason string) {
+	var dropped []*Client
+	h.mu.Lock()
+	for client := range h.documents[docID] {
+		if match == nil || match(client) {
+			delete(h.documents[docID], client)
+			dropped = append(dropped, client)
 		}
 	}
+	if len(h.documents[docID]) == 0 {
+		delete(h.documents, docID)
+	}
+	h.mu.Unlock()
+
+	frame := websocket.FormatCloseMessage(code, reason)
+	for _, client := range dropped {
+		client.shutdown(frame)
+	}
+	if len(dropped) > 0 {
+		log.Printf("Disconnected %d clients from Document %s: %s", len(dropped), docID, reason)
+	}
 }
 
+// deliver queues data for a client. A client whose buffer is full is too slow
+// to keep up, so its connection is closed; ReadPump then unregisters it, which
+// is the only place its Send channel gets closed. Clients that are catching
+// up get the message held back or dropped instead (see Client.accept).
+func (h *Hub) deliver(client *Client, version int64, data []byte) {
+	if client.accept(version, data) {
+		return
+	}
+
+	select {
+	case client.Send <- data:
+	default:
+		log.Printf("Dropping slow client: User %s for Document %s", client.UserID, client.DocumentID)
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/infrastructure/redis"
+	"github.com/google/uuid"
+)
+
+// quiet is how long a client must go without a message to count as having
+// received nothing more
+const quiet = 200 * time.Millisecond
+
+func startHub(t *testing.T, addr string) *Hub {
+	t.Helper()
+	rdb, err := redis.NewRedisClient(addr, "", 0)
+	if err != nil {
+		t.Fatalf("connect to redis: %v", err)
+	}
+	t.Cleanup(func() { rdb.Close() })
+
+	hub := NewHub(rdb)
+	go hub.Run()
+	return hub
+}
+
+func joinHub(hub *Hub, userID, docID uuid.UUID) *Client {
+	client := &Client{
+		Hub:        hub,
+		Send:       make(chan []byte, 16),
+		UserID:     userID,
+		DocumentID: docID,
+		SessionID:  uuid.New(),
+	}
+	// Run subscribes to Redis before handling registrations, so once this
+	// returns the hub hears other nodes
+	hub.Register(client)
+	return client
+}
+
+// received collects the operations client is sent until it has been quiet for a while
+func received(t *testing.T, client *Client) []domain.Operation {
+	t.Helper()
+	var ops []domain.Operation
+	for {
+		select {
+		case data := <-client.Send:
+			var msg BroadcastMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("decode message: %v", err)
+			}
+			if msg.Operation != nil {
+				ops = append(ops, *msg.Operation)
+			}
+		case <-time.After(quiet):
+			return ops
+		}
+	}
+}
+
+func TestHubFanOutAcrossNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hubA := startHub(t, mr.Addr())
+	hubB := startHub(t, mr.Addr())
+
+	docID, author, other := uuid.New(), uuid.New(), uuid.New()
+	sender := joinHub(hubA, author, docID)
+	authorTab := joinHub(hubA, author, docID)
+	otherA := joinHub(hubA, other, docID)
+	authorB := joinHub(hubB, author, docID)
+	otherB := joinHub(hubB, other, docID)
+	elsewhere := joinHub(hubB, other, uuid.New())
+
+	op := domain.Operation{ID: uuid.New(), DocumentID: docID, UserID: author, Type: "insert", Content: "hi", Version: 1}
+	msg := OperationMessage(op)
+	msg.SessionID = sender.SessionID
+	hubA.BroadcastToDocument(docID, msg)
+
+	if ops := received(t, sender); len(ops) != 0 {
+		t.Errorf("sender got its own operation back %d times", len(ops))
+	}
+	for name, client := range map[string]*Client{
+		"author's other tab on A": authorTab,
+		"other user on A":         otherA,
+		"author on B":             authorB,
+		"other user on B":         otherB,
+	} {
+		ops := received(t, client)
+		if len(ops) != 1 {
+			t.Errorf("%s got the operation %d times, want once", name, len(ops))
+			continue
+		}
+		if ops[0].ID != op.ID || ops[0].Version != op.Version {
+			t.Errorf("%s got %+v, want %+v", name, ops[0], op)
+		}
+	}
+	if ops := received(t, elsewhere); len(ops) != 0 {
+		t.Errorf("client on another document got %d operations", len(ops))
+	}
+}
+
+func TestHubPresenceEchoAcrossNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hubA := startHub(t, mr.Addr())
+	hubB := startHub(t, mr.Addr())
+
+	docID, userID := uuid.New(), uuid.New()
+	sender := joinHub(hubB, userID, docID)
+	tab := joinHub(hubB, userID, docID)
+	remote := joinHub(hubA, userID, docID)
+
+	presence := &domain.Presence{UserID: userID, DocumentID: docID, SessionID: sender.SessionID}
+	hubB.BroadcastToDocument(docID, PresenceMessage("update", presence))
+
+	counts := map[*Client]int{}
+	for _, client := range []*Client{sender, tab, remote} {
+		timeout := time.After(quiet)
+	drain:
+		for {
+			select {
+			case <-client.Send:
+				counts[client]++
+			case <-timeout:
+				break drain
+			}
+		}
+	}
+	if counts[sender] != 0 {
+		t.Errorf("sender got its own presence back %d times", counts[sender])
+	}
+	if counts[tab] != 1 || counts[remote] != 1 {
+		t.Errorf("other connections got the presence %d and %d times, want once each", counts[tab], counts[remote])
+	}
+}
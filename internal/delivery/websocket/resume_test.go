@@ -0,0 +1,260 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// logRepo is the part of a CollaborationRepository a catch-up reads: one
+// document, which its owner can see, and the document's operation log
+type logRepo struct {
+	usecase.CollaborationRepository
+	doc *domain.Document
+	ops []*domain.Operation
+	// Runs while the log is being read, as a node committing meanwhile
+	reading func()
+}
+
+func (r *logRepo) GetDocumentByID(id uuid.UUID) (*domain.Document, error) {
+	if id != r.doc.ID {
+		return &domain.Document{}, gorm.ErrRecordNotFound
+	}
+	copied := *r.doc
+	return &copied, nil
+}
+
+func (r *logRepo) GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error) {
+	return &domain.DocumentPermission{}, gorm.ErrRecordNotFound
+}
+
+func (r *logRepo) GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error) {
+	if r.reading != nil {
+		r.reading()
+	}
+	var ops []*domain.Operation
+	for _, op := range r.ops {
+		if op.Version > version {
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+func logged(docID uuid.UUID, version int64) *domain.Operation {
+	return &domain.Operation{ID: uuid.New(), DocumentID: docID, Type: "insert", Content: "x", Version: version}
+}
+
+// frame is any message the server sends, decoded far enough to tell them apart
+type frame struct {
+	Type      string            `json:"type"`
+	Operation *domain.Operation `json:"operation"`
+	Version   int64             `json:"version"`
+	Snapshot  *domain.Document  `json:"snapshot"`
+}
+
+func (f frame) String() string {
+	if f.Operation != nil {
+		return fmt.Sprintf("%s@%d", f.Type, f.Operation.Version)
+	}
+	return f.Type
+}
+
+// resumeServer serves connections that resume repo's document from the
+// since_version query parameter, as the WebSocket handler does
+func resumeServer(t *testing.T, hub *Hub, repo *logRepo) *httptest.Server {
+	t.Helper()
+	collab := usecase.NewCollaborationUsecase(repo, usecase.NewAccessPolicy(repo, nil), usecase.DefaultSnapshotPolicy())
+	upgrader := websocket.Upgrader{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		var since int64
+		json.Unmarshal([]byte(r.URL.Query().Get("since_version")), &since)
+
+		client := &Client{
+			Hub:        hub,
+			Conn:       conn,
+			Send:       make(chan []byte, 16),
+			UserID:     repo.doc.OwnerID,
+			DocumentID: repo.doc.ID,
+			Collab:     collab,
+			SessionID:  uuid.New(),
+		}
+		if err := client.Resume(since); err != nil {
+			return
+		}
+		go client.WritePump()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// readFrames reads n messages, which may arrive batched one per line
+func readFrames(t *testing.T, conn *websocket.Conn, n int) []frame {
+	t.Helper()
+	var frames []frame
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(frames) < n {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read after %v: %v", frames, err)
+		}
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte{'\n'}) {
+			var f frame
+			if err := json.Unmarshal(line, &f); err != nil {
+				t.Fatalf("decode %s: %v", line, err)
+			}
+			frames = append(frames, f)
+		}
+	}
+	return frames
+}
+
+func dial(t *testing.T, srv *httptest.Server, since string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?since_version="+since, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestResumeReplaysThenReleasesHeldMessages(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hub := startHub(t, mr.Addr())
+
+	doc := &domain.Document{ID: uuid.New(), OwnerID: uuid.New(), Type: domain.DocumentTypeText, Content: "xxx", Version: 3}
+	repo := &logRepo{doc: doc, ops: []*domain.Operation{logged(doc.ID, 1), logged(doc.ID, 2), logged(doc.ID, 3)}}
+
+	// While the log is read, version 3 is broadcast (so it reaches the client
+	// twice) and then version 4 and a presence change, which have to wait
+	// for the replay and keep their order
+	var resuming *Client
+	repo.reading = func() {
+		for _, c := range hub.GetDocumentClients(doc.ID) {
+			resuming = c
+		}
+		hub.BroadcastToDocument(doc.ID, OperationMessage(*logged(doc.ID, 3)))
+		hub.BroadcastToDocument(doc.ID, OperationMessage(*logged(doc.ID, 4)))
+		hub.BroadcastToDocument(doc.ID, PresenceMessage("update", &domain.Presence{UserID: uuid.New(), DocumentID: doc.ID}))
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			resuming.mu.Lock()
+			held := len(resuming.held)
+			resuming.mu.Unlock()
+			if held == 3 {
+				return
+			}
+		}
+		t.Errorf("live messages were not held back during the catch-up")
+	}
+
+	conn := dial(t, resumeServer(t, hub, repo), "1")
+	frames := readFrames(t, conn, 5)
+	var got []string
+	for _, f := range frames {
+		got = append(got, f.String())
+	}
+	want := []string{"operation@2", "operation@3", "synced", "operation@4", "presence"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("frames = %v, want %v", got, want)
+	}
+	if frames[2].Version != 3 {
+		t.Errorf("synced at %d, want 3", frames[2].Version)
+	}
+
+	// Live traffic goes straight through afterwards, minus what was replayed
+	hub.BroadcastToDocument(doc.ID, OperationMessage(*logged(doc.ID, 3)))
+	hub.BroadcastToDocument(doc.ID, OperationMessage(*logged(doc.ID, 5)))
+	if f := readFrames(t, conn, 1); f[0].String() != "operation@5" {
+		t.Errorf("after the catch-up got %v, want operation@5", f)
+	}
+}
+
+func TestResumeFallsBackToASnapshot(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hub := startHub(t, mr.Addr())
+
+	// Versions 1 and 2 were compacted away
+	doc := &domain.Document{ID: uuid.New(), OwnerID: uuid.New(), Type: domain.DocumentTypeText, Content: "hello", Version: 3, SnapshotVersion: 3}
+	repo := &logRepo{doc: doc, ops: []*domain.Operation{logged(doc.ID, 3)}}
+
+	conn := dial(t, resumeServer(t, hub, repo), "0")
+	frames := readFrames(t, conn, 2)
+	if frames[0].Type != "snapshot" || frames[0].Version != 3 || frames[0].Snapshot == nil || frames[0].Snapshot.Content != "hello" {
+		t.Errorf("first frame = %+v, want a snapshot of \"hello\" at 3", frames[0])
+	}
+	if frames[1].Type != "synced" || frames[1].Version != 3 {
+		t.Errorf("second frame = %+v, want synced at 3", frames[1])
+	}
+}
+
+func TestResumeFromAFutureVersionFails(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hub := startHub(t, mr.Addr())
+
+	doc := &domain.Document{ID: uuid.New(), OwnerID: uuid.New(), Type: domain.DocumentTypeText, Version: 1}
+	conn := dial(t, resumeServer(t, hub, &logRepo{doc: doc}), "7")
+
+	var reply ServerMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&reply); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if reply.Type != "error" || reply.Code != "invalid_operation" {
+		t.Errorf("reply = %+v, want an invalid_operation error", reply)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("connection stayed open after the failed catch-up")
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(hub.GetDocumentClients(doc.ID)) > 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("client still registered after the failed catch-up")
+		}
+	}
+}
+
+func TestHeldMessagesKeepTheirOrder(t *testing.T) {
+	hub := NewHub(nil)
+	client := &Client{Hub: hub, Send: make(chan []byte, 16), resuming: true}
+
+	for _, m := range []struct {
+		version int64
+		data    string
+	}{{2, "op2"}, {0, "presence"}, {4, "op4"}, {3, "op3"}, {0, "task"}} {
+		hub.deliver(client, m.version, []byte(m.data))
+	}
+	if len(client.Send) != 0 {
+		t.Fatalf("%d messages delivered during the catch-up", len(client.Send))
+	}
+
+	// The catch-up covered up to version 3
+	client.finishResume(3)
+	hub.deliver(client, 3, []byte("op3 again"))
+	hub.deliver(client, 5, []byte("op5"))
+
+	close(client.Send)
+	var got []string
+	for data := range client.Send {
+		got = append(got, string(data))
+	}
+	if want := []string{"presence", "op4", "task", "op5"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+}
@@ -6,18 +6,99 @@ import (
 	"github.com/google/uuid"
 )
 
-// Operation represents a single edit operation (CRDT-based)
+// ElementID uniquely identifies one character in a document's sequence CRDT.
+// Clock is the Lamport timestamp of the insert and Site the inserting user.
+type ElementID struct {
+	Clock int64     `json:"clock"`
+	Site  uuid.UUID `json:"site"`
+}
+
+// IndexUnit is the unit Operation.Position and Length are counted in
+type IndexUnit string
+
+const (
+	UnitUTF16 IndexUnit = "utf16" // UTF-16 code units, as used by browser editors (default)
+	UnitRune  IndexUnit = "rune"  // Unicode code points
+	UnitByte  IndexUnit = "byte"  // UTF-8 bytes
+)
+
+// Operation represents a single edit operation (CRDT-based).
+//
+// Inserts name the element they follow in Origin (the zero ElementID is the
+// start of the document); the i-th character of Content gets the ID
+// {Timestamp + i, UserID}. Deletes list the removed elements in Targets.
+// Operations without Origin/Targets are addressed by Position/Length and are
+// resolved to element IDs by the server before they are broadcast. Those that
+// set BaseVersion are transformed against everything committed after it.
+//
+// Committed operations get IDs of their own from the server. The ID of the
+// client operation they were committed for is kept as RequestID, which is
+// unique per document: one client operation can commit as several.
+//
+// Position and Length are counted in Unit. Committed operations are stored in
+// the per-document operation log and broadcast in UTF-16 code units; their
+// Position/Length are relative to the document at Version-1.
+//
+// Whiteboard operations ("add_shape", "move", "resize", "restyle", "set_text",
+// "reorder", "group", "ungroup" and "delete") list the shapes they change in
+// Shapes instead. Every property they set is a last-writer-wins register
+// stamped {Timestamp, UserID}.
 type Operation struct {
-	ID         uuid.UUID `json:"id"`
-	DocumentID uuid.UUID `json:"document_id"`
-	UserID     uuid.UUID `json:"user_id"`
-	Type       string    `json:"type"` // "insert", "delete", "format"
-	Position   int       `json:"position"`
-	Length     int       `json:"length"`
-	Content    string    `json:"content"`
-	Timestamp  int64     `json:"timestamp"` // Lamport timestamp
-	VectorClock map[uuid.UUID]int64 `json:"vector_clock"` // Vector clock for ordering
-	CreatedAt  time.Time `json:"created_at"`
+	ID          uuid.UUID              `json:"id" gorm:"type:uuid;primary_key"`
+	RequestID   uuid.UUID              `json:"request_id" gorm:"type:uuid;index:idx_operations_document_request,priority:2"` // ID of the client operation this was committed for
+	DocumentID  uuid.UUID              `json:"document_id" gorm:"type:uuid;not null;uniqueIndex:idx_operations_document_version;index:idx_operations_document_request,priority:1"`
+	UserID      uuid.UUID              `json:"user_id" gorm:"type:uuid;not null"`
+	Type        string                 `json:"type" gorm:"type:varchar(20);not null"` // "insert", "delete", "format", or a whiteboard operation
+	Position    int                    `json:"position"`
+	Length      int                    `json:"length"`
+	Unit        IndexUnit              `json:"unit,omitempty" gorm:"type:varchar(10)"`
+	Content     string                 `json:"content" gorm:"type:text"`
+	Timestamp   int64                  `json:"timestamp"`                                                           // Lamport timestamp
+	BaseVersion *int64                 `json:"base_version,omitempty" gorm:"-"`                                     // Document version the client wrote this against
+	Version     int64                  `json:"version" gorm:"not null;uniqueIndex:idx_operations_document_version"` // Document version after the server applied this operation
+	VectorClock map[uuid.UUID]int64    `json:"vector_clock" gorm:"serializer:json"`                                 // Committed: operations per user up to and including this one. Offline: the clock of the last operation the client had applied
+	Origin      *ElementID             `json:"origin,omitempty" gorm:"serializer:json"`                             // insert: element the new text follows
+	Targets     []ElementID            `json:"targets,omitempty" gorm:"serializer:json"`                            // delete: elements to remove; format: first and last element of the range
+	Attributes  map[string]interface{} `json:"attributes,omitempty" gorm:"serializer:json"`                         // format: attributes to set, null removes one
+	Shapes      []Shape                `json:"shapes,omitempty" gorm:"serializer:json"`                             // whiteboard: the shapes to change
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+// OperationRequest records that a client operation, undo or redo was
+// committed to a document. It outlives the operations it committed as, which
+// compaction prunes, so a late retry is still recognised.
+type OperationRequest struct {
+	DocumentID uuid.UUID `json:"document_id" gorm:"type:uuid;primaryKey"`
+	RequestID  uuid.UUID `json:"request_id" gorm:"type:uuid;primaryKey"`
+	Version    int64     `json:"version" gorm:"not null"` // Document version after the last operation committed for it
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+// UndoHistory is one user's undo and redo stacks for one document, stored
+// next to the operation log so whichever node serves them next can undo.
+// Each entry is what one change committed as.
+type UndoHistory struct {
+	DocumentID uuid.UUID     `json:"document_id" gorm:"type:uuid;primaryKey"`
+	UserID     uuid.UUID     `json:"user_id" gorm:"type:uuid;primaryKey"`
+	Undo       [][]Operation `json:"undo" gorm:"serializer:json"`
+	Redo       [][]Operation `json:"redo" gorm:"serializer:json"`
+	Copies     []ElementCopy `json:"copies" gorm:"serializer:json"`
+	Revision   int64         `json:"revision" gorm:"not null"` // Bumped on every save, to catch concurrent writers
+	UpdatedAt  time.Time     `json:"updated_at" gorm:"index"`
+}
+
+// ElementCopy records that undoing a delete brought a deleted element back
+// as a new one
+type ElementCopy struct {
+	Deleted ElementID `json:"deleted"`
+	Copy    ElementID `json:"copy"`
+}
+
+// DeltaOp is one run of identically formatted text in a document's delta
+// representation
+type DeltaOp struct {
+	Insert     string                 `json:"insert"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
 // ClientSession represents an active WebSocket connection
@@ -32,9 +113,15 @@ type ClientSession struct {
 
 // BroadcastMessage represents a message to be broadcasted
 type BroadcastMessage struct {
-	DocumentID uuid.UUID `json:"document_id"`
-	Operation  Operation `json:"operation"`
-	UserID     uuid.UUID `json:"user_id"`
-	Timestamp  time.Time `json:"timestamp"`
+	Type       string     `json:"type"`            // "operation", "presence", "task", "reset", "close" or "permission"
+	Event      string     `json:"event,omitempty"` // presence: "join", "update" or "leave"; task: what happened to it; close: why; permission: "changed", "revoked" or "link_revoked"
+	DocumentID uuid.UUID  `json:"document_id"`
+	Operation  *Operation `json:"operation,omitempty"`
+	Presence   *Presence  `json:"presence,omitempty"`
+	Task       *Task      `json:"task,omitempty"`
+	Document   *Document  `json:"document,omitempty"` // reset: the document as it was replaced
+	Role       Role       `json:"role,omitempty"`     // permission: UserID's new role
+	UserID     uuid.UUID  `json:"user_id"`
+	Timestamp  time.Time  `json:"timestamp"`
+	NodeID     string     `json:"node_id"` // Server node that published the message
 }
-
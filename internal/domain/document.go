@@ -4,28 +4,75 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type DocumentType string
 
 const (
-	DocumentTypeText     DocumentType = "text"
-	DocumentTypeNote     DocumentType = "note"
+	DocumentTypeText       DocumentType = "text"
+	DocumentTypeNote       DocumentType = "note"
 	DocumentTypeWhiteboard DocumentType = "whiteboard"
-	DocumentTypeTask     DocumentType = "task"
+	DocumentTypeTask       DocumentType = "task"
 )
 
 type Document struct {
-	ID          uuid.UUID   `json:"id" gorm:"type:uuid;primary_key"`
-	Title       string      `json:"title" gorm:"not null"`
-	Content     string      `json:"content" gorm:"type:text"`
-	Type        DocumentType `json:"type" gorm:"type:varchar(20);not null"`
-	OwnerID     uuid.UUID   `json:"owner_id" gorm:"type:uuid;not null;index"`
-	IsPublic    bool        `json:"is_public" gorm:"default:false"`
-	ShareToken  string      `json:"share_token" gorm:"uniqueIndex"`
-	Version     int64       `json:"version" gorm:"default:0"`
-	CreatedAt   time.Time   `json:"created_at"`
-	UpdatedAt   time.Time   `json:"updated_at"`
+	ID              uuid.UUID           `json:"id" gorm:"type:uuid;primary_key"`
+	Title           string              `json:"title" gorm:"not null"`
+	Content         string              `json:"content" gorm:"type:text"`
+	Type            DocumentType        `json:"type" gorm:"type:varchar(20);not null"`
+	OwnerID         uuid.UUID           `json:"owner_id" gorm:"type:uuid;not null;index"`
+	IsPublic        bool                `json:"is_public" gorm:"default:false"` // Whether the share link is enabled
+	ShareToken      string              `json:"-" gorm:"uniqueIndex"`           // Only the owner sees it, through ShareLink
+	ShareRole       Role                `json:"-" gorm:"type:varchar(20)"`      // What the share link grants; viewer when unset
+	ShareExpiresAt  *time.Time          `json:"-"`
+	SharePassword   string              `json:"-"` // bcrypt hash; empty when the link needs no password
+	Version         int64               `json:"version" gorm:"default:0"`
+	VectorClock     map[uuid.UUID]int64 `json:"vector_clock,omitempty" gorm:"serializer:json"` // Operations committed per user, see Operation.VectorClock
+	CRDTState       []byte              `json:"-" gorm:"type:bytea"`                           // Serialized sequence CRDT as of SnapshotVersion
+	SnapshotVersion int64               `json:"-" gorm:"default:0"`                            // Version CRDTState reflects; later operations are replayed from the log
+	SnapshotAt      time.Time           `json:"-"`
+	ResetVersion    int64               `json:"-" gorm:"default:0"`            // Version a REST update last replaced the content at; element IDs from before it are reused
+	Delta           []DeltaOp           `json:"delta,omitempty" gorm:"-"`      // Formatted content, filled in when a single document is fetched
+	Whiteboard      *Whiteboard         `json:"whiteboard,omitempty" gorm:"-"` // Whiteboard documents: the shapes, filled in like Delta
+	CreatedAt       time.Time           `json:"created_at"`
+	UpdatedAt       time.Time           `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt      `json:"deleted_at" gorm:"index" swaggertype:"string" format:"date-time"` // Set while the document is in the trash
+}
+
+// ShareLink is how a document's link sharing is set up
+type ShareLink struct {
+	Token             string     `json:"token"`
+	Enabled           bool       `json:"enabled"`
+	Role              Role       `json:"role" enums:"viewer,commenter,editor"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	PasswordProtected bool       `json:"password_protected"`
+}
+
+// ShareLink describes the document's link sharing settings
+func (d *Document) ShareLink() *ShareLink {
+	role := d.ShareRole
+	if role == "" {
+		role = RoleViewer
+	}
+	return &ShareLink{
+		Token:             d.ShareToken,
+		Enabled:           d.IsPublic,
+		Role:              role,
+		ExpiresAt:         d.ShareExpiresAt,
+		PasswordProtected: d.SharePassword != "",
+	}
+}
+
+// LinkSession records one connection that came into a document through its
+// share link, with the link as it was then
+type LinkSession struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"user_id"`
+	DocumentID uuid.UUID `json:"document_id"`
+	GuestName  string    `json:"guest_name,omitempty"` // Empty for logged-in users
+	Token      string    `json:"token"`
+	Password   string    `json:"password,omitempty"` // The link's password hash
 }
 
 type DocumentVersion struct {
@@ -33,6 +80,7 @@ type DocumentVersion struct {
 	DocumentID uuid.UUID `json:"document_id" gorm:"type:uuid;not null;index"`
 	Version    int64     `json:"version" gorm:"not null"`
 	Content    string    `json:"content" gorm:"type:text"`
+	State      []byte    `json:"-" gorm:"type:bytea"` // Serialized CRDT state, set on collaborative snapshots
 	CreatedBy  uuid.UUID `json:"created_by" gorm:"type:uuid;not null"`
 	CreatedAt  time.Time `json:"created_at"`
 }
@@ -41,8 +89,8 @@ type Activity struct {
 	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
 	DocumentID uuid.UUID `json:"document_id" gorm:"type:uuid;not null;index"`
 	UserID     uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
+	GuestName  string    `json:"guest_name,omitempty" gorm:"type:varchar(100)"` // Set when UserID is a guest who came in through the share link
 	Action     string    `json:"action" gorm:"type:varchar(50);not null"`
 	Details    string    `json:"details" gorm:"type:text"`
 	CreatedAt  time.Time `json:"created_at"`
 }
-
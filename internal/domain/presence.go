@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PresenceState string
+
+const (
+	PresenceActive PresenceState = "active"
+	PresenceIdle   PresenceState = "idle"
+)
+
+// Presence is what one connection shares with the other people in a
+// document. Cursor and Selection are UTF-16 offsets into the document as of
+// Version.
+type Presence struct {
+	SessionID  uuid.UUID     `json:"session_id"`
+	UserID     uuid.UUID     `json:"user_id"`
+	GuestName  string        `json:"guest_name,omitempty"` // Set for guests who came in through the share link
+	DocumentID uuid.UUID     `json:"document_id"`
+	Color      string        `json:"color"`
+	State      PresenceState `json:"state"`
+	Cursor     *int          `json:"cursor,omitempty"`
+	Selection  *Selection    `json:"selection,omitempty"`
+	Version    int64         `json:"version"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// Selection is a text range; Head is where the cursor is and may come before Anchor
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TaskStatus is the board column a task sits in
+type TaskStatus string
+
+const (
+	TaskTodo       TaskStatus = "todo"
+	TaskInProgress TaskStatus = "in_progress"
+	TaskDone       TaskStatus = "done"
+)
+
+// TaskStatuses lists the board columns left to right
+var TaskStatuses = []TaskStatus{TaskTodo, TaskInProgress, TaskDone}
+
+type TaskPriority string
+
+const (
+	PriorityLow    TaskPriority = "low"
+	PriorityMedium TaskPriority = "medium"
+	PriorityHigh   TaskPriority = "high"
+	PriorityUrgent TaskPriority = "urgent"
+)
+
+// Task is one item on the board of a task document
+type Task struct {
+	ID          uuid.UUID    `json:"id" gorm:"type:uuid;primary_key"`
+	DocumentID  uuid.UUID    `json:"document_id" gorm:"type:uuid;not null;index"`
+	Title       string       `json:"title" gorm:"not null"`
+	Description string       `json:"description" gorm:"type:text"`
+	Status      TaskStatus   `json:"status" gorm:"type:varchar(20);not null"`
+	Position    int          `json:"position" gorm:"not null"` // Order within the status column, from 0
+	Priority    TaskPriority `json:"priority" gorm:"type:varchar(10);not null"`
+	AssigneeID  *uuid.UUID   `json:"assignee_id" gorm:"type:uuid;index"`
+	Assignee    *User        `json:"assignee,omitempty" gorm:"foreignKey:AssigneeID"`
+	DueDate     *time.Time   `json:"due_date"`
+	CompletedAt *time.Time   `json:"completed_at"` // Set while the task is done
+	CreatedBy   uuid.UUID    `json:"created_by" gorm:"type:uuid;not null"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// TaskFilter narrows a task listing; zero fields match everything
+type TaskFilter struct {
+	Status     TaskStatus
+	AssigneeID *uuid.UUID
+	DueBefore  *time.Time
+}
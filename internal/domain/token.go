@@ -0,0 +1,69 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefreshToken is one link in a login's chain of refresh tokens. Every
+// refresh replaces the token with a new one in the same family; only a hash
+// of the token itself is stored.
+type RefreshToken struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	UserID     uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	FamilyID   uuid.UUID  `json:"family_id" gorm:"type:uuid;not null;index"` // The login the token descends from, also the access tokens' session ID
+	TokenHash  string     `json:"-" gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null;index"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`                   // Set once the token is used, logged out or revoked with its family
+	ReplacedBy *uuid.UUID `json:"replaced_by,omitempty" gorm:"type:uuid"` // The token a refresh exchanged this one for
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TokenPair is what logging in or refreshing hands out
+type TokenPair struct {
+	AccessToken  string    `json:"token" example:"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9..."`
+	RefreshToken string    `json:"refresh_token" example:"k3Jv9c2kq7J0rXW6bq0m1nS3r5dTzKpq3f5yA8gQH1c"`
+	ExpiresAt    time.Time `json:"expires_at"` // When the access token expires
+}
+
+// SigningKey is a key access tokens are signed with. A key is published
+// before it starts signing and stays published after it stops, so verifiers
+// that cache the key set always know every key a live token can carry.
+type SigningKey struct {
+	ID          string    `json:"kid" gorm:"type:varchar(64);primary_key"`
+	Algorithm   string    `json:"alg" gorm:"type:varchar(16);not null"`
+	PrivateKey  string    `json:"-" gorm:"type:text;not null"`      // PKCS #8, encrypted at rest
+	ActivatesAt time.Time `json:"activates_at" gorm:"not null"`     // Signing starts
+	RetiresAt   time.Time `json:"retires_at" gorm:"not null"`       // Signing stops
+	ExpiresAt   time.Time `json:"expires_at" gorm:"not null;index"` // No longer published or accepted
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// JSONWebKey is the public half of a signing key as RFC 7517 describes it
+type JSONWebKey struct {
+	KeyType   string `json:"kty" example:"RSA"`
+	KeyID     string `json:"kid" example:"3f1c0e5a9b7d4c21"`
+	Use       string `json:"use" example:"sig"`
+	Algorithm string `json:"alg" example:"RS256"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty" example:"AQAB"`
+	// Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// OIDCLogin is what the server remembers between sending a user to an
+// identity provider and the provider sending them back
+type OIDCLogin struct {
+	Provider     string    `json:"provider"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"` // PKCE
+	UserID       uuid.UUID `json:"user_id"`       // Signed-in user linking the identity, uuid.Nil for a login
+}
@@ -9,34 +9,75 @@ import (
 type Role string
 
 const (
-	RoleOwner  Role = "owner"
-	RoleEditor Role = "editor"
-	RoleViewer Role = "viewer"
+	RoleOwner     Role = "owner"
+	RoleEditor    Role = "editor"
+	RoleCommenter Role = "commenter"
+	RoleViewer    Role = "viewer"
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
-	Email     string    `json:"email" gorm:"uniqueIndex;not null"`
-	Username  string    `json:"username" gorm:"uniqueIndex;not null"`
-	Password  string    `json:"-" gorm:"not null"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID            uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	Email         string    `json:"email" gorm:"uniqueIndex;not null"`
+	EmailVerified bool      `json:"email_verified" gorm:"not null;default:false"`
+	Username      string    `json:"username" gorm:"uniqueIndex;not null"`
+	Password      string    `json:"-" gorm:"not null"`
+	TOTPEnabled   bool      `json:"totp_enabled" gorm:"not null;default:false"`
+	TOTPSecret    string    `json:"-"`                                      // Base32; set from the start of enrollment
+	TOTPLastStep  int64     `json:"-"`                                      // Time step of the last accepted code, so a code works once
+	IsAdmin       bool      `json:"is_admin" gorm:"not null;default:false"` // Can change the server-wide settings
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
+// DocumentPermission grants one user a role on one document; a user has at
+// most one per document
 type DocumentPermission struct {
 	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
-	DocumentID uuid.UUID `json:"document_id" gorm:"type:uuid;not null;index"`
-	UserID     uuid.UUID `json:"user_id" gorm:"type:uuid;not null;index"`
+	DocumentID uuid.UUID `json:"document_id" gorm:"type:uuid;not null;index;uniqueIndex:idx_permissions_document_user"`
+	UserID     uuid.UUID `json:"user_id" gorm:"type:uuid;not null;index;uniqueIndex:idx_permissions_document_user"`
+	User       *User     `json:"user,omitempty" gorm:"foreignKey:UserID"` // Filled in when listing a document's permissions
 	Role       Role      `json:"role" gorm:"type:varchar(20);not null"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 func (r Role) CanEdit() bool {
 	return r == RoleOwner || r == RoleEditor
 }
 
+func (r Role) CanComment() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleCommenter
+}
+
 func (r Role) CanView() bool {
-	return r == RoleOwner || r == RoleEditor || r == RoleViewer
+	return r == RoleOwner || r == RoleEditor || r == RoleCommenter || r == RoleViewer
+}
+
+// UserIdentity links a user to an account at an external identity provider
+type UserIdentity struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key"`
+	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null;index"`
+	Provider  string    `json:"provider" gorm:"type:varchar(64);not null;uniqueIndex:idx_identities_provider_subject"`
+	Subject   string    `json:"subject" gorm:"type:varchar(255);not null;uniqueIndex:idx_identities_provider_subject"` // The provider's stable ID for the account
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
+// RecoveryCode is a single-use code that stands in for a two-factor code.
+// Only a hash is stored.
+type RecoveryCode struct {
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;index"`
+	CodeHash  string     `json:"-" gorm:"type:varchar(64);not null;index"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Settings are the server-wide settings administrators change while the
+// server runs. There is at most one row.
+type Settings struct {
+	ID          int        `json:"-" gorm:"primary_key"`
+	MFARequired bool       `json:"mfa_required" gorm:"not null;default:false"` // Every account has to use two-factor authentication
+	UpdatedBy   *uuid.UUID `json:"updated_by,omitempty" gorm:"type:uuid"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"` // Unset until an administrator first saves the settings
+}
@@ -0,0 +1,36 @@
+package domain
+
+import "github.com/google/uuid"
+
+type ShapeKind string
+
+const (
+	ShapeRectangle ShapeKind = "rectangle"
+	ShapeEllipse   ShapeKind = "ellipse"
+	ShapeLine      ShapeKind = "line"
+	ShapeText      ShapeKind = "text"      // Text box
+	ShapeConnector ShapeKind = "connector" // Line joining two shapes, see From and To
+)
+
+// Shape is one item on a whiteboard. In a whiteboard operation it carries the
+// ID of the shape to change and the fields the operation type sets; the rest
+// are ignored.
+type Shape struct {
+	ID      uuid.UUID              `json:"id"`
+	Kind    ShapeKind              `json:"kind,omitempty"`
+	X       float64                `json:"x"`
+	Y       float64                `json:"y"`
+	Width   float64                `json:"width"`
+	Height  float64                `json:"height"`
+	Text    string                 `json:"text,omitempty"`
+	Style   map[string]interface{} `json:"style,omitempty"`    // e.g. fill, stroke, stroke_width, font_size; null removes one
+	Z       float64                `json:"z"`                  // Stacking order, higher is in front; ties go to the newer shape
+	GroupID *uuid.UUID             `json:"group_id,omitempty"` // Shapes with the same group move and select together
+	From    *uuid.UUID             `json:"from,omitempty"`     // Connectors: shape the line starts at
+	To      *uuid.UUID             `json:"to,omitempty"`       // Connectors: shape the line ends at
+}
+
+// Whiteboard is the rendered content of a whiteboard document
+type Whiteboard struct {
+	Shapes []Shape `json:"shapes"` // Back to front
+}
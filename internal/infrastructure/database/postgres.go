@@ -34,12 +34,32 @@ func NewPostgresDB(host, port, user, password, dbname string) (*PostgresDB, erro
 }
 
 func (p *PostgresDB) AutoMigrate() error {
+	// Sharing used to add a permission row every time; keep the latest one
+	// per document and user so the unique index can be built
+	if p.DB.Migrator().HasTable(&domain.DocumentPermission{}) {
+		err := p.DB.Exec(`DELETE FROM document_permissions a USING document_permissions b
+			WHERE a.document_id = b.document_id AND a.user_id = b.user_id
+			AND (a.created_at, a.id) < (b.created_at, b.id)`).Error
+		if err != nil {
+			return fmt.Errorf("failed to deduplicate permissions: %w", err)
+		}
+	}
+
 	err := p.DB.AutoMigrate(
 		&domain.User{},
 		&domain.Document{},
 		&domain.DocumentPermission{},
 		&domain.DocumentVersion{},
 		&domain.Activity{},
+		&domain.Operation{},
+		&domain.OperationRequest{},
+		&domain.UndoHistory{},
+		&domain.Task{},
+		&domain.RefreshToken{},
+		&domain.SigningKey{},
+		&domain.UserIdentity{},
+		&domain.RecoveryCode{},
+		&domain.Settings{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to auto-migrate: %w", err)
@@ -55,4 +75,3 @@ func (p *PostgresDB) Close() error {
 	}
 	return sqlDB.Close()
 }
-
@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+// FileMailer writes each email to its own .eml file in a directory instead of
+// sending it, for development
+type FileMailer struct {
+	dir  string
+	from *mail.Address
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &FileMailer{dir: dir, from: sender}, nil
+}
+
+func (m *FileMailer) Send(email *usecase.Email) error {
+	msg, err := message(m.from, email)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(m.dir, time.Now().UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(msg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// MemoryMailer keeps emails in memory instead of sending them, for tests
+type MemoryMailer struct {
+	mu     sync.Mutex
+	emails []usecase.Email
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(email *usecase.Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emails = append(m.emails, *email)
+	return nil
+}
+
+// Sent returns the emails sent so far, oldest first
+func (m *MemoryMailer) Sent() []usecase.Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]usecase.Email(nil), m.emails...)
+}
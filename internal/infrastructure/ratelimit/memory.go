@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+// sweepInterval is how often expired entries are dropped
+const sweepInterval = time.Minute
+
+// MemoryLimiter keeps rate limits, failed logins and lockouts in this
+// process. It suits a single node and tests; with several nodes each one
+// counts separately, so use the Redis backend instead.
+type MemoryLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]time.Time // When each bucket is full again
+	failures  map[string]failures
+	locks     map[string]time.Time // When each lockout ends
+	lastSweep time.Time
+}
+
+type failures struct {
+	count     int64
+	expiresAt time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return NewMemoryLimiterWithClock(time.Now)
+}
+
+// NewMemoryLimiterWithClock makes a MemoryLimiter that tells the time with
+// now, so tests can move it forward
+func NewMemoryLimiterWithClock(now func() time.Time) *MemoryLimiter {
+	return &MemoryLimiter{
+		now:      now,
+		buckets:  make(map[string]time.Time),
+		failures: make(map[string]failures),
+		locks:    make(map[string]time.Time),
+	}
+}
+
+// Allow spends one request from a token bucket, using the same algorithm as
+// the Redis backend
+func (m *MemoryLimiter) Allow(key string, limit usecase.RateLimit) (*usecase.RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	interval := limit.Window / time.Duration(limit.Limit)
+	tat := m.buckets[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+	if allowAt := next.Add(-limit.Window); allowAt.After(now) {
+		return &usecase.RateLimitResult{
+			Limit:      limit.Limit,
+			Reset:      tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}, nil
+	}
+
+	m.buckets[key] = next
+	return &usecase.RateLimitResult{
+		Allowed:   true,
+		Limit:     limit.Limit,
+		Remaining: int((limit.Window - next.Sub(now)) / interval),
+		Reset:     next.Sub(now),
+	}, nil
+}
+
+func (m *MemoryLimiter) RecordFailure(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	f := m.failures[key]
+	if !f.expiresAt.After(now) {
+		f.count = 0
+	}
+	f.count++
+	f.expiresAt = now.Add(ttl)
+	m.failures[key] = f
+	return f.count, nil
+}
+
+func (m *MemoryLimiter) ClearFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	delete(m.locks, key)
+	return nil
+}
+
+func (m *MemoryLimiter) Lock(key string, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[key] = m.now().Add(d)
+	return nil
+}
+
+func (m *MemoryLimiter) LockedFor(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if remaining := m.locks[key].Sub(m.now()); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
+
+// sweep drops expired entries every sweepInterval so idle keys do not pile
+// up. Callers hold m.mu.
+func (m *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, tat := range m.buckets {
+		if !tat.After(now) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, f := range m.failures {
+		if !f.expiresAt.After(now) {
+			delete(m.failures, key)
+		}
+	}
+	for key, until := range m.locks {
+		if !until.After(now) {
+			delete(m.locks, key)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+// clock is a time that only moves when told to
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter() (*MemoryLimiter, *clock) {
+	c := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	return NewMemoryLimiterWithClock(c.Now), c
+}
+
+func TestMemoryLimiterBurstThenDeny(t *testing.T) {
+	m, c := newTestLimiter()
+	limit := usecase.RateLimit{Limit: 5, Window: time.Minute} // One request per 12s
+
+	for i := 1; i <= limit.Limit; i++ {
+		result, err := m.Allow("k", limit)
+		if err != nil {
+			t.Fatalf("allow: %v", err)
+		}
+		if !result.Allowed || result.Remaining != limit.Limit-i || result.Reset != time.Duration(i)*12*time.Second {
+			t.Fatalf("request %d = %+v, want allowed with %d remaining", i, result, limit.Limit-i)
+		}
+	}
+
+	result, _ := m.Allow("k", limit)
+	if result.Allowed || result.RetryAfter != 12*time.Second || result.Reset != time.Minute {
+		t.Fatalf("request over the burst = %+v, want denied for 12s", result)
+	}
+	if other, _ := m.Allow("other", limit); !other.Allowed {
+		t.Errorf("another key was limited too")
+	}
+
+	c.Advance(12*time.Second - time.Millisecond)
+	if result, _ := m.Allow("k", limit); result.Allowed {
+		t.Errorf("allowed before Retry-After was up")
+	}
+	c.Advance(time.Millisecond)
+	if result, _ := m.Allow("k", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("after Retry-After = %+v, want one request allowed", result)
+	}
+
+	// A quiet minute refills the bucket, but no further
+	c.Advance(10 * time.Minute)
+	if result, _ := m.Allow("k", limit); !result.Allowed || result.Remaining != limit.Limit-1 {
+		t.Errorf("after a quiet spell = %+v, want a full burst again", result)
+	}
+}
+
+func TestMemoryLimiterFailuresAndLocks(t *testing.T) {
+	m, c := newTestLimiter()
+
+	for want := int64(1); want <= 3; want++ {
+		if got, _ := m.RecordFailure("k", time.Hour); got != want {
+			t.Fatalf("failure count = %d, want %d", got, want)
+		}
+	}
+	c.Advance(time.Hour)
+	if got, _ := m.RecordFailure("k", time.Hour); got != 1 {
+		t.Errorf("failure count after ttl = %d, want it to start over", got)
+	}
+
+	m.Lock("k", 5*time.Minute)
+	c.Advance(2 * time.Minute)
+	if remaining, _ := m.LockedFor("k"); remaining != 3*time.Minute {
+		t.Errorf("locked for %s, want 3m", remaining)
+	}
+	c.Advance(3 * time.Minute)
+	if remaining, _ := m.LockedFor("k"); remaining != 0 {
+		t.Errorf("still locked for %s after the lock ended", remaining)
+	}
+
+	m.Lock("k", time.Minute)
+	m.ClearFailures("k")
+	if remaining, _ := m.LockedFor("k"); remaining != 0 {
+		t.Errorf("cleared lock still has %s left", remaining)
+	}
+	if got, _ := m.RecordFailure("k", time.Hour); got != 1 {
+		t.Errorf("failure count after clearing = %d, want 1", got)
+	}
+}
@@ -3,13 +3,20 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
+const documentChannelPattern = "document:*"
+
 type RedisClient struct {
 	client *redis.Client
 	pubsub *redis.PubSub
@@ -51,6 +58,328 @@ func (r *RedisClient) SubscribeToDocument(docID string) (*redis.PubSub, error) {
 	return pubsub, nil
 }
 
+// SubscribeToDocuments listens on every document channel with a single pattern
+// subscription and hands each decoded message to handler. Delivery stops when
+// the client is closed.
+func (r *RedisClient) SubscribeToDocuments(handler func(message domain.BroadcastMessage)) error {
+	pubsub := r.client.PSubscribe(r.ctx, documentChannelPattern)
+	if _, err := pubsub.Receive(r.ctx); err != nil {
+		pubsub.Close()
+		return fmt.Errorf("failed to subscribe to document channels: %w", err)
+	}
+	r.pubsub = pubsub
+
+	go func() {
+		for msg := range pubsub.Channel() {
+			var message domain.BroadcastMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+				log.Printf("Error unmarshaling message from %s: %v", msg.Channel, err)
+				continue
+			}
+			handler(message)
+		}
+	}()
+
+	return nil
+}
+
+// Presence records live under one key per session so each can expire on its
+// own; a sorted set per document, scored by expiry time, indexes them
+func presenceKey(docID, sessionID string) string {
+	return fmt.Sprintf("presence:%s:%s", docID, sessionID)
+}
+
+func presenceIndexKey(docID string) string {
+	return fmt.Sprintf("presence:%s", docID)
+}
+
+func (r *RedisClient) SavePresence(presence *domain.Presence, ttl time.Duration) error {
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence: %w", err)
+	}
+
+	docID, sessionID := presence.DocumentID.String(), presence.SessionID.String()
+	index := presenceIndexKey(docID)
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(r.ctx, presenceKey(docID, sessionID), data, ttl)
+	pipe.ZAdd(r.ctx, index, redis.Z{Score: float64(expiresAt), Member: sessionID})
+	pipe.Expire(r.ctx, index, ttl)
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func (r *RedisClient) RemovePresence(docID, sessionID uuid.UUID) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(r.ctx, presenceKey(docID.String(), sessionID.String()))
+	pipe.ZRem(r.ctx, presenceIndexKey(docID.String()), sessionID.String())
+	_, err := pipe.Exec(r.ctx)
+	return err
+}
+
+// ListPresence returns the unexpired presence records of a document
+func (r *RedisClient) ListPresence(docID uuid.UUID) ([]*domain.Presence, error) {
+	index := presenceIndexKey(docID.String())
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := r.client.ZRemRangeByScore(r.ctx, index, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+
+	sessions, err := r.client.ZRange(r.ctx, index, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(sessions))
+	for i, sessionID := range sessions {
+		keys[i] = presenceKey(docID.String(), sessionID)
+	}
+	values, err := r.client.MGet(r.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	presences := make([]*domain.Presence, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // expired between the two reads
+		}
+		var presence domain.Presence
+		if err := json.Unmarshal([]byte(data), &presence); err != nil {
+			log.Printf("Error unmarshaling presence for document %s: %v", docID, err)
+			continue
+		}
+		presences = append(presences, &presence)
+	}
+	return presences, nil
+}
+
+// Link sessions are kept like presence records, indexed per user and document
+func linkSessionKey(docID, userID, sessionID string) string {
+	return fmt.Sprintf("link:%s:%s:%s", docID, userID, sessionID)
+}
+
+func linkSessionIndexKey(docID, userID string) string {
+	return fmt.Sprintf("link:%s:%s", docID, userID)
+}
+
+func (r *RedisClient) SaveLinkSession(session *domain.LinkSession, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal link session: %w", err)
+	}
+
+	docID, userID, sessionID := session.DocumentID.String(), session.UserID.String(), session.ID.String()
+	index := linkSessionIndexKey(docID, userID)
+	expiresAt := time.Now().Add(ttl).Unix()
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(r.ctx, linkSessionKey(docID, userID, sessionID), data, ttl)
+	pipe.ZAdd(r.ctx, index, redis.Z{Score: float64(expiresAt), Member: sessionID})
+	pipe.Expire(r.ctx, index, ttl)
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func (r *RedisClient) RemoveLinkSession(session *domain.LinkSession) error {
+	docID, userID, sessionID := session.DocumentID.String(), session.UserID.String(), session.ID.String()
+	pipe := r.client.TxPipeline()
+	pipe.Del(r.ctx, linkSessionKey(docID, userID, sessionID))
+	pipe.ZRem(r.ctx, linkSessionIndexKey(docID, userID), sessionID)
+	_, err := pipe.Exec(r.ctx)
+	return err
+}
+
+// ListLinkSessions returns a user's unexpired link sessions on a document
+func (r *RedisClient) ListLinkSessions(docID, userID uuid.UUID) ([]*domain.LinkSession, error) {
+	index := linkSessionIndexKey(docID.String(), userID.String())
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := r.client.ZRemRangeByScore(r.ctx, index, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+
+	ids, err := r.client.ZRange(r.ctx, index, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, sessionID := range ids {
+		keys[i] = linkSessionKey(docID.String(), userID.String(), sessionID)
+	}
+	values, err := r.client.MGet(r.ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*domain.LinkSession, 0, len(values))
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue // expired between the two reads
+		}
+		var session domain.LinkSession
+		if err := json.Unmarshal([]byte(data), &session); err != nil {
+			log.Printf("Error unmarshaling link session for document %s: %v", docID, err)
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
+
+func revokedKey(id string) string {
+	return fmt.Sprintf("revoked:%s", id)
+}
+
+// Revoke marks an access token or session ID as revoked for ttl
+func (r *RedisClient) Revoke(id string, ttl time.Duration) error {
+	return r.client.Set(r.ctx, revokedKey(id), 1, ttl).Err()
+}
+
+func (r *RedisClient) IsRevoked(ids ...string) (bool, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = revokedKey(id)
+	}
+	n, err := r.client.Exists(r.ctx, keys...).Result()
+	return n > 0, err
+}
+
+// CountAttempt counts attempts in a fixed window that starts with the first
+func (r *RedisClient) CountAttempt(key string, ttl time.Duration) (int64, error) {
+	key = fmt.Sprintf("attempts:%s", key)
+	pipe := r.client.TxPipeline()
+	count := pipe.Incr(r.ctx, key)
+	pipe.ExpireNX(r.ctx, key, ttl)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// allowScript is the generic cell rate algorithm, a token bucket that only
+// stores when the bucket will next be full (the theoretical arrival time).
+// It uses the server's clock so every node agrees on it.
+//
+// KEYS[1] bucket; ARGV[1] limit, ARGV[2] window in milliseconds.
+// Returns allowed (0/1), remaining, reset and retry after in milliseconds.
+var allowScript = redis.NewScript(`
+redis.replicate_commands()
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local interval = window / limit
+local t = redis.call("TIME")
+local now = t[1] * 1000 + math.floor(t[2] / 1000)
+
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+local next_tat = tat + interval
+local allow_at = next_tat - window
+if allow_at > now then
+	return {0, 0, math.ceil(tat - now), math.ceil(allow_at - now)}
+end
+
+redis.call("SET", KEYS[1], tostring(next_tat), "PX", math.ceil(next_tat - now))
+local remaining = math.floor((window - (next_tat - now)) / interval)
+return {1, remaining, math.ceil(next_tat - now), 0}
+`)
+
+// Allow spends one request from a token bucket shared by every node
+func (r *RedisClient) Allow(key string, limit usecase.RateLimit) (*usecase.RateLimitResult, error) {
+	values, err := allowScript.Run(r.ctx, r.client, []string{fmt.Sprintf("ratelimit:%s", key)},
+		limit.Limit, limit.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return &usecase.RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit.Limit,
+		Remaining:  int(values[1]),
+		Reset:      time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+func loginFailuresKey(key string) string {
+	return fmt.Sprintf("login_failures:%s", key)
+}
+
+func lockoutKey(key string) string {
+	return fmt.Sprintf("lockout:%s", key)
+}
+
+func (r *RedisClient) RecordFailure(key string, ttl time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	count := pipe.Incr(r.ctx, loginFailuresKey(key))
+	pipe.Expire(r.ctx, loginFailuresKey(key), ttl)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+func (r *RedisClient) ClearFailures(key string) error {
+	return r.client.Del(r.ctx, loginFailuresKey(key), lockoutKey(key)).Err()
+}
+
+func (r *RedisClient) Lock(key string, d time.Duration) error {
+	return r.client.Set(r.ctx, lockoutKey(key), 1, d).Err()
+}
+
+func (r *RedisClient) LockedFor(key string) (time.Duration, error) {
+	ttl, err := r.client.PTTL(r.ctx, lockoutKey(key)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// Negative values mean there is no lock
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func oidcLoginKey(state string) string {
+	return fmt.Sprintf("oidc_login:%s", state)
+}
+
+func (r *RedisClient) SaveOIDCLogin(state string, login *domain.OIDCLogin, ttl time.Duration) error {
+	data, err := json.Marshal(login)
+	if err != nil {
+		return fmt.Errorf("failed to marshal login: %w", err)
+	}
+	return r.client.Set(r.ctx, oidcLoginKey(state), data, ttl).Err()
+}
+
+// TakeOIDCLogin reads and deletes a login in one step so a state can only
+// be used once
+func (r *RedisClient) TakeOIDCLogin(state string) (*domain.OIDCLogin, error) {
+	data, err := r.client.GetDel(r.ctx, oidcLoginKey(state)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var login domain.OIDCLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal login: %w", err)
+	}
+	return &login, nil
+}
+
 func (r *RedisClient) SetUserSession(userID, docID string, data interface{}) error {
 	key := fmt.Sprintf("session:%s:%s", userID, docID)
 	value, err := json.Marshal(data)
@@ -71,4 +400,3 @@ func (r *RedisClient) Close() error {
 	}
 	return r.client.Close()
 }
-
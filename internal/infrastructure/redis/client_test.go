@@ -0,0 +1,52 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+func TestLinkSessionsAreSharedUntilTheyExpire(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client, err := NewRedisClient(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Close()
+
+	docID, userID := uuid.New(), uuid.New()
+	first := &domain.LinkSession{ID: uuid.New(), UserID: userID, DocumentID: docID, GuestName: "Ann", Token: "t1"}
+	second := &domain.LinkSession{ID: uuid.New(), UserID: userID, DocumentID: docID, GuestName: "Ann", Token: "t2"}
+	other := &domain.LinkSession{ID: uuid.New(), UserID: uuid.New(), DocumentID: docID, Token: "t1"}
+	for _, session := range []*domain.LinkSession{first, second, other} {
+		if err := client.SaveLinkSession(session, time.Minute); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	sessions, err := client.ListLinkSessions(docID, userID)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("list = %+v, %v, want the user's two sessions", sessions, err)
+	}
+	if err := client.RemoveLinkSession(first); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	sessions, _ = client.ListLinkSessions(docID, userID)
+	if len(sessions) != 1 || *sessions[0] != *second {
+		t.Errorf("after removing one = %+v, want only %+v", sessions, second)
+	}
+
+	// A refreshed session outlives one that was not
+	mr.FastForward(40 * time.Second)
+	client.SaveLinkSession(other, time.Minute)
+	mr.FastForward(40 * time.Second)
+	if sessions, _ := client.ListLinkSessions(docID, userID); len(sessions) != 0 {
+		t.Errorf("expired sessions listed: %+v", sessions)
+	}
+	if sessions, _ := client.ListLinkSessions(docID, other.UserID); len(sessions) != 1 {
+		t.Errorf("refreshed session = %+v, want it still listed", sessions)
+	}
+}
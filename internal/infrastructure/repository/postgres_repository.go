@@ -1,10 +1,14 @@
 package repository
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/collab-platform/backend/internal/domain"
 	"github.com/collab-platform/backend/internal/usecase"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PostgresAuthRepository struct {
@@ -31,6 +35,200 @@ func (r *PostgresAuthRepository) GetUserByID(id uuid.UUID) (*domain.User, error)
 	return &user, err
 }
 
+func (r *PostgresAuthRepository) GetUserByUsername(username string) (*domain.User, error) {
+	var user domain.User
+	err := r.db.Where("username = ?", username).First(&user).Error
+	return &user, err
+}
+
+func (r *PostgresAuthRepository) GetIdentity(provider, subject string) (*domain.UserIdentity, error) {
+	var identity domain.UserIdentity
+	err := r.db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	return &identity, err
+}
+
+func (r *PostgresAuthRepository) CreateIdentity(identity *domain.UserIdentity) error {
+	return r.db.Create(identity).Error
+}
+
+func (r *PostgresAuthRepository) CreateUserWithIdentity(user *domain.User, identity *domain.UserIdentity) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		return tx.Create(identity).Error
+	})
+}
+
+func (r *PostgresAuthRepository) CreateRefreshToken(token *domain.RefreshToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r *PostgresAuthRepository) GetRefreshTokenByHash(hash string) (*domain.RefreshToken, error) {
+	var token domain.RefreshToken
+	err := r.db.Where("token_hash = ?", hash).First(&token).Error
+	return &token, err
+}
+
+func (r *PostgresAuthRepository) RotateRefreshToken(oldID uuid.UUID, next *domain.RefreshToken) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&domain.RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", oldID).
+			Updates(map[string]interface{}{"revoked_at": time.Now(), "replaced_by": next.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Create(next).Error
+	})
+}
+
+func (r *PostgresAuthRepository) RevokeRefreshFamily(familyID uuid.UUID) error {
+	return r.db.Model(&domain.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func (r *PostgresAuthRepository) RevokeUserRefreshTokens(userID uuid.UUID) ([]uuid.UUID, error) {
+	var families []uuid.UUID
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&domain.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Distinct().Pluck("family_id", &families).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&domain.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Update("revoked_at", time.Now()).Error
+	})
+	return families, err
+}
+
+func (r *PostgresAuthRepository) DeleteExpiredRefreshTokens(before time.Time) (int64, error) {
+	result := r.db.Where("expires_at < ?", before).Delete(&domain.RefreshToken{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *PostgresAuthRepository) SetTOTPSecret(userID uuid.UUID, secret string) error {
+	return r.db.Model(&domain.User{}).Where("id = ?", userID).
+		Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error
+}
+
+func (r *PostgresAuthRepository) EnableTOTP(userID uuid.UUID, codes []*domain.RecoveryCode) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&domain.User{}).Where("id = ?", userID).Update("totp_enabled", true).Error; err != nil {
+			return err
+		}
+		return replaceRecoveryCodes(tx, userID, codes)
+	})
+}
+
+func (r *PostgresAuthRepository) DisableTOTP(userID uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&domain.User{}).Where("id = ?", userID).
+			Updates(map[string]interface{}{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error
+	})
+}
+
+func (r *PostgresAuthRepository) ReplaceRecoveryCodes(userID uuid.UUID, codes []*domain.RecoveryCode) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codes)
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uuid.UUID, codes []*domain.RecoveryCode) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&domain.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	return tx.Create(codes).Error
+}
+
+func (r *PostgresAuthRepository) UseRecoveryCode(userID uuid.UUID, hash string) (bool, error) {
+	result := r.db.Model(&domain.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now())
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *PostgresAuthRepository) AdvanceTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	result := r.db.Model(&domain.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *PostgresAuthRepository) VerifyEmail(userID uuid.UUID, email string) error {
+	result := r.db.Model(&domain.User{}).
+		Where("id = ? AND email = ? AND NOT email_verified", userID, email).
+		Updates(map[string]interface{}{"email_verified": true, "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresAuthRepository) ResetPassword(userID uuid.UUID, current, next string) error {
+	result := r.db.Model(&domain.User{}).
+		Where("id = ? AND password = ?", userID, current).
+		Updates(map[string]interface{}{"password": next, "email_verified": true, "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *PostgresAuthRepository) GetSettings() (*domain.Settings, error) {
+	var settings domain.Settings
+	if err := r.db.First(&settings, settingsID).Error; err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+func (r *PostgresAuthRepository) SaveSettings(settings *domain.Settings) error {
+	settings.ID = settingsID
+	return r.db.Save(settings).Error
+}
+
+// settingsID is the key of the only settings row
+const settingsID = 1
+
+type PostgresSigningKeyRepository struct {
+	db *gorm.DB
+}
+
+func NewPostgresSigningKeyRepository(db *gorm.DB) usecase.SigningKeyRepository {
+	return &PostgresSigningKeyRepository{db: db}
+}
+
+func (r *PostgresSigningKeyRepository) ListSigningKeys(now time.Time) ([]*domain.SigningKey, error) {
+	var keys []*domain.SigningKey
+	err := r.db.Where("expires_at > ?", now).Order("activates_at").Find(&keys).Error
+	return keys, err
+}
+
+func (r *PostgresSigningKeyRepository) CreateSigningKey(key *domain.SigningKey) error {
+	return r.db.Create(key).Error
+}
+
+func (r *PostgresSigningKeyRepository) DeleteExpiredSigningKeys(before time.Time) (int64, error) {
+	result := r.db.Where("expires_at <= ?", before).Delete(&domain.SigningKey{})
+	return result.RowsAffected, result.Error
+}
+
 type PostgresDocumentRepository struct {
 	db *gorm.DB
 }
@@ -49,14 +247,101 @@ func (r *PostgresDocumentRepository) GetDocumentByID(id uuid.UUID) (*domain.Docu
 	return &doc, err
 }
 
-func (r *PostgresDocumentRepository) UpdateDocument(doc *domain.Document) error {
-	return r.db.Save(doc).Error
+func (r *PostgresDocumentRepository) UpdateDocument(doc *domain.Document, baseVersion int64) error {
+	result := r.db.Model(&domain.Document{}).
+		Where("id = ? AND version = ?", doc.ID, baseVersion).
+		Updates(map[string]interface{}{
+			"title":            doc.Title,
+			"content":          doc.Content,
+			"crdt_state":       doc.CRDTState,
+			"version":          doc.Version,
+			"snapshot_version": doc.SnapshotVersion,
+			"snapshot_at":      doc.SnapshotAt,
+			"reset_version":    doc.ResetVersion,
+			"updated_at":       doc.UpdatedAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return usecase.ErrStaleWrite
+	}
+	return nil
+}
+
+func (r *PostgresDocumentRepository) GetDocumentByShareToken(token string) (*domain.Document, error) {
+	var doc domain.Document
+	err := r.db.Where("share_token = ?", token).First(&doc).Error
+	return &doc, err
+}
+
+func (r *PostgresDocumentRepository) UpdateShareLink(doc *domain.Document) error {
+	doc.UpdatedAt = time.Now()
+	return r.db.Model(&domain.Document{}).Where("id = ?", doc.ID).Updates(map[string]interface{}{
+		"is_public":        doc.IsPublic,
+		"share_token":      doc.ShareToken,
+		"share_role":       doc.ShareRole,
+		"share_expires_at": doc.ShareExpiresAt,
+		"share_password":   doc.SharePassword,
+		"updated_at":       doc.UpdatedAt,
+	}).Error
 }
 
 func (r *PostgresDocumentRepository) DeleteDocument(id uuid.UUID) error {
 	return r.db.Delete(&domain.Document{}, id).Error
 }
 
+func (r *PostgresDocumentRepository) GetTrashedDocument(id uuid.UUID) (*domain.Document, error) {
+	var doc domain.Document
+	err := r.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id).First(&doc).Error
+	return &doc, err
+}
+
+func (r *PostgresDocumentRepository) GetTrashedDocuments(ownerID uuid.UUID) ([]*domain.Document, error) {
+	var docs []*domain.Document
+	err := r.db.Unscoped().
+		Where("owner_id = ? AND deleted_at IS NOT NULL", ownerID).
+		Order("deleted_at DESC").
+		Find(&docs).Error
+	return docs, err
+}
+
+func (r *PostgresDocumentRepository) RestoreDocument(id uuid.UUID) error {
+	return r.db.Unscoped().Model(&domain.Document{}).Where("id = ?", id).Update("deleted_at", nil).Error
+}
+
+func (r *PostgresDocumentRepository) PurgeDocuments(trashedBefore time.Time) (int64, error) {
+	var ids []uuid.UUID
+	err := r.db.Unscoped().Model(&domain.Document{}).
+		Where("deleted_at < ?", trashedBefore).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		owned := []interface{}{
+			&domain.Operation{},
+			&domain.OperationRequest{},
+			&domain.UndoHistory{},
+			&domain.Task{},
+			&domain.Activity{},
+			&domain.DocumentVersion{},
+			&domain.DocumentPermission{},
+		}
+		for _, model := range owned {
+			if err := tx.Where("document_id IN ?", ids).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&domain.Document{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
 func (r *PostgresDocumentRepository) GetUserDocuments(userID uuid.UUID) ([]*domain.Document, error) {
 	var docs []*domain.Document
 	err := r.db.Where("owner_id = ?", userID).
@@ -79,12 +364,62 @@ func (r *PostgresDocumentRepository) UpdatePermission(perm *domain.DocumentPermi
 	return r.db.Save(perm).Error
 }
 
+func (r *PostgresDocumentRepository) DeletePermission(docID, userID uuid.UUID) error {
+	return r.db.Where("document_id = ? AND user_id = ?", docID, userID).Delete(&domain.DocumentPermission{}).Error
+}
+
 func (r *PostgresDocumentRepository) GetDocumentPermissions(docID uuid.UUID) ([]*domain.DocumentPermission, error) {
 	var perms []*domain.DocumentPermission
-	err := r.db.Where("document_id = ?", docID).Find(&perms).Error
+	err := r.db.Preload("User").Where("document_id = ?", docID).Order("created_at ASC").Find(&perms).Error
 	return perms, err
 }
 
+func (r *PostgresDocumentRepository) TransferOwnership(docID, fromUserID, toUserID uuid.UUID) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&domain.Document{}).
+			Where("id = ? AND owner_id = ?", docID, fromUserID).
+			Update("owner_id", toUserID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return usecase.ErrPermissionDenied
+		}
+
+		now := time.Now()
+		roles := map[uuid.UUID]domain.Role{toUserID: domain.RoleOwner, fromUserID: domain.RoleEditor}
+		for userID, role := range roles {
+			result := tx.Model(&domain.DocumentPermission{}).
+				Where("document_id = ? AND user_id = ?", docID, userID).
+				Updates(map[string]interface{}{"role": role, "updated_at": now})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				continue
+			}
+			err := tx.Create(&domain.DocumentPermission{
+				ID:         uuid.New(),
+				DocumentID: docID,
+				UserID:     userID,
+				Role:       role,
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *PostgresDocumentRepository) GetUserByID(id uuid.UUID) (*domain.User, error) {
+	var user domain.User
+	err := r.db.Where("id = ?", id).First(&user).Error
+	return &user, err
+}
+
 func (r *PostgresDocumentRepository) CreateVersion(version *domain.DocumentVersion) error {
 	return r.db.Create(version).Error
 }
@@ -103,6 +438,12 @@ func (r *PostgresDocumentRepository) CreateActivity(activity *domain.Activity) e
 	return r.db.Create(activity).Error
 }
 
+func (r *PostgresDocumentRepository) GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error) {
+	var ops []*domain.Operation
+	err := r.db.Where("document_id = ? AND version > ?", docID, version).Order("version ASC").Find(&ops).Error
+	return ops, err
+}
+
 func (r *PostgresDocumentRepository) GetDocumentActivities(docID uuid.UUID, limit int) ([]*domain.Activity, error) {
 	var activities []*domain.Activity
 	query := r.db.Where("document_id = ?", docID).Order("created_at DESC")
@@ -131,13 +472,262 @@ func (r *PostgresCollaborationRepository) UpdateDocument(doc *domain.Document) e
 	return r.db.Save(doc).Error
 }
 
-func (r *PostgresCollaborationRepository) GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error) {
+func (r *PostgresCollaborationRepository) CreateActivity(activity *domain.Activity) error {
+	return r.db.Create(activity).Error
+}
+
+func (r *PostgresCollaborationRepository) CommitOperations(doc *domain.Document, baseVersion int64, ops []domain.Operation) error {
+	// Map updates bypass the field's serializer
+	clock, err := json.Marshal(doc.VectorClock)
+	if err != nil {
+		return err
+	}
+
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&domain.Document{}).
+			Where("id = ? AND version = ?", doc.ID, baseVersion).
+			Updates(map[string]interface{}{
+				"content":      doc.Content,
+				"version":      doc.Version,
+				"vector_clock": string(clock),
+				"updated_at":   doc.UpdatedAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return usecase.ErrStaleWrite
+		}
+
+		if len(ops) == 0 {
+			return nil
+		}
+		if err := tx.Create(&ops).Error; err != nil {
+			return err
+		}
+
+		requests := operationRequests(ops)
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&requests)
+		if result.Error != nil {
+			return result.Error
+		}
+		// Another node committed one of them first
+		if result.RowsAffected < int64(len(requests)) {
+			return usecase.ErrDuplicateOperation
+		}
+		return nil
+	})
+}
+
+// operationRequests lists the client operations ops were committed for, each
+// with the version its last operation brought the document to
+func operationRequests(ops []domain.Operation) []domain.OperationRequest {
+	var requests []domain.OperationRequest
+	index := make(map[uuid.UUID]int)
+	for _, op := range ops {
+		if i, ok := index[op.RequestID]; ok {
+			requests[i].Version = op.Version
+			continue
+		}
+		index[op.RequestID] = len(requests)
+		requests = append(requests, domain.OperationRequest{
+			DocumentID: op.DocumentID,
+			RequestID:  op.RequestID,
+			Version:    op.Version,
+			CreatedAt:  op.CreatedAt,
+		})
+	}
+	return requests
+}
+
+func (r *PostgresCollaborationRepository) GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error) {
+	var ops []*domain.Operation
+	err := r.db.Where("document_id = ? AND version > ?", docID, version).Order("version ASC").Find(&ops).Error
+	return ops, err
+}
+
+func (r *PostgresCollaborationRepository) GetOperationsByRequestID(docID, requestID uuid.UUID) ([]*domain.Operation, error) {
+	var ops []*domain.Operation
+	err := r.db.Where("document_id = ? AND request_id = ?", docID, requestID).Order("version ASC").Find(&ops).Error
+	return ops, err
+}
+
+func (r *PostgresCollaborationRepository) GetOperationRequest(docID, requestID uuid.UUID) (*domain.OperationRequest, error) {
+	var request domain.OperationRequest
+	err := r.db.Where("document_id = ? AND request_id = ?", docID, requestID).First(&request).Error
+	return &request, err
+}
+
+func (r *PostgresCollaborationRepository) DeleteOperationRequests(before time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", before).Delete(&domain.OperationRequest{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *PostgresCollaborationRepository) SeedState(doc *domain.Document) error {
+	return r.db.Model(&domain.Document{}).
+		Where("id = ? AND version = ? AND crdt_state IS NULL", doc.ID, doc.SnapshotVersion).
+		Updates(map[string]interface{}{
+			"crdt_state":       doc.CRDTState,
+			"snapshot_version": doc.SnapshotVersion,
+		}).Error
+}
+
+func (r *PostgresCollaborationRepository) CreateSnapshot(doc *domain.Document, version *domain.DocumentVersion) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&domain.Document{}).
+			Where("id = ? AND snapshot_version < ?", doc.ID, version.Version).
+			Updates(map[string]interface{}{
+				"crdt_state":       version.State,
+				"snapshot_version": version.Version,
+				"snapshot_at":      version.CreatedAt,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		return tx.Create(version).Error
+	})
+}
+
+func (r *PostgresCollaborationRepository) GetDocumentsPendingSnapshot(updatedBefore time.Time) ([]*domain.Document, error) {
+	var docs []*domain.Document
+	err := r.db.Select("id").
+		Where("version > snapshot_version AND updated_at < ?", updatedBefore).
+		Find(&docs).Error
+	return docs, err
+}
+
+func (r *PostgresCollaborationRepository) DeleteOperationsBeforeSnapshot(retain int64) (int64, error) {
+	result := r.db.Exec(`DELETE FROM operations USING documents
+		WHERE operations.document_id = documents.id
+		AND operations.version <= documents.snapshot_version - ?`, retain)
+	return result.RowsAffected, result.Error
+}
+
+func (r *PostgresCollaborationRepository) GetUndoHistory(docID, userID uuid.UUID) (*domain.UndoHistory, error) {
+	var history domain.UndoHistory
+	err := r.db.Where("document_id = ? AND user_id = ?", docID, userID).First(&history).Error
+	return &history, err
+}
+
+func (r *PostgresCollaborationRepository) SaveUndoHistory(history *domain.UndoHistory) error {
+	saved := *history
+	saved.Revision++
+
+	var result *gorm.DB
+	if history.Revision == 0 {
+		result = r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&saved)
+	} else {
+		// Struct updates go through the stacks' serializer; Select makes
+		// them write emptied stacks too
+		result = r.db.Model(&saved).
+			Where("revision = ?", history.Revision).
+			Select("undo", "redo", "copies", "revision", "updated_at").
+			Updates(&saved)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return usecase.ErrStaleWrite
+	}
+	history.Revision = saved.Revision
+	return nil
+}
+
+func (r *PostgresCollaborationRepository) DeleteUndoHistories(before time.Time) (int64, error) {
+	result := r.db.Where("updated_at < ?", before).Delete(&domain.UndoHistory{})
+	return result.RowsAffected, result.Error
+}
+
+type PostgresTaskRepository struct {
+	db *gorm.DB
+}
+
+func NewPostgresTaskRepository(db *gorm.DB) usecase.TaskRepository {
+	return &PostgresTaskRepository{db: db}
+}
+
+func (r *PostgresTaskRepository) GetDocumentByID(id uuid.UUID) (*domain.Document, error) {
+	var doc domain.Document
+	err := r.db.Where("id = ?", id).First(&doc).Error
+	return &doc, err
+}
+
+func (r *PostgresTaskRepository) GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error) {
 	var perm domain.DocumentPermission
 	err := r.db.Where("user_id = ? AND document_id = ?", userID, docID).First(&perm).Error
 	return &perm, err
 }
 
-func (r *PostgresCollaborationRepository) CreateActivity(activity *domain.Activity) error {
+func (r *PostgresTaskRepository) CreateActivity(activity *domain.Activity) error {
 	return r.db.Create(activity).Error
 }
 
+func (r *PostgresTaskRepository) CreateTask(task *domain.Task) error {
+	return r.db.Omit("Assignee").Create(task).Error
+}
+
+func (r *PostgresTaskRepository) GetTaskByID(id uuid.UUID) (*domain.Task, error) {
+	var task domain.Task
+	err := r.db.Preload("Assignee").Where("id = ?", id).First(&task).Error
+	return &task, err
+}
+
+func (r *PostgresTaskRepository) LockBoard(docID uuid.UUID, change func(repo usecase.TaskRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var doc domain.Document
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", docID).First(&doc).Error
+		if err != nil {
+			return err
+		}
+		return change(&PostgresTaskRepository{db: tx})
+	})
+}
+
+func (r *PostgresTaskRepository) GetDocumentTasks(docID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error) {
+	var tasks []*domain.Task
+	query := filterTasks(r.db.Preload("Assignee").Where("document_id = ?", docID), filter)
+	err := query.Order("position ASC, created_at ASC").Find(&tasks).Error
+	return tasks, err
+}
+
+func (r *PostgresTaskRepository) FindTasks(userID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error) {
+	var tasks []*domain.Task
+	query := r.db.Preload("Assignee").
+		Where("document_id IN (SELECT id FROM documents WHERE deleted_at IS NULL AND (owner_id = ? OR id IN (SELECT document_id FROM document_permissions WHERE user_id = ?)))", userID, userID)
+	err := filterTasks(query, filter).
+		Order("due_date ASC NULLS LAST, created_at ASC").
+		Find(&tasks).Error
+	return tasks, err
+}
+
+func filterTasks(query *gorm.DB, filter domain.TaskFilter) *gorm.DB {
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.AssigneeID != nil {
+		query = query.Where("assignee_id = ?", *filter.AssigneeID)
+	}
+	if filter.DueBefore != nil {
+		query = query.Where("due_date < ?", *filter.DueBefore)
+	}
+	return query
+}
+
+func (r *PostgresTaskRepository) SaveTasks(tasks []*domain.Task) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, task := range tasks {
+			if err := tx.Omit("Assignee").Save(task).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *PostgresTaskRepository) DeleteTask(id uuid.UUID) error {
+	return r.db.Delete(&domain.Task{}, "id = ?", id).Error
+}
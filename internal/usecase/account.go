@@ -0,0 +1,290 @@
+package usecase
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidAccountToken  = errors.New("invalid, expired or already used link")
+	ErrEmailAlreadyVerified = errors.New("email address is already verified")
+	ErrTooManyEmails        = errors.New("too many emails requested; try again later")
+)
+
+const (
+	// MaxAccountEmails is how many verification or reset emails one account
+	// gets per AccountEmailWindow
+	MaxAccountEmails   = 3
+	AccountEmailWindow = time.Hour
+
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+)
+
+// Email is a plain text message to one recipient
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails
+type Mailer interface {
+	Send(email *Email) error
+}
+
+// AccountPolicy configures email verification and password resets
+type AccountPolicy struct {
+	// AppURL is the frontend links in emails point to, as
+	// <AppURL>/verify-email?token=... and <AppURL>/reset-password?token=...
+	AppURL              string
+	VerificationExpiry  time.Duration
+	PasswordResetExpiry time.Duration
+}
+
+// accountClaims are carried by the tokens in verification and reset links
+type accountClaims struct {
+	Purpose string `json:"purpose"`
+	Email   string `json:"email"`
+	// Stamp ties a reset token to the password it replaces, so it stops
+	// working once the password changes
+	Stamp string `json:"stamp,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// AccountUsecase confirms email addresses and lets users who forgot their
+// password choose a new one. Both work through signed links sent by email.
+type AccountUsecase struct {
+	auth   *AuthUsecase
+	repo   AuthRepository
+	mailer Mailer
+	key    []byte
+	policy AccountPolicy
+	logf   func(format string, args ...interface{})
+}
+
+// NewAccountUsecase signs link tokens with a key derived from secret. Emails
+// are sent in the background and failures reported through logf.
+func NewAccountUsecase(auth *AuthUsecase, repo AuthRepository, mailer Mailer, secret string, policy AccountPolicy, logf func(format string, args ...interface{})) *AccountUsecase {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("account link tokens"))
+	return &AccountUsecase{
+		auth:   auth,
+		repo:   repo,
+		mailer: mailer,
+		key:    mac.Sum(nil),
+		policy: policy,
+		logf:   logf,
+	}
+}
+
+// SendVerificationEmail emails user a link that confirms their address
+func (a *AccountUsecase) SendVerificationEmail(user *domain.User) {
+	token, err := a.sign(user, purposeVerifyEmail, "", a.policy.VerificationExpiry)
+	if err != nil {
+		a.logf("Failed to create verification link for user %s: %v", user.ID, err)
+		return
+	}
+	a.send(&Email{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you did not create an account, you can ignore this email.\n",
+			user.Username, a.link("verify-email", token), humanDuration(a.policy.VerificationExpiry)),
+	})
+}
+
+// ResendVerificationEmail sends a user another verification link
+func (a *AccountUsecase) ResendVerificationEmail(userID uuid.UUID) error {
+	user, err := a.auth.user(userID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	if ok, err := a.allowEmail(user.ID); err != nil {
+		return err
+	} else if !ok {
+		return ErrTooManyEmails
+	}
+	a.SendVerificationEmail(user)
+	return nil
+}
+
+// VerifyEmail confirms the address a verification link was sent to. Each
+// link works once, and only while the account still has that address.
+func (a *AccountUsecase) VerifyEmail(token string) error {
+	claims, user, err := a.parse(token, purposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	if err := a.repo.VerifyEmail(user.ID, claims.Email); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidAccountToken
+		}
+		return err
+	}
+	return nil
+}
+
+// ForgotPassword emails a password reset link to the account with email, if
+// there is one. It never says whether there is, so it cannot be used to find
+// out who has an account.
+func (a *AccountUsecase) ForgotPassword(email string) error {
+	user, err := a.repo.GetUserByEmail(email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if ok, err := a.allowEmail(user.ID); err != nil || !ok {
+		return err
+	}
+
+	token, err := a.sign(user, purposeResetPassword, passwordStamp(user.Password), a.policy.PasswordResetExpiry)
+	if err != nil {
+		return err
+	}
+	a.send(&Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password for your account. To choose a new password, open this link:\n\n%s\n\n"+
+			"The link expires in %s and works once. If you did not ask for this, you can ignore this email; your password stays the same.\n",
+			user.Username, a.link("reset-password", token), humanDuration(a.policy.PasswordResetExpiry)),
+	})
+	return nil
+}
+
+// ResetPassword sets a new password with a reset link's token. The link
+// stops working once the password changes, and every session of the user is
+// signed out. Since the link came by email, the address counts as verified,
+// and any login lockout is lifted.
+func (a *AccountUsecase) ResetPassword(token, password string) error {
+	_, user, err := a.parse(token, purposeResetPassword)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := a.repo.ResetPassword(user.ID, user.Password, string(hashedPassword)); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidAccountToken
+		}
+		return err
+	}
+	// Whoever was locked out for guessing wrong can log in with the new password
+	if err := a.auth.clearLoginFailures(user.Email); err != nil {
+		return err
+	}
+	return a.auth.LogoutAll(user.ID)
+}
+
+// sign makes a link token for user that lasts ttl
+func (a *AccountUsecase) sign(user *domain.User, purpose, stamp string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &accountClaims{
+		Purpose: purpose,
+		Email:   user.Email,
+		Stamp:   stamp,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   user.ID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.key)
+}
+
+// parse checks a link token made for purpose and loads the user it is for.
+// Reset tokens must still match the user's password.
+func (a *AccountUsecase) parse(tokenString, purpose string) (*accountClaims, *domain.User, error) {
+	claims := &accountClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(*jwt.Token) (interface{}, error) {
+		return a.key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid || claims.Purpose != purpose {
+		return nil, nil, ErrInvalidAccountToken
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, nil, ErrInvalidAccountToken
+	}
+	user, err := a.repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAccountToken
+		}
+		return nil, nil, err
+	}
+	if user.Email != claims.Email {
+		return nil, nil, ErrInvalidAccountToken
+	}
+	if purpose == purposeResetPassword && !hmac.Equal([]byte(claims.Stamp), []byte(passwordStamp(user.Password))) {
+		return nil, nil, ErrInvalidAccountToken
+	}
+	return claims, user, nil
+}
+
+// allowEmail counts an email to a user against MaxAccountEmails, so links
+// cannot be used to flood someone's inbox
+func (a *AccountUsecase) allowEmail(userID uuid.UUID) (bool, error) {
+	sent, err := a.auth.revoked.CountAttempt("account_email:"+userID.String(), AccountEmailWindow)
+	if err != nil {
+		return false, err
+	}
+	return sent <= MaxAccountEmails, nil
+}
+
+// send delivers email in the background, so how long a mail server takes
+// tells nobody whether an account exists
+func (a *AccountUsecase) send(email *Email) {
+	go func() {
+		if err := a.mailer.Send(email); err != nil {
+			a.logf("Failed to send %q email to %s: %v", email.Subject, email.To, err)
+		}
+	}()
+}
+
+func (a *AccountUsecase) link(page, token string) string {
+	return strings.TrimSuffix(a.policy.AppURL, "/") + "/" + page + "?token=" + url.QueryEscape(token)
+}
+
+// passwordStamp is a short fingerprint of a password hash; users without a
+// password get one too, so they can set a password by resetting it
+func passwordStamp(hash string) string {
+	return hashToken(hash)[:16]
+}
+
+// humanDuration writes link lifetimes like "48 hours" or "30 minutes"
+func humanDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	if d >= time.Hour && d%time.Hour == 0 {
+		return plural(int64(d/time.Hour), "hour")
+	}
+	return plural(int64((d+time.Minute-1)/time.Minute), "minute")
+}
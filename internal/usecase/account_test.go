@@ -0,0 +1,199 @@
+package usecase_test
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/infrastructure/mail"
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+type accountFixture struct {
+	*authFixture
+	mailer  *mail.MemoryMailer
+	account *usecase.AccountUsecase
+}
+
+func newAccountFixture(t *testing.T) *accountFixture {
+	t.Helper()
+	return newAccountFixtureFor(t, newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{}))
+}
+
+func newAccountFixtureFor(t *testing.T, auth *authFixture) *accountFixture {
+	t.Helper()
+	f := &accountFixture{authFixture: auth, mailer: mail.NewMemoryMailer()}
+	f.account = usecase.NewAccountUsecase(f.auth, f.repo, f.mailer, "test secret", usecase.AccountPolicy{
+		AppURL:              "https://app.example.com/",
+		VerificationExpiry:  48 * time.Hour,
+		PasswordResetExpiry: time.Hour,
+	}, t.Logf)
+	return f
+}
+
+// register signs a user up the way the register endpoint does
+func (f *accountFixture) register(t *testing.T) *domain.User {
+	t.Helper()
+	if _, err := f.auth.Register("ada@example.com", "ada", "old password"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	user, err := f.repo.GetUserByEmail("ada@example.com")
+	if err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	return user
+}
+
+// waitForEmails waits for the n-th email, which is sent in the background,
+// and returns the token from its link
+func (f *accountFixture) waitForEmails(t *testing.T, n int) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(f.mailer.Sent()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d emails sent, want %d", len(f.mailer.Sent()), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return linkToken(t, f.mailer.Sent()[n-1].Body)
+}
+
+// assertNoMoreEmails checks that no email beyond the first n turns up
+func (f *accountFixture) assertNoMoreEmails(t *testing.T, n int) {
+	t.Helper()
+	time.Sleep(100 * time.Millisecond)
+	if sent := f.mailer.Sent(); len(sent) != n {
+		t.Errorf("%d emails sent, want %d: %+v", len(sent), n, sent)
+	}
+}
+
+func linkToken(t *testing.T, body string) string {
+	t.Helper()
+	_, rest, ok := strings.Cut(body, "?token=")
+	if !ok {
+		t.Fatalf("email has no link: %q", body)
+	}
+	token, err := url.QueryUnescape(strings.Fields(rest)[0])
+	if err != nil {
+		t.Fatalf("unescape token: %v", err)
+	}
+	return token
+}
+
+func TestVerifyEmailLinkWorksOnce(t *testing.T) {
+	f := newAccountFixture(t)
+	user := f.register(t)
+
+	f.account.SendVerificationEmail(user)
+	token := f.waitForEmails(t, 1)
+	if to := f.mailer.Sent()[0].To; to != user.Email {
+		t.Errorf("verification sent to %q, want %q", to, user.Email)
+	}
+
+	if err := f.account.VerifyEmail(token); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if user, _ := f.repo.GetUserByID(user.ID); !user.EmailVerified {
+		t.Errorf("email not verified")
+	}
+	if err := f.account.VerifyEmail(token); !errors.Is(err, usecase.ErrInvalidAccountToken) {
+		t.Errorf("second use: err = %v, want ErrInvalidAccountToken", err)
+	}
+}
+
+func TestResetTokenStopsWorkingAfterPasswordChange(t *testing.T) {
+	f := newAccountFixture(t)
+	user := f.register(t)
+	before, err := f.auth.Login(user.Email, "old password")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+
+	if err := f.account.ForgotPassword(user.Email); err != nil {
+		t.Fatalf("forgot password: %v", err)
+	}
+	first := f.waitForEmails(t, 1)
+	if err := f.account.ForgotPassword(user.Email); err != nil {
+		t.Fatalf("forgot password: %v", err)
+	}
+	second := f.waitForEmails(t, 2)
+
+	if err := f.account.ResetPassword(first, "new password"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if _, err := f.auth.Login(user.Email, "new password"); err != nil {
+		t.Errorf("login with the new password: %v", err)
+	}
+	if _, err := f.auth.Refresh(before.Tokens.RefreshToken); err == nil {
+		t.Errorf("session from before the reset still works")
+	}
+
+	// Both links were for the old password
+	for name, token := range map[string]string{"used link": first, "other link": second} {
+		if err := f.account.ResetPassword(token, "another password"); !errors.Is(err, usecase.ErrInvalidAccountToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidAccountToken", name, err)
+		}
+	}
+	if _, err := f.auth.Login(user.Email, "new password"); err != nil {
+		t.Errorf("password changed by a stale link: %v", err)
+	}
+}
+
+func TestAccountTokensOnlyWorkForTheirPurpose(t *testing.T) {
+	f := newAccountFixture(t)
+	user := f.register(t)
+
+	f.account.SendVerificationEmail(user)
+	verify := f.waitForEmails(t, 1)
+	if err := f.account.ForgotPassword(user.Email); err != nil {
+		t.Fatalf("forgot password: %v", err)
+	}
+	reset := f.waitForEmails(t, 2)
+
+	if err := f.account.ResetPassword(verify, "new password"); !errors.Is(err, usecase.ErrInvalidAccountToken) {
+		t.Errorf("verify token used to reset: err = %v, want ErrInvalidAccountToken", err)
+	}
+	if _, err := f.auth.Login(user.Email, "old password"); err != nil {
+		t.Errorf("password changed: %v", err)
+	}
+	if err := f.account.VerifyEmail(reset); !errors.Is(err, usecase.ErrInvalidAccountToken) {
+		t.Errorf("reset token used to verify: err = %v, want ErrInvalidAccountToken", err)
+	}
+	if user, _ := f.repo.GetUserByID(user.ID); user.EmailVerified {
+		t.Errorf("email verified by a reset token")
+	}
+}
+
+func TestForgotPasswordForUnknownEmail(t *testing.T) {
+	f := newAccountFixture(t)
+	f.register(t)
+
+	if err := f.account.ForgotPassword("nobody@example.com"); err != nil {
+		t.Errorf("err = %v, want nil so nobody learns who has an account", err)
+	}
+	f.assertNoMoreEmails(t, 0)
+}
+
+func TestAccountEmailsAreThrottled(t *testing.T) {
+	f := newAccountFixture(t)
+	user := f.register(t)
+
+	for i := 1; i <= usecase.MaxAccountEmails; i++ {
+		if err := f.account.ForgotPassword(user.Email); err != nil {
+			t.Fatalf("forgot password %d: %v", i, err)
+		}
+		f.waitForEmails(t, i)
+	}
+
+	// Over the limit, resets stay quiet and verification says so
+	if err := f.account.ForgotPassword(user.Email); err != nil {
+		t.Errorf("forgot password over the limit: err = %v, want nil", err)
+	}
+	if err := f.account.ResendVerificationEmail(user.ID); !errors.Is(err, usecase.ErrTooManyEmails) {
+		t.Errorf("resend over the limit: err = %v, want ErrTooManyEmails", err)
+	}
+	f.assertNoMoreEmails(t, usecase.MaxAccountEmails)
+}
@@ -2,6 +2,7 @@ package usecase
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/collab-platform/backend/internal/domain"
@@ -12,35 +13,96 @@ import (
 )
 
 var (
-	ErrInvalidCredentials = errors.New("invalid credentials")
-	ErrUserExists         = errors.New("user already exists")
-	ErrUserNotFound       = errors.New("user not found")
+	ErrInvalidCredentials  = errors.New("invalid credentials")
+	ErrUserExists          = errors.New("user already exists")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used; all sessions from that login have been signed out")
 )
 
 type AuthRepository interface {
 	CreateUser(user *domain.User) error
 	GetUserByEmail(email string) (*domain.User, error)
 	GetUserByID(id uuid.UUID) (*domain.User, error)
+	GetUserByUsername(username string) (*domain.User, error)
+	GetIdentity(provider, subject string) (*domain.UserIdentity, error)
+	CreateIdentity(identity *domain.UserIdentity) error
+	// CreateUserWithIdentity creates a user together with their first
+	// external identity
+	CreateUserWithIdentity(user *domain.User, identity *domain.UserIdentity) error
+	CreateRefreshToken(token *domain.RefreshToken) error
+	GetRefreshTokenByHash(hash string) (*domain.RefreshToken, error)
+	// RotateRefreshToken revokes the token with oldID in favour of next and
+	// stores next. It fails with gorm.ErrRecordNotFound if the old token has
+	// already been revoked, so two refreshes can never both succeed.
+	RotateRefreshToken(oldID uuid.UUID, next *domain.RefreshToken) error
+	RevokeRefreshFamily(familyID uuid.UUID) error
+	// RevokeUserRefreshTokens revokes every live refresh token of a user and
+	// returns the families they belonged to
+	RevokeUserRefreshTokens(userID uuid.UUID) ([]uuid.UUID, error)
+	DeleteExpiredRefreshTokens(before time.Time) (int64, error)
+	// SetTOTPSecret stores the secret of an enrollment in progress
+	SetTOTPSecret(userID uuid.UUID, secret string) error
+	// EnableTOTP turns two-factor authentication on with a first set of
+	// recovery codes
+	EnableTOTP(userID uuid.UUID, codes []*domain.RecoveryCode) error
+	// DisableTOTP turns two-factor authentication off and forgets the
+	// secret and recovery codes
+	DisableTOTP(userID uuid.UUID) error
+	ReplaceRecoveryCodes(userID uuid.UUID, codes []*domain.RecoveryCode) error
+	// UseRecoveryCode marks an unused recovery code used, reporting whether
+	// there was one
+	UseRecoveryCode(userID uuid.UUID, hash string) (bool, error)
+	// AdvanceTOTPStep records step as the user's last accepted time step,
+	// reporting false if it is not newer than the last one
+	AdvanceTOTPStep(userID uuid.UUID, step int64) (bool, error)
+	// VerifyEmail marks a user's email verified if it is still email. It
+	// fails with gorm.ErrRecordNotFound if the email has changed or is
+	// already verified.
+	VerifyEmail(userID uuid.UUID, email string) error
+	// ResetPassword replaces a user's password hash current with next and
+	// marks their email verified. It fails with gorm.ErrRecordNotFound if the
+	// hash is no longer current.
+	ResetPassword(userID uuid.UUID, current, next string) error
+	// GetSettings returns the server-wide settings, or gorm.ErrRecordNotFound
+	// if they have never been saved
+	GetSettings() (*domain.Settings, error)
+	SaveSettings(settings *domain.Settings) error
 }
 
 type AuthUsecase struct {
-	repo       AuthRepository
-	jwtSecret  []byte
-	jwtExpiry  time.Duration
+	repo          AuthRepository
+	revoked       TokenRevocationStore
+	keys          *KeyRing
+	jwtExpiry     time.Duration
+	refreshExpiry time.Duration
+	mfa           MFAPolicy
+	attempts      LoginAttemptStore
+	lockout       LockoutPolicy
 }
 
-func NewAuthUsecase(repo AuthRepository, jwtSecret string, jwtExpiry time.Duration) *AuthUsecase {
+func NewAuthUsecase(repo AuthRepository, revoked TokenRevocationStore, keys *KeyRing, jwtExpiry, refreshExpiry time.Duration, mfa MFAPolicy, attempts LoginAttemptStore, lockout LockoutPolicy) *AuthUsecase {
 	return &AuthUsecase{
-		repo:      repo,
-		jwtSecret: []byte(jwtSecret),
-		jwtExpiry: jwtExpiry,
+		repo:          repo,
+		revoked:       revoked,
+		keys:          keys,
+		jwtExpiry:     jwtExpiry,
+		refreshExpiry: refreshExpiry,
+		mfa:           mfa,
+		attempts:      attempts,
+		lockout:       lockout,
 	}
 }
 
 func (a *AuthUsecase) Register(email, username, password string) (*domain.User, error) {
-	existingUser, _ := a.repo.GetUserByEmail(email)
-	if existingUser != nil {
+	_, err := a.repo.GetUserByEmail(email)
+	switch {
+	case err == nil:
 		return nil, ErrUserExists
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -65,61 +127,99 @@ func (a *AuthUsecase) Register(email, username, password string) (*domain.User,
 	return user, nil
 }
 
-func (a *AuthUsecase) Login(email, password string) (string, *domain.User, error) {
+// Login checks a user's credentials and starts a new session: a short-lived
+// access token and the first refresh token of a new family. Users with
+// two-factor authentication, or who are required to set it up, get an MFA
+// token for the second step instead.
+//
+// Repeated wrong passwords lock the email out for a while, whether or not an
+// account uses it; see LockoutPolicy.
+func (a *AuthUsecase) Login(email, password string) (*LoginResult, error) {
+	if err := a.checkLockout(email); err != nil {
+		return nil, err
+	}
+
 	user, err := a.repo.GetUserByEmail(email)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return "", nil, ErrInvalidCredentials
+			if err := a.recordLoginFailure(email); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidCredentials
 		}
-		return "", nil, err
+		return nil, err
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
-		return "", nil, ErrInvalidCredentials
+		if err := a.recordLoginFailure(email); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if err := a.clearLoginFailures(email); err != nil {
+		return nil, err
 	}
 
-	token, err := a.generateJWT(user.ID, user.Email)
+	result, err := a.mfaLogin(user)
 	if err != nil {
-		return "", nil, err
+		return nil, err
 	}
 
 	user.Password = "" // Don't return password
-	return token, user, nil
+	return result, nil
 }
 
+// ValidateToken checks an access token's signature, made with the published
+// key its kid names and that key's algorithm, its expiry and that
+// neither it nor its session has been revoked. Revocation is checked against
+// the shared store, so a token stops working everywhere as soon as it is
+// revoked; if the store cannot be reached the token is rejected.
 func (a *AuthUsecase) ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return a.jwtSecret, nil
-	})
+	token, err := a.keys.Parse(tokenString, &Claims{})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.ID == "" || claims.SessionID == "" || claims.Purpose != "" {
+		// Tokens from before sessions existed cannot be revoked, so they are
+		// not accepted either
+		return nil, ErrInvalidToken
 	}
 
-	return nil, errors.New("invalid token")
+	revoked, err := a.revoked.IsRevoked(claims.ID, claims.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
 }
 
-func (a *AuthUsecase) generateJWT(userID uuid.UUID, email string) (string, error) {
+func (a *AuthUsecase) generateJWT(userID uuid.UUID, email string, sessionID uuid.UUID) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(a.jwtExpiry)
 	claims := &Claims{
-		UserID: userID.String(),
-		Email:  email,
+		UserID:    userID.String(),
+		Email:     email,
+		SessionID: sessionID.String(),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(a.jwtExpiry)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(a.jwtSecret)
+	signed, err := a.keys.Sign(claims)
+	return signed, expiresAt, err
 }
 
 type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`               // The refresh token family the token was issued from
+	Purpose   string `json:"purpose,omitempty"` // Set on MFA tokens, which are not access tokens
 	jwt.RegisteredClaims
 }
-
@@ -0,0 +1,107 @@
+package usecase_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/infrastructure/ratelimit"
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+// memoryRevocationStore is a TokenRevocationStore in a map
+type memoryRevocationStore struct {
+	mu       sync.Mutex
+	revoked  map[string]bool
+	attempts map[string]int64
+}
+
+func newMemoryRevocationStore() *memoryRevocationStore {
+	return &memoryRevocationStore{revoked: make(map[string]bool), attempts: make(map[string]int64)}
+}
+
+func (s *memoryRevocationStore) Revoke(id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = true
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(ids ...string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if s.revoked[id] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryRevocationStore) CountAttempt(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts[key]++
+	return s.attempts[key], nil
+}
+
+// authFixture is an AuthUsecase over in-memory stores
+type authFixture struct {
+	auth     *usecase.AuthUsecase
+	repo     *memoryAuthRepo
+	revoked  *memoryRevocationStore
+	attempts usecase.LoginAttemptStore
+}
+
+func newAuthFixture(t *testing.T, mfa usecase.MFAPolicy, attempts usecase.LoginAttemptStore, lockout usecase.LockoutPolicy) *authFixture {
+	t.Helper()
+	keys := newKeyRing(t, &memoryKeyRepo{}, usecase.AlgorithmEdDSA)
+	if attempts == nil {
+		attempts = ratelimit.NewMemoryLimiter()
+	}
+
+	f := &authFixture{repo: newMemoryAuthRepo(), revoked: newMemoryRevocationStore(), attempts: attempts}
+	f.auth = usecase.NewAuthUsecase(f.repo, f.revoked, keys, 15*time.Minute, 24*time.Hour, mfa, attempts, lockout)
+	return f
+}
+
+// brokenLookupRepo fails every lookup by email
+type brokenLookupRepo struct {
+	*memoryAuthRepo
+}
+
+var errDatabaseDown = errors.New("database down")
+
+func (r brokenLookupRepo) GetUserByEmail(email string) (*domain.User, error) {
+	return &domain.User{}, errDatabaseDown
+}
+
+func TestRegister(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+
+	user, err := f.auth.Register("ada@example.com", "ada", "password")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if user.Password != "" {
+		t.Errorf("password hash returned")
+	}
+	if _, err := f.auth.Register("grace@example.com", "grace", "password"); err != nil {
+		t.Errorf("register a second user: %v", err)
+	}
+	if _, err := f.auth.Register("ada@example.com", "ada2", "password"); !errors.Is(err, usecase.ErrUserExists) {
+		t.Errorf("register a taken email: err = %v, want ErrUserExists", err)
+	}
+}
+
+func TestRegisterReportsLookupFailure(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+	repo := brokenLookupRepo{f.repo}
+	auth := usecase.NewAuthUsecase(repo, f.revoked, nil, 0, 0, usecase.MFAPolicy{}, f.attempts, usecase.LockoutPolicy{})
+
+	if _, err := auth.Register("ada@example.com", "ada", "password"); !errors.Is(err, errDatabaseDown) {
+		t.Errorf("err = %v, want the lookup error", err)
+	}
+}
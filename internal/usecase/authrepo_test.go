@@ -0,0 +1,294 @@
+package usecase_test
+
+import (
+	"sync"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// memoryAuthRepo is an AuthRepository that keeps everything in maps and
+// behaves like the Postgres one where the usecases rely on it
+type memoryAuthRepo struct {
+	mu         sync.Mutex
+	users      map[uuid.UUID]*domain.User
+	identities map[string]*domain.UserIdentity // By provider and subject
+	refresh    map[uuid.UUID]*domain.RefreshToken
+	recovery   map[uuid.UUID][]*domain.RecoveryCode // By user
+	settings   *domain.Settings
+}
+
+func newMemoryAuthRepo() *memoryAuthRepo {
+	return &memoryAuthRepo{
+		users:      make(map[uuid.UUID]*domain.User),
+		identities: make(map[string]*domain.UserIdentity),
+		refresh:    make(map[uuid.UUID]*domain.RefreshToken),
+		recovery:   make(map[uuid.UUID][]*domain.RecoveryCode),
+	}
+}
+
+var _ usecase.AuthRepository = (*memoryAuthRepo)(nil)
+
+// addUser stores user as it is and returns it
+func (r *memoryAuthRepo) addUser(user *domain.User) *domain.User {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *user
+	r.users[user.ID] = &copied
+	return user
+}
+
+func (r *memoryAuthRepo) identityCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.identities)
+}
+
+func (r *memoryAuthRepo) CreateUser(user *domain.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Email == user.Email || u.Username == user.Username {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	copied := *user
+	r.users[user.ID] = &copied
+	return nil
+}
+
+func (r *memoryAuthRepo) find(match func(u *domain.User) bool) (*domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if match(u) {
+			copied := *u
+			return &copied, nil
+		}
+	}
+	// Like gorm's First, which fills in a user either way
+	return &domain.User{}, gorm.ErrRecordNotFound
+}
+
+func (r *memoryAuthRepo) GetUserByEmail(email string) (*domain.User, error) {
+	return r.find(func(u *domain.User) bool { return u.Email == email })
+}
+
+func (r *memoryAuthRepo) GetUserByID(id uuid.UUID) (*domain.User, error) {
+	return r.find(func(u *domain.User) bool { return u.ID == id })
+}
+
+func (r *memoryAuthRepo) GetUserByUsername(username string) (*domain.User, error) {
+	return r.find(func(u *domain.User) bool { return u.Username == username })
+}
+
+func (r *memoryAuthRepo) GetIdentity(provider, subject string) (*domain.UserIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	identity, ok := r.identities[provider+"\x00"+subject]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *identity
+	return &copied, nil
+}
+
+func (r *memoryAuthRepo) CreateIdentity(identity *domain.UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := identity.Provider + "\x00" + identity.Subject
+	if _, ok := r.identities[key]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	copied := *identity
+	r.identities[key] = &copied
+	return nil
+}
+
+func (r *memoryAuthRepo) CreateUserWithIdentity(user *domain.User, identity *domain.UserIdentity) error {
+	if err := r.CreateUser(user); err != nil {
+		return err
+	}
+	return r.CreateIdentity(identity)
+}
+
+func (r *memoryAuthRepo) CreateRefreshToken(token *domain.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *token
+	r.refresh[token.ID] = &copied
+	return nil
+}
+
+func (r *memoryAuthRepo) GetRefreshTokenByHash(hash string) (*domain.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.refresh {
+		if t.TokenHash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryAuthRepo) RotateRefreshToken(oldID uuid.UUID, next *domain.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old, ok := r.refresh[oldID]
+	if !ok || old.RevokedAt != nil {
+		return gorm.ErrRecordNotFound
+	}
+	now := time.Now()
+	old.RevokedAt = &now
+	copied := *next
+	r.refresh[next.ID] = &copied
+	return nil
+}
+
+func (r *memoryAuthRepo) RevokeRefreshFamily(familyID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, t := range r.refresh {
+		if t.FamilyID == familyID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (r *memoryAuthRepo) RevokeUserRefreshTokens(userID uuid.UUID) ([]uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	seen := make(map[uuid.UUID]bool)
+	var families []uuid.UUID
+	for _, t := range r.refresh {
+		if t.UserID == userID && t.RevokedAt == nil {
+			t.RevokedAt = &now
+			if !seen[t.FamilyID] {
+				seen[t.FamilyID] = true
+				families = append(families, t.FamilyID)
+			}
+		}
+	}
+	return families, nil
+}
+
+func (r *memoryAuthRepo) DeleteExpiredRefreshTokens(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, t := range r.refresh {
+		if t.ExpiresAt.Before(before) {
+			delete(r.refresh, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryAuthRepo) update(userID uuid.UUID, change func(u *domain.User) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[userID]
+	if !ok || !change(u) {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *memoryAuthRepo) SetTOTPSecret(userID uuid.UUID, secret string) error {
+	return r.update(userID, func(u *domain.User) bool {
+		u.TOTPSecret, u.TOTPLastStep = secret, 0
+		return true
+	})
+}
+
+func (r *memoryAuthRepo) EnableTOTP(userID uuid.UUID, codes []*domain.RecoveryCode) error {
+	return r.update(userID, func(u *domain.User) bool {
+		u.TOTPEnabled, r.recovery[userID] = true, codes
+		return true
+	})
+}
+
+func (r *memoryAuthRepo) DisableTOTP(userID uuid.UUID) error {
+	return r.update(userID, func(u *domain.User) bool {
+		u.TOTPEnabled, u.TOTPSecret, u.TOTPLastStep = false, "", 0
+		delete(r.recovery, userID)
+		return true
+	})
+}
+
+func (r *memoryAuthRepo) ReplaceRecoveryCodes(userID uuid.UUID, codes []*domain.RecoveryCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recovery[userID] = codes
+	return nil
+}
+
+func (r *memoryAuthRepo) UseRecoveryCode(userID uuid.UUID, hash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, code := range r.recovery[userID] {
+		if code.CodeHash == hash && code.UsedAt == nil {
+			now := time.Now()
+			code.UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryAuthRepo) AdvanceTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	advanced := false
+	err := r.update(userID, func(u *domain.User) bool {
+		if step > u.TOTPLastStep {
+			u.TOTPLastStep, advanced = step, true
+		}
+		return true
+	})
+	return advanced, err
+}
+
+func (r *memoryAuthRepo) VerifyEmail(userID uuid.UUID, email string) error {
+	return r.update(userID, func(u *domain.User) bool {
+		if u.Email != email || u.EmailVerified {
+			return false
+		}
+		u.EmailVerified = true
+		return true
+	})
+}
+
+func (r *memoryAuthRepo) ResetPassword(userID uuid.UUID, current, next string) error {
+	return r.update(userID, func(u *domain.User) bool {
+		if u.Password != current {
+			return false
+		}
+		u.Password, u.EmailVerified = next, true
+		return true
+	})
+}
+
+func (r *memoryAuthRepo) GetSettings() (*domain.Settings, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.settings == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *r.settings
+	return &copied, nil
+}
+
+func (r *memoryAuthRepo) SaveSettings(settings *domain.Settings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *settings
+	r.settings = &copied
+	return nil
+}
@@ -1,125 +1,610 @@
 package usecase
 
 import (
+	"encoding/json"
 	"errors"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/collab-platform/backend/internal/crdt"
 	"github.com/collab-platform/backend/internal/domain"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 var (
 	ErrInvalidOperation = errors.New("invalid operation")
 	ErrConflict         = errors.New("operation conflict")
+	ErrReadOnly         = errors.New("read-only access")
+	ErrStaleVersion     = errors.New("base version is no longer available")
+	ErrStaleWrite       = errors.New("document was modified concurrently")
 )
 
 type CollaborationRepository interface {
 	GetDocumentByID(id uuid.UUID) (*domain.Document, error)
 	UpdateDocument(doc *domain.Document) error
-	GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error)
 	CreateActivity(activity *domain.Activity) error
+	// CommitOperations saves doc's content and version, appends ops to its
+	// operation log and records their RequestIDs in one transaction. It fails
+	// with ErrStaleWrite unless the stored version is still baseVersion, and
+	// with ErrDuplicateOperation if one of the RequestIDs is already recorded.
+	CommitOperations(doc *domain.Document, baseVersion int64, ops []domain.Operation) error
+	GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error)
+	GetOperationsByRequestID(docID, requestID uuid.UUID) ([]*domain.Operation, error)
+	GetOperationRequest(docID, requestID uuid.UUID) (*domain.OperationRequest, error)
+	// DeleteOperationRequests forgets request IDs committed before before
+	DeleteOperationRequests(before time.Time) (int64, error)
+	// SeedState stores doc.CRDTState as the state at doc.SnapshotVersion for a
+	// document that has none yet and is still at that version
+	SeedState(doc *domain.Document) error
+	// CreateSnapshot stores doc's CRDT state as of version.Version along with
+	// the version row, unless a newer snapshot already exists
+	CreateSnapshot(doc *domain.Document, version *domain.DocumentVersion) error
+	GetDocumentsPendingSnapshot(updatedBefore time.Time) ([]*domain.Document, error)
+	// DeleteOperationsBeforeSnapshot prunes log entries more than retain
+	// versions older than each document's snapshot
+	DeleteOperationsBeforeSnapshot(retain int64) (int64, error)
+	// GetUndoHistory returns userID's undo history for a document, or
+	// gorm.ErrRecordNotFound if they have none
+	GetUndoHistory(docID, userID uuid.UUID) (*domain.UndoHistory, error)
+	// SaveUndoHistory stores history and bumps its Revision. It fails with
+	// ErrStaleWrite unless the stored revision is still history.Revision, 0
+	// meaning none is stored yet.
+	SaveUndoHistory(history *domain.UndoHistory) error
+	// DeleteUndoHistories forgets histories last saved before before
+	DeleteUndoHistories(before time.Time) (int64, error)
 }
 
 type CollaborationUsecase struct {
-	repo CollaborationRepository
+	repo   CollaborationRepository
+	access *AccessPolicy
+	policy SnapshotPolicy
+	locks  sync.Map // document ID -> *sync.Mutex
 }
 
-func NewCollaborationUsecase(repo CollaborationRepository) *CollaborationUsecase {
-	return &CollaborationUsecase{repo: repo}
+func NewCollaborationUsecase(repo CollaborationRepository, access *AccessPolicy, policy SnapshotPolicy) *CollaborationUsecase {
+	return &CollaborationUsecase{repo: repo, access: access, policy: policy}
 }
 
-// ApplyOperation applies a CRDT-based operation to a document
-func (c *CollaborationUsecase) ApplyOperation(userID, docID uuid.UUID, op domain.Operation) (*domain.Document, error) {
+// maxCommitAttempts bounds retries when another node commits to the same
+// document between our read and our write
+const maxCommitAttempts = 3
+
+// ApplyOperation applies a CRDT-based operation to a document and returns the
+// document together with the operations that were committed for it.
+//
+// Position-addressed operations that carry a BaseVersion are first transformed
+// against every operation committed since that version. A single incoming
+// operation can commit as several (a delete split by a concurrent insert) or
+// as none (a delete of text someone else already removed). Each committed
+// operation gets its own document version and carries both element IDs and
+// positions relative to the version before it.
+//
+// Resending an operation ID that was already committed returns a
+// *DuplicateOperationError describing the original commit instead of
+// applying it again.
+func (c *CollaborationUsecase) ApplyOperation(userID, docID uuid.UUID, op domain.Operation) (*domain.Document, []domain.Operation, error) {
+	if err := validateOperation(op); err != nil {
+		return nil, nil, err
+	}
+
 	// Check permission
-	perm, err := c.repo.GetPermission(userID, docID)
+	if _, _, err := c.access.Authorize(userID, docID, ActionEdit); err != nil {
+		return nil, nil, err
+	}
+
+	op.UserID = userID
+	op.DocumentID = docID
+	if op.ID == uuid.Nil {
+		op.ID = uuid.New()
+	}
+
+	// Operations on one document are applied one at a time on this node;
+	// CommitOperations catches writers on other nodes
+	lock := c.documentLock(docID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// A client that lost its connection before the ack resends the same ID
+	if err := c.findDuplicate(docID, op.ID); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		doc       *domain.Document
+		committed []domain.Operation
+		err       error
+	)
+	for attempt := 0; ; attempt++ {
+		doc, committed, err = c.commit(docID, op)
+		if !errors.Is(err, ErrStaleWrite) || attempt+1 >= maxCommitAttempts {
+			break
+		}
+	}
+	if errors.Is(err, ErrDuplicateOperation) {
+		// Another node committed the same operation in the meantime
+		if dup := c.findDuplicate(docID, op.ID); dup != nil {
+			return nil, nil, dup
+		}
+	}
 	if err != nil {
-		return nil, errors.New("permission denied")
+		return nil, nil, err
 	}
 
-	if !perm.Role.CanEdit() {
-		return nil, errors.New("read-only access")
+	if len(committed) > 0 {
+		// Undo covers text; whiteboard changes are taken back with further operations
+		if len(op.Shapes) == 0 {
+			c.record(docID, userID, committed)
+		}
+
+		// Log activity
+		activity := &domain.Activity{
+			ID:         uuid.New(),
+			DocumentID: docID,
+			UserID:     userID,
+			GuestName:  c.access.guestName(userID, docID),
+			Action:     "edit",
+			Details:    op.Type,
+			CreatedAt:  time.Now(),
+		}
+		c.repo.CreateActivity(activity)
 	}
 
+	return doc, committed, nil
+}
+
+// commit rebases op onto the latest document version, integrates it and
+// persists the document together with the resulting log entries. Whiteboard
+// operations go through commitBoard.
+func (c *CollaborationUsecase) commit(docID uuid.UUID, op domain.Operation) (*domain.Document, []domain.Operation, error) {
 	doc, err := c.repo.GetDocumentByID(docID)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrDocumentNotFound
+		}
+		return nil, nil, err
+	}
+	if len(op.Shapes) > 0 {
+		return c.commitBoard(doc, op)
+	}
+
+	seq, err := c.loadState(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	missed, err := c.missedSince(doc, op)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Rune and byte offsets count into the text the client saw
+	op, err = normalizePositions(textBefore(seq, missed), op)
+	if err != nil {
+		return nil, nil, err
 	}
+	pending := c.rebase(op, missed)
 
-	// Apply CRDT operation
-	newContent := c.applyCRDTOperation(doc.Content, op)
-	doc.Content = newContent
-	doc.Version++
+	seed, err := seedState(doc, seq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var committed []domain.Operation
+	for len(pending) > 0 {
+		piece := pending[0]
+		pending = pending[1:]
+
+		applied, err := c.applyCRDTOperation(seq, piece)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, a := range applied {
+			a.ID = uuid.New()
+			a.RequestID = op.ID
+			a.Version = doc.Version + int64(len(committed)) + 1
+			a.VectorClock = tick(doc, a.UserID)
+			a.CreatedAt = time.Now()
+			committed = append(committed, a)
+
+			// The remaining pieces were positioned against the state before a
+			var rest []domain.Operation
+			for _, p := range pending {
+				rest = append(rest, c.TransformOperation(p, a)...)
+			}
+			pending = rest
+		}
+	}
+
+	if len(committed) == 0 {
+		return doc, nil, nil
+	}
+	if err := c.save(doc, seq, seed, committed); err != nil {
+		return nil, nil, err
+	}
+	return doc, committed, nil
+}
+
+// seedState returns the state to pin for a document that has no snapshot yet.
+// Such a document is rebuilt from its content, which stops describing the
+// starting state once operations are logged on top of it.
+func seedState(doc *domain.Document, state replica) ([]byte, error) {
+	if len(doc.CRDTState) != 0 {
+		return nil, nil
+	}
+	return json.Marshal(state)
+}
+
+// save persists the operations committed on top of doc, whose state is now
+// state, and snapshots the document when the policy says so
+func (c *CollaborationUsecase) save(doc *domain.Document, state replica, seed []byte, committed []domain.Operation) error {
+	baseVersion := doc.Version
+	if seed != nil {
+		doc.CRDTState = seed
+		doc.SnapshotVersion = baseVersion
+		if err := c.repo.SeedState(doc); err != nil {
+			return err
+		}
+	}
+
+	doc.Content = state.Text()
+	doc.Version += int64(len(committed))
 	doc.UpdatedAt = time.Now()
 
-	if err := c.repo.UpdateDocument(doc); err != nil {
+	if err := c.repo.CommitOperations(doc, baseVersion, committed); err != nil {
+		return err
+	}
+
+	if c.snapshotDue(doc) {
+		// A failed snapshot only means the next load replays a longer tail
+		c.snapshot(doc, state, committed[len(committed)-1].UserID)
+	}
+	return nil
+}
+
+// tick advances doc's vector clock for an operation committed by userID and
+// returns the new clock. Each tick allocates a fresh map, so the result can
+// be stamped on the operation as is.
+func tick(doc *domain.Document, userID uuid.UUID) map[uuid.UUID]int64 {
+	clock := make(map[uuid.UUID]int64, len(doc.VectorClock)+1)
+	for site, n := range doc.VectorClock {
+		clock[site] = n
+	}
+	clock[userID]++
+	doc.VectorClock = clock
+	return clock
+}
+
+// missedSince returns the operations committed after the version a
+// position-addressed operation was written against. ID-addressed operations
+// need no rebasing: element IDs do not move when other text changes, unless
+// a REST update has re-seeded the state since, reusing them for new text.
+func (c *CollaborationUsecase) missedSince(doc *domain.Document, op domain.Operation) ([]domain.Operation, error) {
+	if op.BaseVersion == nil {
+		return nil, nil
+	}
+
+	base := *op.BaseVersion
+	if base < 0 || base > doc.Version {
+		return nil, ErrInvalidOperation
+	}
+	if base < doc.ResetVersion {
+		return nil, ErrStaleVersion
+	}
+	if base == doc.Version || isIDAddressed(op) {
+		return nil, nil
+	}
+
+	since, err := c.repo.GetOperationsSince(doc.ID, base)
+	if err != nil {
 		return nil, err
 	}
+	// Every version since base must be in the log, otherwise something
+	// (a REST update, say) changed the document in a way we cannot transform
+	missed, ok := contiguousFrom(base, since)
+	if !ok || missed[len(missed)-1].Version < doc.Version {
+		return nil, ErrStaleVersion
+	}
+	return missed[:doc.Version-base], nil
+}
+
+// rebase transforms a position-addressed operation, in UTF-16 units, against
+// the operations committed since it was written so it applies to the current
+// version
+func (c *CollaborationUsecase) rebase(op domain.Operation, missed []domain.Operation) []domain.Operation {
+	pieces := []domain.Operation{op}
+	for _, m := range missed {
+		var next []domain.Operation
+		for _, p := range pieces {
+			next = append(next, c.TransformOperation(p, m)...)
+		}
+		pieces = next
+	}
+	return pieces
+}
 
-	// Log activity
-	activity := &domain.Activity{
-		ID:         uuid.New(),
-		DocumentID: docID,
-		UserID:     userID,
-		Action:     "edit",
-		Details:    op.Type,
-		CreatedAt:  time.Now(),
+// textBefore is seq's text as it was before the missed operations were
+// committed: what they inserted is left out and what they deleted kept
+func textBefore(seq *crdt.Sequence, missed []domain.Operation) string {
+	if len(missed) == 0 {
+		return seq.Text()
+	}
+	inserted := make(map[domain.ElementID]bool)
+	deleted := make(map[domain.ElementID]bool)
+	for _, m := range missed {
+		switch m.Type {
+		case "insert":
+			for i := 0; i < utf8.RuneCountInString(m.Content); i++ {
+				inserted[domain.ElementID{Clock: m.Timestamp + int64(i), Site: m.UserID}] = true
+			}
+		case "delete":
+			for _, id := range m.Targets {
+				deleted[id] = true
+			}
+		}
 	}
-	c.repo.CreateActivity(activity)
+	_, text := seq.View(
+		func(id domain.ElementID) bool { return inserted[id] },
+		func(id domain.ElementID) bool { return deleted[id] },
+	)
+	return text
+}
+
+func (c *CollaborationUsecase) documentLock(docID uuid.UUID) *sync.Mutex {
+	lock, _ := c.locks.LoadOrStore(docID, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
 
-	return doc, nil
+func isIDAddressed(op domain.Operation) bool {
+	return op.Origin != nil || len(op.Targets) > 0
 }
 
-// applyCRDTOperation applies a CRDT operation to content
-// This is a simplified CRDT implementation - in production, you'd use a more sophisticated approach
-func (c *CollaborationUsecase) applyCRDTOperation(content string, op domain.Operation) string {
+// validateOperation rejects malformed operations before they touch a document
+func validateOperation(op domain.Operation) error {
+	if len(op.Shapes) > 0 {
+		return validateBoardOperation(op)
+	}
+	if op.Position < 0 || !validUnit(op.Unit) {
+		return ErrInvalidOperation
+	}
 	switch op.Type {
 	case "insert":
-		if op.Position < 0 {
-			op.Position = 0
+		if op.Content == "" {
+			return ErrInvalidOperation
 		}
-		if op.Position > len(content) {
-			op.Position = len(content)
-		}
-		return content[:op.Position] + op.Content + content[op.Position:]
 	case "delete":
-		if op.Position < 0 || op.Position >= len(content) {
-			return content
+		if op.Length <= 0 && len(op.Targets) == 0 {
+			return ErrInvalidOperation
 		}
-		end := op.Position + op.Length
-		if end > len(content) {
-			end = len(content)
+	case "format":
+		if op.Length <= 0 && len(op.Targets) != 2 {
+			return ErrInvalidOperation
+		}
+		if len(op.Attributes) == 0 {
+			return ErrInvalidOperation
+		}
+		for key, value := range op.Attributes {
+			if !validAttribute(key, value) {
+				return ErrInvalidOperation
+			}
 		}
-		return content[:op.Position] + content[end:]
 	default:
-		return content
+		return ErrInvalidOperation
 	}
+	return nil
 }
 
-// TransformOperation transforms an operation against another operation (OT-like)
-func (c *CollaborationUsecase) TransformOperation(op1, op2 domain.Operation) domain.Operation {
-	// Simplified OT - in production, use proper OT algorithm
-	if op1.Type == "insert" && op2.Type == "insert" {
-		if op1.Position <= op2.Position {
-			// op1 happens before op2, no change needed
-			return op1
-		} else {
-			// op1 happens after op2, adjust position
-			op1.Position += len(op2.Content)
-			return op1
-		}
+// validAttribute checks a formatting attribute; a nil value clears it
+func validAttribute(key string, value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch key {
+	case "bold", "italic", "underline", "strike", "code":
+		_, ok := value.(bool)
+		return ok
+	case "link", "color", "background":
+		s, ok := value.(string)
+		return ok && s != ""
+	case "heading":
+		level, ok := value.(float64)
+		return ok && level >= 1 && level <= 6 && level == float64(int(level))
 	}
+	return false
+}
+
+// applyCRDTOperation integrates op into seq and returns the operations it
+// committed as, each carrying element IDs and its UTF-16 position in the state
+// just before it. Position-addressed operations (already in UTF-16 units) are
+// resolved to element IDs and stamped with the next Lamport clock; an
+// ID-addressed delete whose targets are no longer adjacent commits as one
+// delete per run, last run first.
+func (c *CollaborationUsecase) applyCRDTOperation(seq *crdt.Sequence, op domain.Operation) ([]domain.Operation, error) {
+	text := seq.Text()
 
-	if op1.Type == "insert" && op2.Type == "delete" {
-		if op1.Position <= op2.Position {
-			return op1
-		} else if op1.Position > op2.Position+op2.Length {
-			op1.Position -= op2.Length
-			return op1
+	switch op.Type {
+	case "insert":
+		if op.Origin == nil {
+			pos, err := toRuneOffset(text, op.Position, op.Unit)
+			if err != nil {
+				return nil, err
+			}
+			origin := seq.OriginAt(pos)
+			op.Origin = &origin
+			op.Timestamp = seq.Clock() + 1
+		} else if !seq.HasElement(*op.Origin) {
+			return nil, ErrInvalidOperation
 		}
-		// Conflict case - simplified handling
-		return op1
+		if err := integrate(seq, op); err != nil {
+			return nil, err
+		}
+		pos, _ := seq.PositionOf(domain.ElementID{Clock: op.Timestamp, Site: op.UserID})
+		op.Position = fromRuneOffset(text, pos, domain.UnitUTF16)
+		op.Length = textLength(op.Content, domain.UnitUTF16)
+		op.Unit = domain.UnitUTF16
+		return []domain.Operation{op}, nil
+
+	case "delete":
+		if len(op.Targets) == 0 {
+			start, n, err := toRuneRange(text, op.Position, op.Length, op.Unit)
+			if err != nil {
+				return nil, err
+			}
+			op.Targets = seq.IDsInRange(start, n)
+			if len(op.Targets) == 0 {
+				return nil, ErrInvalidOperation
+			}
+			op.Timestamp = seq.Clock() + 1
+			if err := integrate(seq, op); err != nil {
+				return nil, err
+			}
+			return []domain.Operation{withUTF16Range(op, text, start, n)}, nil
+		}
+
+		for _, id := range op.Targets {
+			if !seq.HasElement(id) {
+				return nil, ErrInvalidOperation
+			}
+		}
+		// Deleting the last run first keeps the earlier runs' positions valid
+		spans := seq.VisibleSpans(op.Targets)
+		applied := make([]domain.Operation, 0, len(spans))
+		for i := len(spans) - 1; i >= 0; i-- {
+			piece := op
+			piece.Targets = spans[i].IDs
+			if err := integrate(seq, piece); err != nil {
+				return nil, err
+			}
+			applied = append(applied, withUTF16Range(piece, text, spans[i].Position, len(spans[i].IDs)))
+		}
+		return applied, nil
+
+	case "format":
+		if len(op.Targets) == 0 {
+			start, n, err := toRuneRange(text, op.Position, op.Length, op.Unit)
+			if err != nil {
+				return nil, err
+			}
+			ids := seq.IDsInRange(start, n)
+			if len(ids) == 0 {
+				return nil, ErrInvalidOperation
+			}
+			op.Targets = []domain.ElementID{ids[0], ids[len(ids)-1]}
+			op.Timestamp = seq.Clock() + 1
+		}
+		start, n, ok := seq.RangeOf(op.Targets[0], op.Targets[1])
+		if !ok {
+			return nil, ErrInvalidOperation
+		}
+		if err := integrate(seq, op); err != nil {
+			return nil, err
+		}
+		return []domain.Operation{withUTF16Range(op, text, start, n)}, nil
 	}
+	return nil, ErrInvalidOperation
+}
 
-	return op1
+func integrate(seq *crdt.Sequence, op domain.Operation) error {
+	err := seq.Integrate(op)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, crdt.ErrDuplicateElement):
+		return ErrConflict
+	case errors.Is(err, crdt.ErrInvalidClock), errors.Is(err, crdt.ErrMissingDependency), errors.Is(err, crdt.ErrUnsupportedOp):
+		return ErrInvalidOperation
+	}
+	return err
 }
 
+// TransformOperation transforms op so that it applies after against, where
+// both were written against the same document state and count positions in
+// the same unit. When two inserts land at the same offset the one already committed
+// (against) goes first. A delete can split in two around an insert that landed
+// inside its range, or vanish when against already removed the same text; a
+// format range grows and shrinks with the text inside it.
+func (c *CollaborationUsecase) TransformOperation(op, against domain.Operation) []domain.Operation {
+	switch {
+	case op.Type == "insert" && against.Type == "insert":
+		if against.Position <= op.Position {
+			op.Position += textLength(against.Content, against.Unit)
+		}
+		return []domain.Operation{op}
+
+	case op.Type == "insert" && against.Type == "delete":
+		end := against.Position + against.Length
+		if op.Position >= end {
+			op.Position -= against.Length
+		} else if op.Position > against.Position {
+			// The surrounding text is gone; keep the insert where it was
+			op.Position = against.Position
+		}
+		return []domain.Operation{op}
+
+	case op.Type == "delete" && against.Type == "insert":
+		inserted := textLength(against.Content, against.Unit)
+		end := op.Position + op.Length
+		if against.Position <= op.Position {
+			op.Position += inserted
+			return []domain.Operation{op}
+		}
+		if against.Position >= end {
+			return []domain.Operation{op}
+		}
+		// The insert landed inside the deleted range: delete around it
+		left, right := op, op
+		left.Length = against.Position - op.Position
+		right.Position = against.Position + inserted
+		right.Length = end - against.Position
+		return []domain.Operation{left, right}
+
+	case op.Type == "delete" && against.Type == "delete":
+		end, againstEnd := op.Position+op.Length, against.Position+against.Length
+		if end <= against.Position {
+			return []domain.Operation{op}
+		}
+		if op.Position >= againstEnd {
+			op.Position -= against.Length
+			return []domain.Operation{op}
+		}
+		overlap := min(end, againstEnd) - max(op.Position, against.Position)
+		op.Length -= overlap
+		op.Position = min(op.Position, against.Position)
+		if op.Length == 0 {
+			return nil
+		}
+		return []domain.Operation{op}
+
+	case op.Type == "format" && against.Type == "insert":
+		// Text typed inside a formatted range takes on the formatting
+		inserted := textLength(against.Content, against.Unit)
+		if against.Position <= op.Position {
+			op.Position += inserted
+		} else if against.Position < op.Position+op.Length {
+			op.Length += inserted
+		}
+		return []domain.Operation{op}
+
+	case op.Type == "format" && against.Type == "delete":
+		end, againstEnd := op.Position+op.Length, against.Position+against.Length
+		if end <= against.Position {
+			return []domain.Operation{op}
+		}
+		if op.Position >= againstEnd {
+			op.Position -= against.Length
+			return []domain.Operation{op}
+		}
+		overlap := min(end, againstEnd) - max(op.Position, against.Position)
+		op.Length -= overlap
+		op.Position = min(op.Position, against.Position)
+		if op.Length == 0 {
+			return nil
+		}
+		return []domain.Operation{op}
+	}
+
+	// Formatting never moves text, so nothing is transformed against it
+	return []domain.Operation{op}
+}
@@ -0,0 +1,333 @@
+package usecase_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// collabFixture is a text document its owner and an editor work on together,
+// live and over REST
+type collabFixture struct {
+	repo      *memoryCollabRepo
+	docRepo   *memoryDocumentRepo
+	collab    *usecase.CollaborationUsecase
+	documents *usecase.DocumentUsecase
+	links     *usecase.LinkSessions
+	owner     uuid.UUID
+	editor    uuid.UUID
+	docID     uuid.UUID
+}
+
+func newCollabFixture(t *testing.T, content string) *collabFixture {
+	t.Helper()
+	return newCollabFixtureWithPolicy(t, content, usecase.DefaultSnapshotPolicy())
+}
+
+func newCollabFixtureWithPolicy(t *testing.T, content string, policy usecase.SnapshotPolicy) *collabFixture {
+	t.Helper()
+	repo := newMemoryCollabRepo()
+	f := &collabFixture{repo: repo, docRepo: newMemoryDocumentRepo(repo), owner: uuid.New(), editor: uuid.New()}
+	f.docID = repo.addDocument(f.owner, content).ID
+	repo.share(f.docID, f.editor, domain.RoleEditor)
+
+	f.links = usecase.NewLinkSessions(newMemoryLinkStore())
+	access := usecase.NewAccessPolicy(repo, f.links)
+	f.collab = usecase.NewCollaborationUsecase(repo, access, policy)
+	f.documents = usecase.NewDocumentUsecase(f.docRepo, access, usecase.SharingPolicy{})
+	return f
+}
+
+// apply commits op as userID and returns what it committed as
+func (f *collabFixture) apply(t *testing.T, userID uuid.UUID, op domain.Operation) []domain.Operation {
+	t.Helper()
+	_, committed, err := f.collab.ApplyOperation(userID, f.docID, op)
+	if err != nil {
+		t.Fatalf("apply %s at %d: %v", op.Type, op.Position, err)
+	}
+	return committed
+}
+
+func (f *collabFixture) content(t *testing.T) string {
+	t.Helper()
+	return f.repo.document(t, f.docID).Content
+}
+
+func base(version int64) *int64 {
+	return &version
+}
+
+func insert(pos int, content string) domain.Operation {
+	return domain.Operation{Type: "insert", Position: pos, Content: content}
+}
+
+func del(pos, length int) domain.Operation {
+	return domain.Operation{Type: "delete", Position: pos, Length: length}
+}
+
+func format(pos, length int) domain.Operation {
+	return domain.Operation{Type: "format", Position: pos, Length: length, Attributes: map[string]interface{}{"bold": true}}
+}
+
+// applyText applies the pieces one operation was transformed into to ASCII
+// text the way commit does: each later piece is transformed against the ones
+// before it
+func applyText(c *usecase.CollaborationUsecase, text string, ops ...domain.Operation) string {
+	for len(ops) > 0 {
+		op := ops[0]
+		ops = ops[1:]
+		switch op.Type {
+		case "insert":
+			text = text[:op.Position] + op.Content + text[op.Position:]
+		case "delete":
+			text = text[:op.Position] + text[op.Position+op.Length:]
+		}
+		var rest []domain.Operation
+		for _, p := range ops {
+			rest = append(rest, c.TransformOperation(p, op)...)
+		}
+		ops = rest
+	}
+	return text
+}
+
+func TestTransformOperation(t *testing.T) {
+	c := &usecase.CollaborationUsecase{}
+
+	// Both sides are written against "abcdefgh"
+	tests := []struct {
+		name    string
+		op      domain.Operation
+		against domain.Operation
+		want    []domain.Operation
+	}{
+		{"insert after insert", insert(5, "X"), insert(2, "YY"), []domain.Operation{insert(7, "X")}},
+		{"insert before insert", insert(1, "X"), insert(2, "YY"), []domain.Operation{insert(1, "X")}},
+		{"insert at the same offset goes second", insert(2, "X"), insert(2, "YY"), []domain.Operation{insert(4, "X")}},
+		{"insert after delete", insert(6, "X"), del(1, 3), []domain.Operation{insert(3, "X")}},
+		{"insert before delete", insert(1, "X"), del(2, 3), []domain.Operation{insert(1, "X")}},
+		{"insert inside delete", insert(3, "X"), del(2, 3), []domain.Operation{insert(2, "X")}},
+		{"insert at end of delete", insert(5, "X"), del(2, 3), []domain.Operation{insert(2, "X")}},
+		{"delete after insert", del(4, 2), insert(1, "YY"), []domain.Operation{del(6, 2)}},
+		{"delete before insert", del(1, 2), insert(3, "YY"), []domain.Operation{del(1, 2)}},
+		{"delete at insert offset", del(2, 2), insert(2, "YY"), []domain.Operation{del(4, 2)}},
+		{"insert inside delete splits it", del(1, 4), insert(3, "YY"), []domain.Operation{del(1, 2), del(5, 2)}},
+		{"delete after delete", del(5, 2), del(1, 2), []domain.Operation{del(3, 2)}},
+		{"delete before delete", del(0, 1), del(3, 2), []domain.Operation{del(0, 1)}},
+		{"delete overlapping the start", del(1, 3), del(2, 3), []domain.Operation{del(1, 1)}},
+		{"delete overlapping the end", del(3, 3), del(1, 3), []domain.Operation{del(1, 2)}},
+		{"delete around delete", del(1, 5), del(2, 2), []domain.Operation{del(1, 3)}},
+		{"delete inside delete", del(2, 2), del(1, 5), nil},
+		{"same delete", del(2, 3), del(2, 3), nil},
+		{"format after insert", format(3, 2), insert(1, "YY"), []domain.Operation{format(5, 2)}},
+		{"format around insert grows", format(1, 3), insert(2, "YY"), []domain.Operation{format(1, 5)}},
+		{"format before insert", format(1, 2), insert(3, "YY"), []domain.Operation{format(1, 2)}},
+		{"format after delete", format(5, 2), del(1, 2), []domain.Operation{format(3, 2)}},
+		{"format overlapping delete shrinks", format(1, 4), del(3, 3), []domain.Operation{format(1, 2)}},
+		{"format of deleted text", format(2, 2), del(1, 4), nil},
+		{"insert against format", insert(3, "X"), format(1, 4), []domain.Operation{insert(3, "X")}},
+		{"delete against format", del(1, 3), format(2, 4), []domain.Operation{del(1, 3)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := c.TransformOperation(tt.op, tt.against)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TransformOperation(%+v, %+v) = %+v, want %+v", tt.op, tt.against, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformOperationConverges(t *testing.T) {
+	c := &usecase.CollaborationUsecase{}
+	const text = "abcdefgh"
+
+	ops := []domain.Operation{
+		insert(0, "X"), insert(3, "YY"), insert(8, "Z"),
+		del(0, 2), del(1, 4), del(2, 3), del(3, 1), del(5, 3),
+	}
+	for _, a := range ops {
+		for _, b := range ops {
+			// Inserts at the same offset are ordered by which one commits
+			// first, so the two orders differ on purpose
+			if a.Type == "insert" && b.Type == "insert" && a.Position == b.Position {
+				continue
+			}
+			aFirst := applyText(c, applyText(c, text, a), c.TransformOperation(b, a)...)
+			bFirst := applyText(c, applyText(c, text, b), c.TransformOperation(a, b)...)
+			if aFirst != bFirst {
+				t.Errorf("%s(%d,%d,%q) then %s(%d,%d,%q): %q one way, %q the other",
+					a.Type, a.Position, a.Length, a.Content, b.Type, b.Position, b.Length, b.Content, aFirst, bFirst)
+			}
+		}
+	}
+}
+
+func TestApplyOperationRebasesOntoTheLog(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed []domain.Operation // Applied in turn at the current version
+		op        domain.Operation   // Written against version 0
+		want      string
+		pieces    int
+	}{
+		{
+			name:      "insert after a concurrent insert",
+			committed: []domain.Operation{insert(0, ">> ")},
+			op:        insert(5, ","),
+			want:      ">> hello, world",
+			pieces:    1,
+		},
+		{
+			name:      "delete after concurrent edits",
+			committed: []domain.Operation{insert(5, " there"), del(0, 1), insert(0, "H")},
+			op:        del(5, 6),
+			want:      "Hello there",
+			pieces:    1,
+		},
+		{
+			name:      "delete split by a concurrent insert",
+			committed: []domain.Operation{insert(8, "--")},
+			op:        del(5, 6),
+			want:      "hello--",
+			pieces:    2,
+		},
+		{
+			name:      "delete of text already deleted",
+			committed: []domain.Operation{del(4, 3)},
+			op:        del(5, 1),
+			want:      "hellorld",
+			pieces:    0,
+		},
+		{
+			name:      "format around a concurrent insert",
+			committed: []domain.Operation{insert(2, "y")},
+			op:        format(0, 5),
+			want:      "heyllo world",
+			pieces:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCollabFixture(t, "hello world")
+			for _, op := range tt.committed {
+				f.apply(t, f.owner, op)
+			}
+
+			op := tt.op
+			op.BaseVersion = base(0)
+			committed := f.apply(t, f.editor, op)
+			if len(committed) != tt.pieces {
+				t.Errorf("committed as %d operations, want %d: %+v", len(committed), tt.pieces, committed)
+			}
+			if got := f.content(t); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			for i, c := range committed {
+				if want := int64(len(tt.committed) + i + 1); c.Version != want {
+					t.Errorf("piece %d has version %d, want %d", i, c.Version, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyOperationRejectsBadBaseVersions(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	f.apply(t, f.owner, insert(5, "!"))
+
+	op := insert(0, "x")
+	op.BaseVersion = base(2)
+	if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, op); !errors.Is(err, usecase.ErrInvalidOperation) {
+		t.Errorf("base version from the future: err = %v, want ErrInvalidOperation", err)
+	}
+	op.BaseVersion = base(-1)
+	if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, op); !errors.Is(err, usecase.ErrInvalidOperation) {
+		t.Errorf("negative base version: err = %v, want ErrInvalidOperation", err)
+	}
+	if got := f.content(t); got != "hello!" {
+		t.Errorf("content = %q, want it unchanged", got)
+	}
+}
+
+func TestFormatReachesTheFetchedDelta(t *testing.T) {
+	bold := map[string]interface{}{"bold": true}
+	tests := []struct {
+		name      string
+		committed []domain.Operation // By the owner, before the format
+		format    domain.Operation   // By the editor, against version 0
+		want      []domain.DeltaOp
+	}{
+		{
+			name:   "format alone",
+			format: format(6, 5),
+			want:   []domain.DeltaOp{{Insert: "hello "}, {Insert: "world", Attributes: bold}},
+		},
+		{
+			name:      "concurrent insert inside the range",
+			committed: []domain.Operation{insert(8, "--")},
+			format:    format(6, 5),
+			want:      []domain.DeltaOp{{Insert: "hello "}, {Insert: "wo--rld", Attributes: bold}},
+		},
+		{
+			name:      "concurrent insert before the range",
+			committed: []domain.Operation{insert(0, ">> ")},
+			format:    format(6, 5),
+			want:      []domain.DeltaOp{{Insert: ">> hello "}, {Insert: "world", Attributes: bold}},
+		},
+		{
+			name:      "concurrent delete across the start",
+			committed: []domain.Operation{del(4, 4)},
+			format:    format(6, 5),
+			want:      []domain.DeltaOp{{Insert: "hell"}, {Insert: "rld", Attributes: bold}},
+		},
+		{
+			name:      "concurrent delete of the whole range",
+			committed: []domain.Operation{del(5, 6)},
+			format:    format(6, 5),
+			want:      []domain.DeltaOp{{Insert: "hello"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCollabFixture(t, "hello world")
+			for _, op := range tt.committed {
+				f.apply(t, f.owner, op)
+			}
+			op := tt.format
+			op.BaseVersion = base(0)
+			f.apply(t, f.editor, op)
+
+			doc, err := f.documents.GetDocument(f.owner, f.docID)
+			if err != nil {
+				t.Fatalf("get document: %v", err)
+			}
+			if !reflect.DeepEqual(doc.Delta, tt.want) {
+				t.Errorf("delta = %+v, want %+v", doc.Delta, tt.want)
+			}
+		})
+	}
+
+	t.Run("later edits inside the range are formatted", func(t *testing.T) {
+		f := newCollabFixture(t, "hello world")
+		f.apply(t, f.editor, format(6, 5))
+		f.apply(t, f.owner, insert(8, "--"))
+		f.apply(t, f.owner, del(10, 1))
+
+		doc, err := f.documents.GetDocument(f.editor, f.docID)
+		if err != nil {
+			t.Fatalf("get document: %v", err)
+		}
+		want := []domain.DeltaOp{{Insert: "hello "}, {Insert: "wo--ld", Attributes: bold}}
+		if !reflect.DeepEqual(doc.Delta, want) {
+			t.Errorf("delta = %+v, want %+v", doc.Delta, want)
+		}
+		if doc.Content != "hello wo--ld" {
+			t.Errorf("content = %q", doc.Content)
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package usecase_test
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type requestKey struct {
+	docID     uuid.UUID
+	requestID uuid.UUID
+}
+
+type historyKey struct {
+	docID  uuid.UUID
+	userID uuid.UUID
+}
+
+type permissionKey struct {
+	userID uuid.UUID
+	docID  uuid.UUID
+}
+
+// memoryCollabRepo is a CollaborationRepository, and the PolicyRepository
+// behind it, in maps. Like the Postgres one it commits a document and its
+// operations together, only if the document is still at the base version.
+type memoryCollabRepo struct {
+	mu          sync.Mutex
+	docs        map[uuid.UUID]*domain.Document
+	permissions map[permissionKey]*domain.DocumentPermission
+	ops         []*domain.Operation
+	requests    map[requestKey]*domain.OperationRequest
+	snapshots   []*domain.DocumentVersion
+	histories   map[historyKey]*domain.UndoHistory
+
+	// beforeCommit, if set, runs once at the start of the next commit, as
+	// another node racing it
+	beforeCommit func()
+}
+
+func newMemoryCollabRepo() *memoryCollabRepo {
+	return &memoryCollabRepo{
+		docs:        make(map[uuid.UUID]*domain.Document),
+		permissions: make(map[permissionKey]*domain.DocumentPermission),
+		requests:    make(map[requestKey]*domain.OperationRequest),
+		histories:   make(map[historyKey]*domain.UndoHistory),
+	}
+}
+
+var (
+	_ usecase.CollaborationRepository = (*memoryCollabRepo)(nil)
+	_ usecase.PolicyRepository        = (*memoryCollabRepo)(nil)
+)
+
+// addDocument stores a text document owned by ownerID
+func (r *memoryCollabRepo) addDocument(ownerID uuid.UUID, content string) *domain.Document {
+	doc := &domain.Document{
+		ID:         uuid.New(),
+		Title:      "Notes",
+		ShareToken: uuid.New().String(),
+		Content:    content,
+		Type:       domain.DocumentTypeText,
+		OwnerID:    ownerID,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *doc
+	r.docs[doc.ID] = &copied
+	return doc
+}
+
+// share gives userID a role on a document
+func (r *memoryCollabRepo) share(docID, userID uuid.UUID, role domain.Role) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.permissions[permissionKey{userID: userID, docID: docID}] = &domain.DocumentPermission{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     userID,
+		Role:       role,
+	}
+}
+
+// document returns the stored document as it is
+func (r *memoryCollabRepo) document(t *testing.T, docID uuid.UUID) *domain.Document {
+	t.Helper()
+	doc, err := r.GetDocumentByID(docID)
+	if err != nil {
+		t.Fatalf("load document: %v", err)
+	}
+	return doc
+}
+
+func (r *memoryCollabRepo) GetDocumentByID(id uuid.UUID) (*domain.Document, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	doc, ok := r.docs[id]
+	if !ok || doc.DeletedAt.Valid {
+		return &domain.Document{}, gorm.ErrRecordNotFound
+	}
+	copied := *doc
+	return &copied, nil
+}
+
+func (r *memoryCollabRepo) GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	perm, ok := r.permissions[permissionKey{userID: userID, docID: docID}]
+	if !ok {
+		return &domain.DocumentPermission{}, gorm.ErrRecordNotFound
+	}
+	copied := *perm
+	return &copied, nil
+}
+
+func (r *memoryCollabRepo) UpdateDocument(doc *domain.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *doc
+	r.docs[doc.ID] = &copied
+	return nil
+}
+
+func (r *memoryCollabRepo) CreateActivity(activity *domain.Activity) error {
+	return nil
+}
+
+func (r *memoryCollabRepo) CommitOperations(doc *domain.Document, baseVersion int64, ops []domain.Operation) error {
+	if race := r.beforeCommit; race != nil {
+		r.beforeCommit = nil
+		race()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.docs[doc.ID]
+	if !ok || stored.Version != baseVersion {
+		return usecase.ErrStaleWrite
+	}
+	for _, op := range ops {
+		if _, ok := r.requests[requestKey{docID: op.DocumentID, requestID: op.RequestID}]; ok {
+			return usecase.ErrDuplicateOperation
+		}
+	}
+
+	stored.Content = doc.Content
+	stored.Version = doc.Version
+	stored.VectorClock = doc.VectorClock
+	stored.UpdatedAt = doc.UpdatedAt
+	for i := range ops {
+		op := ops[i]
+		r.ops = append(r.ops, &op)
+		r.requests[requestKey{docID: op.DocumentID, requestID: op.RequestID}] = &domain.OperationRequest{
+			DocumentID: op.DocumentID,
+			RequestID:  op.RequestID,
+			Version:    op.Version,
+			CreatedAt:  op.CreatedAt,
+		}
+	}
+	return nil
+}
+
+// operations returns the stored operations of a document matching keep, in
+// version order
+func (r *memoryCollabRepo) operations(docID uuid.UUID, keep func(op *domain.Operation) bool) []*domain.Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ops []*domain.Operation
+	for _, op := range r.ops {
+		if op.DocumentID == docID && keep(op) {
+			copied := *op
+			ops = append(ops, &copied)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Version < ops[j].Version })
+	return ops
+}
+
+func (r *memoryCollabRepo) GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error) {
+	return r.operations(docID, func(op *domain.Operation) bool { return op.Version > version }), nil
+}
+
+func (r *memoryCollabRepo) GetOperationsByRequestID(docID, requestID uuid.UUID) ([]*domain.Operation, error) {
+	return r.operations(docID, func(op *domain.Operation) bool { return op.RequestID == requestID }), nil
+}
+
+func (r *memoryCollabRepo) GetOperationRequest(docID, requestID uuid.UUID) (*domain.OperationRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	request, ok := r.requests[requestKey{docID: docID, requestID: requestID}]
+	if !ok {
+		return &domain.OperationRequest{}, gorm.ErrRecordNotFound
+	}
+	copied := *request
+	return &copied, nil
+}
+
+func (r *memoryCollabRepo) DeleteOperationRequests(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for key, request := range r.requests {
+		if request.CreatedAt.Before(before) {
+			delete(r.requests, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryCollabRepo) SeedState(doc *domain.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.docs[doc.ID]
+	if ok && stored.Version == doc.SnapshotVersion && len(stored.CRDTState) == 0 {
+		stored.CRDTState = doc.CRDTState
+		stored.SnapshotVersion = doc.SnapshotVersion
+	}
+	return nil
+}
+
+func (r *memoryCollabRepo) CreateSnapshot(doc *domain.Document, version *domain.DocumentVersion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.docs[doc.ID]
+	if !ok || stored.SnapshotVersion >= version.Version {
+		return nil
+	}
+	stored.CRDTState = version.State
+	stored.SnapshotVersion = version.Version
+	stored.SnapshotAt = version.CreatedAt
+	r.snapshots = append(r.snapshots, version)
+	return nil
+}
+
+func (r *memoryCollabRepo) GetDocumentsPendingSnapshot(updatedBefore time.Time) ([]*domain.Document, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var docs []*domain.Document
+	for _, doc := range r.docs {
+		if doc.Version > doc.SnapshotVersion && doc.UpdatedAt.Before(updatedBefore) {
+			docs = append(docs, &domain.Document{ID: doc.ID})
+		}
+	}
+	return docs, nil
+}
+
+func (r *memoryCollabRepo) DeleteOperationsBeforeSnapshot(retain int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kept []*domain.Operation
+	for _, op := range r.ops {
+		if doc, ok := r.docs[op.DocumentID]; !ok || op.Version > doc.SnapshotVersion-retain {
+			kept = append(kept, op)
+		}
+	}
+	pruned := int64(len(r.ops) - len(kept))
+	r.ops = kept
+	return pruned, nil
+}
+
+func (r *memoryCollabRepo) GetUndoHistory(docID, userID uuid.UUID) (*domain.UndoHistory, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history, ok := r.histories[historyKey{docID: docID, userID: userID}]
+	if !ok {
+		return &domain.UndoHistory{}, gorm.ErrRecordNotFound
+	}
+	// As if decoded: pushing onto a loaded stack must not reach the stored one
+	copied := *history
+	copied.Undo = append([][]domain.Operation(nil), history.Undo...)
+	copied.Redo = append([][]domain.Operation(nil), history.Redo...)
+	return &copied, nil
+}
+
+func (r *memoryCollabRepo) SaveUndoHistory(history *domain.UndoHistory) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := historyKey{docID: history.DocumentID, userID: history.UserID}
+	var revision int64
+	if stored, ok := r.histories[key]; ok {
+		revision = stored.Revision
+	}
+	if revision != history.Revision {
+		return usecase.ErrStaleWrite
+	}
+	history.Revision++
+	copied := *history
+	r.histories[key] = &copied
+	return nil
+}
+
+func (r *memoryCollabRepo) DeleteUndoHistories(before time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for key, history := range r.histories {
+		if history.UpdatedAt.Before(before) {
+			delete(r.histories, key)
+			n++
+		}
+	}
+	return n, nil
+}
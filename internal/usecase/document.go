@@ -1,6 +1,8 @@
 package usecase
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -10,33 +12,64 @@ import (
 )
 
 var (
-	ErrDocumentNotFound   = errors.New("document not found")
-	ErrPermissionDenied   = errors.New("permission denied")
+	ErrDocumentNotFound    = errors.New("document not found")
+	ErrPermissionDenied    = errors.New("permission denied")
 	ErrInvalidDocumentType = errors.New("invalid document type")
+	ErrInvalidContent      = errors.New("content is not valid for this document type")
 )
 
 type DocumentRepository interface {
 	CreateDocument(doc *domain.Document) error
 	GetDocumentByID(id uuid.UUID) (*domain.Document, error)
-	UpdateDocument(doc *domain.Document) error
+	// UpdateDocument saves doc's title, content and state, failing with
+	// ErrStaleWrite unless the stored version is still baseVersion
+	UpdateDocument(doc *domain.Document, baseVersion int64) error
+	// DeleteDocument moves a document to the trash
 	DeleteDocument(id uuid.UUID) error
+	// GetTrashedDocument returns a document that is in the trash
+	GetTrashedDocument(id uuid.UUID) (*domain.Document, error)
+	GetTrashedDocuments(ownerID uuid.UUID) ([]*domain.Document, error)
+	GetDocumentByShareToken(token string) (*domain.Document, error)
+	// UpdateShareLink saves only doc's link sharing settings
+	UpdateShareLink(doc *domain.Document) error
+	RestoreDocument(id uuid.UUID) error
+	// PurgeDocuments permanently deletes documents trashed before
+	// trashedBefore, along with everything that belongs to them
+	PurgeDocuments(trashedBefore time.Time) (int64, error)
 	GetUserDocuments(userID uuid.UUID) ([]*domain.Document, error)
 	CreatePermission(perm *domain.DocumentPermission) error
 	GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error)
 	UpdatePermission(perm *domain.DocumentPermission) error
+	DeletePermission(docID, userID uuid.UUID) error
+	// GetDocumentPermissions lists a document's permissions with their users
 	GetDocumentPermissions(docID uuid.UUID) ([]*domain.DocumentPermission, error)
+	// TransferOwnership makes toUserID the document's owner and demotes
+	// fromUserID to editor in one transaction, creating the permission rows
+	// either is missing
+	TransferOwnership(docID, fromUserID, toUserID uuid.UUID) error
+	GetUserByID(id uuid.UUID) (*domain.User, error)
 	CreateVersion(version *domain.DocumentVersion) error
 	GetDocumentVersions(docID uuid.UUID, limit int) ([]*domain.DocumentVersion, error)
 	CreateActivity(activity *domain.Activity) error
 	GetDocumentActivities(docID uuid.UUID, limit int) ([]*domain.Activity, error)
+	GetOperationsSince(docID uuid.UUID, version int64) ([]*domain.Operation, error)
+}
+
+// SharingPolicy limits who can share documents
+type SharingPolicy struct {
+	// RequireVerifiedEmail keeps users who have not verified their email
+	// from sharing documents or being given access to them
+	RequireVerifiedEmail bool
 }
 
 type DocumentUsecase struct {
-	repo DocumentRepository
+	repo    DocumentRepository
+	access  *AccessPolicy
+	sharing SharingPolicy
 }
 
-func NewDocumentUsecase(repo DocumentRepository) *DocumentUsecase {
-	return &DocumentUsecase{repo: repo}
+func NewDocumentUsecase(repo DocumentRepository, access *AccessPolicy, sharing SharingPolicy) *DocumentUsecase {
+	return &DocumentUsecase{repo: repo, access: access, sharing: sharing}
 }
 
 func (d *DocumentUsecase) CreateDocument(userID uuid.UUID, title string, docType domain.DocumentType) (*domain.Document, error) {
@@ -90,54 +123,66 @@ func (d *DocumentUsecase) CreateDocument(userID uuid.UUID, title string, docType
 }
 
 func (d *DocumentUsecase) GetDocument(userID, docID uuid.UUID) (*domain.Document, error) {
-	doc, err := d.repo.GetDocumentByID(docID)
+	doc, _, err := d.access.Authorize(userID, docID, ActionView)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, ErrDocumentNotFound
-		}
 		return nil, err
 	}
 
-	// Check permission
-	perm, err := d.repo.GetPermission(userID, docID)
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+	state, err := d.loadState(doc)
+	if err != nil {
 		return nil, err
 	}
-
-	if perm == nil && !doc.IsPublic {
-		return nil, ErrPermissionDenied
-	}
+	render(doc, state)
 
 	return doc, nil
 }
 
 func (d *DocumentUsecase) UpdateDocument(userID, docID uuid.UUID, title, content string) (*domain.Document, error) {
-	doc, err := d.repo.GetDocumentByID(docID)
+	doc, _, err := d.access.Authorize(userID, docID, ActionEdit)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, ErrDocumentNotFound
-		}
 		return nil, err
 	}
 
-	// Check permission
-	perm, err := d.repo.GetPermission(userID, docID)
-	if err != nil {
-		return nil, ErrPermissionDenied
-	}
-
-	if !perm.Role.CanEdit() {
-		return nil, ErrPermissionDenied
+	// The REST update bumps the version without an operation, so the
+	// snapshot has to move up to the new version with it
+	var state []byte
+	if content == doc.Content {
+		current, err := d.loadState(doc)
+		if err != nil {
+			return nil, err
+		}
+		if state, err = json.Marshal(current); err != nil {
+			return nil, err
+		}
+	} else if doc.Type == domain.DocumentTypeWhiteboard {
+		if _, err := parseWhiteboard(content); err != nil {
+			return nil, ErrInvalidContent
+		}
 	}
+	// Otherwise the wholesale replacement restarts the collaborative sequence
+	// from the new text
 
+	// Operations committed since the read must not be written over
+	baseVersion := doc.Version
 	doc.Title = title
 	doc.Content = content
+	doc.CRDTState = state
 	doc.Version++
+	doc.SnapshotVersion = doc.Version
+	doc.SnapshotAt = time.Now()
 	doc.UpdatedAt = time.Now()
+	if state == nil {
+		doc.ResetVersion = doc.Version
+	}
 
-	if err := d.repo.UpdateDocument(doc); err != nil {
+	if err := d.repo.UpdateDocument(doc, baseVersion); err != nil {
 		return nil, err
 	}
+	// Live clients start over from what is returned, so fill in the same
+	// formatted view a fetch would
+	if current, err := loadSnapshot(doc); err == nil {
+		render(doc, current)
+	}
 
 	// Create version snapshot
 	version := &domain.DocumentVersion{
@@ -145,6 +190,7 @@ func (d *DocumentUsecase) UpdateDocument(userID, docID uuid.UUID, title, content
 		DocumentID: doc.ID,
 		Version:    doc.Version,
 		Content:    content,
+		State:      state,
 		CreatedBy:  userID,
 		CreatedAt:  time.Now(),
 	}
@@ -164,37 +210,128 @@ func (d *DocumentUsecase) UpdateDocument(userID, docID uuid.UUID, title, content
 	return doc, nil
 }
 
+// ShareDocument gives userID a role on a document ownerID owns. Sharing with
+// someone who already has access changes their role.
 func (d *DocumentUsecase) ShareDocument(ownerID, docID uuid.UUID, userID uuid.UUID, role domain.Role) error {
-	doc, err := d.repo.GetDocumentByID(docID)
+	_, err := d.grant(ownerID, docID, userID, role, true)
+	return err
+}
+
+// DeleteDocument moves a document to the trash, where its owner can restore
+// it until PurgeTrash removes it for good. Only the owner can delete it.
+func (d *DocumentUsecase) DeleteDocument(userID, docID uuid.UUID) error {
+	if _, _, err := d.access.Authorize(userID, docID, ActionAdmin); err != nil {
+		return err
+	}
+
+	if err := d.repo.DeleteDocument(docID); err != nil {
+		return err
+	}
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     userID,
+		Action:     "deleted",
+		Details:    "Document moved to trash",
+		CreatedAt:  time.Now(),
+	}
+	d.repo.CreateActivity(activity)
+
+	return nil
+}
+
+// GetTrash lists the documents userID owns that are in the trash, most
+// recently deleted first
+func (d *DocumentUsecase) GetTrash(userID uuid.UUID) ([]*domain.Document, error) {
+	return d.repo.GetTrashedDocuments(userID)
+}
+
+// RestoreDocument takes a document its owner deleted back out of the trash
+func (d *DocumentUsecase) RestoreDocument(userID, docID uuid.UUID) (*domain.Document, error) {
+	doc, err := d.repo.GetTrashedDocument(docID)
 	if err != nil {
-		return ErrDocumentNotFound
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDocumentNotFound
+		}
+		return nil, err
+	}
+	if doc.OwnerID != userID {
+		return nil, ErrPermissionDenied
 	}
 
-	if doc.OwnerID != ownerID {
-		return ErrPermissionDenied
+	if err := d.repo.RestoreDocument(docID); err != nil {
+		return nil, err
 	}
+	doc.DeletedAt = gorm.DeletedAt{}
 
-	perm := &domain.DocumentPermission{
+	activity := &domain.Activity{
 		ID:         uuid.New(),
 		DocumentID: docID,
 		UserID:     userID,
-		Role:       role,
+		Action:     "restored",
+		Details:    "Document restored from trash",
 		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
 	}
+	d.repo.CreateActivity(activity)
+
+	return doc, nil
+}
+
+// PurgeTrash permanently deletes documents that have been in the trash
+// since before cutoff, with their permissions, versions, activities,
+// operation logs and tasks
+func (d *DocumentUsecase) PurgeTrash(cutoff time.Time) (int64, error) {
+	return d.repo.PurgeDocuments(cutoff)
+}
+
+// RunTrashPurge purges documents that have been in the trash for longer than
+// retention every interval until ctx is cancelled
+func (d *DocumentUsecase) RunTrashPurge(ctx context.Context, interval, retention time.Duration, logf func(format string, args ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if purged, err := d.PurgeTrash(time.Now().Add(-retention)); err != nil {
+				logf("Trash purge failed: %v", err)
+			} else if purged > 0 {
+				logf("Purged %d documents from the trash", purged)
+			}
+		}
+	}
+}
 
-	return d.repo.CreatePermission(perm)
+// loadState rebuilds a document's current CRDT state from its snapshot and operation log
+func (d *DocumentUsecase) loadState(doc *domain.Document) (replica, error) {
+	tail, err := d.repo.GetOperationsSince(doc.ID, doc.SnapshotVersion)
+	if err != nil {
+		return nil, err
+	}
+	return restoreState(doc, tail)
 }
 
 func (d *DocumentUsecase) GetUserDocuments(userID uuid.UUID) ([]*domain.Document, error) {
 	return d.repo.GetUserDocuments(userID)
 }
 
-func (d *DocumentUsecase) GetDocumentVersions(docID uuid.UUID, limit int) ([]*domain.DocumentVersion, error) {
+// GetDocumentVersions returns a document's most recent versions to anyone
+// who can see it
+func (d *DocumentUsecase) GetDocumentVersions(userID, docID uuid.UUID, limit int) ([]*domain.DocumentVersion, error) {
+	if _, _, err := d.access.Authorize(userID, docID, ActionView); err != nil {
+		return nil, err
+	}
 	return d.repo.GetDocumentVersions(docID, limit)
 }
 
-func (d *DocumentUsecase) GetDocumentActivities(docID uuid.UUID, limit int) ([]*domain.Activity, error) {
+// GetDocumentActivities returns a document's most recent activity to anyone
+// who can see it
+func (d *DocumentUsecase) GetDocumentActivities(userID, docID uuid.UUID, limit int) ([]*domain.Activity, error) {
+	if _, _, err := d.access.Authorize(userID, docID, ActionView); err != nil {
+		return nil, err
+	}
 	return d.repo.GetDocumentActivities(docID, limit)
 }
-
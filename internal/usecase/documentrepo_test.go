@@ -0,0 +1,252 @@
+package usecase_test
+
+import (
+	"sort"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// memoryDocumentRepo is a DocumentRepository over the same tables as a
+// memoryCollabRepo, so REST changes and live edits see each other
+type memoryDocumentRepo struct {
+	*memoryCollabRepo
+	users    map[uuid.UUID]*domain.User
+	versions []*domain.DocumentVersion
+}
+
+func newMemoryDocumentRepo(tables *memoryCollabRepo) *memoryDocumentRepo {
+	return &memoryDocumentRepo{memoryCollabRepo: tables, users: make(map[uuid.UUID]*domain.User)}
+}
+
+var _ usecase.DocumentRepository = (*memoryDocumentRepo)(nil)
+
+// addUser stores a user with the given ID and returns the ID
+func (r *memoryDocumentRepo) addUser(id uuid.UUID, verified bool) uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.users[id] = &domain.User{ID: id, Username: id.String(), EmailVerified: verified}
+	return id
+}
+
+// change edits the stored document in place
+func (r *memoryDocumentRepo) change(docID uuid.UUID, edit func(doc *domain.Document)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	edit(r.docs[docID])
+}
+
+func (r *memoryDocumentRepo) CreateDocument(doc *domain.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *doc
+	r.docs[doc.ID] = &copied
+	return nil
+}
+
+func (r *memoryDocumentRepo) UpdateDocument(doc *domain.Document, baseVersion int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.docs[doc.ID]
+	if !ok || stored.DeletedAt.Valid || stored.Version != baseVersion {
+		return usecase.ErrStaleWrite
+	}
+	stored.Title = doc.Title
+	stored.Content = doc.Content
+	stored.CRDTState = doc.CRDTState
+	stored.Version = doc.Version
+	stored.SnapshotVersion = doc.SnapshotVersion
+	stored.SnapshotAt = doc.SnapshotAt
+	stored.ResetVersion = doc.ResetVersion
+	stored.UpdatedAt = doc.UpdatedAt
+	return nil
+}
+
+func (r *memoryDocumentRepo) DeleteDocument(id uuid.UUID) error {
+	r.change(id, func(doc *domain.Document) {
+		doc.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	})
+	return nil
+}
+
+func (r *memoryDocumentRepo) trashed(keep func(doc *domain.Document) bool) []*domain.Document {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var docs []*domain.Document
+	for _, doc := range r.docs {
+		if doc.DeletedAt.Valid && keep(doc) {
+			copied := *doc
+			docs = append(docs, &copied)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].DeletedAt.Time.After(docs[j].DeletedAt.Time) })
+	return docs
+}
+
+func (r *memoryDocumentRepo) GetTrashedDocument(id uuid.UUID) (*domain.Document, error) {
+	docs := r.trashed(func(doc *domain.Document) bool { return doc.ID == id })
+	if len(docs) == 0 {
+		return &domain.Document{}, gorm.ErrRecordNotFound
+	}
+	return docs[0], nil
+}
+
+func (r *memoryDocumentRepo) GetTrashedDocuments(ownerID uuid.UUID) ([]*domain.Document, error) {
+	return r.trashed(func(doc *domain.Document) bool { return doc.OwnerID == ownerID }), nil
+}
+
+func (r *memoryDocumentRepo) GetDocumentByShareToken(token string) (*domain.Document, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, doc := range r.docs {
+		if doc.ShareToken == token && !doc.DeletedAt.Valid {
+			copied := *doc
+			return &copied, nil
+		}
+	}
+	return &domain.Document{}, gorm.ErrRecordNotFound
+}
+
+func (r *memoryDocumentRepo) UpdateShareLink(doc *domain.Document) error {
+	r.change(doc.ID, func(stored *domain.Document) {
+		stored.IsPublic = doc.IsPublic
+		stored.ShareToken = doc.ShareToken
+		stored.ShareRole = doc.ShareRole
+		stored.ShareExpiresAt = doc.ShareExpiresAt
+		stored.SharePassword = doc.SharePassword
+	})
+	return nil
+}
+
+func (r *memoryDocumentRepo) RestoreDocument(id uuid.UUID) error {
+	r.change(id, func(doc *domain.Document) { doc.DeletedAt = gorm.DeletedAt{} })
+	return nil
+}
+
+func (r *memoryDocumentRepo) PurgeDocuments(trashedBefore time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for id, doc := range r.docs {
+		if doc.DeletedAt.Valid && doc.DeletedAt.Time.Before(trashedBefore) {
+			delete(r.docs, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *memoryDocumentRepo) GetUserDocuments(userID uuid.UUID) ([]*domain.Document, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var docs []*domain.Document
+	for _, doc := range r.docs {
+		_, shared := r.permissions[permissionKey{userID: userID, docID: doc.ID}]
+		if !doc.DeletedAt.Valid && (doc.OwnerID == userID || shared) {
+			copied := *doc
+			docs = append(docs, &copied)
+		}
+	}
+	return docs, nil
+}
+
+func (r *memoryDocumentRepo) CreatePermission(perm *domain.DocumentPermission) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := permissionKey{userID: perm.UserID, docID: perm.DocumentID}
+	if _, ok := r.permissions[key]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	copied := *perm
+	r.permissions[key] = &copied
+	return nil
+}
+
+func (r *memoryDocumentRepo) UpdatePermission(perm *domain.DocumentPermission) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *perm
+	r.permissions[permissionKey{userID: perm.UserID, docID: perm.DocumentID}] = &copied
+	return nil
+}
+
+func (r *memoryDocumentRepo) DeletePermission(docID, userID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.permissions, permissionKey{userID: userID, docID: docID})
+	return nil
+}
+
+func (r *memoryDocumentRepo) GetDocumentPermissions(docID uuid.UUID) ([]*domain.DocumentPermission, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var perms []*domain.DocumentPermission
+	for key, perm := range r.permissions {
+		if key.docID == docID {
+			copied := *perm
+			if user, ok := r.users[perm.UserID]; ok {
+				u := *user
+				copied.User = &u
+			}
+			perms = append(perms, &copied)
+		}
+	}
+	return perms, nil
+}
+
+func (r *memoryDocumentRepo) TransferOwnership(docID, fromUserID, toUserID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	doc, ok := r.docs[docID]
+	if !ok || doc.OwnerID != fromUserID {
+		return usecase.ErrPermissionDenied
+	}
+	doc.OwnerID = toUserID
+	roles := map[uuid.UUID]domain.Role{toUserID: domain.RoleOwner, fromUserID: domain.RoleEditor}
+	for userID, role := range roles {
+		key := permissionKey{userID: userID, docID: docID}
+		if perm, ok := r.permissions[key]; ok {
+			perm.Role = role
+			continue
+		}
+		r.permissions[key] = &domain.DocumentPermission{ID: uuid.New(), DocumentID: docID, UserID: userID, Role: role}
+	}
+	return nil
+}
+
+func (r *memoryDocumentRepo) GetUserByID(id uuid.UUID) (*domain.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok {
+		return &domain.User{}, gorm.ErrRecordNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (r *memoryDocumentRepo) CreateVersion(version *domain.DocumentVersion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.versions = append(r.versions, version)
+	return nil
+}
+
+func (r *memoryDocumentRepo) GetDocumentVersions(docID uuid.UUID, limit int) ([]*domain.DocumentVersion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var versions []*domain.DocumentVersion
+	for i := len(r.versions) - 1; i >= 0 && (limit <= 0 || len(versions) < limit); i-- {
+		if r.versions[i].DocumentID == docID {
+			versions = append(versions, r.versions[i])
+		}
+	}
+	return versions, nil
+}
+
+func (r *memoryDocumentRepo) GetDocumentActivities(docID uuid.UUID, limit int) ([]*domain.Activity, error) {
+	return nil, nil
+}
@@ -0,0 +1,360 @@
+package usecase
+
+import (
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms access tokens can be signed with
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown signing key")
+	ErrNoSigningKey      = errors.New("no active signing key")
+)
+
+// keyReloadInterval limits how often a token with an unknown kid can make
+// the key ring reload from the database
+const keyReloadInterval = 10 * time.Second
+
+// SigningKeyRepository stores the signing keys every node shares
+type SigningKeyRepository interface {
+	ListSigningKeys(now time.Time) ([]*domain.SigningKey, error)
+	CreateSigningKey(key *domain.SigningKey) error
+	DeleteExpiredSigningKeys(before time.Time) (int64, error)
+}
+
+// KeyPolicy controls the keys a KeyRing creates
+type KeyPolicy struct {
+	Algorithm string        // AlgorithmRS256 or AlgorithmEdDSA
+	Rotation  time.Duration // How long each key signs
+	// Overlap is how long a key is published before it starts signing and
+	// after it stops. It must be at least the access token lifetime.
+	Overlap time.Duration
+}
+
+// KeyRing signs access tokens with the current key and verifies them with
+// any published one. Keys are generated and rotated on schedule, stored in
+// the database so every node signs and verifies with the same set, and
+// encrypted there with the server secret.
+type KeyRing struct {
+	repo   SigningKeyRepository
+	policy KeyPolicy
+	aead   cipher.AEAD
+
+	mu         sync.RWMutex
+	keys       map[string]*loadedKey
+	signing    *loadedKey
+	lastReload time.Time
+}
+
+type loadedKey struct {
+	*domain.SigningKey
+	private crypto.Signer
+}
+
+func NewKeyRing(repo SigningKeyRepository, secret string, policy KeyPolicy) (*KeyRing, error) {
+	sum := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRing{repo: repo, policy: policy, aead: aead, keys: map[string]*loadedKey{}}, nil
+}
+
+// Rotate makes sure a key is signing now and the next one is published a
+// full overlap before it takes over, drops expired keys and reloads the set.
+// A key whose algorithm no longer matches the policy is replaced straight
+// away; it stays published until it expires.
+func (k *KeyRing) Rotate() error {
+	now := time.Now()
+	if _, err := k.repo.DeleteExpiredSigningKeys(now); err != nil {
+		return err
+	}
+	if err := k.reload(now); err != nil {
+		return err
+	}
+
+	k.mu.RLock()
+	signing := k.signing
+	var latest *loadedKey
+	for _, key := range k.keys {
+		if key.Algorithm == k.policy.Algorithm && (latest == nil || key.RetiresAt.After(latest.RetiresAt)) {
+			latest = key
+		}
+	}
+	k.mu.RUnlock()
+
+	created := false
+	if signing == nil || signing.Algorithm != k.policy.Algorithm {
+		key, err := k.create(now)
+		if err != nil {
+			return err
+		}
+		latest, created = key, true
+	}
+	if latest.RetiresAt.Sub(now) < k.policy.Overlap {
+		if _, err := k.create(latest.RetiresAt); err != nil {
+			return err
+		}
+		created = true
+	}
+	if created {
+		return k.reload(now)
+	}
+	return nil
+}
+
+// RunKeyRotation calls Rotate every interval until ctx is cancelled
+func (k *KeyRing) RunKeyRotation(ctx context.Context, interval time.Duration, logf func(format string, args ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Rotate(); err != nil {
+				logf("Signing key rotation failed: %v", err)
+			}
+		}
+	}
+}
+
+// Sign signs claims with the current key and names it in the kid header
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key, err := k.current()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// Parse verifies a token against the published key its kid names. The
+// token must use exactly that key's algorithm.
+func (k *KeyRing) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := k.lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+		}
+		return key.private.Public(), nil
+	}, jwt.WithValidMethods([]string{AlgorithmRS256, AlgorithmEdDSA}))
+}
+
+// JWKS returns the public keys of every published key, newest first
+func (k *KeyRing) JWKS() domain.JSONWebKeySet {
+	k.mu.RLock()
+	keys := make([]*loadedKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	k.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ActivatesAt.After(keys[j].ActivatesAt) })
+	set := domain.JSONWebKeySet{Keys: make([]domain.JSONWebKey, 0, len(keys))}
+	for _, key := range keys {
+		jwk := domain.JSONWebKey{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch pub := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// current is the key to sign with, rotating first if it has retired since
+// the last rotation
+func (k *KeyRing) current() (*loadedKey, error) {
+	now := time.Now()
+	k.mu.RLock()
+	key := k.signing
+	k.mu.RUnlock()
+	if key != nil && now.Before(key.RetiresAt) {
+		return key, nil
+	}
+
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.signing == nil {
+		return nil, ErrNoSigningKey
+	}
+	return k.signing, nil
+}
+
+// lookup finds a published key, reloading if another node may have created
+// it since the last reload
+func (k *KeyRing) lookup(kid string) (*loadedKey, error) {
+	now := time.Now()
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	stale := now.Sub(k.lastReload) >= keyReloadInterval
+	k.mu.RUnlock()
+
+	if !ok && kid != "" && stale {
+		if err := k.reload(now); err != nil {
+			return nil, err
+		}
+		k.mu.RLock()
+		key, ok = k.keys[kid]
+		k.mu.RUnlock()
+	}
+	if !ok || !now.Before(key.ExpiresAt) {
+		return nil, ErrUnknownSigningKey
+	}
+	return key, nil
+}
+
+// reload replaces the cached keys with the published ones in the database
+func (k *KeyRing) reload(now time.Time) error {
+	stored, err := k.repo.ListSigningKeys(now)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*loadedKey, len(stored))
+	var signing *loadedKey
+	for _, key := range stored {
+		private, err := k.decrypt(key.PrivateKey)
+		if err != nil {
+			// Encrypted with a previous secret; Rotate replaces it
+			continue
+		}
+		loaded := &loadedKey{SigningKey: key, private: private}
+		keys[key.ID] = loaded
+
+		// Nodes rotating at the same moment can both add a key; all of them
+		// pick the same one to sign with
+		if !now.Before(key.ActivatesAt) && now.Before(key.RetiresAt) &&
+			(signing == nil || key.ActivatesAt.After(signing.ActivatesAt) ||
+				(key.ActivatesAt.Equal(signing.ActivatesAt) && key.ID > signing.ID)) {
+			signing = loaded
+		}
+	}
+
+	k.mu.Lock()
+	k.keys, k.signing, k.lastReload = keys, signing, now
+	k.mu.Unlock()
+	return nil
+}
+
+// create generates and stores a key that signs from activatesAt on
+func (k *KeyRing) create(activatesAt time.Time) (*loadedKey, error) {
+	var private crypto.Signer
+	var err error
+	switch k.policy.Algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", k.policy.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := k.encrypt(private)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	retiresAt := activatesAt.Add(k.policy.Rotation)
+	key := &domain.SigningKey{
+		ID:          hex.EncodeToString(id),
+		Algorithm:   k.policy.Algorithm,
+		PrivateKey:  encrypted,
+		ActivatesAt: activatesAt,
+		RetiresAt:   retiresAt,
+		ExpiresAt:   retiresAt.Add(k.policy.Overlap),
+		CreatedAt:   time.Now(),
+	}
+	if err := k.repo.CreateSigningKey(key); err != nil {
+		return nil, err
+	}
+	return &loadedKey{SigningKey: key, private: private}, nil
+}
+
+func (k *KeyRing) encrypt(private crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(k.aead.Seal(nonce, nonce, der, nil)), nil
+}
+
+func (k *KeyRing) decrypt(encrypted string) (crypto.Signer, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < k.aead.NonceSize() {
+		return nil, errors.New("encrypted key is too short")
+	}
+	nonce, sealed := data[:k.aead.NonceSize()], data[k.aead.NonceSize():]
+	der, err := k.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	return signer, nil
+}
@@ -0,0 +1,250 @@
+package usecase_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// memoryKeyRepo is a SigningKeyRepository in a slice
+type memoryKeyRepo struct {
+	mu   sync.Mutex
+	keys []*domain.SigningKey
+}
+
+func (r *memoryKeyRepo) ListSigningKeys(now time.Time) ([]*domain.SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var live []*domain.SigningKey
+	for _, k := range r.keys {
+		if k.ExpiresAt.After(now) {
+			live = append(live, k)
+		}
+	}
+	return live, nil
+}
+
+func (r *memoryKeyRepo) CreateSigningKey(key *domain.SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append(r.keys, key)
+	return nil
+}
+
+func (r *memoryKeyRepo) DeleteExpiredSigningKeys(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// age moves every key's schedule d into the past, as if d had gone by
+func (r *memoryKeyRepo) age(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		k.ActivatesAt = k.ActivatesAt.Add(-d)
+		k.RetiresAt = k.RetiresAt.Add(-d)
+		k.ExpiresAt = k.ExpiresAt.Add(-d)
+	}
+}
+
+func newKeyRing(t *testing.T, repo *memoryKeyRepo, algorithm string) *usecase.KeyRing {
+	t.Helper()
+	keys, err := usecase.NewKeyRing(repo, "test secret", usecase.KeyPolicy{
+		Algorithm: algorithm,
+		Rotation:  24 * time.Hour,
+		Overlap:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("create key ring: %v", err)
+	}
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	return keys
+}
+
+func sign(t *testing.T, keys *usecase.KeyRing) string {
+	t.Helper()
+	token, err := keys.Sign(jwt.RegisteredClaims{
+		Subject:   "ada",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return token
+}
+
+// kid returns the key a token names, without verifying it
+func kid(t *testing.T, token string) string {
+	t.Helper()
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatalf("parse %q: %v", token, err)
+	}
+	id, _ := parsed.Header["kid"].(string)
+	return id
+}
+
+func verify(keys *usecase.KeyRing, token string) error {
+	_, err := keys.Parse(token, &jwt.RegisteredClaims{})
+	return err
+}
+
+func TestKeyRotationOverlap(t *testing.T) {
+	repo := &memoryKeyRepo{}
+	keys := newKeyRing(t, repo, usecase.AlgorithmEdDSA)
+	old := sign(t, keys)
+	if n := len(keys.JWKS().Keys); n != 1 {
+		t.Fatalf("%d keys published, want 1", n)
+	}
+
+	// Half an hour before the key retires, its successor is published
+	repo.age(23*time.Hour + 30*time.Minute)
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	jwks := keys.JWKS().Keys
+	if len(jwks) != 2 || jwks[1].KeyID != kid(t, old) {
+		t.Fatalf("published %+v, want the next key ahead of the current one", jwks)
+	}
+	if got := kid(t, sign(t, keys)); got != kid(t, old) {
+		t.Errorf("signed with %s before the current key retired", got)
+	}
+
+	// Half an hour after, the next key signs and the old one still verifies
+	repo.age(time.Hour)
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	current := sign(t, keys)
+	if kid(t, current) != jwks[0].KeyID {
+		t.Errorf("signed with %s, want the next key %s", kid(t, current), jwks[0].KeyID)
+	}
+	for name, token := range map[string]string{"old": old, "current": current} {
+		if err := verify(keys, token); err != nil {
+			t.Errorf("verify the %s token: %v", name, err)
+		}
+	}
+
+	// Once the overlap ends the old key is gone, even before the next
+	// rotation drops it
+	repo.age(time.Hour)
+	if err := verify(keys, old); !errors.Is(err, usecase.ErrUnknownSigningKey) {
+		t.Errorf("verify the old token: err = %v, want ErrUnknownSigningKey", err)
+	}
+	if err := verify(keys, current); err != nil {
+		t.Errorf("verify the current token: %v", err)
+	}
+	if err := keys.Rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if jwks := keys.JWKS().Keys; len(jwks) != 1 || jwks[0].KeyID != kid(t, current) {
+		t.Errorf("published %+v, want only the current key", jwks)
+	}
+}
+
+func TestKeyRingRejectsMismatchedTokens(t *testing.T) {
+	repo := &memoryKeyRepo{}
+	eddsa := newKeyRing(t, repo, usecase.AlgorithmEdDSA)
+	edToken := sign(t, eddsa)
+	// Switching algorithm replaces the signing key straight away; another
+	// node still verifies what the first one signed
+	rsaRing := newKeyRing(t, repo, usecase.AlgorithmRS256)
+	rsaToken := sign(t, rsaRing)
+	if kid(t, rsaToken) == kid(t, edToken) {
+		t.Fatalf("algorithm change kept the EdDSA key signing")
+	}
+	for name, token := range map[string]string{"EdDSA": edToken, "RS256": rsaToken} {
+		if err := verify(rsaRing, token); err != nil {
+			t.Errorf("verify the %s token: %v", name, err)
+		}
+	}
+
+	// An EdDSA token naming the RSA key, signed with a key of the attacker's
+	_, forger, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{Subject: "mallory"})
+	forged.Header["kid"] = kid(t, rsaToken)
+	signed, err := forged.SignedString(forger)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := verify(rsaRing, signed); !errors.Is(err, jwt.ErrTokenUnverifiable) {
+		t.Errorf("algorithm differing from the key's: err = %v, want ErrTokenUnverifiable", err)
+	}
+
+	forged.Header["kid"] = "unknown"
+	if signed, err = forged.SignedString(forger); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := verify(rsaRing, signed); !errors.Is(err, usecase.ErrUnknownSigningKey) {
+		t.Errorf("unknown kid: err = %v, want ErrUnknownSigningKey", err)
+	}
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "mallory"})
+	hmac.Header["kid"] = kid(t, rsaToken)
+	if signed, err = hmac.SignedString([]byte("test secret")); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if err := verify(rsaRing, signed); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("HS256: err = %v, want ErrTokenSignatureInvalid", err)
+	}
+}
+
+func TestJWKSVerifiesTokens(t *testing.T) {
+	repo := &memoryKeyRepo{}
+	edToken := sign(t, newKeyRing(t, repo, usecase.AlgorithmEdDSA))
+	keys := newKeyRing(t, repo, usecase.AlgorithmRS256)
+	rsaToken := sign(t, keys)
+
+	jwks := keys.JWKS().Keys
+	if len(jwks) != 2 {
+		t.Fatalf("published %+v, want both keys", jwks)
+	}
+	// Newest first
+	rsaKey, edKey := jwks[0], jwks[1]
+	if rsaKey.KeyID != kid(t, rsaToken) || edKey.KeyID != kid(t, edToken) {
+		t.Fatalf("published %s and %s, want %s then %s", rsaKey.KeyID, edKey.KeyID, kid(t, rsaToken), kid(t, edToken))
+	}
+	if rsaKey.KeyType != "RSA" || rsaKey.Algorithm != usecase.AlgorithmRS256 || rsaKey.Use != "sig" || rsaKey.Curve != "" || rsaKey.X != "" {
+		t.Errorf("RSA key = %+v", rsaKey)
+	}
+	if edKey.KeyType != "OKP" || edKey.Algorithm != usecase.AlgorithmEdDSA || edKey.Use != "sig" || edKey.Curve != "Ed25519" || edKey.N != "" || edKey.E != "" {
+		t.Errorf("Ed25519 key = %+v", edKey)
+	}
+
+	// Someone with only the published keys can verify the tokens
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode %q: %v", s, err)
+		}
+		return b
+	}
+	public := map[string]interface{}{
+		rsaKey.KeyID: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(decode(rsaKey.N)),
+			E: int(new(big.Int).SetBytes(decode(rsaKey.E)).Int64()),
+		},
+		edKey.KeyID: ed25519.PublicKey(decode(edKey.X)),
+	}
+	for _, token := range []string{rsaToken, edToken} {
+		_, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+			return public[token.Header["kid"].(string)], nil
+		})
+		if err != nil {
+			t.Errorf("verify %s against the JWKS: %v", kid(t, token), err)
+		}
+	}
+}
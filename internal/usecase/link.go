@@ -0,0 +1,317 @@
+package usecase
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrShareLinkNotFound     = errors.New("share link not found")
+	ErrShareLinkExpired      = errors.New("share link has expired")
+	ErrSharePasswordRequired = errors.New("share link password required or incorrect")
+	ErrInvalidShareLink      = errors.New("share link expiry must be in the future")
+	ErrInvalidGuestName      = errors.New("guest name must be at most 50 characters")
+)
+
+// maxGuestName bounds the display name guests pick, in characters
+const maxGuestName = 50
+
+// ShareLinkInput is how an owner sets up link sharing
+type ShareLinkInput struct {
+	Enabled   bool
+	Role      domain.Role // viewer, commenter or editor; unchanged when empty
+	ExpiresAt *time.Time  // nil for a link that does not expire
+	Password  *string     // nil leaves the password as it is, "" removes it
+}
+
+// LinkSessionStore keeps link sessions where every node can see them.
+// Sessions that are not saved again within their TTL disappear.
+type LinkSessionStore interface {
+	SaveLinkSession(session *domain.LinkSession, ttl time.Duration) error
+	RemoveLinkSession(session *domain.LinkSession) error
+	// ListLinkSessions returns userID's unexpired sessions on a document
+	ListLinkSessions(docID, userID uuid.UUID) ([]*domain.LinkSession, error)
+}
+
+// LinkSessionTTL is how long a link session outlives its last refresh; live
+// connections refresh theirs on every pong
+const LinkSessionTTL = PresenceTTL
+
+// LinkSessions keeps track of who came into a document through its share
+// link. The usecases on every node let the link's role stand in for a
+// permission for them, looking the link up again on every check, so that
+// disabling, rotating or expiring it, or changing its password, cuts them off.
+type LinkSessions struct {
+	store LinkSessionStore
+}
+
+// LinkSession is one connection's way into a document through its share link
+type LinkSession struct {
+	UserID     uuid.UUID
+	DocumentID uuid.UUID
+	GuestName  string // Empty for logged-in users
+
+	record domain.LinkSession
+	store  LinkSessionStore
+}
+
+func NewLinkSessions(store LinkSessionStore) *LinkSessions {
+	return &LinkSessions{store: store}
+}
+
+// join records that userID came into a document through doc's current link
+func (l *LinkSessions) join(userID uuid.UUID, doc *domain.Document, guestName string) (*LinkSession, error) {
+	session := &LinkSession{
+		UserID:     userID,
+		DocumentID: doc.ID,
+		GuestName:  guestName,
+		record: domain.LinkSession{
+			ID:         uuid.New(),
+			UserID:     userID,
+			DocumentID: doc.ID,
+			GuestName:  guestName,
+			Token:      doc.ShareToken,
+			Password:   doc.SharePassword,
+		},
+		store: l.store,
+	}
+	if err := l.store.SaveLinkSession(&session.record, LinkSessionTTL); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Refresh keeps the session from expiring while its connection is open
+func (s *LinkSession) Refresh() error {
+	return s.store.SaveLinkSession(&s.record, LinkSessionTTL)
+}
+
+// Leave ends the session when its connection closes
+func (s *LinkSession) Leave() error {
+	return s.store.RemoveLinkSession(&s.record)
+}
+
+// active returns userID's sessions on a document. It is safe to call on a
+// nil LinkSessions.
+func (l *LinkSessions) active(userID, docID uuid.UUID) ([]*domain.LinkSession, error) {
+	if l == nil {
+		return nil, nil
+	}
+	return l.store.ListLinkSessions(docID, userID)
+}
+
+// guestName is the name userID goes by on a document if they are a guest
+func (l *LinkSessions) guestName(userID, docID uuid.UUID) string {
+	sessions, _ := l.active(userID, docID)
+	for _, session := range sessions {
+		if session.GuestName != "" {
+			return session.GuestName
+		}
+	}
+	return ""
+}
+
+// checkShareLink reports whether token opens doc's share link right now
+func checkShareLink(doc *domain.Document, token string) error {
+	if token == "" || !doc.IsPublic || doc.ShareToken != token {
+		return ErrShareLinkNotFound
+	}
+	if doc.ShareExpiresAt != nil && !time.Now().Before(*doc.ShareExpiresAt) {
+		return ErrShareLinkExpired
+	}
+	return nil
+}
+
+// GetShareLink returns a document's link sharing settings, token included.
+// Only the owner can see them.
+func (d *DocumentUsecase) GetShareLink(ownerID, docID uuid.UUID) (*domain.ShareLink, error) {
+	doc, _, err := d.access.Authorize(ownerID, docID, ActionAdmin)
+	if err != nil {
+		return nil, err
+	}
+	return doc.ShareLink(), nil
+}
+
+// UpdateShareLink changes how a document's share link works. The token stays
+// the same; RotateShareToken replaces it.
+func (d *DocumentUsecase) UpdateShareLink(ownerID, docID uuid.UUID, input ShareLinkInput) (*domain.ShareLink, error) {
+	switch input.Role {
+	case "", domain.RoleViewer, domain.RoleCommenter, domain.RoleEditor:
+	default:
+		return nil, ErrInvalidRole
+	}
+	if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidShareLink
+	}
+
+	doc, _, err := d.access.Authorize(ownerID, docID, ActionAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if input.Enabled {
+		if err := d.checkCanShare(ownerID); err != nil {
+			return nil, err
+		}
+	}
+
+	doc.IsPublic = input.Enabled
+	if input.Role != "" {
+		doc.ShareRole = input.Role
+	}
+	doc.ShareExpiresAt = input.ExpiresAt
+	if input.Password != nil {
+		doc.SharePassword = ""
+		if *input.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(*input.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, err
+			}
+			doc.SharePassword = string(hash)
+		}
+	}
+	if err := d.repo.UpdateShareLink(doc); err != nil {
+		return nil, err
+	}
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     ownerID,
+		Action:     "share_link_updated",
+		Details:    string(doc.ShareLink().Role),
+		CreatedAt:  time.Now(),
+	}
+	if !doc.IsPublic {
+		activity.Details = "disabled"
+	}
+	d.repo.CreateActivity(activity)
+
+	return doc.ShareLink(), nil
+}
+
+// RotateShareToken gives a document's share link a new token, so that the
+// old link stops working
+func (d *DocumentUsecase) RotateShareToken(ownerID, docID uuid.UUID) (*domain.ShareLink, error) {
+	doc, _, err := d.access.Authorize(ownerID, docID, ActionAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	doc.ShareToken = uuid.New().String()
+	if err := d.repo.UpdateShareLink(doc); err != nil {
+		return nil, err
+	}
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     ownerID,
+		Action:     "share_link_rotated",
+		Details:    "Share link token replaced",
+		CreatedAt:  time.Now(),
+	}
+	d.repo.CreateActivity(activity)
+
+	return doc.ShareLink(), nil
+}
+
+// OpenShareLink returns the document a share link leads to and the role it
+// is opened with. userID is nil for anonymous visitors; a logged-in user keeps
+// their own role if it is better than the link's.
+func (d *DocumentUsecase) OpenShareLink(token, password string, userID *uuid.UUID) (*domain.Document, domain.Role, error) {
+	doc, err := d.resolveShareLink(token, password)
+	if err != nil {
+		return nil, "", err
+	}
+
+	role := doc.ShareLink().Role
+	if userID != nil {
+		own, err := d.access.role(*userID, doc)
+		if err != nil {
+			return nil, "", err
+		}
+		if roleRank(own) > roleRank(role) {
+			role = own
+		}
+	}
+
+	state, err := d.loadState(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	render(doc, state)
+
+	return doc, role, nil
+}
+
+// JoinShareLink lets someone into a live session on the document a share
+// link leads to. userID is nil for guests, who get a fresh ID for the session
+// and go by guestName. The caller must Leave the returned session when the
+// connection ends.
+func (d *DocumentUsecase) JoinShareLink(token, password string, userID *uuid.UUID, guestName string) (*LinkSession, error) {
+	doc, err := d.resolveShareLink(token, password)
+	if err != nil {
+		return nil, err
+	}
+
+	var id uuid.UUID
+	if userID != nil {
+		id = *userID
+		guestName = ""
+	} else {
+		id = uuid.New()
+		guestName = strings.TrimSpace(guestName)
+		if guestName == "" {
+			guestName = "Guest"
+		}
+		if utf8.RuneCountInString(guestName) > maxGuestName {
+			return nil, ErrInvalidGuestName
+		}
+	}
+	session, err := d.access.links.join(id, doc, guestName)
+	if err != nil {
+		return nil, err
+	}
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: doc.ID,
+		UserID:     id,
+		GuestName:  guestName,
+		Action:     "joined_via_link",
+		Details:    string(doc.ShareLink().Role),
+		CreatedAt:  time.Now(),
+	}
+	d.repo.CreateActivity(activity)
+
+	return session, nil
+}
+
+// resolveShareLink loads the document token opens, checking its password
+func (d *DocumentUsecase) resolveShareLink(token, password string) (*domain.Document, error) {
+	if token == "" {
+		return nil, ErrShareLinkNotFound
+	}
+	doc, err := d.repo.GetDocumentByShareToken(token)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareLinkNotFound
+		}
+		return nil, err
+	}
+	if err := checkShareLink(doc, token); err != nil {
+		return nil, err
+	}
+	if doc.SharePassword != "" &&
+		bcrypt.CompareHashAndPassword([]byte(doc.SharePassword), []byte(password)) != nil {
+		return nil, ErrSharePasswordRequired
+	}
+	return doc, nil
+}
@@ -0,0 +1,203 @@
+package usecase_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// memoryLinkStore is a LinkSessionStore that never expires anything
+type memoryLinkStore struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*domain.LinkSession
+}
+
+func newMemoryLinkStore() *memoryLinkStore {
+	return &memoryLinkStore{sessions: make(map[uuid.UUID]*domain.LinkSession)}
+}
+
+func (s *memoryLinkStore) SaveLinkSession(session *domain.LinkSession, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *session
+	s.sessions[session.ID] = &copied
+	return nil
+}
+
+func (s *memoryLinkStore) RemoveLinkSession(session *domain.LinkSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.ID)
+	return nil
+}
+
+func (s *memoryLinkStore) ListLinkSessions(docID, userID uuid.UUID) ([]*domain.LinkSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sessions []*domain.LinkSession
+	for _, session := range s.sessions {
+		if session.DocumentID == docID && session.UserID == userID {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions, nil
+}
+
+// shareLink turns on the fixture document's share link and returns its token
+func (f *collabFixture) shareLink(t *testing.T, input usecase.ShareLinkInput) string {
+	t.Helper()
+	input.Enabled = true
+	link, err := f.documents.UpdateShareLink(f.owner, f.docID, input)
+	if err != nil {
+		t.Fatalf("update share link: %v", err)
+	}
+	return link.Token
+}
+
+func password(p string) *string {
+	return &p
+}
+
+func TestShareLinkExpiry(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	expires := time.Now().Add(time.Hour)
+	token := f.shareLink(t, usecase.ShareLinkInput{Role: domain.RoleEditor, ExpiresAt: &expires})
+
+	doc, role, err := f.documents.OpenShareLink(token, "", nil)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if doc.Content != "hello" || role != domain.RoleEditor {
+		t.Errorf("opened %q as %q, want \"hello\" as editor", doc.Content, role)
+	}
+	guest, err := f.documents.JoinShareLink(token, "", nil, "")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer guest.Leave()
+	if guest.GuestName != "Guest" {
+		t.Errorf("guest name = %q, want the default", guest.GuestName)
+	}
+	f.apply(t, guest.UserID, insert(5, "!"))
+
+	// The link runs out while the guest is still connected
+	f.docRepo.change(f.docID, func(doc *domain.Document) {
+		past := time.Now().Add(-time.Second)
+		doc.ShareExpiresAt = &past
+	})
+	if _, _, err := f.documents.OpenShareLink(token, "", nil); !errors.Is(err, usecase.ErrShareLinkExpired) {
+		t.Errorf("open after expiry: err = %v, want ErrShareLinkExpired", err)
+	}
+	if _, _, err := f.collab.ApplyOperation(guest.UserID, f.docID, insert(0, ">")); !errors.Is(err, usecase.ErrPermissionDenied) {
+		t.Errorf("guest edit after expiry: err = %v, want ErrPermissionDenied", err)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	if _, err := f.documents.UpdateShareLink(f.owner, f.docID, usecase.ShareLinkInput{Enabled: true, ExpiresAt: &past}); !errors.Is(err, usecase.ErrInvalidShareLink) {
+		t.Errorf("expiry in the past: err = %v, want ErrInvalidShareLink", err)
+	}
+	// Lifting the expiry lets the same session back in
+	f.shareLink(t, usecase.ShareLinkInput{})
+	f.apply(t, guest.UserID, insert(0, ">"))
+	if got := f.content(t); got != ">hello!" {
+		t.Errorf("content = %q, want %q", got, ">hello!")
+	}
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	token := f.shareLink(t, usecase.ShareLinkInput{Password: password("first")})
+
+	if _, _, err := f.documents.OpenShareLink(token, "", nil); !errors.Is(err, usecase.ErrSharePasswordRequired) {
+		t.Errorf("open without the password: err = %v, want ErrSharePasswordRequired", err)
+	}
+	if _, err := f.documents.JoinShareLink(token, "wrong", nil, "Ann"); !errors.Is(err, usecase.ErrSharePasswordRequired) {
+		t.Errorf("join with the wrong password: err = %v, want ErrSharePasswordRequired", err)
+	}
+	guest, err := f.documents.JoinShareLink(token, "first", nil, "  Ann ")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	defer guest.Leave()
+	if guest.GuestName != "Ann" {
+		t.Errorf("guest name = %q, want it trimmed", guest.GuestName)
+	}
+	if _, err := f.documents.GetDocument(guest.UserID, f.docID); err != nil {
+		t.Fatalf("guest read: %v", err)
+	}
+
+	// Changing the password cuts off sessions that came in with the old one,
+	// while an update that leaves it alone does not
+	f.shareLink(t, usecase.ShareLinkInput{Role: domain.RoleViewer})
+	if _, err := f.documents.GetDocument(guest.UserID, f.docID); err != nil {
+		t.Errorf("guest read after an unrelated update: %v", err)
+	}
+	f.shareLink(t, usecase.ShareLinkInput{Password: password("second")})
+	if _, err := f.documents.GetDocument(guest.UserID, f.docID); !errors.Is(err, usecase.ErrPermissionDenied) {
+		t.Errorf("guest read after the password changed: err = %v, want ErrPermissionDenied", err)
+	}
+	if _, _, err := f.documents.OpenShareLink(token, "first", nil); !errors.Is(err, usecase.ErrSharePasswordRequired) {
+		t.Errorf("open with the old password: err = %v, want ErrSharePasswordRequired", err)
+	}
+
+	// Removing it opens the link to anyone
+	f.shareLink(t, usecase.ShareLinkInput{Password: password("")})
+	if _, _, err := f.documents.OpenShareLink(token, "", nil); err != nil {
+		t.Errorf("open once the password is removed: %v", err)
+	}
+}
+
+func TestShareLinkRotationAndRoles(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	token := f.shareLink(t, usecase.ShareLinkInput{Role: domain.RoleCommenter})
+
+	// Logged-in users keep a better role of their own
+	if _, role, err := f.documents.OpenShareLink(token, "", &f.editor); err != nil || role != domain.RoleEditor {
+		t.Errorf("editor opened the link as %q, %v, want editor", role, err)
+	}
+	member, err := f.documents.JoinShareLink(token, "", &f.owner, "ignored")
+	if err != nil {
+		t.Fatalf("owner join: %v", err)
+	}
+	member.Leave()
+	if member.UserID != f.owner || member.GuestName != "" {
+		t.Errorf("logged-in session = %+v, want the owner without a guest name", member)
+	}
+	if _, err := f.documents.JoinShareLink(token, "", nil, strings.Repeat("n", 51)); !errors.Is(err, usecase.ErrInvalidGuestName) {
+		t.Errorf("long guest name: err = %v, want ErrInvalidGuestName", err)
+	}
+
+	rotated, err := f.documents.RotateShareToken(f.owner, f.docID)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if rotated.Token == token {
+		t.Fatalf("rotation kept the token")
+	}
+	if _, _, err := f.documents.OpenShareLink(token, "", nil); !errors.Is(err, usecase.ErrShareLinkNotFound) {
+		t.Errorf("open the old token: err = %v, want ErrShareLinkNotFound", err)
+	}
+	if _, role, err := f.documents.OpenShareLink(rotated.Token, "", nil); err != nil || role != domain.RoleCommenter {
+		t.Errorf("open the new token: %q, %v, want commenter", role, err)
+	}
+
+	if _, err := f.documents.UpdateShareLink(f.owner, f.docID, usecase.ShareLinkInput{Enabled: true, Role: domain.RoleOwner}); !errors.Is(err, usecase.ErrInvalidRole) {
+		t.Errorf("owner role link: err = %v, want ErrInvalidRole", err)
+	}
+	if _, err := f.documents.GetShareLink(f.editor, f.docID); !errors.Is(err, usecase.ErrPermissionDenied) {
+		t.Errorf("editor reading the link: err = %v, want ErrPermissionDenied", err)
+	}
+	if _, err := f.documents.UpdateShareLink(f.owner, f.docID, usecase.ShareLinkInput{}); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	if _, _, err := f.documents.OpenShareLink(rotated.Token, "", nil); !errors.Is(err, usecase.ErrShareLinkNotFound) {
+		t.Errorf("open a disabled link: err = %v, want ErrShareLinkNotFound", err)
+	}
+}
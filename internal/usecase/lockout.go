@@ -0,0 +1,103 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrAccountLocked = errors.New("too many failed logins")
+
+// AccountLockedError says how long until an account can be logged in to
+// again. It matches ErrAccountLocked with errors.Is.
+type AccountLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("too many failed logins; try again in %s", humanDuration(e.RetryAfter))
+}
+
+func (e *AccountLockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// LoginAttemptStore keeps count of failed logins and lockouts. A shared
+// backend applies them on every node.
+type LoginAttemptStore interface {
+	// RecordFailure counts a failed login for key and returns how many there
+	// have been. The count is forgotten ttl after the last failure.
+	RecordFailure(key string, ttl time.Duration) (int64, error)
+	// ClearFailures forgets key's failed logins and lifts any lockout
+	ClearFailures(key string) error
+	Lock(key string, d time.Duration) error
+	// LockedFor reports how much longer key is locked, zero if it is not
+	LockedFor(key string) (time.Duration, error)
+}
+
+// LockoutPolicy locks an account out of password logins after Threshold
+// failures in a row. The first lockout lasts Base and each further failure
+// doubles it, up to Max. A Threshold of zero turns lockouts off.
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// loginFailureMemory is how long failed logins are remembered after the last
+// one
+const loginFailureMemory = 24 * time.Hour
+
+// lockoutKey identifies an account by the email used to log in, so addresses
+// without an account are treated the same as those with one
+func lockoutKey(email string) string {
+	return "login:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLockout fails with an AccountLockedError while email is locked out
+func (a *AuthUsecase) checkLockout(email string) error {
+	if a.lockout.Threshold <= 0 {
+		return nil
+	}
+	remaining, err := a.attempts.LockedFor(lockoutKey(email))
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return &AccountLockedError{RetryAfter: remaining}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login and locks the account once there
+// have been too many
+func (a *AuthUsecase) recordLoginFailure(email string) error {
+	if a.lockout.Threshold <= 0 {
+		return nil
+	}
+	key := lockoutKey(email)
+	failures, err := a.attempts.RecordFailure(key, loginFailureMemory)
+	if err != nil {
+		return err
+	}
+	if failures < int64(a.lockout.Threshold) {
+		return nil
+	}
+
+	d := a.lockout.Base
+	for i := int64(a.lockout.Threshold); i < failures && d < a.lockout.Max; i++ {
+		d *= 2
+	}
+	if d > a.lockout.Max {
+		d = a.lockout.Max
+	}
+	return a.attempts.Lock(key, d)
+}
+
+func (a *AuthUsecase) clearLoginFailures(email string) error {
+	if a.lockout.Threshold <= 0 {
+		return nil
+	}
+	return a.attempts.ClearFailures(lockoutKey(email))
+}
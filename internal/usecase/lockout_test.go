@@ -0,0 +1,160 @@
+package usecase_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/infrastructure/ratelimit"
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+// clock is a time that only moves when told to
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var testLockout = usecase.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: 5 * time.Minute}
+
+// newLockoutFixture has a user ada@example.com with the password "password"
+// and counts failed logins on clk
+func newLockoutFixture(t *testing.T) (*accountFixture, *clock) {
+	t.Helper()
+	clk := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	f := newAccountFixtureFor(t, newAuthFixture(t, usecase.MFAPolicy{}, ratelimit.NewMemoryLimiterWithClock(clk.Now), testLockout))
+	if _, err := f.auth.Register("ada@example.com", "ada", "password"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	return f, clk
+}
+
+// lockedFor is how long the next login for ada@example.com is refused, zero
+// if it is not
+func lockedFor(t *testing.T, f *accountFixture) time.Duration {
+	t.Helper()
+	_, err := f.auth.Login("ada@example.com", "password")
+	var locked *usecase.AccountLockedError
+	switch {
+	case errors.As(err, &locked):
+		if !errors.Is(err, usecase.ErrAccountLocked) {
+			t.Errorf("lockout does not match ErrAccountLocked")
+		}
+		return locked.RetryAfter
+	case err != nil:
+		t.Fatalf("login: %v", err)
+	}
+	return 0
+}
+
+func failLogin(t *testing.T, f *accountFixture) {
+	t.Helper()
+	if _, err := f.auth.Login("ada@example.com", "wrong"); !errors.Is(err, usecase.ErrInvalidCredentials) {
+		t.Fatalf("wrong password: err = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLockoutDoublesUpToMax(t *testing.T) {
+	f, clk := newLockoutFixture(t)
+
+	for i := 1; i < testLockout.Threshold; i++ {
+		failLogin(t, f)
+	}
+	// Checking the password does not count as a failure, so this logs in
+	if d := lockedFor(t, f); d != 0 {
+		t.Fatalf("locked for %s below the threshold", d)
+	}
+	for i := 1; i < testLockout.Threshold; i++ {
+		failLogin(t, f)
+	}
+
+	// The failure at the threshold locks for Base, each one after it for
+	// twice as long as the last, up to Max
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		failLogin(t, f)
+		if d := lockedFor(t, f); d != want {
+			t.Fatalf("locked for %s, want %s", d, want)
+		}
+		clk.Advance(want - time.Second)
+		if d := lockedFor(t, f); d != time.Second {
+			t.Fatalf("locked for %s a second before the end, want 1s", d)
+		}
+		clk.Advance(time.Second)
+	}
+}
+
+func TestLockoutAppliesWithoutAnAccount(t *testing.T) {
+	f, _ := newLockoutFixture(t)
+
+	for i := 0; i < testLockout.Threshold; i++ {
+		if _, err := f.auth.Login("nobody@example.com", "wrong"); !errors.Is(err, usecase.ErrInvalidCredentials) {
+			t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+		}
+	}
+	if _, err := f.auth.Login("Nobody@Example.com ", "wrong"); !errors.Is(err, usecase.ErrAccountLocked) {
+		t.Errorf("err = %v, want ErrAccountLocked", err)
+	}
+	if d := lockedFor(t, f); d != 0 {
+		t.Errorf("another account locked for %s", d)
+	}
+}
+
+func TestLockoutResetsOnSuccessfulLogin(t *testing.T) {
+	f, clk := newLockoutFixture(t)
+
+	for i := 0; i < testLockout.Threshold+1; i++ {
+		failLogin(t, f)
+		clk.Advance(testLockout.Max)
+	}
+	// Logging in forgets the failures...
+	if d := lockedFor(t, f); d != 0 {
+		t.Fatalf("locked for %s after the lockout ended", d)
+	}
+	// ...so it takes the full threshold again, and starts from Base
+	for i := 1; i < testLockout.Threshold; i++ {
+		failLogin(t, f)
+	}
+	if _, err := f.auth.Login("ada@example.com", "password"); err != nil {
+		t.Fatalf("locked out below the threshold: %v", err)
+	}
+	for i := 0; i < testLockout.Threshold; i++ {
+		failLogin(t, f)
+	}
+	if d := lockedFor(t, f); d != testLockout.Base {
+		t.Errorf("locked for %s, want %s", d, testLockout.Base)
+	}
+}
+
+func TestLockoutResetsOnPasswordReset(t *testing.T) {
+	f, _ := newLockoutFixture(t)
+
+	for i := 0; i < testLockout.Threshold; i++ {
+		failLogin(t, f)
+	}
+	if d := lockedFor(t, f); d != testLockout.Base {
+		t.Fatalf("locked for %s, want %s", d, testLockout.Base)
+	}
+
+	if err := f.account.ForgotPassword("ada@example.com"); err != nil {
+		t.Fatalf("forgot password: %v", err)
+	}
+	if err := f.account.ResetPassword(f.waitForEmails(t, 1), "new password"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if _, err := f.auth.Login("ada@example.com", "new password"); err != nil {
+		t.Errorf("login right after the reset: %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package usecase
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidMFAToken     = errors.New("invalid or expired two-factor login; please sign in again")
+	ErrInvalidMFACode      = errors.New("invalid two-factor code")
+	ErrTooManyMFAAttempts  = errors.New("too many two-factor attempts; try again in a few minutes")
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotSetUp   = errors.New("two-factor authentication has not been set up")
+	ErrTwoFactorRequired   = errors.New("two-factor authentication is required for every account")
+)
+
+const (
+	// MFATokenTTL is how long the second step of a login can take
+	MFATokenTTL = 5 * time.Minute
+	// A user can try MaxMFAAttempts codes every MFAAttemptWindow
+	MaxMFAAttempts   = 5
+	MFAAttemptWindow = 5 * time.Minute
+
+	totpPeriod        = 30 // seconds
+	totpDigits        = 6
+	totpSkew          = 1 // steps either side of now that are accepted
+	recoveryCodeCount = 10
+	mfaPurposeVerify  = "mfa"
+	mfaPurposeEnroll  = "mfa_setup"
+)
+
+// MFAPolicy controls two-factor authentication
+type MFAPolicy struct {
+	// Required makes users without two-factor authentication set it up
+	// before a login completes, and stops anyone turning it off. It is the
+	// default until an administrator saves the settings; see UpdateSettings.
+	Required bool
+	Issuer   string // Shown next to the account in authenticator apps
+}
+
+// LoginResult is the outcome of a password or identity provider login. Either Tokens is set, or
+// MFAToken is and the login finishes with VerifyMFA, or with enrolling in
+// two-factor authentication when MFASetupRequired is set.
+type LoginResult struct {
+	Tokens           *domain.TokenPair
+	User             *domain.User
+	MFAToken         string
+	MFASetupRequired bool
+}
+
+// TOTPSetup is what an authenticator app needs to start generating codes
+type TOTPSetup struct {
+	Secret     string `json:"secret" example:"JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"`
+	OTPAuthURI string `json:"otpauth_uri" example:"otpauth://totp/Collab%20Platform:user@example.com?secret=JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP&issuer=Collab%20Platform"`
+}
+
+// VerifyMFA finishes a login with a two-factor code or a recovery code. The
+// MFA token from Login works once.
+func (a *AuthUsecase) VerifyMFA(mfaToken, code string) (*domain.TokenPair, *domain.User, error) {
+	claims, err := a.parseMFAToken(mfaToken, mfaPurposeVerify)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user, err := a.mfaUser(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, nil, ErrInvalidMFAToken
+	}
+	if err := a.checkSecondFactor(user, code); err != nil {
+		return nil, nil, err
+	}
+
+	return a.finishMFALogin(claims, user)
+}
+
+// ValidateMFASetupToken checks a token Login handed out to a user who has to
+// set up two-factor authentication before signing in
+func (a *AuthUsecase) ValidateMFASetupToken(tokenString string) (*Claims, error) {
+	return a.parseMFAToken(tokenString, mfaPurposeEnroll)
+}
+
+// CompleteMFASetup finishes the login that made a user set up two-factor
+// authentication, once they have enabled it
+func (a *AuthUsecase) CompleteMFASetup(claims *Claims) (*domain.TokenPair, error) {
+	user, err := a.mfaUser(claims)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	pair, _, err := a.finishMFALogin(claims, user)
+	return pair, err
+}
+
+// SetupTOTP starts two-factor enrollment with a new secret. It only takes
+// effect once EnableTOTP confirms the user's app produces the same codes.
+func (a *AuthUsecase) SetupTOTP(userID uuid.UUID) (*TOTPSetup, error) {
+	user, err := a.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+	if err := a.repo.SetTOTPSecret(userID, secret); err != nil {
+		return nil, err
+	}
+
+	label := url.PathEscape(a.mfa.Issuer + ":" + user.Email)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {a.mfa.Issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return &TOTPSetup{
+		Secret:     secret,
+		OTPAuthURI: "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+// EnableTOTP turns two-factor authentication on once code shows the user's
+// app is set up, and returns their recovery codes. They are only shown now.
+// Codes tried count against the same limit as logins.
+func (a *AuthUsecase) EnableTOTP(userID uuid.UUID, code string) ([]string, error) {
+	user, err := a.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+	if err := a.countMFAAttempt(user); err != nil {
+		return nil, err
+	}
+	if ok, err := a.checkTOTP(user, code); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, records, err := newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.repo.EnableTOTP(userID, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking a code or
+// recovery code. It is refused when two-factor authentication is required.
+func (a *AuthUsecase) DisableTOTP(userID uuid.UUID, code string) error {
+	if required, err := a.mfaRequired(); err != nil {
+		return err
+	} else if required {
+		return ErrTwoFactorRequired
+	}
+	user, err := a.user(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+	if err := a.checkSecondFactor(user, code); err != nil {
+		return err
+	}
+	return a.repo.DisableTOTP(userID)
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes after checking a
+// code or recovery code
+func (a *AuthUsecase) RegenerateRecoveryCodes(userID uuid.UUID, code string) ([]string, error) {
+	user, err := a.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err := a.checkSecondFactor(user, code); err != nil {
+		return nil, err
+	}
+
+	codes, records, err := newRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.repo.ReplaceRecoveryCodes(userID, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// mfaLogin decides whether a login needs a second step
+func (a *AuthUsecase) mfaLogin(user *domain.User) (*LoginResult, error) {
+	purpose := mfaPurposeVerify
+	if !user.TOTPEnabled {
+		required, err := a.mfaRequired()
+		if err != nil {
+			return nil, err
+		}
+		if !required {
+			pair, err := a.startSession(user)
+			if err != nil {
+				return nil, err
+			}
+			return &LoginResult{Tokens: pair, User: user}, nil
+		}
+		purpose = mfaPurposeEnroll
+	}
+
+	now := time.Now()
+	token, err := a.keys.Sign(&Claims{
+		UserID:  user.ID.String(),
+		Email:   user.Email,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(MFATokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, MFAToken: token, MFASetupRequired: purpose == mfaPurposeEnroll}, nil
+}
+
+func (a *AuthUsecase) parseMFAToken(tokenString, purpose string) (*Claims, error) {
+	token, err := a.keys.Parse(tokenString, &Claims{})
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid || claims.Purpose != purpose || claims.ID == "" {
+		return nil, ErrInvalidMFAToken
+	}
+
+	revoked, err := a.revoked.IsRevoked(claims.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	if revoked {
+		return nil, ErrInvalidMFAToken
+	}
+	return claims, nil
+}
+
+func (a *AuthUsecase) mfaUser(claims *Claims) (*domain.User, error) {
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	user, err := a.repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidMFAToken
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// finishMFALogin uses up an MFA token and starts the session it stood for
+func (a *AuthUsecase) finishMFALogin(claims *Claims, user *domain.User) (*domain.TokenPair, *domain.User, error) {
+	if err := a.revoked.Revoke(claims.ID, MFATokenTTL); err != nil {
+		return nil, nil, err
+	}
+	pair, err := a.startSession(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	user.Password = "" // Don't return password
+	return pair, user, nil
+}
+
+func (a *AuthUsecase) user(userID uuid.UUID) (*domain.User, error) {
+	user, err := a.repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkSecondFactor accepts a current authenticator code or an unused
+// recovery code, which is used up. Attempts are limited per user rather than
+// per login, since a password alone is enough to start new logins.
+func (a *AuthUsecase) checkSecondFactor(user *domain.User, code string) error {
+	if err := a.countMFAAttempt(user); err != nil {
+		return err
+	}
+
+	if ok, err := a.checkTOTP(user, code); err != nil || ok {
+		return err
+	}
+
+	normalized := strings.NewReplacer(" ", "", "-", "").Replace(strings.ToLower(code))
+	if len(normalized) == 10 {
+		used, err := a.repo.UseRecoveryCode(user.ID, hashToken(normalized[:5]+"-"+normalized[5:]))
+		if err != nil || used {
+			return err
+		}
+	}
+	return ErrInvalidMFACode
+}
+
+// countMFAAttempt counts a code about to be checked for user, failing once
+// there have been too many lately
+func (a *AuthUsecase) countMFAAttempt(user *domain.User) error {
+	attempts, err := a.revoked.CountAttempt("mfa:"+user.ID.String(), MFAAttemptWindow)
+	if err != nil {
+		return err
+	}
+	if attempts > MaxMFAAttempts {
+		return ErrTooManyMFAAttempts
+	}
+	return nil
+}
+
+// checkTOTP reports whether code is the user's code for now or a step
+// either side. Each step's code is accepted once.
+func (a *AuthUsecase) checkTOTP(user *domain.User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return false, nil
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return a.repo.AdvanceTOTPStep(user.ID, step)
+		}
+	}
+	return false, nil
+}
+
+// totpCode is the RFC 6238 code for a time step
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newRecoveryCodes makes a fresh set of recovery codes like "a1b2c-d3e4f"
+func newRecoveryCodes(userID uuid.UUID) ([]string, []*domain.RecoveryCode, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	records := make([]*domain.RecoveryCode, recoveryCodeCount)
+	now := time.Now()
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		records[i] = &domain.RecoveryCode{
+			ID:        uuid.New(),
+			UserID:    userID,
+			CodeHash:  hashToken(codes[i]),
+			CreatedAt: now,
+		}
+	}
+	return codes, records, nil
+}
@@ -0,0 +1,248 @@
+package usecase_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+const step = 30 * time.Second
+
+// totp is the code an authenticator app shows for secret at a moment, as
+// RFC 6238 describes it
+func totp(secret string, at time.Time) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[offset:])&0x7fffffff%1000000)
+}
+
+// awayFromStepEdge waits for the next time step if the current one is about
+// to end, so codes worked out now are still for the step the server sees
+func awayFromStepEdge() {
+	if left := 30 - time.Now().Unix()%30; left < 5 {
+		time.Sleep(time.Duration(left) * time.Second)
+	}
+}
+
+// enroll registers email and turns two-factor authentication on with the
+// code for at, returning the secret and recovery codes
+func (f *authFixture) enroll(t *testing.T, email string, at time.Time) (*domain.User, string, []string) {
+	t.Helper()
+	user, err := f.auth.Register(email, email, "password")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	setup, err := f.auth.SetupTOTP(user.ID)
+	if err != nil {
+		t.Fatalf("set up: %v", err)
+	}
+	codes, err := f.auth.EnableTOTP(user.ID, totp(setup.Secret, at))
+	if err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	return user, setup.Secret, codes
+}
+
+// mfaLogin logs email in with its password and returns the second step
+func (f *authFixture) mfaLogin(t *testing.T, email string) *usecase.LoginResult {
+	t.Helper()
+	result, err := f.auth.Login(email, "password")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if result.MFAToken == "" || result.Tokens != nil {
+		t.Fatalf("login = %+v, want an MFA token and no tokens", result)
+	}
+	return result
+}
+
+func TestTOTPAcceptsOneStepEitherSide(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	awayFromStepEdge()
+	now := time.Now()
+	_, secret, _ := f.enroll(t, "ada@example.com", now.Add(-step))
+
+	login := f.mfaLogin(t, "ada@example.com")
+	if _, _, err := f.auth.VerifyMFA(login.MFAToken, totp(secret, now.Add(2*step))); !errors.Is(err, usecase.ErrInvalidMFACode) {
+		t.Errorf("code two steps ahead: err = %v, want ErrInvalidMFACode", err)
+	}
+	tokens, _, err := f.auth.VerifyMFA(login.MFAToken, totp(secret, now.Add(step)))
+	if err != nil {
+		t.Fatalf("code a step ahead: %v", err)
+	}
+	if _, err := f.auth.ValidateToken(tokens.AccessToken); err != nil {
+		t.Errorf("access token from the login: %v", err)
+	}
+}
+
+func TestTOTPCodesWorkOnce(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	awayFromStepEdge()
+	now := time.Now()
+	_, secret, _ := f.enroll(t, "ada@example.com", now)
+
+	login := f.mfaLogin(t, "ada@example.com")
+	// The code that enabled two-factor authentication, and an earlier one
+	for name, at := range map[string]time.Time{"enabling code": now, "earlier code": now.Add(-step)} {
+		if _, _, err := f.auth.VerifyMFA(login.MFAToken, totp(secret, at)); !errors.Is(err, usecase.ErrInvalidMFACode) {
+			t.Errorf("%s: err = %v, want ErrInvalidMFACode", name, err)
+		}
+	}
+	code := totp(secret, now.Add(step))
+	if _, _, err := f.auth.VerifyMFA(login.MFAToken, code); err != nil {
+		t.Fatalf("next code: %v", err)
+	}
+	if _, _, err := f.auth.VerifyMFA(f.mfaLogin(t, "ada@example.com").MFAToken, code); !errors.Is(err, usecase.ErrInvalidMFACode) {
+		t.Errorf("same code at the next login: err = %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	user, _, codes := f.enroll(t, "ada@example.com", time.Now())
+	if len(codes) != 10 {
+		t.Fatalf("%d recovery codes, want 10", len(codes))
+	}
+
+	if _, _, err := f.auth.VerifyMFA(f.mfaLogin(t, "ada@example.com").MFAToken, codes[0]); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if _, _, err := f.auth.VerifyMFA(f.mfaLogin(t, "ada@example.com").MFAToken, codes[0]); !errors.Is(err, usecase.ErrInvalidMFACode) {
+		t.Errorf("used recovery code: err = %v, want ErrInvalidMFACode", err)
+	}
+
+	// Typed in capitals with a space for the dash
+	typed := strings.ToUpper(strings.Replace(codes[1], "-", " ", 1))
+	fresh, err := f.auth.RegenerateRecoveryCodes(user.ID, typed)
+	if err != nil {
+		t.Fatalf("regenerate with %q: %v", typed, err)
+	}
+	if len(fresh) != 10 || fresh[0] == codes[0] {
+		t.Errorf("regenerated %v, want 10 new codes", fresh)
+	}
+	if _, _, err := f.auth.VerifyMFA(f.mfaLogin(t, "ada@example.com").MFAToken, codes[2]); !errors.Is(err, usecase.ErrInvalidMFACode) {
+		t.Errorf("replaced recovery code: err = %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestEnableTOTPCountsAttempts(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	user, err := f.auth.Register("ada@example.com", "ada", "password")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	setup, err := f.auth.SetupTOTP(user.ID)
+	if err != nil {
+		t.Fatalf("set up: %v", err)
+	}
+
+	for i := 0; i < usecase.MaxMFAAttempts; i++ {
+		if _, err := f.auth.EnableTOTP(user.ID, "000000"); !errors.Is(err, usecase.ErrInvalidMFACode) {
+			t.Fatalf("wrong code %d: err = %v, want ErrInvalidMFACode", i+1, err)
+		}
+	}
+	if _, err := f.auth.EnableTOTP(user.ID, totp(setup.Secret, time.Now())); !errors.Is(err, usecase.ErrTooManyMFAAttempts) {
+		t.Errorf("right code after the limit: err = %v, want ErrTooManyMFAAttempts", err)
+	}
+	if user, _ := f.repo.GetUserByID(user.ID); user.TOTPEnabled {
+		t.Errorf("two-factor authentication enabled")
+	}
+}
+
+// makeAdmin registers email as an administrator
+func (f *authFixture) makeAdmin(t *testing.T, email string) *domain.User {
+	t.Helper()
+	registered, err := f.auth.Register(email, email, "password")
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	admin, _ := f.repo.GetUserByID(registered.ID)
+	admin.IsAdmin = true
+	return f.repo.addUser(admin)
+}
+
+func TestAdminRequiresTwoFactor(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	admin := f.makeAdmin(t, "admin@example.com")
+	grace, secret, _ := f.enroll(t, "grace@example.com", time.Now())
+	f.login(t, "ada@example.com")
+	required := true
+
+	if _, err := f.auth.UpdateSettings(grace.ID, usecase.SettingsInput{MFARequired: &required}); !errors.Is(err, usecase.ErrAdminRequired) {
+		t.Fatalf("update by a user: err = %v, want ErrAdminRequired", err)
+	}
+	if _, err := f.auth.GetSettings(grace.ID); !errors.Is(err, usecase.ErrAdminRequired) {
+		t.Errorf("get by a user: err = %v, want ErrAdminRequired", err)
+	}
+	settings, err := f.auth.UpdateSettings(admin.ID, usecase.SettingsInput{MFARequired: &required})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if !settings.MFARequired || settings.UpdatedBy == nil || *settings.UpdatedBy != admin.ID || settings.UpdatedAt == nil {
+		t.Errorf("settings = %+v, want required and updated by the admin", settings)
+	}
+
+	// Another node sees the setting, whatever it was started with
+	other := usecase.NewAuthUsecase(f.repo, f.revoked, newKeyRing(t, &memoryKeyRepo{}, usecase.AlgorithmEdDSA),
+		15*time.Minute, 24*time.Hour, usecase.MFAPolicy{}, f.attempts, usecase.LockoutPolicy{})
+	result, err := other.Login("ada@example.com", "password")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if !result.MFASetupRequired || result.Tokens != nil {
+		t.Errorf("login = %+v, want two-factor setup required", result)
+	}
+	if err := other.DisableTOTP(grace.ID, totp(secret, time.Now().Add(step))); !errors.Is(err, usecase.ErrTwoFactorRequired) {
+		t.Errorf("disable: err = %v, want ErrTwoFactorRequired", err)
+	}
+
+	// Changing nothing keeps it required
+	if settings, err := other.UpdateSettings(admin.ID, usecase.SettingsInput{}); err != nil || !settings.MFARequired {
+		t.Fatalf("empty update = %+v, %v; want still required", settings, err)
+	}
+	required = false
+	if _, err := f.auth.UpdateSettings(admin.ID, usecase.SettingsInput{MFARequired: &required}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if result, err := other.Login("ada@example.com", "password"); err != nil || result.Tokens == nil {
+		t.Errorf("login = %+v, %v; want tokens", result, err)
+	}
+}
+
+func TestMFARequiredDefaultsToConfig(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{Required: true, Issuer: "Collab"}, nil, usecase.LockoutPolicy{})
+	admin := f.makeAdmin(t, "admin@example.com")
+
+	settings, err := f.auth.GetSettings(admin.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !settings.MFARequired || settings.UpdatedAt != nil {
+		t.Errorf("settings = %+v, want required by default and never saved", settings)
+	}
+	if result := f.mfaLogin(t, "admin@example.com"); !result.MFASetupRequired {
+		t.Errorf("login = %+v, want two-factor setup required", result)
+	}
+
+	required := false
+	if _, err := f.auth.UpdateSettings(admin.ID, usecase.SettingsInput{MFARequired: &required}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if result, err := f.auth.Login("admin@example.com", "password"); err != nil || result.Tokens == nil {
+		t.Errorf("login = %+v, %v; want tokens", result, err)
+	}
+}
@@ -0,0 +1,316 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownProvider     = errors.New("unknown identity provider")
+	ErrProviderUnavailable = errors.New("identity provider unavailable")
+	ErrInvalidLoginState   = errors.New("login expired or was not started here; please try again")
+	ErrIdentityNotVerified = errors.New("identity provider rejected the login")
+	ErrIdentityNotLinked   = errors.New("no account is linked to this identity")
+	ErrIdentityInUse       = errors.New("this identity is linked to another account")
+)
+
+// OIDCLoginTTL is how long a user has to come back from the identity provider
+const OIDCLoginTTL = 10 * time.Minute
+
+// ExternalIdentity is who an identity provider says signed in
+type ExternalIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// IdentityProvider runs the authorization code flow against one OpenID
+// Connect provider
+type IdentityProvider interface {
+	// AuthCodeURL is where to send the user to sign in
+	AuthCodeURL(state, nonce, codeChallenge string) (string, error)
+	// Exchange redeems an authorization code and returns the identity from
+	// the verified ID token, which must carry nonce
+	Exchange(code, codeVerifier, nonce string) (*ExternalIdentity, error)
+}
+
+// OIDCProvider is an identity provider users can sign in with
+type OIDCProvider struct {
+	Name     string
+	Provider IdentityProvider
+	// AllowSignup creates an account on first login for identities that do
+	// not match an existing user
+	AllowSignup bool
+}
+
+// OIDCLoginStore keeps logins in progress where every node can see them
+type OIDCLoginStore interface {
+	SaveOIDCLogin(state string, login *domain.OIDCLogin, ttl time.Duration) error
+	// TakeOIDCLogin returns and forgets a login, nil if there is none
+	TakeOIDCLogin(state string) (*domain.OIDCLogin, error)
+}
+
+// OIDCUsecase signs users in through external identity providers. It links
+// each provider account to a user the first time it is used and hands out
+// the same tokens, or two-factor challenge, as a password login.
+type OIDCUsecase struct {
+	auth      *AuthUsecase
+	repo      AuthRepository
+	logins    OIDCLoginStore
+	providers map[string]OIDCProvider
+}
+
+func NewOIDCUsecase(auth *AuthUsecase, repo AuthRepository, logins OIDCLoginStore, providers []OIDCProvider) *OIDCUsecase {
+	byName := make(map[string]OIDCProvider, len(providers))
+	for _, p := range providers {
+		byName[p.Name] = p
+	}
+	return &OIDCUsecase{auth: auth, repo: repo, logins: logins, providers: byName}
+}
+
+// Providers lists the names of the configured identity providers
+func (o *OIDCUsecase) Providers() []string {
+	names := make([]string, 0, len(o.providers))
+	for name := range o.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartLogin begins a login with provider and returns the URL to send the
+// user to and the state the provider will send back with them
+func (o *OIDCUsecase) StartLogin(provider string) (string, string, error) {
+	return o.start(provider, uuid.Nil)
+}
+
+// StartLink begins linking a provider account to a signed-in user, the way
+// StartLogin begins a login. It is how an account whose email address is not
+// verified gets linked.
+func (o *OIDCUsecase) StartLink(userID uuid.UUID, provider string) (string, string, error) {
+	return o.start(provider, userID)
+}
+
+func (o *OIDCUsecase) start(provider string, userID uuid.UUID) (string, string, error) {
+	p, ok := o.providers[provider]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomString()
+	if err != nil {
+		return "", "", err
+	}
+
+	authURL, err := p.Provider.AuthCodeURL(state, nonce, codeChallenge(verifier))
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	login := &domain.OIDCLogin{Provider: provider, Nonce: nonce, CodeVerifier: verifier, UserID: userID}
+	if err := o.logins.SaveOIDCLogin(state, login, OIDCLoginTTL); err != nil {
+		return "", "", err
+	}
+	return authURL, state, nil
+}
+
+// FinishLogin completes a login with the code and state the provider sent
+// the user back with. Each state works once.
+//
+// The identity is matched to a user by the link made at an earlier login,
+// then by an email address both the provider and this server have verified.
+// Failing both, a user is created if the provider allows signups. Users with
+// two-factor authentication, or who are required to set it up, get an MFA
+// token for the second step as they would after a password login.
+func (o *OIDCUsecase) FinishLogin(provider, code, state string) (*LoginResult, error) {
+	p, identity, err := o.finish(provider, code, state, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := o.resolveUser(p, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := o.auth.mfaLogin(user)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = "" // Don't return password
+	return result, nil
+}
+
+// FinishLink completes a link started with StartLink by the same user
+func (o *OIDCUsecase) FinishLink(userID uuid.UUID, provider, code, state string) error {
+	p, identity, err := o.finish(provider, code, state, userID)
+	if err != nil {
+		return err
+	}
+
+	linked, err := o.repo.GetIdentity(p.Name, identity.Subject)
+	switch {
+	case err == nil:
+		if linked.UserID != userID {
+			return ErrIdentityInUse
+		}
+		return nil
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+
+	return o.repo.CreateIdentity(&domain.UserIdentity{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Provider:  p.Name,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	})
+}
+
+// finish takes the login state was issued for, which must have been started
+// by userID (uuid.Nil for a login), and redeems code for the identity
+func (o *OIDCUsecase) finish(provider, code, state string, userID uuid.UUID) (OIDCProvider, *ExternalIdentity, error) {
+	p, ok := o.providers[provider]
+	if !ok {
+		return OIDCProvider{}, nil, ErrUnknownProvider
+	}
+
+	login, err := o.logins.TakeOIDCLogin(state)
+	if err != nil {
+		return OIDCProvider{}, nil, err
+	}
+	if login == nil || login.Provider != provider || login.UserID != userID {
+		return OIDCProvider{}, nil, ErrInvalidLoginState
+	}
+
+	identity, err := p.Provider.Exchange(code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return OIDCProvider{}, nil, fmt.Errorf("%w: %v", ErrIdentityNotVerified, err)
+	}
+	return p, identity, nil
+}
+
+// resolveUser finds or creates the user an identity belongs to
+func (o *OIDCUsecase) resolveUser(p OIDCProvider, identity *ExternalIdentity) (*domain.User, error) {
+	linked, err := o.repo.GetIdentity(p.Name, identity.Subject)
+	switch {
+	case err == nil:
+		return o.repo.GetUserByID(linked.UserID)
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	// An unverified address could belong to someone else
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, ErrIdentityNotLinked
+	}
+
+	link := &domain.UserIdentity{
+		ID:        uuid.New(),
+		Provider:  p.Name,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	}
+
+	user, err := o.repo.GetUserByEmail(identity.Email)
+	switch {
+	case err == nil:
+		// Until the owner has proven the address is theirs, it may have been
+		// registered by someone waiting for its real owner to sign in here
+		if !user.EmailVerified {
+			return nil, fmt.Errorf("%w: sign in with your password and link it from your account", ErrIdentityNotLinked)
+		}
+		link.UserID = user.ID
+		if err := o.repo.CreateIdentity(link); err != nil {
+			return nil, err
+		}
+		return user, nil
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	}
+
+	if !p.AllowSignup {
+		return nil, ErrIdentityNotLinked
+	}
+
+	username, err := o.freeUsername(identity)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user = &domain.User{
+		ID:            uuid.New(),
+		Email:         identity.Email,
+		EmailVerified: true, // Only verified addresses get this far
+		Username:      username,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	link.UserID = user.ID
+	if err := o.repo.CreateUserWithIdentity(user, link); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// freeUsername picks a username for a new user from what the provider knows
+// about them, adding a suffix if it is taken
+func (o *OIDCUsecase) freeUsername(identity *ExternalIdentity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		_, err := o.repo.GetUserByUsername(candidate)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s-%s", base, uuid.NewString()[:6])
+	}
+	return "", errors.New("could not find a free username")
+}
+
+// randomString returns 32 random bytes, URL-safe encoded
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// codeChallenge is the S256 PKCE challenge for verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,517 @@
+package usecase_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/infrastructure/oidc"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	testClientID     = "collab"
+	testClientSecret = "client secret"
+)
+
+// mockIdP is an OpenID Connect provider with discovery, a key set and a token
+// endpoint that checks PKCE the way a real one does
+type mockIdP struct {
+	server *httptest.Server
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	issuer   string // Issuer in the discovery document
+	pending  map[string]pendingCode
+	verifier string // Code verifier of the last token request
+}
+
+// pendingCode is an authorization code the provider has handed out
+type pendingCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := &mockIdP{key: key, pending: make(map[string]pendingCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	issuer := idp.issuer
+	idp.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                idp.server.URL + "/authorize",
+		"token_endpoint":                        idp.server.URL + "/token",
+		"jwks_uri":                              idp.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := idp.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": "test",
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	// Client credentials are form-encoded before Basic auth (RFC 6749 2.3.1)
+	id, secret, ok := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if !ok || id != testClientID || secret != testClientSecret {
+		fail("invalid_client")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		fail("invalid_request")
+		return
+	}
+
+	idp.mu.Lock()
+	verifier := r.PostForm.Get("code_verifier")
+	idp.verifier = verifier
+	code, ok := idp.pending[r.PostForm.Get("code")]
+	delete(idp.pending, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(verifier))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		fail("invalid_grant")
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, code.claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		fail("server_error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "id_token": signed})
+}
+
+// signIn plays the user signing in at authURL: it returns the code the
+// provider would send them back with, for an ID token carrying the nonce
+// from authURL and claims, which override the defaults
+func (idp *mockIdP) signIn(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse authorization URL: %v", err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization URL has no S256 code challenge: %s", authURL)
+	}
+	if q.Get("client_id") != testClientID {
+		t.Fatalf("authorization URL client_id = %q", q.Get("client_id"))
+	}
+
+	now := time.Now()
+	all := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"nonce":          q.Get("nonce"),
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+
+	code := uuid.NewString()
+	idp.mu.Lock()
+	idp.pending[code] = pendingCode{challenge: q.Get("code_challenge"), claims: all}
+	idp.mu.Unlock()
+	return code
+}
+
+// memoryLoginStore is an OIDCLoginStore in a map
+type memoryLoginStore struct {
+	mu     sync.Mutex
+	logins map[string]*domain.OIDCLogin
+}
+
+func (s *memoryLoginStore) SaveOIDCLogin(state string, login *domain.OIDCLogin, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *login
+	s.logins[state] = &copied
+	return nil
+}
+
+func (s *memoryLoginStore) TakeOIDCLogin(state string) (*domain.OIDCLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login := s.logins[state]
+	delete(s.logins, state)
+	return login, nil
+}
+
+type oidcFixture struct {
+	*authFixture
+	idp  *mockIdP
+	oidc *usecase.OIDCUsecase
+}
+
+func newOIDCFixture(t *testing.T, allowSignup bool) *oidcFixture {
+	t.Helper()
+	return newOIDCFixtureWithMFA(t, allowSignup, usecase.MFAPolicy{})
+}
+
+func newOIDCFixtureWithMFA(t *testing.T, allowSignup bool, mfa usecase.MFAPolicy) *oidcFixture {
+	t.Helper()
+	f := &oidcFixture{authFixture: newAuthFixture(t, mfa, nil, usecase.LockoutPolicy{}), idp: newMockIdP(t)}
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       f.idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  "https://app.example.com/oidc/callback",
+	})
+	f.oidc = usecase.NewOIDCUsecase(f.auth, f.repo, &memoryLoginStore{logins: make(map[string]*domain.OIDCLogin)}, []usecase.OIDCProvider{
+		{Name: "idp", Provider: provider, AllowSignup: allowSignup},
+	})
+	return f
+}
+
+// login signs in with the provider, which says claims about the user
+func (f *oidcFixture) login(t *testing.T, claims jwt.MapClaims) (*domain.User, error) {
+	t.Helper()
+	result, err := f.loginResult(t, claims)
+	if err != nil {
+		return nil, err
+	}
+	return result.User, nil
+}
+
+func (f *oidcFixture) loginResult(t *testing.T, claims jwt.MapClaims) (*usecase.LoginResult, error) {
+	t.Helper()
+	authURL, state, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+	return f.oidc.FinishLogin("idp", f.idp.signIn(t, authURL, claims), state)
+}
+
+func TestOIDCLoginPKCERoundTrip(t *testing.T) {
+	f := newOIDCFixture(t, true)
+
+	authURL, state, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+	if got := mustQuery(t, authURL).Get("state"); got != state {
+		t.Fatalf("authorization URL state = %q, want %q", got, state)
+	}
+	code := f.idp.signIn(t, authURL, nil)
+
+	result, err := f.oidc.FinishLogin("idp", code, state)
+	if err != nil {
+		t.Fatalf("finish login: %v", err)
+	}
+	pair, user := result.Tokens, result.User
+	if pair == nil || pair.AccessToken == "" || pair.RefreshToken == "" {
+		t.Fatalf("login returned no tokens: %+v", pair)
+	}
+	if _, err := f.auth.ValidateToken(pair.AccessToken); err != nil {
+		t.Errorf("access token rejected: %v", err)
+	}
+	if user.Email != "ada@example.com" {
+		t.Errorf("signed in as %q", user.Email)
+	}
+
+	// The verifier sent to the token endpoint must be the one the challenge
+	// was made from, and never appear in the authorization URL
+	f.idp.mu.Lock()
+	verifier := f.idp.verifier
+	f.idp.mu.Unlock()
+	challenge := mustQuery(t, authURL).Get("code_challenge")
+	sum := sha256.Sum256([]byte(verifier))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		t.Errorf("verifier %q does not match challenge %q", verifier, challenge)
+	}
+	for _, values := range mustQuery(t, authURL) {
+		if values[0] == verifier {
+			t.Errorf("authorization URL leaks the code verifier")
+		}
+	}
+}
+
+func TestOIDCLoginRejectsCodeFromAnotherLogin(t *testing.T) {
+	f := newOIDCFixture(t, true)
+
+	firstURL, _, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+	_, secondState, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+
+	// The second login's verifier does not match the first login's
+	// challenge, so the provider refuses to redeem the code
+	code := f.idp.signIn(t, firstURL, nil)
+	if _, err := f.oidc.FinishLogin("idp", code, secondState); !errors.Is(err, usecase.ErrIdentityNotVerified) {
+		t.Errorf("code from another login: err = %v, want ErrIdentityNotVerified", err)
+	}
+}
+
+func TestOIDCLoginRejectsStateMismatch(t *testing.T) {
+	f := newOIDCFixture(t, true)
+
+	authURL, state, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+	code := f.idp.signIn(t, authURL, nil)
+
+	if _, err := f.oidc.FinishLogin("idp", code, "forged state"); !errors.Is(err, usecase.ErrInvalidLoginState) {
+		t.Errorf("unknown state: err = %v, want ErrInvalidLoginState", err)
+	}
+	if _, err := f.oidc.FinishLogin("idp", code, state); err != nil {
+		t.Fatalf("finish login: %v", err)
+	}
+	if _, err := f.oidc.FinishLogin("idp", code, state); !errors.Is(err, usecase.ErrInvalidLoginState) {
+		t.Errorf("state used twice: err = %v, want ErrInvalidLoginState", err)
+	}
+
+	// A state started for linking is no good for logging in, and the
+	// other way round
+	user := f.repo.addUser(&domain.User{ID: uuid.New(), Email: "grace@example.com", Username: "grace"})
+	linkURL, linkState, err := f.oidc.StartLink(user.ID, "idp")
+	if err != nil {
+		t.Fatalf("start link: %v", err)
+	}
+	if _, err := f.oidc.FinishLogin("idp", f.idp.signIn(t, linkURL, nil), linkState); !errors.Is(err, usecase.ErrInvalidLoginState) {
+		t.Errorf("link state used to log in: err = %v, want ErrInvalidLoginState", err)
+	}
+	loginURL, loginState, err := f.oidc.StartLogin("idp")
+	if err != nil {
+		t.Fatalf("start login: %v", err)
+	}
+	if err := f.oidc.FinishLink(user.ID, "idp", f.idp.signIn(t, loginURL, nil), loginState); !errors.Is(err, usecase.ErrInvalidLoginState) {
+		t.Errorf("login state used to link: err = %v, want ErrInvalidLoginState", err)
+	}
+}
+
+func TestOIDCLoginRejectsBadIDToken(t *testing.T) {
+	for name, claims := range map[string]jwt.MapClaims{
+		"nonce mismatch":  {"nonce": "replayed nonce"},
+		"wrong audience":  {"aud": "another-client"},
+		"wrong issuer":    {"iss": "https://evil.example.com"},
+		"expired":         {"exp": time.Now().Add(-time.Hour).Unix()},
+		"missing subject": {"sub": ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := newOIDCFixture(t, true)
+			if _, err := f.login(t, claims); !errors.Is(err, usecase.ErrIdentityNotVerified) {
+				t.Errorf("err = %v, want ErrIdentityNotVerified", err)
+			}
+			if f.repo.identityCount() != 0 {
+				t.Errorf("rejected login linked an identity")
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryRejectsWrongIssuer(t *testing.T) {
+	f := newOIDCFixture(t, true)
+	f.idp.mu.Lock()
+	f.idp.issuer = "https://evil.example.com"
+	f.idp.mu.Unlock()
+
+	if _, _, err := f.oidc.StartLogin("idp"); !errors.Is(err, usecase.ErrProviderUnavailable) {
+		t.Errorf("err = %v, want ErrProviderUnavailable", err)
+	}
+}
+
+func TestOIDCFirstLoginProvisioning(t *testing.T) {
+	t.Run("signup allowed", func(t *testing.T) {
+		f := newOIDCFixture(t, true)
+		user, err := f.login(t, jwt.MapClaims{"preferred_username": "ada"})
+		if err != nil {
+			t.Fatalf("first login: %v", err)
+		}
+		if user.Username != "ada" || !user.EmailVerified {
+			t.Errorf("new user = %+v, want username ada with a verified email", user)
+		}
+
+		again, err := f.login(t, jwt.MapClaims{"email": "ada@new-domain.example.com"})
+		if err != nil {
+			t.Fatalf("second login: %v", err)
+		}
+		if again.ID != user.ID {
+			t.Errorf("second login signed in as %s, want the linked user %s", again.ID, user.ID)
+		}
+	})
+
+	t.Run("signup not allowed", func(t *testing.T) {
+		f := newOIDCFixture(t, false)
+		if _, err := f.login(t, nil); !errors.Is(err, usecase.ErrIdentityNotLinked) {
+			t.Errorf("err = %v, want ErrIdentityNotLinked", err)
+		}
+		if _, err := f.repo.GetUserByEmail("ada@example.com"); err == nil {
+			t.Errorf("a user was created")
+		}
+	})
+
+	t.Run("email not verified by the provider", func(t *testing.T) {
+		f := newOIDCFixture(t, true)
+		if _, err := f.login(t, jwt.MapClaims{"email_verified": false}); !errors.Is(err, usecase.ErrIdentityNotLinked) {
+			t.Errorf("err = %v, want ErrIdentityNotLinked", err)
+		}
+	})
+}
+
+func TestOIDCLinksExistingUser(t *testing.T) {
+	t.Run("verified email", func(t *testing.T) {
+		f := newOIDCFixture(t, false)
+		existing := f.repo.addUser(&domain.User{ID: uuid.New(), Email: "ada@example.com", EmailVerified: true, Username: "ada"})
+
+		user, err := f.login(t, nil)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if user.ID != existing.ID {
+			t.Errorf("signed in as %s, want %s", user.ID, existing.ID)
+		}
+		if identity, err := f.repo.GetIdentity("idp", "subject-1"); err != nil || identity.UserID != existing.ID {
+			t.Errorf("identity = %+v, %v; want it linked to %s", identity, err, existing.ID)
+		}
+	})
+
+	t.Run("unverified email", func(t *testing.T) {
+		// Whoever registered the address first may not own it
+		f := newOIDCFixture(t, true)
+		existing := f.repo.addUser(&domain.User{ID: uuid.New(), Email: "ada@example.com", Username: "ada"})
+
+		if _, err := f.login(t, nil); !errors.Is(err, usecase.ErrIdentityNotLinked) {
+			t.Fatalf("err = %v, want ErrIdentityNotLinked", err)
+		}
+		if f.repo.identityCount() != 0 {
+			t.Fatalf("identity linked to an unverified account")
+		}
+
+		// The account's owner links it while signed in instead
+		linkURL, state, err := f.oidc.StartLink(existing.ID, "idp")
+		if err != nil {
+			t.Fatalf("start link: %v", err)
+		}
+		if err := f.oidc.FinishLink(existing.ID, "idp", f.idp.signIn(t, linkURL, nil), state); err != nil {
+			t.Fatalf("finish link: %v", err)
+		}
+		user, err := f.login(t, nil)
+		if err != nil {
+			t.Fatalf("login after linking: %v", err)
+		}
+		if user.ID != existing.ID {
+			t.Errorf("signed in as %s, want %s", user.ID, existing.ID)
+		}
+	})
+
+	t.Run("identity linked to someone else", func(t *testing.T) {
+		f := newOIDCFixture(t, true)
+		first, err := f.login(t, nil)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		other := f.repo.addUser(&domain.User{ID: uuid.New(), Email: "grace@example.com", Username: "grace"})
+
+		linkURL, state, err := f.oidc.StartLink(other.ID, "idp")
+		if err != nil {
+			t.Fatalf("start link: %v", err)
+		}
+		if err := f.oidc.FinishLink(other.ID, "idp", f.idp.signIn(t, linkURL, nil), state); !errors.Is(err, usecase.ErrIdentityInUse) {
+			t.Errorf("err = %v, want ErrIdentityInUse", err)
+		}
+		if identity, _ := f.repo.GetIdentity("idp", "subject-1"); identity == nil || identity.UserID != first.ID {
+			t.Errorf("identity moved to another user: %+v", identity)
+		}
+	})
+}
+
+func TestOIDCLoginAsksForSecondFactor(t *testing.T) {
+	t.Run("two-factor authentication on", func(t *testing.T) {
+		f := newOIDCFixture(t, false)
+		f.repo.addUser(&domain.User{ID: uuid.New(), Email: "ada@example.com", EmailVerified: true, Username: "ada", TOTPEnabled: true})
+
+		result, err := f.loginResult(t, nil)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if result.Tokens != nil || result.MFAToken == "" || result.MFASetupRequired {
+			t.Errorf("result = %+v, want an MFA token to verify and no tokens", result)
+		}
+	})
+
+	t.Run("two-factor authentication required", func(t *testing.T) {
+		f := newOIDCFixtureWithMFA(t, true, usecase.MFAPolicy{Required: true})
+
+		result, err := f.loginResult(t, nil)
+		if err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if result.Tokens != nil || result.MFAToken == "" || !result.MFASetupRequired {
+			t.Errorf("result = %+v, want an MFA token to set up with and no tokens", result)
+		}
+		// The MFA token must not work as an access token
+		if _, err := f.auth.ValidateToken(result.MFAToken); err == nil {
+			t.Errorf("MFA token accepted as an access token")
+		}
+	})
+}
+
+func mustQuery(t *testing.T, rawURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse %q: %v", rawURL, err)
+	}
+	return u.Query()
+}
@@ -0,0 +1,197 @@
+package usecase
+
+import (
+	"errors"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidRole          = errors.New("invalid role")
+	ErrOwnerAccess          = errors.New("the owner's access cannot be changed; transfer ownership instead")
+	ErrPermissionNotFound   = errors.New("user has no access to the document")
+	ErrEmailNotVerified     = errors.New("verify your email address before sharing documents")
+	ErrRecipientNotVerified = errors.New("documents can only be shared with users who have verified their email address")
+)
+
+// ListPermissions returns who has access to a document and with what role.
+// Anyone with access can see it.
+func (d *DocumentUsecase) ListPermissions(userID, docID uuid.UUID) ([]*domain.DocumentPermission, error) {
+	if _, _, err := d.access.Authorize(userID, docID, ActionView); err != nil {
+		return nil, err
+	}
+
+	return d.repo.GetDocumentPermissions(docID)
+}
+
+// ChangeRole changes the role of someone who already has access to a
+// document the caller owns
+func (d *DocumentUsecase) ChangeRole(ownerID, docID, userID uuid.UUID, role domain.Role) (*domain.DocumentPermission, error) {
+	return d.grant(ownerID, docID, userID, role, false)
+}
+
+// grant sets userID's role on a document ownerID owns. Unless create is set,
+// userID must already have access.
+func (d *DocumentUsecase) grant(ownerID, docID, userID uuid.UUID, role domain.Role, create bool) (*domain.DocumentPermission, error) {
+	// Ownership only changes hands through TransferOwnership
+	if role != domain.RoleEditor && role != domain.RoleCommenter && role != domain.RoleViewer {
+		return nil, ErrInvalidRole
+	}
+	if _, _, err := d.access.Authorize(ownerID, docID, ActionAdmin); err != nil {
+		return nil, err
+	}
+	if userID == ownerID {
+		return nil, ErrOwnerAccess
+	}
+
+	perm, err := d.repo.GetPermission(userID, docID)
+	switch {
+	case err == nil:
+		if perm.Role == domain.RoleOwner {
+			return nil, ErrOwnerAccess
+		}
+		perm.Role = role
+		perm.UpdatedAt = time.Now()
+		if err := d.repo.UpdatePermission(perm); err != nil {
+			return nil, err
+		}
+		return perm, nil
+
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return nil, err
+	case !create:
+		return nil, ErrPermissionNotFound
+	}
+
+	if err := d.checkCanShareWith(ownerID, userID); err != nil {
+		return nil, err
+	}
+	perm = &domain.DocumentPermission{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     userID,
+		Role:       role,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	if err := d.repo.CreatePermission(perm); err != nil {
+		return nil, err
+	}
+	return perm, nil
+}
+
+// checkCanShare makes sure userID may give others access, when sharing
+// requires a verified email
+func (d *DocumentUsecase) checkCanShare(userID uuid.UUID) error {
+	if !d.sharing.RequireVerifiedEmail {
+		return nil
+	}
+	user, err := d.repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	if !user.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// checkCanShareWith makes sure ownerID may give userID access: userID has
+// to exist and, when sharing requires it, both have verified their email
+func (d *DocumentUsecase) checkCanShareWith(ownerID, userID uuid.UUID) error {
+	if err := d.checkCanShare(ownerID); err != nil {
+		return err
+	}
+	user, err := d.repo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	if d.sharing.RequireVerifiedEmail && !user.EmailVerified {
+		return ErrRecipientNotVerified
+	}
+	return nil
+}
+
+// RevokePermission takes away userID's access to a document. The owner can
+// revoke anyone else's access and everyone else can give up their own.
+func (d *DocumentUsecase) RevokePermission(requesterID, docID, userID uuid.UUID) error {
+	action := ActionAdmin
+	if requesterID == userID {
+		action = ActionView
+	}
+	doc, _, err := d.access.Authorize(requesterID, docID, action)
+	if err != nil {
+		return err
+	}
+	if userID == doc.OwnerID {
+		return ErrOwnerAccess
+	}
+
+	if _, err := d.repo.GetPermission(userID, docID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPermissionNotFound
+		}
+		return err
+	}
+	if err := d.repo.DeletePermission(docID, userID); err != nil {
+		return err
+	}
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     requesterID,
+		Action:     "access_revoked",
+		Details:    userID.String(),
+		CreatedAt:  time.Now(),
+	}
+	d.repo.CreateActivity(activity)
+
+	return nil
+}
+
+// TransferOwnership makes newOwnerID the owner of a document. Someone who
+// has no access yet is given it, under the same rules as sharing. The
+// previous owner stays on as an editor.
+func (d *DocumentUsecase) TransferOwnership(ownerID, docID, newOwnerID uuid.UUID) (*domain.Document, error) {
+	doc, _, err := d.access.Authorize(ownerID, docID, ActionAdmin)
+	if err != nil {
+		return nil, err
+	}
+	if newOwnerID == ownerID {
+		return doc, nil
+	}
+
+	_, err = d.repo.GetPermission(newOwnerID, docID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = d.checkCanShareWith(ownerID, newOwnerID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := d.repo.TransferOwnership(docID, ownerID, newOwnerID); err != nil {
+		return nil, err
+	}
+	doc.OwnerID = newOwnerID
+
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     ownerID,
+		Action:     "ownership_transferred",
+		Details:    newOwnerID.String(),
+		CreatedAt:  time.Now(),
+	}
+	d.repo.CreateActivity(activity)
+
+	return doc, nil
+}
@@ -0,0 +1,184 @@
+package usecase_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// role returns userID's stored role on the fixture's document, empty if
+// they have no permission row
+func (f *collabFixture) role(userID uuid.UUID) domain.Role {
+	perm, err := f.repo.GetPermission(userID, f.docID)
+	if err != nil {
+		return ""
+	}
+	return perm.Role
+}
+
+// requireVerifiedEmail makes f.documents enforce verified emails on sharing
+func (f *collabFixture) requireVerifiedEmail() {
+	access := usecase.NewAccessPolicy(f.repo, f.links)
+	f.documents = usecase.NewDocumentUsecase(f.docRepo, access, usecase.SharingPolicy{RequireVerifiedEmail: true})
+}
+
+func TestShareAndChangeRole(t *testing.T) {
+	f := newCollabFixture(t, "")
+	reader := f.docRepo.addUser(uuid.New(), false)
+
+	if err := f.documents.ShareDocument(f.owner, f.docID, reader, domain.RoleViewer); err != nil {
+		t.Fatalf("share: %v", err)
+	}
+	if _, err := f.documents.ChangeRole(f.owner, f.docID, reader, domain.RoleCommenter); err != nil {
+		t.Fatalf("change role: %v", err)
+	}
+	if got := f.role(reader); got != domain.RoleCommenter {
+		t.Errorf("role = %q, want commenter", got)
+	}
+
+	stranger := f.docRepo.addUser(uuid.New(), true)
+	for name, tt := range map[string]struct {
+		call func() error
+		want error
+	}{
+		"change role of someone without access": {call: func() error {
+			_, err := f.documents.ChangeRole(f.owner, f.docID, stranger, domain.RoleEditor)
+			return err
+		}, want: usecase.ErrPermissionNotFound},
+		"share with an unknown user": {call: func() error {
+			return f.documents.ShareDocument(f.owner, f.docID, uuid.New(), domain.RoleViewer)
+		}, want: usecase.ErrUserNotFound},
+		"make someone an owner": {call: func() error {
+			return f.documents.ShareDocument(f.owner, f.docID, stranger, domain.RoleOwner)
+		}, want: usecase.ErrInvalidRole},
+		"change the owner's role": {call: func() error {
+			_, err := f.documents.ChangeRole(f.owner, f.docID, f.owner, domain.RoleViewer)
+			return err
+		}, want: usecase.ErrOwnerAccess},
+		"share as an editor": {call: func() error {
+			return f.documents.ShareDocument(f.editor, f.docID, stranger, domain.RoleViewer)
+		}, want: usecase.ErrPermissionDenied},
+	} {
+		if err := tt.call(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", name, err, tt.want)
+		}
+	}
+	if got := f.role(stranger); got != "" {
+		t.Errorf("refused changes gave the stranger role %q", got)
+	}
+}
+
+func TestSharingRequiresVerifiedEmails(t *testing.T) {
+	f := newCollabFixture(t, "")
+	f.requireVerifiedEmail()
+	unverified := f.docRepo.addUser(uuid.New(), false)
+	verified := f.docRepo.addUser(uuid.New(), true)
+
+	f.docRepo.addUser(f.owner, false)
+	if err := f.documents.ShareDocument(f.owner, f.docID, verified, domain.RoleViewer); !errors.Is(err, usecase.ErrEmailNotVerified) {
+		t.Errorf("unverified owner: err = %v, want ErrEmailNotVerified", err)
+	}
+
+	f.docRepo.addUser(f.owner, true)
+	if err := f.documents.ShareDocument(f.owner, f.docID, unverified, domain.RoleViewer); !errors.Is(err, usecase.ErrRecipientNotVerified) {
+		t.Errorf("unverified recipient: err = %v, want ErrRecipientNotVerified", err)
+	}
+	if err := f.documents.ShareDocument(f.owner, f.docID, verified, domain.RoleViewer); err != nil {
+		t.Errorf("both verified: %v", err)
+	}
+	// Role changes are not sharing anew
+	if _, err := f.documents.ChangeRole(f.owner, f.docID, f.editor, domain.RoleViewer); err != nil {
+		t.Errorf("change the role of an unverified editor: %v", err)
+	}
+}
+
+func TestRevokePermission(t *testing.T) {
+	f := newCollabFixture(t, "")
+	viewer := uuid.New()
+	f.repo.share(f.docID, viewer, domain.RoleViewer)
+
+	if err := f.documents.RevokePermission(f.editor, f.docID, viewer); !errors.Is(err, usecase.ErrPermissionDenied) {
+		t.Errorf("editor revoking someone else: err = %v, want ErrPermissionDenied", err)
+	}
+	if err := f.documents.RevokePermission(f.owner, f.docID, f.owner); !errors.Is(err, usecase.ErrOwnerAccess) {
+		t.Errorf("revoking the owner: err = %v, want ErrOwnerAccess", err)
+	}
+	if err := f.documents.RevokePermission(f.owner, f.docID, uuid.New()); !errors.Is(err, usecase.ErrPermissionNotFound) {
+		t.Errorf("revoking a stranger: err = %v, want ErrPermissionNotFound", err)
+	}
+
+	if err := f.documents.RevokePermission(viewer, f.docID, viewer); err != nil {
+		t.Errorf("giving up one's own access: %v", err)
+	}
+	if err := f.documents.RevokePermission(f.owner, f.docID, f.editor); err != nil {
+		t.Errorf("owner revoking the editor: %v", err)
+	}
+	if f.role(viewer) != "" || f.role(f.editor) != "" {
+		t.Errorf("roles left after revoking: %q, %q", f.role(viewer), f.role(f.editor))
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	t.Run("to a collaborator", func(t *testing.T) {
+		f := newCollabFixture(t, "")
+		doc, err := f.documents.TransferOwnership(f.owner, f.docID, f.editor)
+		if err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+		if doc.OwnerID != f.editor || f.repo.document(t, f.docID).OwnerID != f.editor {
+			t.Errorf("owner = %s, want the editor", doc.OwnerID)
+		}
+		if f.role(f.editor) != domain.RoleOwner || f.role(f.owner) != domain.RoleEditor {
+			t.Errorf("roles = %q for the new owner, %q for the old one", f.role(f.editor), f.role(f.owner))
+		}
+		// The old owner can no longer hand it back
+		if _, err := f.documents.TransferOwnership(f.owner, f.docID, f.owner); !errors.Is(err, usecase.ErrPermissionDenied) {
+			t.Errorf("transfer by the old owner: err = %v, want ErrPermissionDenied", err)
+		}
+	})
+
+	t.Run("to someone without access", func(t *testing.T) {
+		f := newCollabFixture(t, "")
+		newcomer := f.docRepo.addUser(uuid.New(), false)
+		if _, err := f.documents.TransferOwnership(f.owner, f.docID, newcomer); err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+		if f.repo.document(t, f.docID).OwnerID != newcomer || f.role(newcomer) != domain.RoleOwner {
+			t.Errorf("newcomer has role %q, want to own the document", f.role(newcomer))
+		}
+		if f.role(f.owner) != domain.RoleEditor {
+			t.Errorf("old owner has role %q, want editor", f.role(f.owner))
+		}
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		f := newCollabFixture(t, "")
+		f.requireVerifiedEmail()
+		f.docRepo.addUser(f.owner, true)
+		unverified := f.docRepo.addUser(uuid.New(), false)
+
+		for name, tt := range map[string]struct {
+			from, to uuid.UUID
+			want     error
+		}{
+			"by an editor":              {f.editor, f.editor, usecase.ErrPermissionDenied},
+			"to an unknown user":        {f.owner, uuid.New(), usecase.ErrUserNotFound},
+			"to an unverified newcomer": {f.owner, unverified, usecase.ErrRecipientNotVerified},
+		} {
+			if _, err := f.documents.TransferOwnership(tt.from, f.docID, tt.to); !errors.Is(err, tt.want) {
+				t.Errorf("%s: err = %v, want %v", name, err, tt.want)
+			}
+		}
+		if f.repo.document(t, f.docID).OwnerID != f.owner || f.role(unverified) != "" {
+			t.Errorf("a refused transfer changed the document's access")
+		}
+
+		// A collaborator who was given access before needs nothing more
+		if _, err := f.documents.TransferOwnership(f.owner, f.docID, f.editor); err != nil {
+			t.Errorf("transfer to the unverified editor: %v", err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package usecase
+
+import (
+	"errors"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Action is something a user can do with a document
+type Action int
+
+const (
+	ActionView Action = iota
+	ActionComment
+	ActionEdit
+	// ActionAdmin covers sharing, deleting and handing the document over
+	ActionAdmin
+)
+
+// PolicyRepository is what access decisions are made from
+type PolicyRepository interface {
+	GetDocumentByID(id uuid.UUID) (*domain.Document, error)
+	GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error)
+}
+
+// AccessPolicy decides what each user may do with each document. The
+// document, task, collaboration and presence usecases all ask it rather than
+// reading permissions themselves.
+//
+// A user's role is the best of owning the document, their own permission and
+// the role of the share link they joined a live session through.
+type AccessPolicy struct {
+	repo  PolicyRepository
+	links *LinkSessions
+}
+
+func NewAccessPolicy(repo PolicyRepository, links *LinkSessions) *AccessPolicy {
+	return &AccessPolicy{repo: repo, links: links}
+}
+
+// Authorize loads a document and checks that userID may take action on it.
+// It fails with ErrDocumentNotFound for documents that do not exist or are
+// in the trash, ErrReadOnly when userID can see the document but not make
+// the change, and ErrPermissionDenied otherwise.
+func (a *AccessPolicy) Authorize(userID, docID uuid.UUID, action Action) (*domain.Document, domain.Role, error) {
+	doc, err := a.repo.GetDocumentByID(docID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrDocumentNotFound
+		}
+		return nil, "", err
+	}
+
+	role, err := a.role(userID, doc)
+	if err != nil {
+		return nil, "", err
+	}
+	if !role.CanView() {
+		return nil, "", ErrPermissionDenied
+	}
+	if !allows(role, action) {
+		if action == ActionAdmin {
+			return nil, "", ErrPermissionDenied
+		}
+		return nil, "", ErrReadOnly
+	}
+	return doc, role, nil
+}
+
+// role works out userID's role on doc, empty if they have none
+func (a *AccessPolicy) role(userID uuid.UUID, doc *domain.Document) (domain.Role, error) {
+	if userID == doc.OwnerID {
+		return domain.RoleOwner, nil
+	}
+
+	var role domain.Role
+	perm, err := a.repo.GetPermission(userID, doc.ID)
+	switch {
+	case err == nil:
+		role = perm.Role
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return "", err
+	}
+
+	// No link grants more than an editor already has
+	if roleRank(role) >= roleRank(domain.RoleEditor) {
+		return role, nil
+	}
+	sessions, err := a.links.active(userID, doc.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, session := range sessions {
+		// Links that were disabled, rotated, expired or given a new
+		// password since the session joined no longer count
+		if checkShareLink(doc, session.Token) != nil || doc.SharePassword != session.Password {
+			continue
+		}
+		if linkRole := doc.ShareLink().Role; roleRank(linkRole) > roleRank(role) {
+			role = linkRole
+		}
+		break
+	}
+	return role, nil
+}
+
+// guestName is the name userID goes by on a document if they are a guest
+func (a *AccessPolicy) guestName(userID, docID uuid.UUID) string {
+	return a.links.guestName(userID, docID)
+}
+
+func allows(role domain.Role, action Action) bool {
+	switch action {
+	case ActionView:
+		return role.CanView()
+	case ActionComment:
+		return role.CanComment()
+	case ActionEdit:
+		return role.CanEdit()
+	case ActionAdmin:
+		return role == domain.RoleOwner
+	}
+	return false
+}
+
+func roleRank(role domain.Role) int {
+	switch role {
+	case domain.RoleOwner:
+		return 4
+	case domain.RoleEditor:
+		return 3
+	case domain.RoleCommenter:
+		return 2
+	case domain.RoleViewer:
+		return 1
+	}
+	return 0
+}
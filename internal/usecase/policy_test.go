@@ -0,0 +1,116 @@
+package usecase_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+func TestAuthorizeRoles(t *testing.T) {
+	f := newCollabFixture(t, "")
+	viewer, stranger := uuid.New(), uuid.New()
+	f.repo.share(f.docID, viewer, domain.RoleViewer)
+	policy := usecase.NewAccessPolicy(f.repo, f.links)
+
+	tests := []struct {
+		name   string
+		user   uuid.UUID
+		action usecase.Action
+		role   domain.Role
+		err    error
+	}{
+		{"owner administers", f.owner, usecase.ActionAdmin, domain.RoleOwner, nil},
+		{"editor edits", f.editor, usecase.ActionEdit, domain.RoleEditor, nil},
+		{"editor cannot administer", f.editor, usecase.ActionAdmin, "", usecase.ErrPermissionDenied},
+		{"viewer views", viewer, usecase.ActionView, domain.RoleViewer, nil},
+		{"viewer cannot comment", viewer, usecase.ActionComment, "", usecase.ErrReadOnly},
+		{"stranger cannot view", stranger, usecase.ActionView, "", usecase.ErrPermissionDenied},
+	}
+	for _, tt := range tests {
+		doc, role, err := policy.Authorize(tt.user, f.docID, tt.action)
+		if !errors.Is(err, tt.err) || role != tt.role {
+			t.Errorf("%s: role %q, err %v; want %q, %v", tt.name, role, err, tt.role, tt.err)
+		}
+		if err == nil && doc.ID != f.docID {
+			t.Errorf("%s: authorized document %s", tt.name, doc.ID)
+		}
+	}
+
+	if _, _, err := policy.Authorize(f.owner, uuid.New(), usecase.ActionView); !errors.Is(err, usecase.ErrDocumentNotFound) {
+		t.Errorf("missing document: err = %v, want ErrDocumentNotFound", err)
+	}
+	if err := f.documents.DeleteDocument(f.owner, f.docID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, _, err := policy.Authorize(f.owner, f.docID, usecase.ActionView); !errors.Is(err, usecase.ErrDocumentNotFound) {
+		t.Errorf("trashed document: err = %v, want ErrDocumentNotFound", err)
+	}
+}
+
+func TestAuthorizeThroughShareLinks(t *testing.T) {
+	f := newCollabFixture(t, "")
+	viewer := uuid.New()
+	f.repo.share(f.docID, viewer, domain.RoleViewer)
+	token := f.shareLink(t, usecase.ShareLinkInput{Role: domain.RoleCommenter})
+	// Another node, which sees the same link sessions
+	otherNode := usecase.NewAccessPolicy(f.repo, f.links)
+
+	role := func(userID uuid.UUID) domain.Role {
+		t.Helper()
+		_, role, err := otherNode.Authorize(userID, f.docID, usecase.ActionView)
+		if errors.Is(err, usecase.ErrPermissionDenied) {
+			return ""
+		}
+		if err != nil {
+			t.Fatalf("authorize: %v", err)
+		}
+		return role
+	}
+
+	guest, err := f.documents.JoinShareLink(token, "", nil, "Ann")
+	if err != nil {
+		t.Fatalf("guest join: %v", err)
+	}
+	upgraded, err := f.documents.JoinShareLink(token, "", &viewer, "")
+	if err != nil {
+		t.Fatalf("viewer join: %v", err)
+	}
+	if _, err := f.documents.JoinShareLink(token, "", &f.editor, ""); err != nil {
+		t.Fatalf("editor join: %v", err)
+	}
+	if role(guest.UserID) != domain.RoleCommenter || role(viewer) != domain.RoleCommenter {
+		t.Errorf("through the link: guest %q, viewer %q, want commenter", role(guest.UserID), role(viewer))
+	}
+	if role(f.editor) != domain.RoleEditor {
+		t.Errorf("editor through a commenter link = %q, want their own editor role", role(f.editor))
+	}
+
+	// Expiry takes the link's role away until it is lifted
+	f.docRepo.change(f.docID, func(doc *domain.Document) {
+		past := time.Now().Add(-time.Second)
+		doc.ShareExpiresAt = &past
+	})
+	if role(guest.UserID) != "" || role(viewer) != domain.RoleViewer {
+		t.Errorf("expired link: guest %q, viewer %q, want nothing and viewer", role(guest.UserID), role(viewer))
+	}
+	f.shareLink(t, usecase.ShareLinkInput{})
+	if role(guest.UserID) != domain.RoleCommenter {
+		t.Errorf("after lifting the expiry: guest %q, want commenter", role(guest.UserID))
+	}
+
+	// Leaving ends one connection's session; rotating ends them all
+	upgraded.Leave()
+	if role(viewer) != domain.RoleViewer {
+		t.Errorf("after leaving: viewer %q, want viewer", role(viewer))
+	}
+	if _, err := f.documents.RotateShareToken(f.owner, f.docID); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if role(guest.UserID) != "" {
+		t.Errorf("rotated link: guest %q, want nothing", role(guest.UserID))
+	}
+}
@@ -0,0 +1,171 @@
+package usecase
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/collab-platform/backend/internal/domain"
+)
+
+// PositionError reports an operation offset that does not fall on a
+// character boundary, or lies outside the document
+type PositionError struct {
+	Unit   domain.IndexUnit
+	Offset int
+	Reason string
+}
+
+func (e *PositionError) Error() string {
+	return fmt.Sprintf("invalid %s offset %d: %s", e.Unit, e.Offset, e.Reason)
+}
+
+func (e *PositionError) Unwrap() error {
+	return ErrInvalidOperation
+}
+
+func normalizeUnit(unit domain.IndexUnit) domain.IndexUnit {
+	if unit == "" {
+		return domain.UnitUTF16
+	}
+	return unit
+}
+
+func validUnit(unit domain.IndexUnit) bool {
+	switch unit {
+	case "", domain.UnitUTF16, domain.UnitRune, domain.UnitByte:
+		return true
+	}
+	return false
+}
+
+// utf16Len is the number of UTF-16 code units needed to encode r
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// textLength measures s in the given unit
+func textLength(s string, unit domain.IndexUnit) int {
+	switch normalizeUnit(unit) {
+	case domain.UnitByte:
+		return len(s)
+	case domain.UnitRune:
+		return utf8.RuneCountInString(s)
+	}
+	n := 0
+	for _, r := range s {
+		n += utf16Len(r)
+	}
+	return n
+}
+
+// toRuneOffset converts an offset into text from unit to a rune index. Offsets
+// that would split a surrogate pair or a multi-byte UTF-8 sequence are rejected.
+func toRuneOffset(text string, offset int, unit domain.IndexUnit) (int, error) {
+	unit = normalizeUnit(unit)
+	if offset < 0 {
+		return 0, &PositionError{Unit: unit, Offset: offset, Reason: "negative offset"}
+	}
+
+	switch unit {
+	case domain.UnitRune:
+		if offset > utf8.RuneCountInString(text) {
+			return 0, &PositionError{Unit: unit, Offset: offset, Reason: "past end of document"}
+		}
+		return offset, nil
+
+	case domain.UnitByte:
+		if offset > len(text) {
+			return 0, &PositionError{Unit: unit, Offset: offset, Reason: "past end of document"}
+		}
+		if offset < len(text) && !utf8.RuneStart(text[offset]) {
+			return 0, &PositionError{Unit: unit, Offset: offset, Reason: "inside a multi-byte UTF-8 sequence"}
+		}
+		return utf8.RuneCountInString(text[:offset]), nil
+	}
+
+	units, runes := 0, 0
+	for _, r := range text {
+		if units == offset {
+			return runes, nil
+		}
+		units += utf16Len(r)
+		if units > offset {
+			return 0, &PositionError{Unit: unit, Offset: offset, Reason: "inside a surrogate pair"}
+		}
+		runes++
+	}
+	if units == offset {
+		return runes, nil
+	}
+	return 0, &PositionError{Unit: unit, Offset: offset, Reason: "past end of document"}
+}
+
+// fromRuneOffset converts a rune index into text to an offset in unit
+func fromRuneOffset(text string, runeOffset int, unit domain.IndexUnit) int {
+	if normalizeUnit(unit) == domain.UnitRune {
+		return runeOffset
+	}
+	prefix := text
+	i := 0
+	for byteIdx := range text {
+		if i == runeOffset {
+			prefix = text[:byteIdx]
+			break
+		}
+		i++
+	}
+	return textLength(prefix, unit)
+}
+
+// toRuneRange converts [offset, offset+length) in unit to a rune offset and length
+func toRuneRange(text string, offset, length int, unit domain.IndexUnit) (int, int, error) {
+	start, err := toRuneOffset(text, offset, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := toRuneOffset(text, offset+length, unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end - start, nil
+}
+
+// normalizePositions converts a position-addressed operation to UTF-16 units,
+// the unit of the operation log. Rune and byte offsets can only be converted
+// against the text they were written for, which for an operation based on an
+// older version is the text at that version.
+func normalizePositions(text string, op domain.Operation) (domain.Operation, error) {
+	unit := normalizeUnit(op.Unit)
+	if unit == domain.UnitUTF16 || isIDAddressed(op) {
+		op.Unit = domain.UnitUTF16
+		return op, nil
+	}
+
+	switch op.Type {
+	case "insert":
+		pos, err := toRuneOffset(text, op.Position, unit)
+		if err != nil {
+			return op, err
+		}
+		op.Position = fromRuneOffset(text, pos, domain.UnitUTF16)
+		op.Unit = domain.UnitUTF16
+	case "delete", "format":
+		start, n, err := toRuneRange(text, op.Position, op.Length, unit)
+		if err != nil {
+			return op, err
+		}
+		op = withUTF16Range(op, text, start, n)
+	}
+	return op, nil
+}
+
+// withUTF16Range sets op's position to the rune range [start, start+n) of text, in UTF-16 units
+func withUTF16Range(op domain.Operation, text string, start, n int) domain.Operation {
+	op.Position = fromRuneOffset(text, start, domain.UnitUTF16)
+	op.Length = fromRuneOffset(text, start+n, domain.UnitUTF16) - op.Position
+	op.Unit = domain.UnitUTF16
+	return op
+}
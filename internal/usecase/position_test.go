@@ -0,0 +1,138 @@
+package usecase_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+)
+
+func inUnit(op domain.Operation, unit domain.IndexUnit) domain.Operation {
+	op.Unit = unit
+	return op
+}
+
+func TestOperationUnits(t *testing.T) {
+	// 😀 is two UTF-16 units and four bytes, é one unit and two bytes
+	const text = "a😀é!"
+	tests := []struct {
+		name     string
+		op       domain.Operation
+		want     string
+		position int // Of the committed operation, in UTF-16 units
+		length   int
+	}{
+		{"utf16 insert after a surrogate pair", insert(3, "X"), "a😀Xé!", 3, 1},
+		{"rune insert after a surrogate pair", inUnit(insert(2, "X"), domain.UnitRune), "a😀Xé!", 3, 1},
+		{"byte insert after a surrogate pair", inUnit(insert(5, "X"), domain.UnitByte), "a😀Xé!", 3, 1},
+		{"byte insert after a two-byte rune", inUnit(insert(7, "X"), domain.UnitByte), "a😀éX!", 4, 1},
+		{"utf16 delete of a surrogate pair", del(1, 2), "aé!", 1, 2},
+		{"rune delete of a surrogate pair", inUnit(del(1, 1), domain.UnitRune), "aé!", 1, 2},
+		{"byte delete of multi-byte runes", inUnit(del(1, 6), domain.UnitByte), "a!", 1, 3},
+		{"insert of a surrogate pair", insert(4, "🎉"), "a😀é🎉!", 4, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCollabFixture(t, text)
+			committed := f.apply(t, f.editor, tt.op)
+			if got := f.content(t); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if len(committed) != 1 {
+				t.Fatalf("committed as %d operations, want 1", len(committed))
+			}
+			c := committed[0]
+			if c.Unit != domain.UnitUTF16 || c.Position != tt.position || c.Length != tt.length {
+				t.Errorf("committed at %d+%d %s, want %d+%d utf16", c.Position, c.Length, c.Unit, tt.position, tt.length)
+			}
+		})
+	}
+}
+
+func TestOperationPositionErrors(t *testing.T) {
+	const text = "a😀é!🎉"
+	tests := []struct {
+		name   string
+		op     domain.Operation
+		unit   domain.IndexUnit
+		offset int
+		reason string
+	}{
+		{"utf16 offset inside a surrogate pair", insert(2, "X"), domain.UnitUTF16, 2, "inside a surrogate pair"},
+		{"utf16 delete ending inside a surrogate pair", del(0, 2), domain.UnitUTF16, 2, "inside a surrogate pair"},
+		{"utf16 offset inside the last surrogate pair", insert(6, "X"), domain.UnitUTF16, 6, "inside a surrogate pair"},
+		{"utf16 offset past the end", insert(8, "X"), domain.UnitUTF16, 8, "past end of document"},
+		{"byte offset inside a four-byte rune", inUnit(insert(3, "X"), domain.UnitByte), domain.UnitByte, 3, "inside a multi-byte UTF-8 sequence"},
+		{"byte delete ending inside a two-byte rune", inUnit(del(1, 5), domain.UnitByte), domain.UnitByte, 6, "inside a multi-byte UTF-8 sequence"},
+		{"byte offset past the end", inUnit(insert(13, "X"), domain.UnitByte), domain.UnitByte, 13, "past end of document"},
+		{"rune offset past the end", inUnit(insert(6, "X"), domain.UnitRune), domain.UnitRune, 6, "past end of document"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCollabFixture(t, text)
+			_, _, err := f.collab.ApplyOperation(f.editor, f.docID, tt.op)
+
+			var posErr *usecase.PositionError
+			if !errors.As(err, &posErr) {
+				t.Fatalf("err = %v, want a PositionError", err)
+			}
+			if posErr.Unit != tt.unit || posErr.Offset != tt.offset || posErr.Reason != tt.reason {
+				t.Errorf("err = %+v, want %s offset %d %s", posErr, tt.unit, tt.offset, tt.reason)
+			}
+			if !errors.Is(err, usecase.ErrInvalidOperation) {
+				t.Errorf("PositionError does not match ErrInvalidOperation")
+			}
+			if got := f.content(t); got != text {
+				t.Errorf("content = %q, want it unchanged", got)
+			}
+		})
+	}
+}
+
+func TestStaleRuneAndByteOffsetsCountIntoTheBaseVersion(t *testing.T) {
+	// Everyone else's edits move the text in the current version: "é" is at
+	// byte 1 of the base version but byte 6 now
+	setup := func(t *testing.T) *collabFixture {
+		f := newCollabFixture(t, "héllo wörld")
+		f.apply(t, f.owner, insert(0, "😀 "))
+		f.apply(t, f.owner, del(8, 1))
+		f.apply(t, f.owner, insert(8, ", 🎉"))
+		if got := f.content(t); got != "😀 héllo, 🎉wörld" {
+			t.Fatalf("content = %q", got)
+		}
+		return f
+	}
+
+	tests := []struct {
+		name string
+		op   domain.Operation
+		want string
+	}{
+		{"byte delete", inUnit(del(1, 2), domain.UnitByte), "😀 hllo, 🎉wörld"},
+		{"rune insert", inUnit(insert(9, "!"), domain.UnitRune), "😀 héllo, 🎉wör!ld"},
+		{"byte format of deleted text", inUnit(format(6, 1), domain.UnitByte), "😀 héllo, 🎉wörld"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := setup(t)
+			op := tt.op
+			op.BaseVersion = base(0)
+			f.apply(t, f.editor, op)
+			if got := f.content(t); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("offset checked against the base version", func(t *testing.T) {
+		f := setup(t)
+		// Byte 9 is inside "ö" in the base version, but a boundary now
+		op := inUnit(insert(9, "X"), domain.UnitByte)
+		op.BaseVersion = base(0)
+		var posErr *usecase.PositionError
+		if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, op); !errors.As(err, &posErr) {
+			t.Errorf("err = %v, want a PositionError", err)
+		}
+	})
+}
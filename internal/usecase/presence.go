@@ -0,0 +1,243 @@
+package usecase
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+// PresenceStore keeps presence records where every node can see them.
+// Records that are not saved again within their TTL disappear.
+type PresenceStore interface {
+	SavePresence(presence *domain.Presence, ttl time.Duration) error
+	RemovePresence(docID, sessionID uuid.UUID) error
+	ListPresence(docID uuid.UUID) ([]*domain.Presence, error)
+}
+
+// PresenceTTL is how long a presence record outlives its last refresh; live
+// connections refresh theirs on every pong
+const PresenceTTL = 2 * time.Minute
+
+// presenceColors is the palette users are assigned from
+var presenceColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#469990", "#9a6324", "#800000", "#808000", "#000075",
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type PresenceUsecase struct {
+	repo   CollaborationRepository
+	store  PresenceStore
+	access *AccessPolicy
+}
+
+func NewPresenceUsecase(repo CollaborationRepository, store PresenceStore, access *AccessPolicy) *PresenceUsecase {
+	return &PresenceUsecase{repo: repo, store: store, access: access}
+}
+
+// Join starts sharing presence for one connection of userID to a document
+func (p *PresenceUsecase) Join(userID, docID, sessionID uuid.UUID) (*domain.Presence, error) {
+	doc, err := p.document(userID, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	presence := &domain.Presence{
+		SessionID:  sessionID,
+		UserID:     userID,
+		GuestName:  p.access.guestName(userID, docID),
+		DocumentID: docID,
+		Color:      colorFor(userID),
+		State:      domain.PresenceActive,
+		Version:    doc.Version,
+		UpdatedAt:  time.Now(),
+	}
+	if err := p.store.SavePresence(presence, PresenceTTL); err != nil {
+		return nil, err
+	}
+	return presence, nil
+}
+
+// Update applies a client's presence change to its current record. The
+// cursor and selection count UTF-16 units into the document at
+// update.Version and are rebased to the current version before saving.
+// Fields the update leaves empty keep their current value, except that a nil
+// cursor or selection clears it.
+func (p *PresenceUsecase) Update(current *domain.Presence, update domain.Presence) (*domain.Presence, error) {
+	switch update.State {
+	case "", domain.PresenceActive, domain.PresenceIdle:
+	default:
+		return nil, fmt.Errorf("%w: unknown presence state %q", ErrInvalidOperation, update.State)
+	}
+	if update.Color != "" && !colorPattern.MatchString(update.Color) {
+		return nil, fmt.Errorf("%w: color must be #rrggbb", ErrInvalidOperation)
+	}
+	if (update.Cursor != nil && *update.Cursor < 0) ||
+		(update.Selection != nil && (update.Selection.Anchor < 0 || update.Selection.Head < 0)) {
+		return nil, &PositionError{Unit: domain.UnitUTF16, Offset: -1, Reason: "negative offset"}
+	}
+
+	doc, err := p.document(current.UserID, current.DocumentID)
+	if err != nil {
+		return nil, err
+	}
+	if update.Version < 0 || update.Version > doc.Version {
+		return nil, ErrInvalidOperation
+	}
+
+	next := *current
+	if update.State != "" {
+		next.State = update.State
+	}
+	if update.Color != "" {
+		next.Color = update.Color
+	}
+	next.Cursor = update.Cursor
+	next.Selection = update.Selection
+	next.Version = update.Version
+	next.UpdatedAt = time.Now()
+
+	if err := p.rebase(doc, &next); err != nil {
+		return nil, err
+	}
+	if err := p.store.SavePresence(&next, PresenceTTL); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Refresh extends a presence record's TTL, rebasing it to the current version
+func (p *PresenceUsecase) Refresh(presence *domain.Presence) (*domain.Presence, error) {
+	doc, err := p.repo.GetDocumentByID(presence.DocumentID)
+	if err != nil {
+		return nil, err
+	}
+
+	next := *presence
+	if err := p.rebase(doc, &next); err != nil {
+		return nil, err
+	}
+	if err := p.store.SavePresence(&next, PresenceTTL); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+func (p *PresenceUsecase) Leave(presence *domain.Presence) error {
+	return p.store.RemovePresence(presence.DocumentID, presence.SessionID)
+}
+
+// List returns everyone currently in a document, with positions rebased to
+// its current version
+func (p *PresenceUsecase) List(userID, docID uuid.UUID) ([]*domain.Presence, error) {
+	doc, err := p.document(userID, docID)
+	if err != nil {
+		return nil, err
+	}
+
+	presences, err := p.store.ListPresence(docID)
+	if err != nil {
+		return nil, err
+	}
+	for _, presence := range presences {
+		if err := p.rebase(doc, presence); err != nil {
+			return nil, err
+		}
+	}
+	if presences == nil {
+		presences = []*domain.Presence{}
+	}
+	return presences, nil
+}
+
+// document loads a document userID has access to
+func (p *PresenceUsecase) document(userID, docID uuid.UUID) (*domain.Document, error) {
+	doc, _, err := p.access.Authorize(userID, docID, ActionView)
+	return doc, err
+}
+
+// rebase moves presence's cursor and selection through every operation
+// committed since presence.Version. Positions the operation log can no
+// longer account for (after compaction or a REST update) are dropped
+// rather than left pointing at the wrong text.
+func (p *PresenceUsecase) rebase(doc *domain.Document, presence *domain.Presence) error {
+	if presence.Version >= doc.Version {
+		presence.Version = doc.Version
+		clampPresence(presence, textLength(doc.Content, domain.UnitUTF16))
+		return nil
+	}
+	if presence.Cursor == nil && presence.Selection == nil {
+		presence.Version = doc.Version
+		return nil
+	}
+
+	since, err := p.repo.GetOperationsSince(doc.ID, presence.Version)
+	if err != nil {
+		return err
+	}
+	history, ok := contiguousFrom(presence.Version, since)
+	if !ok || history[len(history)-1].Version < doc.Version {
+		presence.Cursor, presence.Selection = nil, nil
+		presence.Version = doc.Version
+		return nil
+	}
+
+	for _, op := range history[:doc.Version-presence.Version] {
+		own := op.UserID == presence.UserID
+		if presence.Cursor != nil {
+			cursor := transformOffset(*presence.Cursor, op, own)
+			presence.Cursor = &cursor
+		}
+		if presence.Selection != nil {
+			presence.Selection = &domain.Selection{
+				Anchor: transformOffset(presence.Selection.Anchor, op, own),
+				Head:   transformOffset(presence.Selection.Head, op, own),
+			}
+		}
+	}
+	presence.Version = doc.Version
+	clampPresence(presence, textLength(doc.Content, domain.UnitUTF16))
+	return nil
+}
+
+// transformOffset moves a UTF-16 offset through a committed operation. Text
+// inserted right at the offset pushes it along only if the insert is the
+// offset owner's own typing.
+func transformOffset(pos int, op domain.Operation, own bool) int {
+	switch op.Type {
+	case "insert":
+		if op.Position < pos || (op.Position == pos && own) {
+			return pos + textLength(op.Content, domain.UnitUTF16)
+		}
+	case "delete":
+		if pos >= op.Position+op.Length {
+			return pos - op.Length
+		}
+		if pos > op.Position {
+			return op.Position
+		}
+	}
+	return pos
+}
+
+func clampPresence(presence *domain.Presence, length int) {
+	if presence.Cursor != nil && *presence.Cursor > length {
+		presence.Cursor = &length
+	}
+	if presence.Selection != nil {
+		presence.Selection.Anchor = min(presence.Selection.Anchor, length)
+		presence.Selection.Head = min(presence.Selection.Head, length)
+	}
+}
+
+// colorFor picks a stable colour for a user so they look the same to everyone
+func colorFor(userID uuid.UUID) string {
+	h := fnv.New32a()
+	h.Write(userID[:])
+	return presenceColors[h.Sum32()%uint32(len(presenceColors))]
+}
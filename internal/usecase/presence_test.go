@@ -0,0 +1,219 @@
+package usecase_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// memoryPresenceStore is a PresenceStore that never expires anything
+type memoryPresenceStore struct {
+	mu        sync.Mutex
+	presences map[uuid.UUID]*domain.Presence // By session
+}
+
+func (s *memoryPresenceStore) SavePresence(presence *domain.Presence, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := *presence
+	s.presences[presence.SessionID] = &copied
+	return nil
+}
+
+func (s *memoryPresenceStore) RemovePresence(docID, sessionID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.presences, sessionID)
+	return nil
+}
+
+func (s *memoryPresenceStore) ListPresence(docID uuid.UUID) ([]*domain.Presence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var presences []*domain.Presence
+	for _, presence := range s.presences {
+		if presence.DocumentID == docID {
+			copied := *presence
+			presences = append(presences, &copied)
+		}
+	}
+	return presences, nil
+}
+
+func newPresence(t *testing.T, f *collabFixture) (*usecase.PresenceUsecase, *domain.Presence) {
+	t.Helper()
+	store := &memoryPresenceStore{presences: make(map[uuid.UUID]*domain.Presence)}
+	presence := usecase.NewPresenceUsecase(f.repo, store, usecase.NewAccessPolicy(f.repo, f.links))
+	joined, err := presence.Join(f.editor, f.docID, uuid.New())
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	return presence, joined
+}
+
+func at(offset int) *int {
+	return &offset
+}
+
+func TestPresenceRebasesOntoTheCurrentVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		committed []domain.Operation // By the owner unless own is set
+		own       bool
+		cursor    int // In "hello world" at version 0
+		want      int
+	}{
+		{"insert before", []domain.Operation{insert(0, ">> ")}, false, 5, 8},
+		{"insert after", []domain.Operation{insert(8, "--")}, false, 5, 5},
+		{"someone else's insert at the cursor", []domain.Operation{insert(5, ",")}, false, 5, 5},
+		{"own insert at the cursor", []domain.Operation{insert(5, ",")}, true, 5, 6},
+		{"surrogate pair before", []domain.Operation{insert(0, "😀")}, false, 5, 7},
+		{"delete before", []domain.Operation{del(0, 2)}, false, 5, 3},
+		{"delete around", []domain.Operation{del(3, 5)}, false, 5, 3},
+		{"delete ending at the cursor", []domain.Operation{del(2, 3)}, false, 5, 2},
+		{"delete after", []domain.Operation{del(6, 5)}, false, 5, 5},
+		{"several", []domain.Operation{insert(0, "ab"), del(1, 3), insert(4, "xyz")}, false, 6, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newCollabFixture(t, "hello world")
+			presence, joined := newPresence(t, f)
+			for _, op := range tt.committed {
+				if tt.own {
+					f.apply(t, f.editor, op)
+				} else {
+					f.apply(t, f.owner, op)
+				}
+			}
+
+			updated, err := presence.Update(joined, domain.Presence{Cursor: at(tt.cursor), Version: 0})
+			if err != nil {
+				t.Fatalf("update: %v", err)
+			}
+			if updated.Cursor == nil || *updated.Cursor != tt.want {
+				t.Errorf("cursor = %v, want %d", updated.Cursor, tt.want)
+			}
+			if want := int64(len(tt.committed)); updated.Version != want {
+				t.Errorf("version = %d, want %d", updated.Version, want)
+			}
+		})
+	}
+}
+
+func TestPresenceSelectionFollowsTheText(t *testing.T) {
+	f := newCollabFixture(t, "hello world")
+	presence, joined := newPresence(t, f)
+
+	// The editor selects "world", backwards
+	updated, err := presence.Update(joined, domain.Presence{Selection: &domain.Selection{Anchor: 11, Head: 6}, Version: 0})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	f.apply(t, f.owner, insert(0, "Well, "))
+	f.apply(t, f.owner, del(14, 3)) // "Well, hello wod"
+	refreshed, err := presence.Refresh(updated)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if want := (&domain.Selection{Anchor: 14, Head: 12}); !reflect.DeepEqual(refreshed.Selection, want) {
+		t.Errorf("selection = %+v, want %+v", refreshed.Selection, want)
+	}
+
+	// Everyone else sees the same, rebased from what was stored
+	f.apply(t, f.owner, del(0, 6))
+	listed, err := presence.List(f.owner, f.docID)
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("list = %+v, %v", listed, err)
+	}
+	if want := (&domain.Selection{Anchor: 8, Head: 6}); !reflect.DeepEqual(listed[0].Selection, want) || listed[0].Version != 3 {
+		t.Errorf("listed selection = %+v at %d, want %+v at 3", listed[0].Selection, listed[0].Version, want)
+	}
+}
+
+func TestPresenceDropsPositionsTheLogCannotRebase(t *testing.T) {
+	t.Run("compacted log", func(t *testing.T) {
+		f := newCollabFixtureWithPolicy(t, "ab", everyThree)
+		presence, joined := newPresence(t, f)
+		f.typeOut(t, "cdefg")
+		if _, err := f.collab.CompactOperationLogs(); err != nil {
+			t.Fatalf("compact: %v", err)
+		}
+
+		updated, err := presence.Update(joined, domain.Presence{Cursor: at(1), Selection: &domain.Selection{Anchor: 0, Head: 1}, Version: 0})
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		if updated.Cursor != nil || updated.Selection != nil || updated.Version != 5 {
+			t.Errorf("presence = %+v, want no positions at version 5", updated)
+		}
+
+		// Versions the log still covers are rebased as usual
+		updated, err = presence.Update(joined, domain.Presence{Cursor: at(1), Version: 2})
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		if updated.Cursor == nil || *updated.Cursor != 1 {
+			t.Errorf("cursor = %v, want 1", updated.Cursor)
+		}
+	})
+
+	t.Run("REST update", func(t *testing.T) {
+		f := newCollabFixture(t, "hello world")
+		presence, joined := newPresence(t, f)
+		updated, err := presence.Update(joined, domain.Presence{Cursor: at(5), Version: 0})
+		if err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		// The log covers the first version but not the update after it
+		f.apply(t, f.owner, insert(0, ">"))
+		if _, err := f.documents.UpdateDocument(f.owner, f.docID, "Notes", "bye"); err != nil {
+			t.Fatalf("update document: %v", err)
+		}
+
+		refreshed, err := presence.Refresh(updated)
+		if err != nil {
+			t.Fatalf("refresh: %v", err)
+		}
+		if refreshed.Cursor != nil || refreshed.Version != 2 {
+			t.Errorf("presence = %+v, want no cursor at version 2", refreshed)
+		}
+	})
+}
+
+func TestPresenceUpdateValidation(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	presence, joined := newPresence(t, f)
+
+	updated, err := presence.Update(joined, domain.Presence{Cursor: at(40), Selection: &domain.Selection{Anchor: 2, Head: 40}, State: domain.PresenceIdle, Color: "#123abc"})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if *updated.Cursor != 5 || updated.Selection.Head != 5 || updated.Selection.Anchor != 2 {
+		t.Errorf("positions past the end = %v, %+v, want them clamped to 5", *updated.Cursor, updated.Selection)
+	}
+	if updated.State != domain.PresenceIdle || updated.Color != "#123abc" {
+		t.Errorf("state %q, color %q", updated.State, updated.Color)
+	}
+
+	for name, update := range map[string]domain.Presence{
+		"unknown state":   {State: "away"},
+		"bad color":       {Color: "red"},
+		"future version":  {Version: 1},
+		"negative cursor": {Cursor: at(-1)},
+	} {
+		if _, err := presence.Update(joined, update); !errors.Is(err, usecase.ErrInvalidOperation) {
+			t.Errorf("%s: err = %v, want ErrInvalidOperation", name, err)
+		}
+	}
+	var posErr *usecase.PositionError
+	if _, err := presence.Update(joined, domain.Presence{Selection: &domain.Selection{Anchor: -1}}); !errors.As(err, &posErr) {
+		t.Errorf("negative selection: err = %v, want a PositionError", err)
+	}
+}
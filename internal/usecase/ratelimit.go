@@ -0,0 +1,29 @@
+package usecase
+
+import "time"
+
+// RateLimit allows Limit requests per Window. Unused allowance builds up to
+// Limit, so a quiet client can send a burst of that size.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// RateLimitResult is what a rate limiter decided about one request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the full limit is available again
+	Reset time.Duration
+	// RetryAfter is how long until the next request will be allowed, zero
+	// if this one was
+	RetryAfter time.Duration
+}
+
+// RateLimiter counts requests against per-key limits. A shared backend
+// limits a key across every node; an in-memory one only on its own node.
+type RateLimiter interface {
+	// Allow spends one request from key's allowance under limit
+	Allow(key string, limit RateLimit) (*RateLimitResult, error)
+}
@@ -0,0 +1,128 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrDuplicateOperation = errors.New("operation already applied")
+
+// DuplicateOperationError is returned by ApplyOperation for a retried
+// operation whose ID has already been committed. Operations holds what the
+// first attempt committed as, so the retry can be acknowledged the same way;
+// it is empty once those operations have been compacted out of the log.
+type DuplicateOperationError struct {
+	OperationID uuid.UUID
+	Operations  []domain.Operation
+	version     int64
+}
+
+func (e *DuplicateOperationError) Error() string {
+	return fmt.Sprintf("operation %s already applied", e.OperationID)
+}
+
+func (e *DuplicateOperationError) Unwrap() error {
+	return ErrDuplicateOperation
+}
+
+// Version is the document version right after the original commit
+func (e *DuplicateOperationError) Version() int64 {
+	return e.version
+}
+
+// CatchUp is what a reconnecting client needs to get from the version it last
+// saw to the current one: either the operations it missed, in order, or a
+// snapshot of the whole document when the log no longer reaches back that far.
+type CatchUp struct {
+	Version    int64
+	Operations []domain.Operation
+	Snapshot   *domain.Document
+}
+
+// CatchUp returns everything committed to a document after version since
+func (c *CollaborationUsecase) CatchUp(userID, docID uuid.UUID, since int64) (*CatchUp, error) {
+	doc, _, err := c.access.Authorize(userID, docID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+	if since < 0 || since > doc.Version {
+		return nil, ErrInvalidOperation
+	}
+	if since == doc.Version {
+		return &CatchUp{Version: since}, nil
+	}
+
+	missed, err := c.repo.GetOperationsSince(docID, since)
+	if err != nil {
+		return nil, err
+	}
+	if replay, ok := contiguousFrom(since, missed); ok && replay[len(replay)-1].Version >= doc.Version {
+		return &CatchUp{Version: replay[len(replay)-1].Version, Operations: replay}, nil
+	}
+
+	// The gap was compacted away or bridged by a REST update
+	state, err := c.loadReplica(doc)
+	if err != nil {
+		return nil, err
+	}
+	render(doc, state)
+	return &CatchUp{Version: doc.Version, Snapshot: doc}, nil
+}
+
+// contiguousFrom reports whether ops are exactly versions since+1, since+2, ...
+func contiguousFrom(since int64, ops []*domain.Operation) ([]domain.Operation, bool) {
+	if len(ops) == 0 {
+		return nil, false
+	}
+	replay := make([]domain.Operation, len(ops))
+	for i, op := range ops {
+		if op.Version != since+int64(i)+1 {
+			return nil, false
+		}
+		replay[i] = *op
+	}
+	return replay, true
+}
+
+// findDuplicate returns a *DuplicateOperationError if a client operation ID
+// was already committed
+func (c *CollaborationUsecase) findDuplicate(docID, opID uuid.UUID) error {
+	ops, version, committed, err := c.priorCommit(docID, opID)
+	if err != nil {
+		return err
+	}
+	if !committed {
+		return nil
+	}
+	return &DuplicateOperationError{OperationID: opID, Operations: ops, version: version}
+}
+
+// priorCommit looks up what a client operation ID was committed as, if it
+// was. The operations come from the log; the request record keeps the ID
+// known for the retry window after compaction has pruned them.
+func (c *CollaborationUsecase) priorCommit(docID, requestID uuid.UUID) ([]domain.Operation, int64, bool, error) {
+	prior, err := c.repo.GetOperationsByRequestID(docID, requestID)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if len(prior) > 0 {
+		ops := make([]domain.Operation, len(prior))
+		for i, op := range prior {
+			ops[i] = *op
+		}
+		return ops, ops[len(ops)-1].Version, true, nil
+	}
+
+	request, err := c.repo.GetOperationRequest(docID, requestID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return nil, request.Version, true, nil
+}
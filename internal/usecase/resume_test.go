@@ -0,0 +1,110 @@
+package usecase_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+func TestCatchUpReplaysTheLog(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	var committed []domain.Operation
+	for _, op := range []domain.Operation{insert(5, " world"), del(0, 1), insert(0, "H")} {
+		committed = append(committed, f.apply(t, f.owner, op)...)
+	}
+
+	catchUp, err := f.collab.CatchUp(f.editor, f.docID, 1)
+	if err != nil {
+		t.Fatalf("catch up: %v", err)
+	}
+	if catchUp.Snapshot != nil || catchUp.Version != 3 || !reflect.DeepEqual(catchUp.Operations, committed[1:]) {
+		t.Errorf("catch up from 1 = %+v, want versions 2 and 3", catchUp)
+	}
+
+	catchUp, err = f.collab.CatchUp(f.editor, f.docID, 3)
+	if err != nil || catchUp.Version != 3 || catchUp.Operations != nil || catchUp.Snapshot != nil {
+		t.Errorf("catch up from the current version = %+v, %v, want nothing to send", catchUp, err)
+	}
+	if _, err := f.collab.CatchUp(f.editor, f.docID, 4); !errors.Is(err, usecase.ErrInvalidOperation) {
+		t.Errorf("catch up from a future version: err = %v, want ErrInvalidOperation", err)
+	}
+	if _, err := f.collab.CatchUp(uuid.New(), f.docID, 0); !errors.Is(err, usecase.ErrPermissionDenied) {
+		t.Errorf("catch up by a stranger: err = %v, want ErrPermissionDenied", err)
+	}
+}
+
+func TestResentOperationIsAcknowledgedAgain(t *testing.T) {
+	f := newCollabFixtureWithPolicy(t, "hello world", everyThree)
+	op := del(5, 6)
+	op.ID = uuid.New()
+	op.BaseVersion = base(0)
+	f.apply(t, f.owner, insert(8, "--"))
+	first := f.apply(t, f.editor, op) // Split around the insert
+	if len(first) != 2 || f.content(t) != "hello--" {
+		t.Fatalf("committed as %d operations giving %q, want 2 giving \"hello--\"", len(first), f.content(t))
+	}
+
+	resend := func(t *testing.T) *usecase.DuplicateOperationError {
+		t.Helper()
+		before := f.content(t)
+		_, committed, err := f.collab.ApplyOperation(f.editor, f.docID, op)
+		var dup *usecase.DuplicateOperationError
+		if !errors.As(err, &dup) || committed != nil {
+			t.Fatalf("resend: err = %v, want a DuplicateOperationError", err)
+		}
+		if dup.OperationID != op.ID || dup.Version() != 3 {
+			t.Errorf("duplicate of %s at version %d, want %s at 3", dup.OperationID, dup.Version(), op.ID)
+		}
+		if got := f.content(t); got != before {
+			t.Errorf("content = %q, want it unchanged", got)
+		}
+		return dup
+	}
+
+	if dup := resend(t); !reflect.DeepEqual(dup.Operations, first) {
+		t.Errorf("duplicate operations = %+v, want %+v", dup.Operations, first)
+	}
+
+	// Once compaction prunes the entries, the request ID still stops a
+	// second commit
+	f.typeOut(t, "!!!") // Snapshot at 6
+	if pruned, err := f.collab.CompactOperationLogs(); err != nil || pruned != 4 {
+		t.Fatalf("pruned %d, %v, want versions 1 to 4", pruned, err)
+	}
+	if dup := resend(t); len(dup.Operations) != 0 {
+		t.Errorf("duplicate operations after compaction = %+v, want none", dup.Operations)
+	}
+}
+
+func TestOperationCommittedByAnotherNodeMeanwhile(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	otherNode := usecase.NewCollaborationUsecase(f.repo, usecase.NewAccessPolicy(f.repo, f.links), usecase.DefaultSnapshotPolicy())
+
+	// The client's first connection went to another node, which commits
+	// the operation while this node is committing the resend
+	op := insert(5, "!")
+	op.ID = uuid.New()
+	var theirs []domain.Operation
+	f.repo.beforeCommit = func() {
+		var err error
+		if _, theirs, err = otherNode.ApplyOperation(f.editor, f.docID, op); err != nil {
+			t.Errorf("commit on the other node: %v", err)
+		}
+	}
+
+	_, committed, err := f.collab.ApplyOperation(f.editor, f.docID, op)
+	var dup *usecase.DuplicateOperationError
+	if !errors.As(err, &dup) || committed != nil {
+		t.Fatalf("err = %v, want a DuplicateOperationError", err)
+	}
+	if !reflect.DeepEqual(dup.Operations, theirs) || dup.Version() != 1 {
+		t.Errorf("duplicate = %+v at %d, want the other node's %+v", dup.Operations, dup.Version(), theirs)
+	}
+	if got := f.content(t); got != "hello!" {
+		t.Errorf("content = %q, want the operation applied once", got)
+	}
+}
@@ -0,0 +1,185 @@
+package usecase
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TokenRevocationStore remembers revoked token IDs and session IDs, and
+// recent attempts at checks that must not be guessed, where every node can
+// see them. Entries only need to outlive the tokens they refer to.
+type TokenRevocationStore interface {
+	Revoke(id string, ttl time.Duration) error
+	// IsRevoked reports whether any of ids has been revoked
+	IsRevoked(ids ...string) (bool, error)
+	// CountAttempt records an attempt against key and returns how many there
+	// have been since the first one, counting restarts after ttl
+	CountAttempt(key string, ttl time.Duration) (int64, error)
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token works once: presenting one that has already been
+// used means it was copied, so the whole family is revoked and everyone
+// holding a token from that login has to sign in again.
+func (a *AuthUsecase) Refresh(refreshToken string) (*domain.TokenPair, error) {
+	current, err := a.repo.GetRefreshTokenByHash(hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	if current.RevokedAt != nil {
+		if err := a.revokeFamily(current.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if !current.ExpiresAt.After(time.Now()) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	user, err := a.repo.GetUserByID(current.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	token, next, err := a.newRefreshToken(user.ID, current.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.repo.RotateRefreshToken(current.ID, next); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Another request used the same token first
+			if err := a.revokeFamily(current.FamilyID); err != nil {
+				return nil, err
+			}
+			return nil, ErrRefreshTokenReused
+		}
+		return nil, err
+	}
+
+	return a.issue(user, current.FamilyID, token)
+}
+
+// Logout ends the session an access token belongs to: its refresh tokens
+// stop working and every access token issued from them is rejected
+func (a *AuthUsecase) Logout(claims *Claims) error {
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := a.revoked.Revoke(claims.ID, a.jwtExpiry); err != nil {
+		return err
+	}
+	return a.revokeFamily(sessionID)
+}
+
+// LogoutAll ends every session of a user, on every device
+func (a *AuthUsecase) LogoutAll(userID uuid.UUID) error {
+	families, err := a.repo.RevokeUserRefreshTokens(userID)
+	if err != nil {
+		return err
+	}
+	for _, familyID := range families {
+		if err := a.revoked.Revoke(familyID.String(), a.jwtExpiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeExpiredRefreshTokens deletes refresh tokens that expired before cutoff.
+// Used and revoked tokens are kept until then so reuse can still be detected.
+func (a *AuthUsecase) PurgeExpiredRefreshTokens(cutoff time.Time) (int64, error) {
+	return a.repo.DeleteExpiredRefreshTokens(cutoff)
+}
+
+// RunTokenCleanup purges expired refresh tokens every interval until ctx is
+// cancelled
+func (a *AuthUsecase) RunTokenCleanup(ctx context.Context, interval time.Duration, logf func(format string, args ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if purged, err := a.PurgeExpiredRefreshTokens(time.Now()); err != nil {
+				logf("Refresh token cleanup failed: %v", err)
+			} else if purged > 0 {
+				logf("Purged %d expired refresh tokens", purged)
+			}
+		}
+	}
+}
+
+// startSession begins a new refresh token family for user
+func (a *AuthUsecase) startSession(user *domain.User) (*domain.TokenPair, error) {
+	familyID := uuid.New()
+	token, refresh, err := a.newRefreshToken(user.ID, familyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.repo.CreateRefreshToken(refresh); err != nil {
+		return nil, err
+	}
+	return a.issue(user, familyID, token)
+}
+
+// issue pairs a refresh token with a new access token for the same session
+func (a *AuthUsecase) issue(user *domain.User, familyID uuid.UUID, refreshToken string) (*domain.TokenPair, error) {
+	accessToken, expiresAt, err := a.generateJWT(user.ID, user.Email, familyID)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+	}, nil
+}
+
+// revokeFamily stops a session's refresh tokens and access tokens working
+func (a *AuthUsecase) revokeFamily(familyID uuid.UUID) error {
+	if err := a.repo.RevokeRefreshFamily(familyID); err != nil {
+		return err
+	}
+	return a.revoked.Revoke(familyID.String(), a.jwtExpiry)
+}
+
+// newRefreshToken makes a random refresh token and the record stored for it
+func (a *AuthUsecase) newRefreshToken(userID, familyID uuid.UUID) (string, *domain.RefreshToken, error) {
+	token, err := randomString()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	return token, &domain.RefreshToken{
+		ID:        uuid.New(),
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(a.refreshExpiry),
+		CreatedAt: now,
+	}, nil
+}
+
+// hashToken is how refresh tokens are looked up; only the hash is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package usecase_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// login registers email if needed and starts a new session for it
+func (f *authFixture) login(t *testing.T, email string) *domain.TokenPair {
+	t.Helper()
+	if _, err := f.repo.GetUserByEmail(email); err != nil {
+		if _, err := f.auth.Register(email, email, "password"); err != nil {
+			t.Fatalf("register %s: %v", email, err)
+		}
+	}
+	result, err := f.auth.Login(email, "password")
+	if err != nil {
+		t.Fatalf("login %s: %v", email, err)
+	}
+	return result.Tokens
+}
+
+// signedIn reports whether both halves of a token pair still work. Checking
+// the refresh token uses it up, so tokens is rotated when it does.
+func (f *authFixture) signedIn(t *testing.T, tokens *domain.TokenPair) bool {
+	t.Helper()
+	_, accessErr := f.auth.ValidateToken(tokens.AccessToken)
+	next, refreshErr := f.auth.Refresh(tokens.RefreshToken)
+	if (accessErr == nil) != (refreshErr == nil) {
+		t.Fatalf("access token err = %v but refresh err = %v", accessErr, refreshErr)
+	}
+	if refreshErr != nil {
+		return false
+	}
+	*tokens = *next
+	return true
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+	first := f.login(t, "ada@example.com")
+
+	next, err := f.auth.Refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if next.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token not rotated")
+	}
+	before, err := f.auth.ValidateToken(first.AccessToken)
+	if err != nil {
+		t.Fatalf("validate the first access token: %v", err)
+	}
+	after, err := f.auth.ValidateToken(next.AccessToken)
+	if err != nil {
+		t.Fatalf("validate the new access token: %v", err)
+	}
+	if after.SessionID != before.SessionID || after.ID == before.ID {
+		t.Errorf("new access token is session %s id %s, want session %s with a new id", after.SessionID, after.ID, before.SessionID)
+	}
+
+	if _, err := f.auth.Refresh("not a token"); !errors.Is(err, usecase.ErrInvalidRefreshToken) {
+		t.Errorf("unknown token: err = %v, want ErrInvalidRefreshToken", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesTheFamily(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+	stolen := f.login(t, "ada@example.com")
+	other := f.login(t, "ada@example.com")
+
+	rotated, err := f.auth.Refresh(stolen.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, err := f.auth.Refresh(stolen.RefreshToken); !errors.Is(err, usecase.ErrRefreshTokenReused) {
+		t.Fatalf("replay: err = %v, want ErrRefreshTokenReused", err)
+	}
+
+	// Whoever holds the rotated token is signed out too
+	if _, err := f.auth.ValidateToken(rotated.AccessToken); !errors.Is(err, usecase.ErrTokenRevoked) {
+		t.Errorf("rotated access token: err = %v, want ErrTokenRevoked", err)
+	}
+	if _, err := f.auth.Refresh(rotated.RefreshToken); !errors.Is(err, usecase.ErrRefreshTokenReused) {
+		t.Errorf("rotated refresh token: err = %v, want ErrRefreshTokenReused", err)
+	}
+	if !f.signedIn(t, other) {
+		t.Errorf("another login of the same user was signed out")
+	}
+}
+
+func TestLogoutEndsOneSession(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+	phone := f.login(t, "ada@example.com")
+	laptop := f.login(t, "ada@example.com")
+	// An access token from earlier in the session
+	earlier := phone.AccessToken
+	if !f.signedIn(t, phone) {
+		t.Fatalf("phone not signed in")
+	}
+
+	claims, err := f.auth.ValidateToken(phone.AccessToken)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if err := f.auth.Logout(claims); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+
+	if f.signedIn(t, phone) {
+		t.Errorf("phone still signed in")
+	}
+	if _, err := f.auth.ValidateToken(earlier); !errors.Is(err, usecase.ErrTokenRevoked) {
+		t.Errorf("earlier access token: err = %v, want ErrTokenRevoked", err)
+	}
+	if !f.signedIn(t, laptop) {
+		t.Errorf("laptop signed out")
+	}
+
+	claims.SessionID = "not a session"
+	if err := f.auth.Logout(claims); !errors.Is(err, usecase.ErrInvalidToken) {
+		t.Errorf("bad session id: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestLogoutAllEndsEverySessionOfTheUser(t *testing.T) {
+	f := newAuthFixture(t, usecase.MFAPolicy{}, nil, usecase.LockoutPolicy{})
+	phone := f.login(t, "ada@example.com")
+	laptop := f.login(t, "ada@example.com")
+	if !f.signedIn(t, laptop) {
+		t.Fatalf("laptop not signed in")
+	}
+	grace := f.login(t, "grace@example.com")
+
+	claims, err := f.auth.ValidateToken(phone.AccessToken)
+	if err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	userID, err := uuid.Parse(claims.UserID)
+	if err != nil {
+		t.Fatalf("user id: %v", err)
+	}
+	if err := f.auth.LogoutAll(userID); err != nil {
+		t.Fatalf("logout all: %v", err)
+	}
+
+	for name, tokens := range map[string]*domain.TokenPair{"phone": phone, "laptop": laptop} {
+		if f.signedIn(t, tokens) {
+			t.Errorf("%s still signed in", name)
+		}
+	}
+	if !f.signedIn(t, grace) {
+		t.Errorf("another user was signed out")
+	}
+	if !f.signedIn(t, f.login(t, "ada@example.com")) {
+		t.Errorf("cannot sign in again afterwards")
+	}
+}
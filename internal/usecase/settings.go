@@ -0,0 +1,80 @@
+package usecase
+
+import (
+	"errors"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrAdminRequired = errors.New("only administrators can do this")
+
+// SettingsInput is how an administrator changes the server-wide settings
+type SettingsInput struct {
+	MFARequired *bool // nil leaves it as it is
+}
+
+// GetSettings returns the server-wide settings to an administrator
+func (a *AuthUsecase) GetSettings(adminID uuid.UUID) (*domain.Settings, error) {
+	if err := a.checkAdmin(adminID); err != nil {
+		return nil, err
+	}
+	return a.settings()
+}
+
+// UpdateSettings changes the server-wide settings for every node. Requiring
+// two-factor authentication takes effect at each user's next login; sessions
+// already signed in are left alone.
+func (a *AuthUsecase) UpdateSettings(adminID uuid.UUID, input SettingsInput) (*domain.Settings, error) {
+	if err := a.checkAdmin(adminID); err != nil {
+		return nil, err
+	}
+	settings, err := a.settings()
+	if err != nil {
+		return nil, err
+	}
+
+	if input.MFARequired != nil {
+		settings.MFARequired = *input.MFARequired
+	}
+	now := time.Now()
+	settings.UpdatedBy, settings.UpdatedAt = &adminID, &now
+	if err := a.repo.SaveSettings(settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// settings are the saved settings, or the configured defaults before an
+// administrator first saves them
+func (a *AuthUsecase) settings() (*domain.Settings, error) {
+	settings, err := a.repo.GetSettings()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &domain.Settings{MFARequired: a.mfa.Required}, nil
+	}
+	return settings, err
+}
+
+// mfaRequired reports whether every account has to use two-factor
+// authentication. Settings are read each time so a change made on one node
+// applies on all of them straight away.
+func (a *AuthUsecase) mfaRequired() (bool, error) {
+	settings, err := a.settings()
+	if err != nil {
+		return false, err
+	}
+	return settings.MFARequired, nil
+}
+
+func (a *AuthUsecase) checkAdmin(userID uuid.UUID) error {
+	user, err := a.user(userID)
+	if err != nil {
+		return err
+	}
+	if !user.IsAdmin {
+		return ErrAdminRequired
+	}
+	return nil
+}
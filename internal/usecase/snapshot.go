@@ -0,0 +1,252 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/collab-platform/backend/internal/crdt"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+// SnapshotPolicy controls how often a document's CRDT state is written out
+// and how much of the operation log survives compaction
+type SnapshotPolicy struct {
+	// Snapshot once this many operations have been committed since the last one
+	EveryOps int64
+	// ... or once the last snapshot is this old
+	Interval time.Duration
+	// Operations kept behind the latest snapshot for late joiners and replay
+	RetainOps int64
+	// How long committed request IDs are remembered, so that a client
+	// retrying an operation after compaction does not apply it twice
+	RetryWindow time.Duration
+}
+
+func DefaultSnapshotPolicy() SnapshotPolicy {
+	return SnapshotPolicy{
+		EveryOps:    100,
+		Interval:    30 * time.Second,
+		RetainOps:   1000,
+		RetryWindow: 7 * 24 * time.Hour,
+	}
+}
+
+// replica is the CRDT state behind a document's content: a text sequence, or
+// a board for whiteboard documents
+type replica interface {
+	json.Marshaler
+	Integrate(op domain.Operation) error
+	// Text is what the document stores as its plain content
+	Text() string
+}
+
+// loadSnapshot restores the CRDT state a document's snapshot holds, seeding
+// it from the plain content for documents that have never been edited
+// collaboratively
+func loadSnapshot(doc *domain.Document) (replica, error) {
+	if doc.Type == domain.DocumentTypeWhiteboard {
+		if len(doc.CRDTState) == 0 {
+			return boardFromContent(doc), nil
+		}
+		board := crdt.NewBoard()
+		if err := json.Unmarshal(doc.CRDTState, board); err != nil {
+			return nil, err
+		}
+		return board, nil
+	}
+
+	if len(doc.CRDTState) == 0 {
+		return crdt.FromText(doc.Content), nil
+	}
+	seq := crdt.NewSequence()
+	if err := json.Unmarshal(doc.CRDTState, seq); err != nil {
+		return nil, err
+	}
+	return seq, nil
+}
+
+// restoreState rebuilds a document's current state: its latest snapshot
+// plus the tail of operations committed after it. Operations past doc.Version
+// were committed after doc was read and are left out.
+func restoreState(doc *domain.Document, tail []*domain.Operation) (replica, error) {
+	// Without a stored state the content is current: commits seed the state
+	// before the first operation is logged
+	if len(doc.CRDTState) == 0 {
+		return loadSnapshot(doc)
+	}
+	for len(tail) > 0 && tail[len(tail)-1].Version > doc.Version {
+		tail = tail[:len(tail)-1]
+	}
+	if int64(len(tail)) != doc.Version-doc.SnapshotVersion {
+		return nil, fmt.Errorf("operation log for document %s is missing versions after %d", doc.ID, doc.SnapshotVersion)
+	}
+
+	state, err := loadSnapshot(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range tail {
+		if err := state.Integrate(*op); err != nil {
+			return nil, fmt.Errorf("failed to replay operation %s: %w", op.ID, err)
+		}
+	}
+	return state, nil
+}
+
+// restoreSequence is restoreState for documents edited as text
+func restoreSequence(doc *domain.Document, tail []*domain.Operation) (*crdt.Sequence, error) {
+	state, err := restoreState(doc, tail)
+	if err != nil {
+		return nil, err
+	}
+	seq, ok := state.(*crdt.Sequence)
+	if !ok {
+		return nil, errNotText
+	}
+	return seq, nil
+}
+
+// render fills in doc's content, and its structured form, from state
+func render(doc *domain.Document, state replica) {
+	doc.Content = state.Text()
+	switch s := state.(type) {
+	case *crdt.Sequence:
+		doc.Delta = s.Delta()
+	case *crdt.Board:
+		wb := s.Whiteboard()
+		doc.Whiteboard = &wb
+	}
+}
+
+func (c *CollaborationUsecase) loadReplica(doc *domain.Document) (replica, error) {
+	tail, err := c.repo.GetOperationsSince(doc.ID, doc.SnapshotVersion)
+	if err != nil {
+		return nil, err
+	}
+	return restoreState(doc, tail)
+}
+
+func (c *CollaborationUsecase) loadState(doc *domain.Document) (*crdt.Sequence, error) {
+	tail, err := c.repo.GetOperationsSince(doc.ID, doc.SnapshotVersion)
+	if err != nil {
+		return nil, err
+	}
+	return restoreSequence(doc, tail)
+}
+
+func (c *CollaborationUsecase) snapshotDue(doc *domain.Document) bool {
+	pending := doc.Version - doc.SnapshotVersion
+	if pending <= 0 {
+		return false
+	}
+	if c.policy.EveryOps > 0 && pending >= c.policy.EveryOps {
+		return true
+	}
+	return c.policy.Interval > 0 && time.Since(doc.SnapshotAt) >= c.policy.Interval
+}
+
+// snapshot records state as the document's state at doc.Version
+func (c *CollaborationUsecase) snapshot(doc *domain.Document, current replica, createdBy uuid.UUID) error {
+	state, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+
+	doc.CRDTState = state
+	doc.SnapshotVersion = doc.Version
+	doc.SnapshotAt = time.Now()
+
+	version := &domain.DocumentVersion{
+		ID:         uuid.New(),
+		DocumentID: doc.ID,
+		Version:    doc.Version,
+		Content:    doc.Content,
+		State:      state,
+		CreatedBy:  createdBy,
+		CreatedAt:  doc.SnapshotAt,
+	}
+	return c.repo.CreateSnapshot(doc, version)
+}
+
+// SnapshotIdleDocuments snapshots documents that have unsnapshotted
+// operations but have not been edited for a full snapshot interval, so a
+// burst of edits followed by silence does not leave a long tail to replay.
+// Snapshots taken here are attributed to the nil user.
+func (c *CollaborationUsecase) SnapshotIdleDocuments() (int, error) {
+	docs, err := c.repo.GetDocumentsPendingSnapshot(time.Now().Add(-c.policy.Interval))
+	if err != nil {
+		return 0, err
+	}
+
+	taken := 0
+	for _, stale := range docs {
+		if err := c.snapshotDocument(stale.ID); err != nil {
+			return taken, err
+		}
+		taken++
+	}
+	return taken, nil
+}
+
+func (c *CollaborationUsecase) snapshotDocument(docID uuid.UUID) error {
+	lock := c.documentLock(docID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	doc, err := c.repo.GetDocumentByID(docID)
+	if err != nil {
+		return err
+	}
+	if doc.Version == doc.SnapshotVersion {
+		return nil
+	}
+	state, err := c.loadReplica(doc)
+	if err != nil {
+		return err
+	}
+	return c.snapshot(doc, state, uuid.Nil)
+}
+
+// CompactOperationLogs prunes operations that are older than each document's
+// latest snapshot by more than the retention window
+func (c *CollaborationUsecase) CompactOperationLogs() (int64, error) {
+	return c.repo.DeleteOperationsBeforeSnapshot(c.policy.RetainOps)
+}
+
+// PruneOperationRequests forgets request IDs committed longer ago than the
+// retry window
+func (c *CollaborationUsecase) PruneOperationRequests() (int64, error) {
+	return c.repo.DeleteOperationRequests(time.Now().Add(-c.policy.RetryWindow))
+}
+
+// RunMaintenance snapshots idle documents, compacts operation logs and prunes
+// request IDs and idle undo histories every interval until ctx is done
+func (c *CollaborationUsecase) RunMaintenance(ctx context.Context, interval time.Duration, logf func(format string, args ...interface{})) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := c.SnapshotIdleDocuments(); err != nil {
+				logf("Snapshot job failed: %v", err)
+			}
+			if pruned, err := c.CompactOperationLogs(); err != nil {
+				logf("Operation log compaction failed: %v", err)
+			} else if pruned > 0 {
+				logf("Compacted %d operations", pruned)
+			}
+			if _, err := c.PruneOperationRequests(); err != nil {
+				logf("Request ID pruning failed: %v", err)
+			}
+			if _, err := c.PruneUndoHistories(time.Now().Add(-undoHistoryIdle)); err != nil {
+				logf("Undo history pruning failed: %v", err)
+			}
+		}
+	}
+}
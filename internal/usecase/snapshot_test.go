@@ -0,0 +1,176 @@
+package usecase_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// everyThree snapshots every third operation and keeps two behind it
+var everyThree = usecase.SnapshotPolicy{EveryOps: 3, RetainOps: 2}
+
+// typeOut appends text one rune at a time, one version each
+func (f *collabFixture) typeOut(t *testing.T, text string) {
+	t.Helper()
+	for _, r := range text {
+		f.apply(t, f.owner, insert(len(f.content(t)), string(r)))
+	}
+}
+
+func TestSnapshotsAreTakenByPolicy(t *testing.T) {
+	f := newCollabFixtureWithPolicy(t, "ab", everyThree)
+	f.typeOut(t, "cdefg")
+
+	doc := f.repo.document(t, f.docID)
+	if doc.Version != 5 || doc.SnapshotVersion != 3 {
+		t.Fatalf("version %d, snapshot at %d, want 5 and 3", doc.Version, doc.SnapshotVersion)
+	}
+	if len(f.repo.snapshots) != 1 || f.repo.snapshots[0].Content != "abcde" {
+		t.Fatalf("snapshots = %+v, want one of \"abcde\"", f.repo.snapshots)
+	}
+
+	// The snapshot plus the tail after it is the current document
+	fetched, err := f.documents.GetDocument(f.owner, f.docID)
+	if err != nil {
+		t.Fatalf("get document: %v", err)
+	}
+	if fetched.Content != "abcdefg" {
+		t.Errorf("content = %q, want %q", fetched.Content, "abcdefg")
+	}
+
+	// The idle job catches up with the tail, once
+	taken, err := f.collab.SnapshotIdleDocuments()
+	if err != nil || taken != 1 {
+		t.Fatalf("idle snapshots = %d, %v, want 1", taken, err)
+	}
+	if doc := f.repo.document(t, f.docID); doc.SnapshotVersion != 5 {
+		t.Errorf("snapshot at %d after the idle job, want 5", doc.SnapshotVersion)
+	}
+	if taken, _ := f.collab.SnapshotIdleDocuments(); taken != 0 {
+		t.Errorf("idle job took %d more snapshots of an unchanged document", taken)
+	}
+	f.apply(t, f.editor, insert(0, ">"))
+	if got := f.content(t); got != ">abcdefg" {
+		t.Errorf("content after the idle snapshot = %q", got)
+	}
+}
+
+func TestCompactionKeepsTheRetainedTail(t *testing.T) {
+	f := newCollabFixtureWithPolicy(t, "ab", everyThree)
+	f.typeOut(t, "cdefg") // Snapshot at 3
+
+	pruned, err := f.collab.CompactOperationLogs()
+	if err != nil || pruned != 1 {
+		t.Fatalf("pruned %d, %v, want only version 1", pruned, err)
+	}
+
+	// Catching up from inside the retained log replays it...
+	catchUp, err := f.collab.CatchUp(f.editor, f.docID, 2)
+	if err != nil {
+		t.Fatalf("catch up: %v", err)
+	}
+	if catchUp.Snapshot != nil || len(catchUp.Operations) != 3 || catchUp.Operations[0].Version != 3 || catchUp.Version != 5 {
+		t.Errorf("catch up from 2 = %+v, want versions 3 to 5", catchUp)
+	}
+
+	// ...but from before it the client gets the whole document instead
+	catchUp, err = f.collab.CatchUp(f.editor, f.docID, 0)
+	if err != nil {
+		t.Fatalf("catch up: %v", err)
+	}
+	if catchUp.Snapshot == nil || catchUp.Snapshot.Content != "abcdefg" || catchUp.Operations != nil || catchUp.Version != 5 {
+		t.Errorf("catch up from 0 = %+v, want a snapshot at version 5", catchUp)
+	}
+
+	// An offset written against a compacted version cannot be rebased
+	op := insert(0, "x")
+	op.BaseVersion = base(0)
+	if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, op); !errors.Is(err, usecase.ErrStaleVersion) {
+		t.Errorf("apply against a compacted version: err = %v, want ErrStaleVersion", err)
+	}
+	op.BaseVersion = base(2)
+	f.apply(t, f.editor, op)
+	if got := f.content(t); got != "xabcdefg" {
+		t.Errorf("content = %q", got)
+	}
+}
+
+func TestRestoreRefusesAnIncompleteLog(t *testing.T) {
+	f := newCollabFixtureWithPolicy(t, "ab", everyThree)
+	f.typeOut(t, "cdefg")
+
+	// Lose version 4, after the snapshot
+	f.repo.mu.Lock()
+	for i, op := range f.repo.ops {
+		if op.Version == 4 {
+			f.repo.ops = append(f.repo.ops[:i], f.repo.ops[i+1:]...)
+			break
+		}
+	}
+	f.repo.mu.Unlock()
+
+	if _, err := f.documents.GetDocument(f.owner, f.docID); err == nil || !strings.Contains(err.Error(), "missing versions after 3") {
+		t.Errorf("get document: err = %v, want missing versions", err)
+	}
+	if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, insert(0, "x")); err == nil {
+		t.Errorf("applied an operation on top of an incomplete log")
+	}
+	if got := f.content(t); got != "abcdefg" {
+		t.Errorf("content = %q, want it unchanged", got)
+	}
+}
+
+func TestIDAddressedOperationsFromBeforeAResetAreStale(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	f.apply(t, f.owner, insert(5, "!"))
+
+	// The editor's client knows "hello!" by element ID: "e" is the second
+	// seeded element
+	e := domain.ElementID{Clock: 2}
+	deleteE := domain.Operation{Type: "delete", Targets: []domain.ElementID{e}, BaseVersion: base(1)}
+
+	// A title change keeps the state, and with it the IDs
+	if _, err := f.documents.UpdateDocument(f.owner, f.docID, "Renamed", "hello!"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	f.apply(t, f.editor, deleteE)
+	if got := f.content(t); got != "hllo!" {
+		t.Fatalf("content = %q, want %q", got, "hllo!")
+	}
+
+	// Replacing the content seeds the IDs again, for different text
+	if _, err := f.documents.UpdateDocument(f.owner, f.docID, "Renamed", "goodbye"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	reset := f.repo.document(t, f.docID).Version
+
+	// The log cannot bridge the update, so a reconnect starts over too
+	catchUp, err := f.collab.CatchUp(f.editor, f.docID, reset-2)
+	if err != nil {
+		t.Fatalf("catch up: %v", err)
+	}
+	if catchUp.Snapshot == nil || catchUp.Snapshot.Content != "goodbye" || catchUp.Version != reset {
+		t.Errorf("catch up across the reset = %+v, want a snapshot", catchUp)
+	}
+
+	deleteE.ID = uuid.UUID{1}
+	deleteE.BaseVersion = base(reset - 1)
+	if _, _, err := f.collab.ApplyOperation(f.editor, f.docID, deleteE); !errors.Is(err, usecase.ErrStaleVersion) {
+		t.Errorf("ID-addressed operation from before the reset: err = %v, want ErrStaleVersion", err)
+	}
+	if got := f.content(t); got != "goodbye" {
+		t.Errorf("content = %q, want it unchanged", got)
+	}
+
+	// Against the reset version the same ID is the new text's second rune
+	deleteE.ID = uuid.UUID{2}
+	deleteE.BaseVersion = base(reset)
+	f.apply(t, f.editor, deleteE)
+	if got := f.content(t); got != "godbye" {
+		t.Errorf("content = %q, want %q", got, "godbye")
+	}
+}
@@ -0,0 +1,322 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/collab-platform/backend/internal/crdt"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrDependencyDropped = errors.New("an earlier queued operation was dropped")
+
+// maxSyncOperations bounds the size of one offline queue upload
+const maxSyncOperations = 1000
+
+// DroppedOperation is an offline operation that could not be merged
+type DroppedOperation struct {
+	ID     uuid.UUID `json:"id"`
+	Reason string    `json:"reason"`
+}
+
+// SyncResult is the outcome of merging an offline queue. Applying Accepted
+// and Missed together, in version order, to the document as it was at the
+// queue's base version reproduces the document at Version.
+type SyncResult struct {
+	Version  int64              `json:"version"`
+	Accepted []domain.Operation `json:"accepted"` // What the queue committed as, including earlier commits of resent operations
+	Missed   []domain.Operation `json:"missed"`   // Everything else committed after the base version
+	Dropped  []DroppedOperation `json:"dropped"`
+
+	// Operations committed by this call, which still need broadcasting
+	Committed []domain.Operation `json:"-"`
+}
+
+// SyncOperations merges a queue of operations a client made offline, in the
+// order it made them, starting from document version baseVersion.
+//
+// Each queued operation is resolved against the document as its author saw
+// it: the base version, plus whatever its vector clock shows the client had
+// already received since, plus the queue's own earlier operations. That pins
+// it to element IDs, after which it merges with everything that happened
+// meanwhile like any other CRDT operation. An operation that cannot be
+// resolved is dropped, and so is the rest of the queue, which was written on
+// top of it.
+func (c *CollaborationUsecase) SyncOperations(userID, docID uuid.UUID, baseVersion int64, ops []domain.Operation) (*SyncResult, error) {
+	if len(ops) > maxSyncOperations {
+		return nil, fmt.Errorf("%w: at most %d operations per sync", ErrInvalidOperation, maxSyncOperations)
+	}
+
+	if _, _, err := c.access.Authorize(userID, docID, ActionEdit); err != nil {
+		return nil, err
+	}
+
+	for i := range ops {
+		ops[i].UserID = userID
+		ops[i].DocumentID = docID
+		if ops[i].ID == uuid.Nil {
+			ops[i].ID = uuid.New()
+		}
+	}
+
+	lock := c.documentLock(docID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var (
+		result *SyncResult
+		err    error
+	)
+	for attempt := 0; ; attempt++ {
+		// A batch that lost a race to another node is merged again, which
+		// also picks up queued operations the other node committed
+		result, err = c.syncBatch(docID, baseVersion, ops)
+		if (!errors.Is(err, ErrStaleWrite) && !errors.Is(err, ErrDuplicateOperation)) || attempt+1 >= maxCommitAttempts {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Each queued operation is undone on its own
+	var entries [][]domain.Operation
+	for start := 0; start < len(result.Committed); {
+		end := start + 1
+		for end < len(result.Committed) && result.Committed[end].RequestID == result.Committed[start].RequestID {
+			end++
+		}
+		entries = append(entries, result.Committed[start:end])
+		start = end
+	}
+	if len(entries) > 0 {
+		c.record(docID, userID, entries...)
+	}
+
+	if len(result.Committed) > 0 {
+		activity := &domain.Activity{
+			ID:         uuid.New(),
+			DocumentID: docID,
+			UserID:     userID,
+			GuestName:  c.access.guestName(userID, docID),
+			Action:     "sync",
+			Details:    fmt.Sprintf("%d offline operations", len(ops)-len(result.Dropped)),
+			CreatedAt:  time.Now(),
+		}
+		c.repo.CreateActivity(activity)
+	}
+
+	return result, nil
+}
+
+func (c *CollaborationUsecase) syncBatch(docID uuid.UUID, baseVersion int64, ops []domain.Operation) (*SyncResult, error) {
+	doc, err := c.repo.GetDocumentByID(docID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDocumentNotFound
+		}
+		return nil, err
+	}
+	if baseVersion < 0 || baseVersion > doc.Version {
+		return nil, ErrInvalidOperation
+	}
+
+	seq, err := c.loadState(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []domain.Operation
+	if baseVersion < doc.Version {
+		since, err := c.repo.GetOperationsSince(docID, baseVersion)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if history, ok = contiguousFrom(baseVersion, since); !ok || history[len(history)-1].Version < doc.Version {
+			return nil, ErrStaleVersion
+		}
+		history = history[:doc.Version-baseVersion]
+	}
+
+	seed, err := seedState(doc, seq)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := make(map[uuid.UUID]bool, len(ops))
+	for _, op := range ops {
+		queued[op.ID] = true
+	}
+	view := newOfflineView(history, queued)
+
+	result := &SyncResult{Accepted: []domain.Operation{}, Missed: []domain.Operation{}, Dropped: []DroppedOperation{}}
+	for _, h := range history {
+		if !queued[h.RequestID] {
+			result.Missed = append(result.Missed, h)
+		}
+	}
+
+	seen := make(map[uuid.UUID]bool, len(ops))
+	var dropped error
+	for _, op := range ops {
+		if seen[op.ID] {
+			result.Dropped = append(result.Dropped, DroppedOperation{ID: op.ID, Reason: ErrDuplicateOperation.Error()})
+			continue
+		}
+		seen[op.ID] = true
+
+		if dropped != nil {
+			result.Dropped = append(result.Dropped, DroppedOperation{ID: op.ID, Reason: ErrDependencyDropped.Error()})
+			continue
+		}
+
+		// Resent operations that made it in before the connection dropped.
+		// Their log entries may have been compacted away, leaving nothing to
+		// report as accepted, but they are still not applied twice.
+		prior, _, committed, err := c.priorCommit(docID, op.ID)
+		if err != nil {
+			return nil, err
+		}
+		if committed {
+			result.Accepted = append(result.Accepted, prior...)
+			continue
+		}
+
+		applied, err := view.merge(c, seq, op)
+		if errors.Is(err, ErrInvalidOperation) || errors.Is(err, ErrConflict) {
+			dropped = err
+			result.Dropped = append(result.Dropped, DroppedOperation{ID: op.ID, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, a := range applied {
+			a.ID = uuid.New()
+			a.RequestID = op.ID
+			a.Version = doc.Version + int64(len(result.Committed)) + 1
+			a.VectorClock = tick(doc, a.UserID)
+			a.CreatedAt = time.Now()
+			result.Committed = append(result.Committed, a)
+			result.Accepted = append(result.Accepted, a)
+		}
+	}
+
+	if len(result.Committed) > 0 {
+		if err := c.save(doc, seq, seed, result.Committed); err != nil {
+			return nil, err
+		}
+	}
+	result.Version = doc.Version
+	return result, nil
+}
+
+// offlineView reconstructs, per queued operation, the document its author was
+// looking at: operations committed after the base version are hidden unless
+// the operation's vector clock covers them or they came from the queue itself
+type offlineView struct {
+	queued     map[uuid.UUID]bool
+	insertedBy map[domain.ElementID]*domain.Operation
+	deletedBy  map[domain.ElementID]*domain.Operation
+	// Elements the queue deleted, even if someone else already had
+	ownDeletes map[domain.ElementID]bool
+}
+
+func newOfflineView(history []domain.Operation, queued map[uuid.UUID]bool) *offlineView {
+	v := &offlineView{
+		queued:     queued,
+		insertedBy: make(map[domain.ElementID]*domain.Operation),
+		deletedBy:  make(map[domain.ElementID]*domain.Operation),
+		ownDeletes: make(map[domain.ElementID]bool),
+	}
+	for i := range history {
+		h := &history[i]
+		switch h.Type {
+		case "insert":
+			clock := h.Timestamp
+			for range h.Content {
+				v.insertedBy[domain.ElementID{Clock: clock, Site: h.UserID}] = h
+				clock++
+			}
+		case "delete":
+			for _, id := range h.Targets {
+				v.deletedBy[id] = h
+			}
+		}
+	}
+	return v
+}
+
+// unseen reports whether op's author had not received h when writing op
+func (v *offlineView) unseen(h *domain.Operation, op domain.Operation) bool {
+	if v.queued[h.RequestID] {
+		return false
+	}
+	if h.VectorClock == nil || op.VectorClock == nil {
+		return true
+	}
+	return h.VectorClock[h.UserID] > op.VectorClock[h.UserID]
+}
+
+// merge pins a queued position-addressed operation to the element IDs its
+// author saw and integrates it into seq
+func (v *offlineView) merge(c *CollaborationUsecase, seq *crdt.Sequence, op domain.Operation) ([]domain.Operation, error) {
+	if err := validateOperation(op); err != nil {
+		return nil, err
+	}
+	if isIDAddressed(op) {
+		return c.applyCRDTOperation(seq, op)
+	}
+
+	ids, text := seq.View(
+		func(id domain.ElementID) bool {
+			h, ok := v.insertedBy[id]
+			return ok && v.unseen(h, op)
+		},
+		func(id domain.ElementID) bool {
+			h, ok := v.deletedBy[id]
+			return ok && !v.ownDeletes[id] && v.unseen(h, op)
+		},
+	)
+
+	switch op.Type {
+	case "insert":
+		pos, err := toRuneOffset(text, op.Position, op.Unit)
+		if err != nil {
+			return nil, err
+		}
+		origin := crdt.Head
+		if pos > 0 {
+			origin = ids[pos-1]
+		}
+		op.Origin = &origin
+		op.Timestamp = seq.Clock() + 1
+
+	case "delete", "format":
+		start, n, err := toRuneRange(text, op.Position, op.Length, op.Unit)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrInvalidOperation
+		}
+		targets := append([]domain.ElementID(nil), ids[start:start+n]...)
+		if op.Type == "delete" {
+			for _, id := range targets {
+				v.ownDeletes[id] = true
+			}
+			op.Targets = targets
+		} else {
+			op.Targets = []domain.ElementID{targets[0], targets[n-1]}
+		}
+		op.Timestamp = seq.Clock() + 1
+	}
+
+	// Edits to text someone else deleted meanwhile commit as nothing
+	return c.applyCRDTOperation(seq, op)
+}
@@ -0,0 +1,149 @@
+package usecase_test
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+// queued is an offline operation made after its author had received the
+// operations clock counts
+func queued(op domain.Operation, clock map[uuid.UUID]int64) domain.Operation {
+	op.ID = uuid.New()
+	op.VectorClock = clock
+	return op
+}
+
+// replay applies a sync result's accepted and missed operations in version
+// order to the text at the queue's base version
+func replay(c *usecase.CollaborationUsecase, text string, result *usecase.SyncResult) string {
+	ops := append(append([]domain.Operation{}, result.Accepted...), result.Missed...)
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Version < ops[j].Version })
+	for _, op := range ops {
+		text = applyText(c, text, op)
+	}
+	return text
+}
+
+func TestSyncMergesDivergingOfflineQueues(t *testing.T) {
+	const start = "hello world"
+	f := newCollabFixture(t, start)
+	alice, bob := f.editor, uuid.New()
+	f.repo.share(f.docID, bob, domain.RoleEditor)
+
+	// Two edits go in while Alice and Bob are offline. Alice hears about
+	// the first before she loses her connection for good.
+	bang := f.apply(t, f.owner, insert(11, "!"))[0] // "hello world!"
+	f.apply(t, f.owner, del(0, 1))                  // "ello world!"
+
+	// Alice's second edit counts the "!" she had seen by then
+	aliceQueue := []domain.Operation{
+		queued(insert(5, ","), map[uuid.UUID]int64{}),                // "hello, world"
+		queued(insert(13, "?"), map[uuid.UUID]int64{f.owner: 1}),     // "hello, world!?"
+		queued(del(0, 1), map[uuid.UUID]int64{f.owner: 1, alice: 2}), // "ello, world!?"
+	}
+	aliceResult, err := f.collab.SyncOperations(alice, f.docID, 0, aliceQueue)
+	if err != nil {
+		t.Fatalf("alice's sync: %v", err)
+	}
+	if len(aliceResult.Dropped) != 0 {
+		t.Fatalf("alice's queue dropped %+v", aliceResult.Dropped)
+	}
+	if got := f.content(t); got != "ello, world!?" {
+		t.Errorf("content after alice = %q, want %q", got, "ello, world!?")
+	}
+	if len(aliceResult.Missed) != 2 || aliceResult.Missed[0].ID != bang.ID {
+		t.Errorf("alice missed %+v, want both of the owner's edits", aliceResult.Missed)
+	}
+	if got := replay(f.collab, start, aliceResult); got != f.content(t) {
+		t.Errorf("replaying alice's result gives %q, want %q", got, f.content(t))
+	}
+
+	// Bob saw none of it. His delete takes the "h" the owner had already
+	// deleted too, so his next edit counts it as gone. His third edit is past
+	// the end of his text, so it and everything after it are dropped.
+	bobQueue := []domain.Operation{
+		queued(del(0, 6), map[uuid.UUID]int64{}),            // "world"
+		queued(insert(1, "-"), map[uuid.UUID]int64{bob: 1}), // "w-orld"
+		queued(insert(20, "x"), map[uuid.UUID]int64{bob: 2}),
+		queued(insert(0, ">"), map[uuid.UUID]int64{bob: 3}),
+	}
+	bobResult, err := f.collab.SyncOperations(bob, f.docID, 0, bobQueue)
+	if err != nil {
+		t.Fatalf("bob's sync: %v", err)
+	}
+	if got := f.content(t); got != ",w-orld!?" {
+		t.Errorf("content after bob = %q, want %q", got, ",w-orld!?")
+	}
+	if len(bobResult.Dropped) != 2 ||
+		bobResult.Dropped[0].ID != bobQueue[2].ID || bobResult.Dropped[1].ID != bobQueue[3].ID ||
+		bobResult.Dropped[1].Reason != usecase.ErrDependencyDropped.Error() {
+		t.Errorf("bob's dropped = %+v, want his last two edits", bobResult.Dropped)
+	}
+	for _, a := range bobResult.Accepted {
+		if a.RequestID != bobQueue[0].ID && a.RequestID != bobQueue[1].ID {
+			t.Errorf("accepted %+v from a dropped edit", a)
+		}
+	}
+	if len(bobResult.Missed) != 2+len(aliceResult.Accepted) {
+		t.Errorf("bob missed %d operations, want the owner's and alice's", len(bobResult.Missed))
+	}
+	if got := replay(f.collab, start, bobResult); got != f.content(t) {
+		t.Errorf("replaying bob's result gives %q, want %q", got, f.content(t))
+	}
+	if doc := f.repo.document(t, f.docID); bobResult.Version != doc.Version {
+		t.Errorf("bob's result is at version %d, want %d", bobResult.Version, doc.Version)
+	}
+}
+
+func TestSyncWithoutVectorClocksSeesOnlyTheBaseVersion(t *testing.T) {
+	f := newCollabFixture(t, "hello world")
+	f.apply(t, f.owner, insert(0, ">> "))
+
+	// Without a clock the client is taken to have seen nothing after its
+	// base version, so the offset counts into "hello world"
+	result, err := f.collab.SyncOperations(f.editor, f.docID, 0, []domain.Operation{queued(insert(5, ","), nil)})
+	if err != nil || len(result.Dropped) != 0 {
+		t.Fatalf("sync = %+v, %v", result, err)
+	}
+	if got := f.content(t); got != ">> hello, world" {
+		t.Errorf("content = %q, want %q", got, ">> hello, world")
+	}
+}
+
+func TestSyncResendsAreNotAppliedTwice(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	queue := []domain.Operation{queued(insert(5, "!"), nil), queued(insert(6, "?"), nil)}
+
+	first, err := f.collab.SyncOperations(f.editor, f.docID, 0, queue[:1])
+	if err != nil {
+		t.Fatalf("first sync: %v", err)
+	}
+
+	// The connection dropped before the reply, so the whole queue is resent,
+	// with the second edit listed twice by mistake
+	resent, err := f.collab.SyncOperations(f.editor, f.docID, 0, append(queue, queue[1]))
+	if err != nil {
+		t.Fatalf("second sync: %v", err)
+	}
+	if got := f.content(t); got != "hello!?" {
+		t.Errorf("content = %q, want %q", got, "hello!?")
+	}
+	if len(resent.Accepted) != 2 || resent.Accepted[0].ID != first.Accepted[0].ID {
+		t.Errorf("accepted %+v, want the earlier commit and the new one", resent.Accepted)
+	}
+	if len(resent.Missed) != 0 {
+		t.Errorf("missed %+v, want the queue's own operations left out", resent.Missed)
+	}
+	if len(resent.Dropped) != 1 || resent.Dropped[0].Reason != usecase.ErrDuplicateOperation.Error() {
+		t.Errorf("dropped %+v, want the repeated edit", resent.Dropped)
+	}
+
+	if _, err := f.collab.SyncOperations(f.editor, f.docID, 5, queue); !errors.Is(err, usecase.ErrInvalidOperation) {
+		t.Errorf("sync from a future version: err = %v, want ErrInvalidOperation", err)
+	}
+}
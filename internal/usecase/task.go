@@ -0,0 +1,468 @@
+package usecase
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTaskNotFound    = errors.New("task not found")
+	ErrNotTaskBoard    = errors.New("document is not a task board")
+	ErrInvalidTask     = errors.New("invalid task")
+	ErrInvalidAssignee = errors.New("assignee has no access to the document")
+)
+
+// maxTaskTitleLength bounds task titles, in bytes
+const maxTaskTitleLength = 500
+
+type TaskRepository interface {
+	GetDocumentByID(id uuid.UUID) (*domain.Document, error)
+	GetPermission(userID, docID uuid.UUID) (*domain.DocumentPermission, error)
+	CreateActivity(activity *domain.Activity) error
+	CreateTask(task *domain.Task) error
+	// GetTaskByID returns a task with its assignee loaded
+	GetTaskByID(id uuid.UUID) (*domain.Task, error)
+	// GetDocumentTasks lists a document's tasks matching filter, by position
+	GetDocumentTasks(docID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error)
+	// FindTasks lists the tasks matching filter in every document userID can
+	// view, soonest due first
+	FindTasks(userID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error)
+	// SaveTasks updates tasks in one transaction
+	SaveTasks(tasks []*domain.Task) error
+	DeleteTask(id uuid.UUID) error
+	// LockBoard runs change in a transaction that holds a lock on the
+	// document, passing it a repository that works inside the transaction.
+	// Changes to one board are made one at a time across every node.
+	LockBoard(docID uuid.UUID, change func(repo TaskRepository) error) error
+}
+
+// TaskInput describes a new task, or the new details of an existing one.
+// Status and AssigneeID are only read when creating; use MoveTask and
+// AssignTask to change them.
+type TaskInput struct {
+	Title       string
+	Description string
+	Status      domain.TaskStatus   // Defaults to todo
+	Priority    domain.TaskPriority // Defaults to medium
+	AssigneeID  *uuid.UUID
+	DueDate     *time.Time
+}
+
+type TaskUsecase struct {
+	repo   TaskRepository
+	access *AccessPolicy
+}
+
+func NewTaskUsecase(repo TaskRepository, access *AccessPolicy) *TaskUsecase {
+	return &TaskUsecase{repo: repo, access: access}
+}
+
+// ListTasks returns a task document's board column by column, each in order
+func (t *TaskUsecase) ListTasks(userID, docID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error) {
+	if filter.Status != "" && !validStatus(filter.Status) {
+		return nil, ErrInvalidTask
+	}
+	if err := t.board(userID, docID, false); err != nil {
+		return nil, err
+	}
+
+	tasks, err := t.repo.GetDocumentTasks(docID, filter)
+	if err != nil {
+		return nil, err
+	}
+	sortBoard(tasks)
+	return tasks, nil
+}
+
+// FindTasks finds tasks across every document userID can view, such as
+// everything assigned to them
+func (t *TaskUsecase) FindTasks(userID uuid.UUID, filter domain.TaskFilter) ([]*domain.Task, error) {
+	if filter.Status != "" && !validStatus(filter.Status) {
+		return nil, ErrInvalidTask
+	}
+	return t.repo.FindTasks(userID, filter)
+}
+
+// CreateTask adds a task to the bottom of its column
+func (t *TaskUsecase) CreateTask(userID, docID uuid.UUID, input TaskInput) (*domain.Task, error) {
+	if input.Status == "" {
+		input.Status = domain.TaskTodo
+	}
+	if err := validateTaskInput(&input); err != nil {
+		return nil, err
+	}
+	if !validStatus(input.Status) {
+		return nil, ErrInvalidTask
+	}
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+	if err := t.checkAssignee(docID, input.AssigneeID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	task := &domain.Task{
+		ID:          uuid.New(),
+		DocumentID:  docID,
+		Title:       input.Title,
+		Description: input.Description,
+		Status:      input.Status,
+		Priority:    input.Priority,
+		AssigneeID:  input.AssigneeID,
+		DueDate:     input.DueDate,
+		CreatedBy:   userID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if task.Status == domain.TaskDone {
+		task.CompletedAt = &now
+	}
+	err := t.lockBoard(docID, func(repo TaskRepository) error {
+		column, err := repo.GetDocumentTasks(docID, domain.TaskFilter{Status: input.Status})
+		if err != nil {
+			return err
+		}
+		task.Position = len(column)
+		return repo.CreateTask(task)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_created", task.Title)
+	return t.repo.GetTaskByID(task.ID)
+}
+
+// UpdateTask replaces a task's title, description, priority and due date
+func (t *TaskUsecase) UpdateTask(userID, docID, taskID uuid.UUID, input TaskInput) (*domain.Task, error) {
+	if err := validateTaskInput(&input); err != nil {
+		return nil, err
+	}
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+
+	var task *domain.Task
+	err := t.lockBoard(docID, func(repo TaskRepository) error {
+		var err error
+		if task, err = findTask(repo, docID, taskID); err != nil {
+			return err
+		}
+		task.Title = input.Title
+		task.Description = input.Description
+		task.Priority = input.Priority
+		task.DueDate = input.DueDate
+		task.UpdatedAt = time.Now()
+		return repo.SaveTasks([]*domain.Task{task})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_updated", task.Title)
+	return task, nil
+}
+
+// MoveTask puts a task at position in the status column, counted from 0;
+// positions past the end of the column put it last. Moving a task into the
+// done column completes it and moving it out reopens it.
+func (t *TaskUsecase) MoveTask(userID, docID, taskID uuid.UUID, status domain.TaskStatus, position int) (*domain.Task, error) {
+	if !validStatus(status) || position < 0 {
+		return nil, ErrInvalidTask
+	}
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+
+	task, err := t.move(docID, taskID, status, position)
+	if err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_moved", task.Title)
+	return task, nil
+}
+
+// CompleteTask moves a task to the bottom of the done column. A task that is
+// already done stays where it is.
+func (t *TaskUsecase) CompleteTask(userID, docID, taskID uuid.UUID) (*domain.Task, error) {
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+
+	task, err := findTask(t.repo, docID, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if task.Status == domain.TaskDone {
+		return task, nil
+	}
+	if task, err = t.move(docID, taskID, domain.TaskDone, -1); err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_completed", task.Title)
+	return task, nil
+}
+
+// AssignTask hands a task to assigneeID, who needs access to the document,
+// or unassigns it when assigneeID is nil
+func (t *TaskUsecase) AssignTask(userID, docID, taskID uuid.UUID, assigneeID *uuid.UUID) (*domain.Task, error) {
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+	if err := t.checkAssignee(docID, assigneeID); err != nil {
+		return nil, err
+	}
+
+	var task *domain.Task
+	err := t.lockBoard(docID, func(repo TaskRepository) error {
+		var err error
+		if task, err = findTask(repo, docID, taskID); err != nil {
+			return err
+		}
+		task.AssigneeID = assigneeID
+		task.UpdatedAt = time.Now()
+		return repo.SaveTasks([]*domain.Task{task})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_assigned", task.Title)
+	return t.repo.GetTaskByID(task.ID)
+}
+
+// DeleteTask removes a task from the board and returns it as it was
+func (t *TaskUsecase) DeleteTask(userID, docID, taskID uuid.UUID) (*domain.Task, error) {
+	if err := t.board(userID, docID, true); err != nil {
+		return nil, err
+	}
+
+	var task *domain.Task
+	err := t.lockBoard(docID, func(repo TaskRepository) error {
+		var err error
+		if task, err = findTask(repo, docID, taskID); err != nil {
+			return err
+		}
+		if err := repo.DeleteTask(task.ID); err != nil {
+			return err
+		}
+
+		// Close the gap it left
+		column, err := repo.GetDocumentTasks(docID, domain.TaskFilter{Status: task.Status})
+		if err != nil {
+			return err
+		}
+		return repo.SaveTasks(renumber(column))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.logActivity(docID, userID, "task_deleted", task.Title)
+	return task, nil
+}
+
+// move reorders the board around a task; a negative position means the end
+// of the column
+func (t *TaskUsecase) move(docID, taskID uuid.UUID, status domain.TaskStatus, position int) (*domain.Task, error) {
+	var task *domain.Task
+	err := t.lockBoard(docID, func(repo TaskRepository) error {
+		var err error
+		task, err = reorder(repo, docID, taskID, status, position)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+func reorder(repo TaskRepository, docID, taskID uuid.UUID, status domain.TaskStatus, position int) (*domain.Task, error) {
+	task, err := findTask(repo, docID, taskID)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := repo.GetDocumentTasks(docID, domain.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+	sortBoard(tasks)
+
+	var from, to []*domain.Task
+	for _, other := range tasks {
+		if other.ID == task.ID {
+			continue
+		}
+		if other.Status == task.Status {
+			from = append(from, other)
+		}
+		if other.Status == status {
+			to = append(to, other)
+		}
+	}
+
+	if position < 0 || position > len(to) {
+		position = len(to)
+	}
+	to = append(to[:position], append([]*domain.Task{task}, to[position:]...)...)
+
+	now := time.Now()
+	if status == domain.TaskDone && task.Status != domain.TaskDone {
+		task.CompletedAt = &now
+	} else if status != domain.TaskDone {
+		task.CompletedAt = nil
+	}
+	task.UpdatedAt = now
+	// Saved even when it lands where it was
+	task.Position = -1
+
+	changed := renumber(to)
+	if task.Status != status {
+		task.Status = status
+		changed = append(changed, renumber(from)...)
+	}
+
+	if err := repo.SaveTasks(changed); err != nil {
+		return nil, err
+	}
+	return task, nil
+}
+
+// renumber gives a column's tasks consecutive positions and returns the ones
+// that moved
+func renumber(column []*domain.Task) []*domain.Task {
+	var changed []*domain.Task
+	for i, task := range column {
+		if task.Position != i {
+			task.Position = i
+			changed = append(changed, task)
+		}
+	}
+	return changed
+}
+
+// sortBoard orders tasks column by column, then by position. Tasks that ended
+// up sharing a position stay in creation order.
+func sortBoard(tasks []*domain.Task) {
+	column := make(map[domain.TaskStatus]int, len(domain.TaskStatuses))
+	for i, status := range domain.TaskStatuses {
+		column[status] = i
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if a.Status != b.Status {
+			return column[a.Status] < column[b.Status]
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// board checks userID can see, or with edit set change, a task document
+func (t *TaskUsecase) board(userID, docID uuid.UUID, edit bool) error {
+	action := ActionView
+	if edit {
+		action = ActionEdit
+	}
+	doc, _, err := t.access.Authorize(userID, docID, action)
+	if err != nil {
+		return err
+	}
+
+	if doc.Type != domain.DocumentTypeTask {
+		return ErrNotTaskBoard
+	}
+	return nil
+}
+
+func findTask(repo TaskRepository, docID, taskID uuid.UUID) (*domain.Task, error) {
+	task, err := repo.GetTaskByID(taskID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+	if task.DocumentID != docID {
+		return nil, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+// checkAssignee makes sure tasks are only handed to people who can see them
+func (t *TaskUsecase) checkAssignee(docID uuid.UUID, assigneeID *uuid.UUID) error {
+	if assigneeID == nil {
+		return nil
+	}
+	perm, err := t.repo.GetPermission(*assigneeID, docID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidAssignee
+		}
+		return err
+	}
+	if !perm.Role.CanView() {
+		return ErrInvalidAssignee
+	}
+	return nil
+}
+
+// lockBoard runs change with the board locked. Positions are renumbered from
+// what is read under the lock, so concurrent changes on different nodes
+// cannot leave duplicate or missing positions.
+func (t *TaskUsecase) lockBoard(docID uuid.UUID, change func(repo TaskRepository) error) error {
+	err := t.repo.LockBoard(docID, change)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// The board was deleted after it was authorized
+		return ErrDocumentNotFound
+	}
+	return err
+}
+
+func (t *TaskUsecase) logActivity(docID, userID uuid.UUID, action, title string) {
+	activity := &domain.Activity{
+		ID:         uuid.New(),
+		DocumentID: docID,
+		UserID:     userID,
+		Action:     action,
+		Details:    title,
+		CreatedAt:  time.Now(),
+	}
+	t.repo.CreateActivity(activity)
+}
+
+// validateTaskInput checks the details of a task, filling in the default priority
+func validateTaskInput(input *TaskInput) error {
+	input.Title = strings.TrimSpace(input.Title)
+	if input.Title == "" || len(input.Title) > maxTaskTitleLength {
+		return ErrInvalidTask
+	}
+	switch input.Priority {
+	case "":
+		input.Priority = domain.PriorityMedium
+	case domain.PriorityLow, domain.PriorityMedium, domain.PriorityHigh, domain.PriorityUrgent:
+	default:
+		return ErrInvalidTask
+	}
+	return nil
+}
+
+func validStatus(status domain.TaskStatus) bool {
+	for _, s := range domain.TaskStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
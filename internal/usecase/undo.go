@@ -0,0 +1,369 @@
+package usecase
+
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/collab-platform/backend/internal/crdt"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNothingToUndo = errors.New("nothing to undo")
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// maxUndoDepth bounds how many changes each user can undo per document
+const maxUndoDepth = 100
+
+// undoHistoryIdle is how long a user's history outlives their last change
+const undoHistoryIdle = time.Hour
+
+// undoHistory is a user's stored undo history for one document, loaded for
+// one change to it
+type undoHistory struct {
+	docID    uuid.UUID
+	userID   uuid.UUID
+	undo     [][]domain.Operation
+	redo     [][]domain.Operation
+	revision int64
+
+	// Text restored by an undo comes back as new elements; this maps each
+	// deleted element to the copy that replaced it, so undoing the insert
+	// that first typed it removes the copy
+	copies map[domain.ElementID]domain.ElementID
+}
+
+// current follows id through the copies made of it
+func (h *undoHistory) current(id domain.ElementID) domain.ElementID {
+	for {
+		next, ok := h.copies[id]
+		if !ok {
+			return id
+		}
+		id = next
+	}
+}
+
+func (c *CollaborationUsecase) loadHistory(docID, userID uuid.UUID) (*undoHistory, error) {
+	h := &undoHistory{docID: docID, userID: userID, copies: make(map[domain.ElementID]domain.ElementID)}
+	stored, err := c.repo.GetUndoHistory(docID, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h.undo, h.redo, h.revision = stored.Undo, stored.Redo, stored.Revision
+	for _, copied := range stored.Copies {
+		h.copies[copied.Deleted] = copied.Copy
+	}
+	return h, nil
+}
+
+func (c *CollaborationUsecase) saveHistory(h *undoHistory) error {
+	stored := &domain.UndoHistory{
+		DocumentID: h.docID,
+		UserID:     h.userID,
+		Undo:       h.undo,
+		Redo:       h.redo,
+		Revision:   h.revision,
+		UpdatedAt:  time.Now(),
+	}
+	for deleted, copied := range h.copies {
+		stored.Copies = append(stored.Copies, domain.ElementCopy{Deleted: deleted, Copy: copied})
+	}
+	return c.repo.SaveUndoHistory(stored)
+}
+
+// updateHistory applies change to userID's stored history, starting over
+// from a fresh copy if another node saved it in between
+func (c *CollaborationUsecase) updateHistory(docID, userID uuid.UUID, change func(h *undoHistory)) error {
+	for attempt := 0; ; attempt++ {
+		h, err := c.loadHistory(docID, userID)
+		if err != nil {
+			return err
+		}
+		change(h)
+		err = c.saveHistory(h)
+		if !errors.Is(err, ErrStaleWrite) || attempt+1 >= maxCommitAttempts {
+			return err
+		}
+	}
+}
+
+// record pushes changes userID just committed onto their undo stack, each
+// entry undone on its own. A new change ends the redo chain, as in any
+// editor. The changes stand whether or not the history saves; one that fails
+// only leaves them out of undo. Call it holding the document lock.
+func (c *CollaborationUsecase) record(docID, userID uuid.UUID, entries ...[]domain.Operation) {
+	c.updateHistory(docID, userID, func(h *undoHistory) {
+		h.undo = append(h.undo, entries...)
+		if len(h.undo) > maxUndoDepth {
+			h.undo = h.undo[len(h.undo)-maxUndoDepth:]
+		}
+		h.redo = nil
+	})
+}
+
+// pop removes taken, the entries most recently taken off the top of stack,
+// if nobody has changed the stack since
+func pop(stack [][]domain.Operation, taken [][]domain.Operation) [][]domain.Operation {
+	for _, entry := range taken {
+		n := len(stack)
+		if n == 0 || stack[n-1][0].ID != entry[0].ID {
+			break
+		}
+		stack = stack[:n-1]
+	}
+	return stack
+}
+
+// Undo takes back userID's most recent change to a document that has not
+// been undone yet, leaving everyone else's edits alone. Text the change
+// inserted is deleted, text it deleted is inserted again where it was, and
+// formatting it applied is reverted where nobody has reformatted since.
+//
+// The inverse is worked out from element IDs against the document as it is
+// now, so it lands correctly whatever was committed in between. Changes that
+// have nothing left to take back (someone deleted all the text they typed,
+// say) are skipped. requestID is stamped on the committed operations as
+// RequestID; resending it returns a *DuplicateOperationError.
+//
+// History is stored next to the operation log, so the change can be undone
+// through any node, and is dropped after undoHistoryIdle without edits.
+func (c *CollaborationUsecase) Undo(userID, docID, requestID uuid.UUID) (*domain.Document, []domain.Operation, error) {
+	return c.revert(userID, docID, requestID, false)
+}
+
+// Redo takes back userID's most recent undo, if nothing else was changed since
+func (c *CollaborationUsecase) Redo(userID, docID, requestID uuid.UUID) (*domain.Document, []domain.Operation, error) {
+	return c.revert(userID, docID, requestID, true)
+}
+
+func (c *CollaborationUsecase) revert(userID, docID, requestID uuid.UUID, redo bool) (*domain.Document, []domain.Operation, error) {
+	if _, _, err := c.access.Authorize(userID, docID, ActionEdit); err != nil {
+		return nil, nil, err
+	}
+	if requestID == uuid.Nil {
+		requestID = uuid.New()
+	}
+
+	lock := c.documentLock(docID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := c.findDuplicate(docID, requestID); err != nil {
+		return nil, nil, err
+	}
+
+	h, err := c.loadHistory(docID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	from, action, empty := h.undo, "undo", ErrNothingToUndo
+	if redo {
+		from, action, empty = h.redo, "redo", ErrNothingToRedo
+	}
+
+	// Entries with nothing left to take back are skipped, and dropped along
+	// with the one that is taken back
+	var taken [][]domain.Operation
+	for len(from) > 0 {
+		entry := from[len(from)-1]
+
+		var (
+			doc       *domain.Document
+			committed []domain.Operation
+			err       error
+		)
+		for attempt := 0; ; attempt++ {
+			doc, committed, err = c.commitInverse(h, docID, userID, requestID, entry)
+			if !errors.Is(err, ErrStaleWrite) || attempt+1 >= maxCommitAttempts {
+				break
+			}
+		}
+		if errors.Is(err, ErrDuplicateOperation) {
+			if dup := c.findDuplicate(docID, requestID); dup != nil {
+				return nil, nil, dup
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		from = from[:len(from)-1]
+		taken = append(taken, entry)
+		if len(committed) == 0 {
+			continue
+		}
+
+		// Undoing an undo is a redo and vice versa. The inverse is committed
+		// either way, so a history that fails to save is not reported.
+		c.updateHistory(docID, userID, func(stored *undoHistory) {
+			if redo {
+				stored.redo = pop(stored.redo, taken)
+				stored.undo = append(stored.undo, committed)
+			} else {
+				stored.undo = pop(stored.undo, taken)
+				stored.redo = append(stored.redo, committed)
+			}
+			for id, copied := range h.copies {
+				stored.copies[id] = copied
+			}
+		})
+
+		activity := &domain.Activity{
+			ID:         uuid.New(),
+			DocumentID: docID,
+			UserID:     userID,
+			GuestName:  c.access.guestName(userID, docID),
+			Action:     action,
+			Details:    committed[0].Type,
+			CreatedAt:  time.Now(),
+		}
+		c.repo.CreateActivity(activity)
+
+		return doc, committed, nil
+	}
+
+	if len(taken) > 0 {
+		if err := c.updateHistory(docID, userID, func(stored *undoHistory) {
+			if redo {
+				stored.redo = pop(stored.redo, taken)
+			} else {
+				stored.undo = pop(stored.undo, taken)
+			}
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, empty
+}
+
+// commitInverse commits the inverse of a change, last operation first
+func (c *CollaborationUsecase) commitInverse(h *undoHistory, docID, userID, requestID uuid.UUID, entry []domain.Operation) (*domain.Document, []domain.Operation, error) {
+	doc, err := c.repo.GetDocumentByID(docID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrDocumentNotFound
+		}
+		return nil, nil, err
+	}
+
+	seq, err := c.loadState(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := seedState(doc, seq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var inverse []inverseOperation
+	for i := len(entry) - 1; i >= 0; i-- {
+		inverse = append(inverse, h.invert(seq, entry[i])...)
+	}
+
+	var committed []domain.Operation
+	copies := make(map[domain.ElementID]domain.ElementID)
+	for _, next := range inverse {
+		inv := next.op
+		inv.ID = uuid.New()
+		inv.UserID = userID
+		inv.DocumentID = docID
+		inv.Unit = domain.UnitUTF16
+		inv.Timestamp = seq.Clock() + 1
+
+		applied, err := c.applyCRDTOperation(seq, inv)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, id := range next.restores {
+			copies[id] = domain.ElementID{Clock: inv.Timestamp + int64(i), Site: userID}
+		}
+		for _, a := range applied {
+			a.ID = uuid.New()
+			a.RequestID = requestID
+			a.Version = doc.Version + int64(len(committed)) + 1
+			a.VectorClock = tick(doc, a.UserID)
+			a.CreatedAt = time.Now()
+			committed = append(committed, a)
+		}
+	}
+
+	if len(committed) == 0 {
+		return doc, nil, nil
+	}
+	if err := c.save(doc, seq, seed, committed); err != nil {
+		return nil, nil, err
+	}
+
+	for id, copied := range copies {
+		h.copies[id] = copied
+	}
+	return doc, committed, nil
+}
+
+// inverseOperation is one operation of an inverse. A restoring insert lists
+// the deleted elements it brings back, one per rune of its content.
+type inverseOperation struct {
+	op       domain.Operation
+	restores []domain.ElementID
+}
+
+// invert returns the ID-addressed operations that take back a committed
+// operation in seq's current state, or nothing if nothing of it is left
+func (h *undoHistory) invert(seq *crdt.Sequence, op domain.Operation) []inverseOperation {
+	switch op.Type {
+	case "insert":
+		n := utf8.RuneCountInString(op.Content)
+		ids := make([]domain.ElementID, n)
+		for i := range ids {
+			ids[i] = h.current(domain.ElementID{Clock: op.Timestamp + int64(i), Site: op.UserID})
+		}
+		var visible []domain.ElementID
+		for _, span := range seq.VisibleSpans(ids) {
+			visible = append(visible, span.IDs...)
+		}
+		if len(visible) == 0 {
+			return nil
+		}
+		return []inverseOperation{{op: domain.Operation{Type: "delete", Targets: visible}}}
+
+	case "delete":
+		// Deleted text comes back as a copy right where it was, ahead of
+		// anything typed in its place since
+		var restores []inverseOperation
+		for _, run := range seq.Runs(op.Targets) {
+			origin, _ := seq.Before(run.IDs[0], op.Timestamp)
+			restores = append(restores, inverseOperation{
+				op:       domain.Operation{Type: "insert", Origin: &origin, Content: run.Text},
+				restores: run.IDs,
+			})
+		}
+		return restores
+
+	case "format":
+		var reverts []inverseOperation
+		for _, run := range seq.RevertFormat(domain.ElementID{Clock: op.Timestamp, Site: op.UserID}) {
+			reverts = append(reverts, inverseOperation{op: domain.Operation{
+				Type:       "format",
+				Targets:    []domain.ElementID{run.Start, run.End},
+				Attributes: run.Attributes,
+			}})
+		}
+		return reverts
+	}
+	return nil
+}
+
+// PruneUndoHistories forgets the undo histories of users who have not
+// changed a document since before cutoff
+func (c *CollaborationUsecase) PruneUndoHistories(cutoff time.Time) (int64, error) {
+	return c.repo.DeleteUndoHistories(cutoff)
+}
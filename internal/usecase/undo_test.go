@@ -0,0 +1,100 @@
+package usecase_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/collab-platform/backend/internal/usecase"
+	"github.com/google/uuid"
+)
+
+func (f *collabFixture) undo(t *testing.T, c *usecase.CollaborationUsecase, userID uuid.UUID) {
+	t.Helper()
+	if _, _, err := c.Undo(userID, f.docID, uuid.New()); err != nil {
+		t.Fatalf("undo: %v", err)
+	}
+}
+
+func (f *collabFixture) redo(t *testing.T, c *usecase.CollaborationUsecase, userID uuid.UUID) {
+	t.Helper()
+	if _, _, err := c.Redo(userID, f.docID, uuid.New()); err != nil {
+		t.Fatalf("redo: %v", err)
+	}
+}
+
+func TestUndoTakesBackOnlyTheCallersChanges(t *testing.T) {
+	f := newCollabFixture(t, "hello world")
+	// A second node sharing the same database
+	other := usecase.NewCollaborationUsecase(f.repo, usecase.NewAccessPolicy(f.repo, f.links), usecase.DefaultSnapshotPolicy())
+
+	f.apply(t, f.editor, insert(5, ",")) // "hello, world"
+	// The owner has not seen the comma
+	op := insert(11, "!")
+	op.BaseVersion = base(0)
+	f.apply(t, f.owner, op)                // "hello, world!"
+	f.apply(t, f.editor, del(7, 5))        // "hello, !"
+	f.apply(t, f.owner, insert(0, "Oh, ")) // "Oh, hello, !"
+
+	steps := []struct {
+		name string
+		run  func()
+		want string
+	}{
+		{"editor undoes the delete elsewhere", func() { f.undo(t, other, f.editor) }, "Oh, hello, world!"},
+		{"editor undoes the comma", func() { f.undo(t, other, f.editor) }, "Oh, hello world!"},
+		{"editor redoes the comma", func() { f.redo(t, f.collab, f.editor) }, "Oh, hello, world!"},
+		{"owner undoes their insert", func() { f.undo(t, f.collab, f.owner) }, "hello, world!"},
+		{"owner undoes the bang", func() { f.undo(t, other, f.owner) }, "hello, world"},
+	}
+	for _, step := range steps {
+		step.run()
+		if got := f.content(t); got != step.want {
+			t.Fatalf("after %s: content = %q, want %q", step.name, got, step.want)
+		}
+	}
+
+	if _, _, err := other.Undo(f.owner, f.docID, uuid.New()); !errors.Is(err, usecase.ErrNothingToUndo) {
+		t.Errorf("owner's third undo: err = %v, want ErrNothingToUndo", err)
+	}
+	// The editor can still undo the comma they redid, and redo the delete
+	// they undid on the other node
+	f.undo(t, f.collab, f.editor)
+	if _, _, err := other.Undo(f.editor, f.docID, uuid.New()); !errors.Is(err, usecase.ErrNothingToUndo) {
+		t.Errorf("editor's last undo: err = %v, want ErrNothingToUndo", err)
+	}
+	f.redo(t, other, f.editor)
+	f.redo(t, f.collab, f.editor)
+	if got := f.content(t); got != "hello, " {
+		t.Errorf("after the editor's redos: content = %q, want %q", got, "hello, ")
+	}
+}
+
+func TestUndoSkipsChangesWithNothingLeft(t *testing.T) {
+	f := newCollabFixture(t, "hello")
+	f.apply(t, f.editor, insert(5, " there")) // "hello there"
+	f.apply(t, f.editor, insert(0, "Oh "))    // "Oh hello there"
+	f.apply(t, f.owner, del(0, 3))            // "hello there"
+
+	f.undo(t, f.collab, f.editor)
+	if got := f.content(t); got != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+	if _, _, err := f.collab.Undo(f.editor, f.docID, uuid.New()); !errors.Is(err, usecase.ErrNothingToUndo) {
+		t.Errorf("second undo: err = %v, want ErrNothingToUndo", err)
+	}
+
+	f.redo(t, f.collab, f.editor)
+	if got := f.content(t); got != "hello there" {
+		t.Errorf("content after redo = %q, want %q", got, "hello there")
+	}
+	if _, _, err := f.collab.Redo(f.editor, f.docID, uuid.New()); !errors.Is(err, usecase.ErrNothingToRedo) {
+		t.Errorf("second redo: err = %v, want ErrNothingToRedo", err)
+	}
+
+	// A new change ends the redo chain
+	f.undo(t, f.collab, f.editor)
+	f.apply(t, f.editor, insert(0, ">"))
+	if _, _, err := f.collab.Redo(f.editor, f.docID, uuid.New()); !errors.Is(err, usecase.ErrNothingToRedo) {
+		t.Errorf("redo after a new change: err = %v, want ErrNothingToRedo", err)
+	}
+}
@@ -0,0 +1,223 @@
+package usecase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/collab-platform/backend/internal/crdt"
+	"github.com/collab-platform/backend/internal/domain"
+	"github.com/google/uuid"
+)
+
+var (
+	errNotText       = fmt.Errorf("%w: text operation on a whiteboard", ErrInvalidOperation)
+	errNotWhiteboard = fmt.Errorf("%w: whiteboard operation on a text document", ErrInvalidOperation)
+)
+
+// maxStyleKeys bounds the style properties one shape can carry
+const maxStyleKeys = 32
+
+// parseWhiteboard reads whiteboard content as stored in a document, rejecting
+// anything a client could not have produced with whiteboard operations
+func parseWhiteboard(content string) (domain.Whiteboard, error) {
+	var wb domain.Whiteboard
+	if strings.TrimSpace(content) == "" {
+		return wb, nil
+	}
+	if err := json.Unmarshal([]byte(content), &wb); err != nil {
+		return wb, err
+	}
+	seen := make(map[uuid.UUID]bool, len(wb.Shapes))
+	for _, s := range wb.Shapes {
+		if s.ID == uuid.Nil || seen[s.ID] || !validShape(s) {
+			return wb, ErrInvalidContent
+		}
+		seen[s.ID] = true
+	}
+	return wb, nil
+}
+
+// boardFromContent seeds the board of a whiteboard that has never been edited
+// collaboratively. Content from before whiteboards were structured, which is
+// not whiteboard JSON, opens as a single text box holding it.
+func boardFromContent(doc *domain.Document) *crdt.Board {
+	wb, err := parseWhiteboard(doc.Content)
+	if err != nil {
+		wb = domain.Whiteboard{Shapes: []domain.Shape{{
+			// Derived from the document so every load seeds the same board
+			ID:    uuid.NewSHA1(doc.ID, []byte("content")),
+			Kind:  domain.ShapeText,
+			Text:  doc.Content,
+			Width: 400, Height: 200,
+		}}}
+	}
+	return crdt.BoardFromWhiteboard(wb)
+}
+
+// validateBoardOperation checks a whiteboard operation's shapes carry what
+// its type needs
+func validateBoardOperation(op domain.Operation) error {
+	if !crdt.IsBoardOperation(op.Type) || op.Timestamp < 0 {
+		return ErrInvalidOperation
+	}
+	seen := make(map[uuid.UUID]bool, len(op.Shapes))
+	for _, s := range op.Shapes {
+		if s.ID == uuid.Nil {
+			// New shapes may leave their ID to the server
+			if op.Type != "add_shape" {
+				return ErrInvalidOperation
+			}
+		} else if seen[s.ID] {
+			return ErrInvalidOperation
+		}
+		seen[s.ID] = true
+
+		switch op.Type {
+		case "add_shape":
+			if !validShape(s) {
+				return ErrInvalidOperation
+			}
+		case "resize":
+			if s.Width < 0 || s.Height < 0 {
+				return ErrInvalidOperation
+			}
+		case "restyle":
+			if len(s.Style) == 0 || !validStyle(s.Style) {
+				return ErrInvalidOperation
+			}
+		case "group":
+			if s.GroupID == nil {
+				return ErrInvalidOperation
+			}
+		}
+	}
+	return nil
+}
+
+func validShape(s domain.Shape) bool {
+	switch s.Kind {
+	case domain.ShapeRectangle, domain.ShapeEllipse, domain.ShapeLine, domain.ShapeText:
+		if s.From != nil || s.To != nil {
+			return false
+		}
+	case domain.ShapeConnector:
+	default:
+		return false
+	}
+	return s.Width >= 0 && s.Height >= 0 && validStyle(s.Style)
+}
+
+// validStyle checks style properties are plain values; nil removes one
+func validStyle(style map[string]interface{}) bool {
+	if len(style) > maxStyleKeys {
+		return false
+	}
+	for key, value := range style {
+		if key == "" || len(key) > 64 {
+			return false
+		}
+		switch value.(type) {
+		case nil, string, float64, bool:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *CollaborationUsecase) loadBoard(doc *domain.Document) (*crdt.Board, error) {
+	state, err := c.loadReplica(doc)
+	if err != nil {
+		return nil, err
+	}
+	board, ok := state.(*crdt.Board)
+	if !ok {
+		return nil, errNotWhiteboard
+	}
+	return board, nil
+}
+
+// commitBoard integrates a whiteboard operation and persists it. Board
+// operations never need rebasing: concurrent writes to a shape are settled
+// by their stamps, so op commits as is, or not at all when every shape it
+// changes has been deleted.
+func (c *CollaborationUsecase) commitBoard(doc *domain.Document, op domain.Operation) (*domain.Document, []domain.Operation, error) {
+	board, err := c.loadBoard(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	seed, err := seedState(doc, board)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A client stamping its own writes cannot have seen a later clock than ours
+	if op.Timestamp == 0 {
+		op.Timestamp = board.Clock() + 1
+	} else if op.Timestamp > board.Clock()+1 {
+		return nil, nil, ErrInvalidOperation
+	}
+
+	op.Shapes = append([]domain.Shape(nil), op.Shapes...)
+	if op.Type == "add_shape" {
+		added := make(map[uuid.UUID]bool, len(op.Shapes))
+		for i := range op.Shapes {
+			if op.Shapes[i].ID == uuid.Nil {
+				op.Shapes[i].ID = uuid.New()
+			}
+			added[op.Shapes[i].ID] = true
+		}
+		// Connectors attach to shapes on the board or added alongside them
+		for _, s := range op.Shapes {
+			for _, end := range []*uuid.UUID{s.From, s.To} {
+				if end == nil || added[*end] {
+					continue
+				}
+				if _, live := board.Has(*end); !live {
+					return nil, nil, fmt.Errorf("%w: connector end %s is not on the board", ErrInvalidOperation, *end)
+				}
+			}
+		}
+	} else {
+		live := op.Shapes[:0]
+		for _, s := range op.Shapes {
+			exists, isLive := board.Has(s.ID)
+			if !exists {
+				return nil, nil, fmt.Errorf("%w: unknown shape %s", ErrInvalidOperation, s.ID)
+			}
+			if isLive {
+				live = append(live, s)
+			}
+		}
+		if len(live) == 0 {
+			return doc, nil, nil
+		}
+		op.Shapes = live
+	}
+
+	if err := board.Integrate(op); err != nil {
+		switch {
+		case errors.Is(err, crdt.ErrDuplicateShape):
+			return nil, nil, ErrConflict
+		case errors.Is(err, crdt.ErrUnknownShape), errors.Is(err, crdt.ErrUnsupportedOp):
+			return nil, nil, ErrInvalidOperation
+		}
+		return nil, nil, err
+	}
+
+	op.RequestID = op.ID
+	op.ID = uuid.New()
+	op.BaseVersion = nil
+	op.Version = doc.Version + 1
+	op.VectorClock = tick(doc, op.UserID)
+	op.CreatedAt = time.Now()
+	committed := []domain.Operation{op}
+
+	if err := c.save(doc, board, seed, committed); err != nil {
+		return nil, nil, err
+	}
+	return doc, committed, nil
+}